@@ -24,11 +24,17 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/op/go-logging"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
@@ -50,28 +56,121 @@ type fabricCAConfig struct {
 }
 
 var myViper = viper.New()
+var configBaseDir string
 var log = logging.MustGetLogger("fabric_sdk_go")
 var format = logging.MustStringFormatter(
 	`%{color}%{time:15:04:05.000} [%{module}] %{level:.4s} : %{message}`,
 )
 
+// EnvPrefix prefixes the environment variables that override config values.
+// A config key maps to the variable named after its upper cased path with the
+// dots replaced by underscores, FABRIC_SDK_CLIENT_FABRICCA_SERVERURL overrides
+// client.fabricCA.serverURL. The variables in envAliases are also supported
+const EnvPrefix = "FABRIC_SDK"
+
+// envAliases are the short environment variable names of the config keys most
+// commonly overridden between deployments
+var envAliases = map[string]string{
+	"client.fabricCA.serverURL":       EnvPrefix + "_CA_URL",
+	"client.fabricCA.certfiles":       EnvPrefix + "_CA_TLS_CERTFILES",
+	"client.fabricCA.client.keyfile":  EnvPrefix + "_CA_TLS_CLIENT_KEYFILE",
+	"client.fabricCA.client.certfile": EnvPrefix + "_CA_TLS_CLIENT_CERTFILE",
+	"client.tls.certificate":          EnvPrefix + "_TLS_CERTIFICATE",
+}
+
+func init() {
+	myViper.SetEnvPrefix(EnvPrefix)
+	myViper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	myViper.AutomaticEnv()
+	for key, env := range envAliases {
+		myViper.BindEnv(key, env)
+	}
+}
+
+// SupportedConfigFormats are the formats the config can be written in
+var SupportedConfigFormats = []string{"yaml", "yml", "json", "toml"}
+
 // InitConfig ...
-// initConfig reads in config file
+// initConfig reads in config file, its format is detected from its extension
 func InitConfig(configFile string) error {
+	return InitConfigWithFormat(configFile, "")
+}
 
-	if configFile != "" {
-		// create new viper
-		myViper.SetConfigFile(configFile)
-		// If a config file is found, read it in.
-		err := myViper.ReadInConfig()
+// InitConfigWithFormat reads in the config file in the given format
+/**
+ * @param {string} configFile the config is read from
+ * @param {string} format of the config, one of SupportedConfigFormats. When
+ * empty the format is detected from the extension of configFile
+ */
+func InitConfigWithFormat(configFile string, format string) error {
 
-		if err == nil {
-			log.Infof("Using config file: %s", myViper.ConfigFileUsed())
-		} else {
+	if configFile != "" {
+		if format == "" {
+			format = strings.TrimPrefix(filepath.Ext(configFile), ".")
+			if format == "" {
+				return fmt.Errorf("Cannot detect the format of config file %s, it has no extension", configFile)
+			}
+		}
+		if err := checkConfigFormat(format); err != nil {
+			return err
+		}
+		file, err := os.Open(configFile)
+		if err != nil {
 			return fmt.Errorf("Fatal error config file: %v", err)
 		}
+		defer file.Close()
+		err = InitConfigFromReader(file, format)
+		if err != nil {
+			return err
+		}
+		log.Infof("Using config file: %s", configFile)
+		return nil
+	}
+
+	initLogging()
+	return nil
+}
+
+// InitConfigFromReader reads in the config from r, for config that does not
+// live in a file such as a mounted secret or an embedded asset
+/**
+ * @param {io.Reader} r the config is read from
+ * @param {string} format of the config, one of SupportedConfigFormats
+ */
+func InitConfigFromReader(r io.Reader, format string) error {
+	if err := checkConfigFormat(format); err != nil {
+		return err
+	}
+	myViper.SetConfigType(strings.ToLower(format))
+	if err := myViper.ReadConfig(r); err != nil {
+		return fmt.Errorf("Fatal error config file: %v", err)
+	}
+
+	initLogging()
+	return nil
+}
+
+// checkConfigFormat returns an error if format, compared case insensitively,
+// is not one of SupportedConfigFormats
+func checkConfigFormat(format string) error {
+	for _, supported := range SupportedConfigFormats {
+		if strings.EqualFold(format, supported) {
+			return nil
+		}
 	}
+	return fmt.Errorf("Unsupported config format [%s], expected one of %s",
+		format, strings.Join(SupportedConfigFormats, ", "))
+}
+
+// SetConfigBaseDir sets the directory relative paths in the config, such as
+// certificate files and the key store path, are resolved against. When it is
+// not set they are resolved against the working directory
+func SetConfigBaseDir(dir string) {
+	configBaseDir = dir
+}
 
+// initLogging sets up the SDK logger from client.logging
+func initLogging() {
 	backend := logging.NewLogBackend(os.Stderr, "", 0)
 	backendFormatter := logging.NewBackendFormatter(backend, format)
 
@@ -86,8 +185,15 @@ func InitConfig(configFile string) error {
 		}
 	}
 	logging.SetBackend(backendFormatter).SetLevel(logging.Level(logLevel), "fabric_sdk_go")
+}
 
-	return nil
+// resolvePath resolves a relative path from the config against the config
+// base dir
+func resolvePath(path string) string {
+	if path == "" || configBaseDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(configBaseDir, path)
 }
 
 // GetFabricClientViper returns the internal viper instance used by the
@@ -147,7 +253,7 @@ func IsTLSEnabled() bool {
 func GetTLSCACertPool() *x509.CertPool {
 	certPool := x509.NewCertPool()
 	if myViper.GetString("client.tls.certificate") != "" {
-		rawData, err := ioutil.ReadFile(myViper.GetString("tls.certificate"))
+		rawData, err := ioutil.ReadFile(resolvePath(myViper.GetString("client.tls.certificate")))
 		if err != nil {
 			panic(err)
 		}
@@ -182,6 +288,28 @@ func GetSecurityLevel() int {
 
 }
 
+// GetSecurityProvider returns the BCCSP provider keys are generated and
+// stored with, SW or PKCS11
+func GetSecurityProvider() string {
+	return myViper.GetString("client.security.provider")
+}
+
+// GetSecurityProviderLibPath returns the path of the PKCS11 library
+func GetSecurityProviderLibPath() string {
+	return myViper.GetString("client.security.pkcs11.library")
+}
+
+// GetSecurityProviderLabel returns the label of the PKCS11 token, which
+// selects the HSM slot keys are stored in
+func GetSecurityProviderLabel() string {
+	return myViper.GetString("client.security.pkcs11.label")
+}
+
+// GetSecurityProviderPin returns the PIN of the PKCS11 token
+func GetSecurityProviderPin() string {
+	return myViper.GetString("client.security.pkcs11.pin")
+}
+
 // GetOrdererHost ...
 func GetOrdererHost() string {
 	return myViper.GetString("client.orderer.host")
@@ -192,13 +320,63 @@ func GetFabricCAID() string {
 	return myViper.GetString("client.fabricCA.id")
 }
 
+// GetFabricCAIdentityTypes returns the identity types identities can be
+// registered with, nil when not configured
+func GetFabricCAIdentityTypes() []string {
+	return myViper.GetStringSlice("client.fabricCA.identityTypes")
+}
+
+// GetFabricCARegistrationDefaults returns the type and affiliation identities
+// are registered with by the fabric-ca server named caName when the
+// registration request leaves them empty, set by defaultType and
+// defaultAffiliation, empty when not configured
+func GetFabricCARegistrationDefaults(caName string) (string, string) {
+	key := fabricCAKey(caName)
+	return myViper.GetString(key + ".defaultType"), myViper.GetString(key + ".defaultAffiliation")
+}
+
+// GetFabricCATLSCA returns the name of the configured fabric-ca server acting
+// as the TLS CA of the fabric-ca server named caName, set by tlsCA, empty when
+// not configured. The TLS CA must be another configured server
+func GetFabricCATLSCA(caName string) (string, error) {
+	tlsCA := myViper.GetString(fabricCAKey(caName) + ".tlsCA")
+	if tlsCA == "" {
+		return "", nil
+	}
+	if fabricCAKey(tlsCA) == fabricCAKey(caName) {
+		return "", fmt.Errorf("fabric-ca server %s cannot be its own TLS CA", fabricCAName(caName))
+	}
+	if _, err := getFabricCAConfig(tlsCA); err != nil {
+		return "", fmt.Errorf("TLS CA of fabric-ca server %s: %s", fabricCAName(caName), err)
+	}
+	return tlsCA, nil
+}
+
 // GetFabricCAClientPath This method will read the fabric-ca configurations from the
 // config yaml file and return the path to a json client config file
 // in the format that is expected by the fabric-ca client
 func GetFabricCAClientPath() (string, error) {
-	filePath := "/tmp/client-config.json"
-	fabricCAConf := fabricCAConfig{}
-	err := myViper.UnmarshalKey("client.fabricCA", &fabricCAConf)
+	return GetFabricCAClientPathForCA("")
+}
+
+// GetFabricCAClientPathForCA This method will read the configurations of the
+// fabric-ca server named caName from the config yaml file and return the path
+// to a json client config file in the format that is expected by the fabric-ca
+// client. Named servers are configured under client.fabricCAs.<caName>, an
+// empty caName or the id of client.fabricCA selects the default server. The
+// file is created in the default temporary directory, see
+// WriteFabricCAClientConfig
+func GetFabricCAClientPathForCA(caName string) (string, error) {
+	return WriteFabricCAClientConfig(caName, "")
+}
+
+// WriteFabricCAClientConfig writes the json client config of the fabric-ca
+// server named caName, see GetFabricCAClientPathForCA, to a new file in dir,
+// the default temporary directory when empty, and returns its path. File
+// names are unique, made of the process id and a random part, so that
+// concurrent writers do not collide
+func WriteFabricCAClientConfig(caName string, dir string) (string, error) {
+	fabricCAConf, err := getFabricCAConfig(caName)
 	if err != nil {
 		return "", err
 	}
@@ -207,13 +385,235 @@ func GetFabricCAClientPath() (string, error) {
 		return "", err
 	}
 
-	err = ioutil.WriteFile(filePath, jsonConfig, 0644)
-	return filePath, err
+	prefix := "client-config"
+	if caName != "" {
+		prefix += "-" + caName
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	file, err := ioutil.TempFile(dir, fmt.Sprintf("%s-%d-*.json", prefix, os.Getpid()))
+	if err != nil {
+		return "", fmt.Errorf("Failed to create the fabric-ca client config in %s: %s", dir, err)
+	}
+	_, err = file.Write(jsonConfig)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("Failed to write the fabric-ca client config %s: %s", file.Name(), err)
+	}
+	return file.Name(), nil
+}
+
+// GetFabricCAServerURL returns the URL of the fabric-ca server named caName
+func GetFabricCAServerURL(caName string) (string, error) {
+	fabricCAConf, err := getFabricCAConfig(caName)
+	if err != nil {
+		return "", err
+	}
+	return fabricCAConf.ServerURL, nil
+}
+
+// FabricCATLSConfig is the TLS configuration of the connection to a fabric-ca
+// server
+type FabricCATLSConfig struct {
+	// Enabled is true for https server URLs
+	Enabled bool
+	// CertFiles are the trusted root certificate files, the system roots
+	// are trusted when there are none
+	CertFiles []string
+	// ClientKeyFile and ClientCertFile are the key and certificate presented
+	// to servers requiring mutual TLS, both or neither are set
+	ClientKeyFile  string
+	ClientCertFile string
+	// ServerNameOverride is the name the server certificate is verified
+	// against, and sent for SNI, instead of the host of the server URL
+	ServerNameOverride string
+	// PinnedSHA256 are the hex encoded SHA-256 fingerprints the server
+	// certificate must match one of, on top of being trusted
+	PinnedSHA256 []string
+}
+
+// GetFabricCATLSConfig returns the TLS configuration of the connection to the
+// fabric-ca server named caName, from its certfiles and client keyfile and
+// certfile
+func GetFabricCATLSConfig(caName string) (*FabricCATLSConfig, error) {
+	fabricCAConf, err := getFabricCAConfig(caName)
+	if err != nil {
+		return nil, err
+	}
+	if (fabricCAConf.Client.Keyfile == "") != (fabricCAConf.Client.Certfile == "") {
+		return nil, fmt.Errorf("fabric-ca server %s: client keyfile and certfile must be set together for mutual TLS", fabricCAName(caName))
+	}
+	return &FabricCATLSConfig{
+		Enabled:            strings.HasPrefix(strings.ToLower(fabricCAConf.ServerURL), "https://"),
+		CertFiles:          fabricCAConf.Certfiles,
+		ClientKeyFile:      fabricCAConf.Client.Keyfile,
+		ClientCertFile:     fabricCAConf.Client.Certfile,
+		ServerNameOverride: myViper.GetString(fabricCAKey(caName) + ".serverNameOverride"),
+		PinnedSHA256:       myViper.GetStringSlice(fabricCAKey(caName) + ".pinnedSHA256"),
+	}, nil
+}
+
+// Defaults of the connection settings of fabric-ca servers
+const (
+	DefaultFabricCAConnectTimeout = 10 * time.Second
+	DefaultFabricCARequestTimeout = 30 * time.Second
+	DefaultFabricCAKeepAlive      = 30 * time.Second
+)
+
+// FabricCAConnectionConfig tunes the HTTP connections to a fabric-ca server
+type FabricCAConnectionConfig struct {
+	// ConnectTimeout bounds establishing a connection, TLS handshake
+	// included
+	ConnectTimeout time.Duration
+	// RequestTimeout bounds a request, from connecting to reading the
+	// response
+	RequestTimeout time.Duration
+	// KeepAlive is the period of the keep-alive probes of the connections,
+	// negative to disable them
+	KeepAlive time.Duration
+}
+
+// GetFabricCAConnectionConfig returns the connection settings of the
+// fabric-ca server named caName, durations like "10s" set by connectTimeout,
+// requestTimeout and keepAlive, the defaults when unset
+func GetFabricCAConnectionConfig(caName string) (*FabricCAConnectionConfig, error) {
+	key := fabricCAKey(caName)
+	connection := &FabricCAConnectionConfig{}
+	for _, setting := range []struct {
+		name         string
+		value        *time.Duration
+		defaultValue time.Duration
+	}{
+		{"connectTimeout", &connection.ConnectTimeout, DefaultFabricCAConnectTimeout},
+		{"requestTimeout", &connection.RequestTimeout, DefaultFabricCARequestTimeout},
+		{"keepAlive", &connection.KeepAlive, DefaultFabricCAKeepAlive},
+	} {
+		*setting.value = setting.defaultValue
+		if !myViper.IsSet(key+"."+setting.name) || myViper.GetString(key+"."+setting.name) == "" {
+			continue
+		}
+		value, err := cast.ToDurationE(myViper.Get(key + "." + setting.name))
+		if err != nil {
+			return nil, fmt.Errorf("fabric-ca server %s: %s %v is not a duration", fabricCAName(caName),
+				setting.name, myViper.Get(key+"."+setting.name))
+		}
+		if value < 0 && setting.name != "keepAlive" {
+			return nil, fmt.Errorf("fabric-ca server %s: %s %s is negative", fabricCAName(caName),
+				setting.name, value)
+		}
+		*setting.value = value
+	}
+	return connection, nil
+}
+
+// OrgRegistrarConfig is the registrar an organization registers and revokes
+// identities with by default
+type OrgRegistrarConfig struct {
+	EnrollID     string
+	EnrollSecret string
+}
+
+// OrgCAConfig is the crypto and CA configuration of an organization
+type OrgCAConfig struct {
+	// Name of the organization
+	Name string
+	// MSPID is the id of the MSP of the organization
+	MSPID string
+	// CryptoPath is the directory of the crypto material of the
+	// organization
+	CryptoPath string
+	// CAName is the name of the fabric-ca server of the organization, empty
+	// for the default server
+	CAName    string
+	ServerURL string
+	TLS       *FabricCATLSConfig
+	Registrar OrgRegistrarConfig
+}
+
+// GetConfiguredOrgs returns the sorted names of the organizations configured
+// under client.organizations
+func GetConfiguredOrgs() []string {
+	var orgs []string
+	for org := range myViper.GetStringMap("client.organizations") {
+		orgs = append(orgs, org)
+	}
+	sort.Strings(orgs)
+	return orgs
+}
+
+// GetCAConfigForOrg returns the configuration of the organization orgName,
+// configured under client.organizations.<orgName> by mspID, cryptoPath, ca,
+// the name of its fabric-ca server, the default one when unset, and
+// registrar.enrollId and registrar.enrollSecret
+func GetCAConfigForOrg(orgName string) (*OrgCAConfig, error) {
+	key := "client.organizations." + orgName
+	if orgName == "" || !myViper.IsSet(key) {
+		return nil, fmt.Errorf("org %s is not configured, configured orgs are [%s]",
+			orgName, strings.Join(GetConfiguredOrgs(), ", "))
+	}
+	orgConf := &OrgCAConfig{
+		Name:       orgName,
+		MSPID:      myViper.GetString(key + ".mspID"),
+		CryptoPath: resolvePath(myViper.GetString(key + ".cryptoPath")),
+		CAName:     myViper.GetString(key + ".ca"),
+		Registrar: OrgRegistrarConfig{
+			EnrollID:     myViper.GetString(key + ".registrar.enrollId"),
+			EnrollSecret: myViper.GetString(key + ".registrar.enrollSecret"),
+		},
+	}
+	var err error
+	if orgConf.ServerURL, err = GetFabricCAServerURL(orgConf.CAName); err != nil {
+		return nil, fmt.Errorf("org %s: %s", orgName, err)
+	}
+	if orgConf.TLS, err = GetFabricCATLSConfig(orgConf.CAName); err != nil {
+		return nil, fmt.Errorf("org %s: %s", orgName, err)
+	}
+	return orgConf, nil
+}
+
+// fabricCAName returns the name of the fabric-ca server named caName in
+// messages, the id of the default server for an empty caName
+func fabricCAName(caName string) string {
+	if caName == "" {
+		return GetFabricCAID()
+	}
+	return caName
+}
+
+// fabricCAKey returns the config key of the fabric-ca server named caName
+func fabricCAKey(caName string) string {
+	if caName != "" && caName != GetFabricCAID() {
+		return "client.fabricCAs." + caName
+	}
+	return "client.fabricCA"
+}
+
+// getFabricCAConfig reads the configurations of the fabric-ca server named caName
+func getFabricCAConfig(caName string) (*fabricCAConfig, error) {
+	key := fabricCAKey(caName)
+	if !myViper.IsSet(key) && key != "client.fabricCA" {
+		return nil, fmt.Errorf("fabric-ca server %s is not configured", caName)
+	}
+	// Values are read one by one, rather than unmarshalled from key, for the
+	// environment overrides to apply
+	fabricCAConf := fabricCAConfig{
+		ServerURL: myViper.GetString(key + ".serverURL"),
+	}
+	for _, certfile := range myViper.GetStringSlice(key + ".certfiles") {
+		fabricCAConf.Certfiles = append(fabricCAConf.Certfiles, resolvePath(certfile))
+	}
+	fabricCAConf.Client.Keyfile = resolvePath(myViper.GetString(key + ".client.keyfile"))
+	fabricCAConf.Client.Certfile = resolvePath(myViper.GetString(key + ".client.certfile"))
+	return &fabricCAConf, nil
 }
 
 // GetKeyStorePath ...
 func GetKeyStorePath() string {
-	return myViper.GetString("client.keystore.path")
+	return resolvePath(myViper.GetString("client.keystore.path"))
 }
 
 // GetOrdererPort ...
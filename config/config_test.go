@@ -20,9 +20,14 @@ limitations under the License.
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -85,3 +90,371 @@ func TestMain(m *testing.M) {
 	}
 	os.Exit(m.Run())
 }
+
+func TestInitConfigFromReader(t *testing.T) {
+	t.Cleanup(func() {
+		SetConfigBaseDir("")
+		InitConfigFromReader(strings.NewReader(""), "yaml")
+	})
+
+	yamlConfig := `
+client:
+ fabricCA:
+  serverURL: "http://localhost:7054"
+  certfiles:
+    - "root.pem"
+    - "/etc/root.pem"
+  client:
+   keyfile: "tls_client-key.pem"
+   certfile: "tls_client-cert.pem"
+ keystore:
+  path: "keystore"
+`
+	if err := InitConfigFromReader(strings.NewReader(yamlConfig), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	if url, _ := GetFabricCAServerURL(""); url != "http://localhost:7054" {
+		t.Fatalf("Expected the CA URL from the yaml config, got [%s]", url)
+	}
+	if path := GetKeyStorePath(); path != "keystore" {
+		t.Fatalf("Expected the key store path to be unresolved without a base dir, got [%s]", path)
+	}
+
+	SetConfigBaseDir("/config")
+	if path := GetKeyStorePath(); path != "/config/keystore" {
+		t.Fatalf("Expected the key store path to resolve against the base dir, got [%s]", path)
+	}
+	fabricCAConf, err := getFabricCAConfig("")
+	if err != nil {
+		t.Fatalf("getFabricCAConfig return error[%s]", err)
+	}
+	if fabricCAConf.Certfiles[0] != "/config/root.pem" || fabricCAConf.Certfiles[1] != "/etc/root.pem" {
+		t.Fatalf("Unexpected certfiles %v", fabricCAConf.Certfiles)
+	}
+	if fabricCAConf.Client.Keyfile != "/config/tls_client-key.pem" ||
+		fabricCAConf.Client.Certfile != "/config/tls_client-cert.pem" {
+		t.Fatalf("Unexpected client TLS files %+v", fabricCAConf.Client)
+	}
+
+	jsonConfig := `{"client": {"keystore": {"path": "/tmp/keystore"}}}`
+	if err := InitConfigFromReader(strings.NewReader(jsonConfig), "json"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	if path := GetKeyStorePath(); path != "/tmp/keystore" {
+		t.Fatalf("Expected the key store path from the json config, got [%s]", path)
+	}
+
+	if err := InitConfigFromReader(strings.NewReader(yamlConfig), "ini"); err == nil {
+		t.Fatalf("InitConfigFromReader should have failed for an unsupported format")
+	}
+}
+
+func TestInitConfigWithFormat(t *testing.T) {
+	t.Cleanup(func() {
+		InitConfigFromReader(strings.NewReader(""), "yaml")
+	})
+
+	tomlConfig := `
+[client.fabricCA]
+serverURL = "http://localhost:7054"
+certfiles = ["/etc/root.pem"]
+
+[client.fabricCA.client]
+keyfile = "/etc/tls_client-key.pem"
+certfile = "/etc/tls_client-cert.pem"
+`
+	dir := t.TempDir()
+	for _, name := range []string{"config.toml", "config.conf", "config"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(tomlConfig), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+
+	if err := InitConfigWithFormat(filepath.Join(dir, "config.conf"), "ini"); err == nil ||
+		!strings.Contains(err.Error(), "Unsupported config format") {
+		t.Fatalf("Expected an unsupported format error, got %v", err)
+	}
+	if err := InitConfig(filepath.Join(dir, "config.conf")); err == nil ||
+		!strings.Contains(err.Error(), "Unsupported config format") {
+		t.Fatalf("Expected an unsupported format error for the extension, got %v", err)
+	}
+	if err := InitConfig(filepath.Join(dir, "config")); err == nil ||
+		!strings.Contains(err.Error(), "Cannot detect the format") {
+		t.Fatalf("Expected an undetected format error, got %v", err)
+	}
+
+	for _, test := range []struct{ file, format string }{
+		{"config.toml", ""},
+		{"config.conf", "toml"},
+		{"config", "TOML"},
+	} {
+		if err := InitConfigWithFormat(filepath.Join(dir, test.file), test.format); err != nil {
+			t.Fatalf("InitConfigWithFormat(%s, %s) return error[%s]", test.file, test.format, err)
+		}
+		if url, _ := GetFabricCAServerURL(""); url != "http://localhost:7054" {
+			t.Fatalf("Expected the CA URL from the toml config, got [%s]", url)
+		}
+	}
+
+	configFile, err := WriteFabricCAClientConfig("", dir)
+	if err != nil {
+		t.Fatalf("WriteFabricCAClientConfig return error[%s]", err)
+	}
+	raw, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatalf("Failed to read the fabric-ca client config: %s", err)
+	}
+	var fabricCAConf fabricCAConfig
+	if err := json.Unmarshal(raw, &fabricCAConf); err != nil {
+		t.Fatalf("The fabric-ca client config is not valid json: %s", err)
+	}
+	if fabricCAConf.ServerURL != "http://localhost:7054" ||
+		len(fabricCAConf.Certfiles) != 1 || fabricCAConf.Certfiles[0] != "/etc/root.pem" ||
+		fabricCAConf.Client.Keyfile != "/etc/tls_client-key.pem" ||
+		fabricCAConf.Client.Certfile != "/etc/tls_client-cert.pem" {
+		t.Fatalf("Unexpected fabric-ca client config %+v", fabricCAConf)
+	}
+}
+
+func TestGetCAConfigForOrg(t *testing.T) {
+	t.Cleanup(func() {
+		SetConfigBaseDir("")
+		InitConfigFromReader(strings.NewReader(""), "yaml")
+	})
+
+	yamlConfig := `
+client:
+ fabricCA:
+  id: "ca-org1"
+  serverURL: "http://localhost:7054"
+ fabricCAs:
+  ca-org2:
+   serverURL: "https://localhost:8054"
+   certfiles:
+    - "org2/tls-ca.pem"
+ organizations:
+  org1:
+   mspID: "Org1MSP"
+   cryptoPath: "org1/msp"
+   registrar:
+    enrollId: "admin"
+    enrollSecret: "adminpw"
+  org2:
+   mspID: "Org2MSP"
+   cryptoPath: "/crypto/org2/msp"
+   ca: "ca-org2"
+   registrar:
+    enrollId: "admin2"
+    enrollSecret: "adminpw2"
+`
+	if err := InitConfigFromReader(strings.NewReader(yamlConfig), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	SetConfigBaseDir("/config")
+
+	if orgs := GetConfiguredOrgs(); len(orgs) != 2 || orgs[0] != "org1" || orgs[1] != "org2" {
+		t.Fatalf("Unexpected configured orgs %v", orgs)
+	}
+
+	org1, err := GetCAConfigForOrg("org1")
+	if err != nil {
+		t.Fatalf("GetCAConfigForOrg return error[%s]", err)
+	}
+	if org1.MSPID != "Org1MSP" || org1.CryptoPath != "/config/org1/msp" || org1.CAName != "" ||
+		org1.ServerURL != "http://localhost:7054" || org1.TLS.Enabled ||
+		org1.Registrar != (OrgRegistrarConfig{EnrollID: "admin", EnrollSecret: "adminpw"}) {
+		t.Fatalf("Unexpected org1 config %+v", org1)
+	}
+
+	org2, err := GetCAConfigForOrg("org2")
+	if err != nil {
+		t.Fatalf("GetCAConfigForOrg return error[%s]", err)
+	}
+	if org2.MSPID != "Org2MSP" || org2.CryptoPath != "/crypto/org2/msp" || org2.CAName != "ca-org2" ||
+		org2.ServerURL != "https://localhost:8054" || !org2.TLS.Enabled ||
+		len(org2.TLS.CertFiles) != 1 || org2.TLS.CertFiles[0] != "/config/org2/tls-ca.pem" ||
+		org2.Registrar != (OrgRegistrarConfig{EnrollID: "admin2", EnrollSecret: "adminpw2"}) {
+		t.Fatalf("Unexpected org2 config %+v", org2)
+	}
+
+	_, err = GetCAConfigForOrg("org3")
+	if err == nil || err.Error() != "org org3 is not configured, configured orgs are [org1, org2]" {
+		t.Fatalf("Expected an org not configured error, got %v", err)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	t.Cleanup(func() {
+		InitConfigFromReader(strings.NewReader(""), "yaml")
+	})
+	yamlConfig := `
+client:
+ fabricCA:
+  serverURL: "http://localhost:7054"
+  client:
+   keyfile: "tls_client-key.pem"
+ fabricCAs:
+  ca1:
+   serverURL: "http://localhost:8054"
+`
+	if err := InitConfigFromReader(strings.NewReader(yamlConfig), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	t.Setenv("FABRIC_SDK_CA_URL", "https://ca.example.com:7054")
+	t.Setenv("FABRIC_SDK_CLIENT_FABRICCA_CLIENT_KEYFILE", "/secrets/tls_client-key.pem")
+	t.Setenv("FABRIC_SDK_CLIENT_FABRICCAS_CA1_SERVERURL", "https://ca1.example.com:8054")
+
+	filePath, err := GetFabricCAClientPath()
+	if err != nil {
+		t.Fatalf("GetFabricCAClientPath return error[%s]", err)
+	}
+	defer os.Remove(filePath)
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read the client config: %s", err)
+	}
+	var clientConfig fabricCAConfig
+	if err := json.Unmarshal(data, &clientConfig); err != nil {
+		t.Fatalf("Failed to unmarshal the client config: %s", err)
+	}
+	if clientConfig.ServerURL != "https://ca.example.com:7054" {
+		t.Fatalf("Expected the CA URL override in the client config, got [%s]", clientConfig.ServerURL)
+	}
+	if clientConfig.Client.Keyfile != "/secrets/tls_client-key.pem" {
+		t.Fatalf("Expected the keyfile override in the client config, got [%s]", clientConfig.Client.Keyfile)
+	}
+
+	if url, _ := GetFabricCAServerURL("ca1"); url != "https://ca1.example.com:8054" {
+		t.Fatalf("Expected the ca1 URL override, got [%s]", url)
+	}
+}
+
+func TestGetFabricCAConnectionConfig(t *testing.T) {
+	t.Cleanup(func() {
+		InitConfigFromReader(strings.NewReader(""), "yaml")
+	})
+	yamlConfig := `
+client:
+ fabricCA:
+  serverURL: "http://localhost:7054"
+ fabricCAs:
+  ca1:
+   serverURL: "http://localhost:8054"
+   connectTimeout: "2s"
+   requestTimeout: "1m"
+   keepAlive: "-1s"
+  ca2:
+   serverURL: "http://localhost:9054"
+   requestTimeout: "soon"
+`
+	if err := InitConfigFromReader(strings.NewReader(yamlConfig), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	connection, err := GetFabricCAConnectionConfig("")
+	if err != nil {
+		t.Fatalf("GetFabricCAConnectionConfig return error[%s]", err)
+	}
+	if *connection != (FabricCAConnectionConfig{ConnectTimeout: DefaultFabricCAConnectTimeout,
+		RequestTimeout: DefaultFabricCARequestTimeout, KeepAlive: DefaultFabricCAKeepAlive}) {
+		t.Fatalf("Expected the default connection config, got %+v", connection)
+	}
+	connection, err = GetFabricCAConnectionConfig("ca1")
+	if err != nil {
+		t.Fatalf("GetFabricCAConnectionConfig return error[%s]", err)
+	}
+	if *connection != (FabricCAConnectionConfig{ConnectTimeout: 2 * time.Second, RequestTimeout: time.Minute,
+		KeepAlive: -time.Second}) {
+		t.Fatalf("Expected the configured connection config, got %+v", connection)
+	}
+	if _, err := GetFabricCAConnectionConfig("ca2"); err == nil {
+		t.Fatalf("GetFabricCAConnectionConfig should have rejected an invalid duration")
+	}
+}
+
+func TestGetFabricCARegistrationDefaults(t *testing.T) {
+	t.Cleanup(func() {
+		InitConfigFromReader(strings.NewReader(""), "yaml")
+	})
+	yamlConfig := `
+client:
+ fabricCA:
+  serverURL: "http://localhost:7054"
+  defaultType: "user"
+  defaultAffiliation: "org1.department1"
+ fabricCAs:
+  ca1:
+   serverURL: "http://localhost:8054"
+   defaultAffiliation: "org2"
+`
+	if err := InitConfigFromReader(strings.NewReader(yamlConfig), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	if identityType, affiliation := GetFabricCARegistrationDefaults(""); identityType != "user" ||
+		affiliation != "org1.department1" {
+		t.Fatalf("Unexpected registration defaults %s, %s", identityType, affiliation)
+	}
+	if identityType, affiliation := GetFabricCARegistrationDefaults("ca1"); identityType != "" ||
+		affiliation != "org2" {
+		t.Fatalf("Unexpected registration defaults of ca1 %s, %s", identityType, affiliation)
+	}
+}
+
+func TestGetFabricCATLSCA(t *testing.T) {
+	t.Cleanup(func() {
+		InitConfigFromReader(strings.NewReader(""), "yaml")
+	})
+	yamlConfig := `
+client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "http://localhost:7054"
+  tlsCA: "tlsca"
+ fabricCAs:
+  tlsca:
+   serverURL: "http://localhost:8054"
+  ca1:
+   serverURL: "http://localhost:9054"
+   tlsCA: "unknown"
+  ca2:
+   serverURL: "http://localhost:10054"
+   tlsCA: "ca2"
+`
+	if err := InitConfigFromReader(strings.NewReader(yamlConfig), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	if tlsCA, err := GetFabricCATLSCA(""); err != nil || tlsCA != "tlsca" {
+		t.Fatalf("Unexpected TLS CA %s, error %v", tlsCA, err)
+	}
+	if tlsCA, err := GetFabricCATLSCA("tlsca"); err != nil || tlsCA != "" {
+		t.Fatalf("Unexpected TLS CA of tlsca %s, error %v", tlsCA, err)
+	}
+	if _, err := GetFabricCATLSCA("ca1"); err == nil || !strings.Contains(err.Error(), "fabric-ca server unknown is not configured") {
+		t.Fatalf("Expected an unconfigured TLS CA error, got %v", err)
+	}
+	if _, err := GetFabricCATLSCA("ca2"); err == nil || !strings.Contains(err.Error(), "cannot be its own TLS CA") {
+		t.Fatalf("Expected a self TLS CA error, got %v", err)
+	}
+}
+
+func TestWriteFabricCAClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatalf("TempDir return error[%s]", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	first, err := WriteFabricCAClientConfig("", dir)
+	if err != nil {
+		t.Fatalf("WriteFabricCAClientConfig return error[%s]", err)
+	}
+	second, err := WriteFabricCAClientConfig("", dir)
+	if err != nil {
+		t.Fatalf("WriteFabricCAClientConfig return error[%s]", err)
+	}
+	if first == second || filepath.Dir(first) != dir {
+		t.Fatalf("Expected unique client configs in %s, got %s and %s", dir, first, second)
+	}
+	if !strings.HasPrefix(filepath.Base(first), fmt.Sprintf("client-config-%d-", os.Getpid())) {
+		t.Fatalf("Expected the process id in the client config name, got %s", first)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ValidationError is returned by Validate. It lists all the problems found in
+// the config
+type ValidationError struct {
+	Problems []string
+}
+
+// Error returns the error message
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+// IsConfigValidationEnabled returns true when clients validate the config
+// when they are constructed, from client.validateConfig
+func IsConfigValidationEnabled() bool {
+	return myViper.GetBool("client.validateConfig")
+}
+
+// Validate checks the fabric-ca servers, TLS and crypto configurations,
+// returning a *ValidationError listing every problem found. Files the config
+// refers to, such as TLS certificates, must exist
+func Validate() error {
+	var problems []string
+
+	caNames := []string{""}
+	for caName := range myViper.GetStringMap("client.fabricCAs") {
+		caNames = append(caNames, caName)
+	}
+	sort.Strings(caNames[1:])
+	for _, caName := range caNames {
+		problems = append(problems, validateFabricCAConfig(caName)...)
+	}
+
+	for _, org := range GetConfiguredOrgs() {
+		problems = append(problems, validateOrgConfig(org)...)
+	}
+
+	if IsTLSEnabled() {
+		certificate := myViper.GetString("client.tls.certificate")
+		if certificate == "" {
+			problems = append(problems, "client.tls.certificate is not set while TLS is enabled")
+		} else if problem := checkFile("client.tls.certificate", resolvePath(certificate)); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	problems = append(problems, validateSecurityConfig()...)
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validateFabricCAConfig checks the configuration of the fabric-ca server
+// named caName
+func validateFabricCAConfig(caName string) []string {
+	name := fabricCAName(caName)
+	fabricCAConf, err := getFabricCAConfig(caName)
+	if err != nil {
+		return []string{fmt.Sprintf("fabric-ca server %s: %s", name, err)}
+	}
+
+	var problems []string
+	if fabricCAConf.ServerURL == "" {
+		problems = append(problems, fmt.Sprintf("fabric-ca server %s: serverURL is not set", name))
+	} else if u, err := url.Parse(fabricCAConf.ServerURL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("fabric-ca server %s: serverURL %s is not an http or https URL", name, fabricCAConf.ServerURL))
+	}
+	for _, certfile := range fabricCAConf.Certfiles {
+		if problem := checkFile(fmt.Sprintf("fabric-ca server %s: certfile", name), certfile); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	for _, pin := range myViper.GetStringSlice(fabricCAKey(caName) + ".pinnedSHA256") {
+		if _, err := ParseSHA256Fingerprint(pin); err != nil {
+			problems = append(problems, fmt.Sprintf("fabric-ca server %s: %s", name, err))
+		}
+	}
+	if _, err := GetFabricCAConnectionConfig(caName); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := GetFabricCATLSCA(caName); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if (fabricCAConf.Client.Keyfile == "") != (fabricCAConf.Client.Certfile == "") {
+		problems = append(problems, fmt.Sprintf("fabric-ca server %s: client keyfile and certfile must be set together for mutual TLS", name))
+	}
+	if fabricCAConf.Client.Keyfile != "" {
+		if problem := checkFile(fmt.Sprintf("fabric-ca server %s: client keyfile", name), fabricCAConf.Client.Keyfile); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if fabricCAConf.Client.Certfile != "" {
+		if problem := checkFile(fmt.Sprintf("fabric-ca server %s: client certfile", name), fabricCAConf.Client.Certfile); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// validateOrgConfig checks the configuration of the organization org
+func validateOrgConfig(org string) []string {
+	orgConf, err := GetCAConfigForOrg(org)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	if orgConf.MSPID == "" {
+		problems = append(problems, fmt.Sprintf("org %s: mspID is not set", org))
+	}
+	if (orgConf.Registrar.EnrollID == "") != (orgConf.Registrar.EnrollSecret == "") {
+		problems = append(problems, fmt.Sprintf("org %s: registrar enrollId and enrollSecret must be set together", org))
+	}
+	return problems
+}
+
+// validateSecurityConfig checks the crypto configuration under
+// client.security
+func validateSecurityConfig() []string {
+	var problems []string
+	switch algorithm := GetSecurityAlgorithm(); algorithm {
+	case "", "SHA2", "SHA3":
+	default:
+		problems = append(problems, fmt.Sprintf("client.security.hashAlgorithm %s is not SHA2 or SHA3", algorithm))
+	}
+	switch level := GetSecurityLevel(); level {
+	case 0, 256, 384:
+	default:
+		problems = append(problems, fmt.Sprintf("client.security.level %d is not 256 or 384", level))
+	}
+
+	switch provider := GetSecurityProvider(); provider {
+	case "", "SW":
+		if GetKeyStorePath() == "" {
+			problems = append(problems, "client.keystore.path is not set")
+		}
+	case "PKCS11":
+		if library := GetSecurityProviderLibPath(); library == "" {
+			problems = append(problems, "client.security.pkcs11.library is not set")
+		} else if problem := checkFile("client.security.pkcs11.library", library); problem != "" {
+			problems = append(problems, problem)
+		}
+		if GetSecurityProviderLabel() == "" {
+			problems = append(problems, "client.security.pkcs11.label is not set")
+		}
+		if GetSecurityProviderPin() == "" {
+			problems = append(problems, "client.security.pkcs11.pin is not set")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("client.security.provider %s is not SW or PKCS11", provider))
+	}
+	return problems
+}
+
+// ParseSHA256Fingerprint decodes a hex encoded SHA-256 fingerprint, whose
+// bytes may be separated by colons
+func ParseSHA256Fingerprint(fingerprint string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1))
+	if err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("pinnedSHA256 %s is not a hex encoded SHA-256 fingerprint", fingerprint)
+	}
+	return decoded, nil
+}
+
+// checkFile returns a problem naming what when the file at path does not
+// exist
+func checkFile(what string, path string) string {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("%s %s does not exist", what, path)
+		}
+		return fmt.Sprintf("%s %s: %s", what, path, err)
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	t.Cleanup(func() {
+		SetConfigBaseDir("")
+		InitConfigFromReader(strings.NewReader(""), "yaml")
+	})
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatalf("TempDir return error[%s]", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(path.Join(dir, "root.pem"), []byte("root"), 0644); err != nil {
+		t.Fatalf("WriteFile return error[%s]", err)
+	}
+	SetConfigBaseDir(dir)
+
+	validConfig := `
+client:
+ tls:
+  enabled: true
+  certificate: "root.pem"
+ security:
+  hashAlgorithm: "SHA2"
+  level: 256
+  provider: "SW"
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "https://localhost:7054"
+  tlsCA: "tlsca"
+  certfiles:
+    - "root.pem"
+ fabricCAs:
+  tlsca:
+   serverURL: "https://localhost:8054"
+ organizations:
+  org1:
+   mspID: "Org1MSP"
+   ca: "tlsca"
+ keystore:
+  path: "keystore"
+`
+	if err := InitConfigFromReader(strings.NewReader(validConfig), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	if err := Validate(); err != nil {
+		t.Fatalf("Validate return error[%s]", err)
+	}
+
+	invalidConfig := `
+client:
+ tls:
+  enabled: true
+  certificate: "missing-tls.pem"
+ security:
+  provider: "PKCS11"
+  pkcs11:
+   library: "/nonexistent/libsofthsm2.so"
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "localhost:7054"
+  certfiles:
+    - "missing-root.pem"
+  pinnedSHA256:
+    - "AB:CD"
+  tlsCA: "missing-tlsca"
+ fabricCAs:
+  tlsca:
+   client:
+    certfile: "/nonexistent/tls_client-cert.pem"
+ organizations:
+  org1:
+   registrar:
+    enrollId: "admin"
+  org2:
+   mspID: "Org2MSP"
+   ca: "unknown"
+`
+	if err := InitConfigFromReader(strings.NewReader(invalidConfig), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader return error[%s]", err)
+	}
+	err = Validate()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Validate should have returned a ValidationError, got [%v]", err)
+	}
+	expected := []string{
+		"fabric-ca server DEFAULT: serverURL localhost:7054 is not an http or https URL",
+		"fabric-ca server DEFAULT: certfile " + path.Join(dir, "missing-root.pem") + " does not exist",
+		"fabric-ca server DEFAULT: pinnedSHA256 AB:CD is not a hex encoded SHA-256 fingerprint",
+		"TLS CA of fabric-ca server DEFAULT: fabric-ca server missing-tlsca is not configured",
+		"fabric-ca server tlsca: serverURL is not set",
+		"fabric-ca server tlsca: client keyfile and certfile must be set together for mutual TLS",
+		"fabric-ca server tlsca: client certfile /nonexistent/tls_client-cert.pem does not exist",
+		"org org1: mspID is not set",
+		"org org1: registrar enrollId and enrollSecret must be set together",
+		"org org2: fabric-ca server unknown is not configured",
+		"client.tls.certificate " + path.Join(dir, "missing-tls.pem") + " does not exist",
+		"client.security.pkcs11.library /nonexistent/libsofthsm2.so does not exist",
+		"client.security.pkcs11.label is not set",
+		"client.security.pkcs11.pin is not set",
+	}
+	if strings.Join(validationErr.Problems, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected problems:\n%s", strings.Join(validationErr.Problems, "\n"))
+	}
+}
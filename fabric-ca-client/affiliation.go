@@ -0,0 +1,319 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-ca/util"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// AffiliationResponse describes an affiliation and what an affiliation
+// operation affected
+type AffiliationResponse struct {
+	// Name is the full path of the affiliation, e.g. org1.department1
+	Name string
+	// Affiliations lists the full paths of all child affiliations
+	Affiliations []string
+	// Identities lists the names of the identities in the affiliation
+	// and its child affiliations
+	Identities []string
+}
+
+// affiliationInfo is the affiliation tree sent by the CA
+type affiliationInfo struct {
+	Name         string            `json:"name"`
+	Affiliations []affiliationInfo `json:"affiliations,omitempty"`
+	Identities   []struct {
+		ID string `json:"id"`
+	} `json:"identities,omitempty"`
+}
+
+// AddAffiliation adds an affiliation to the Fabric CA
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Full path of the affiliation, e.g. org1.department1
+// @returns {AffiliationResponse} The added affiliation
+// @returns {error} Error
+func (fabricCAServices *services) AddAffiliation(registrar fabricclient.User,
+	name string) (*AffiliationResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Affiliation name cannot be empty")
+	}
+	body, err := util.Marshal(map[string]string{"name": name}, "AddAffiliationRequest")
+	if err != nil {
+		return nil, err
+	}
+	return fabricCAServices.affiliationRequest(registrar, "POST", "affiliations", body)
+}
+
+// GetAffiliation returns an affiliation of the Fabric CA
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Full path of the affiliation, e.g. org1.department1
+// @returns {AffiliationResponse} The affiliation
+// @returns {error} Error
+func (fabricCAServices *services) GetAffiliation(registrar fabricclient.User,
+	name string) (*AffiliationResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Affiliation name cannot be empty")
+	}
+	return fabricCAServices.affiliationRequest(registrar, "GET",
+		"affiliations/"+url.PathEscape(name), nil)
+}
+
+// GetAllAffiliations returns all affiliations of the Fabric CA as a flat
+// list, failing with ErrTooManyResults beyond the maximum of
+// WithMaxListResults. The CA sends the affiliations as a tree, decoded whole
+// @param {User} registrar The User that is initiating the request
+// @returns {[]AffiliationResponse} The affiliations, parents before children
+// @returns {error} Error
+func (fabricCAServices *services) GetAllAffiliations(registrar fabricclient.
+	User) ([]*AffiliationResponse, error) {
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	result, err := fabricCAServices.send(ctx, identity, "GET", "affiliations", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting affiliations: %w", err)
+	}
+	var root affiliationInfo
+	if err := decodeResult(result, &root); err != nil {
+		return nil, err
+	}
+	var affiliations []*AffiliationResponse
+	var flatten func(info affiliationInfo) error
+	flatten = func(info affiliationInfo) error {
+		// The root of the tree is unnamed
+		if info.Name != "" {
+			if err := fabricCAServices.checkListSize(len(affiliations)); err != nil {
+				return err
+			}
+			affiliations = append(affiliations, newAffiliationResponse(info))
+		}
+		for _, child := range info.Affiliations {
+			if err := flatten(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := flatten(root); err != nil {
+		return nil, fmt.Errorf("Error getting affiliations: %w", err)
+	}
+	return affiliations, nil
+}
+
+// AffiliationNode is an affiliation of the affiliation tree returned by
+// GetAffiliationTree
+type AffiliationNode struct {
+	// Name is the last element of the path of the affiliation, e.g.
+	// department1, empty for the root of the tree
+	Name string
+	// Path is the full path of the affiliation, e.g. org1.department1
+	Path string
+	// Children are the child affiliations, sorted by name
+	Children []*AffiliationNode
+}
+
+// GetAffiliationTree returns all affiliations of the Fabric CA as a tree
+// @param {User} registrar The User that is initiating the request
+// @returns {AffiliationNode} The unnamed root of the tree, whose children
+// are the top level affiliations
+// @returns {error} Error
+func (fabricCAServices *services) GetAffiliationTree(registrar fabricclient.User) (*AffiliationNode, error) {
+	affiliations, err := fabricCAServices.GetAllAffiliations(registrar)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(affiliations))
+	for _, affiliation := range affiliations {
+		paths = append(paths, affiliation.Name)
+	}
+	return newAffiliationTree(paths), nil
+}
+
+// newAffiliationTree builds the tree of dotted affiliation paths, in any
+// order. The parents missing from paths are created
+func newAffiliationTree(paths []string) *AffiliationNode {
+	root := &AffiliationNode{}
+	nodes := map[string]*AffiliationNode{"": root}
+	for _, path := range paths {
+		parent := root
+		for _, name := range strings.Split(path, ".") {
+			if name == "" {
+				continue
+			}
+			childPath := name
+			if parent.Path != "" {
+				childPath = parent.Path + "." + name
+			}
+			node, ok := nodes[childPath]
+			if !ok {
+				node = &AffiliationNode{Name: name, Path: childPath}
+				nodes[childPath] = node
+				parent.Children = append(parent.Children, node)
+			}
+			parent = node
+		}
+	}
+	for _, node := range nodes {
+		sort.Slice(node.Children, func(i, j int) bool {
+			return node.Children[i].Name < node.Children[j].Name
+		})
+	}
+	return root
+}
+
+// RemoveAffiliation removes an affiliation from the Fabric CA
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Full path of the affiliation, e.g. org1.department1
+// @param {bool} force Also remove the child affiliations and all identities
+// in the affiliation, the CA refuses to remove a non empty affiliation otherwise
+// @returns {AffiliationResponse} The removed affiliations and identities
+// @returns {error} Error
+func (fabricCAServices *services) RemoveAffiliation(registrar fabricclient.User,
+	name string, force bool) (*AffiliationResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Affiliation name cannot be empty")
+	}
+	endpoint := "affiliations/" + url.PathEscape(name)
+	if force {
+		endpoint += "?force=true"
+	}
+	return fabricCAServices.affiliationRequest(registrar, "DELETE", endpoint, nil)
+}
+
+// RevokeSummary is the result of a RevokeAffiliation call
+type RevokeSummary struct {
+	// Affiliation is the full path of the revoked affiliation
+	Affiliation string
+	// Total is the number of identities in the affiliation and its child
+	// affiliations
+	Total int
+	// Revoked lists the identities whose certificates were revoked
+	Revoked []string
+	// AlreadyRevoked lists the identities the CA reported as already
+	// revoked, e.g. by a previous attempt
+	AlreadyRevoked []string
+	// Skipped lists the identities which were not revoked: the registrar
+	// itself, which would not be able to revoke the others anymore
+	Skipped []string
+	// Errors are the errors the revocation of identities failed with, by
+	// identity name
+	Errors map[string]error
+	// CRL is the DER encoded CRL generated once the identities are revoked,
+	// nil unless the registrar has the hf.GenCRL attribute
+	CRL []byte
+	// CRLErr is the error the CRL generation failed with
+	CRLErr error
+}
+
+// RevokeAffiliation revokes the certificates of all identities in an
+// affiliation and its child affiliations, e.g. when it is compromised.
+// Revocations continue past the identities which fail, so that the call can
+// be retried until it reports no error
+// @param {User} registrar The User that is initiating the revocations
+// @param {string} affiliation Full path of the affiliation, e.g. org1.department1
+// @param {RevocationReason} reason The reason for revocation
+// @returns {RevokeSummary} The identities revoked, and those which failed
+// @returns {error} Error preventing any revocation, like an unknown affiliation
+func (fabricCAServices *services) RevokeAffiliation(registrar fabricclient.User,
+	affiliation string, reason RevocationReason) (RevokeSummary, error) {
+	summary := RevokeSummary{Affiliation: affiliation, Errors: map[string]error{}}
+	if _, err := revocationReason(&RevocationRequest{ReasonCode: reason}); err != nil {
+		return summary, err
+	}
+	if registrar == nil {
+		return summary, fmt.Errorf("Registrar cannot be nil")
+	}
+	caps, err := fabricCAServices.GetRegistrarCapabilities(registrar)
+	if err != nil {
+		return summary, err
+	}
+	response, err := fabricCAServices.GetAffiliation(registrar, affiliation)
+	if err != nil {
+		return summary, fmt.Errorf("Error listing the identities of %s: %w", affiliation, err)
+	}
+	summary.Total = len(response.Identities)
+	for _, name := range response.Identities {
+		if name == registrar.GetName() {
+			summary.Skipped = append(summary.Skipped, name)
+			continue
+		}
+		err := fabricCAServices.Revoke(registrar, &RevocationRequest{Name: name, ReasonCode: reason})
+		switch {
+		case err == nil:
+			summary.Revoked = append(summary.Revoked, name)
+		case errors.Is(err, ErrAlreadyRevoked):
+			summary.AlreadyRevoked = append(summary.AlreadyRevoked, name)
+		default:
+			summary.Errors[name] = err
+		}
+	}
+	if caps.GenCRL {
+		summary.CRL, summary.CRLErr = fabricCAServices.GenerateCRL(registrar, nil)
+	}
+	return summary, nil
+}
+
+// affiliationRequest sends an affiliation request signed by the registrar
+func (fabricCAServices *services) affiliationRequest(registrar fabricclient.User,
+	method string, endpoint string, body []byte) (*AffiliationResponse, error) {
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	result, err := fabricCAServices.send(ctx, identity, method, endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("Affiliation request failed: %w", err)
+	}
+	var info affiliationInfo
+	if err := decodeResult(result, &info); err != nil {
+		return nil, err
+	}
+	return newAffiliationResponse(info), nil
+}
+
+// newAffiliationResponse collects the child affiliations and identities of
+// an affiliation tree
+func newAffiliationResponse(info affiliationInfo) *AffiliationResponse {
+	response := &AffiliationResponse{Name: info.Name}
+	var collect func(info affiliationInfo)
+	collect = func(info affiliationInfo) {
+		for _, id := range info.Identities {
+			response.Identities = append(response.Identities, id.ID)
+		}
+		for _, child := range info.Affiliations {
+			response.Affiliations = append(response.Affiliations, child.Name)
+			collect(child)
+		}
+	}
+	collect(info)
+	return response
+}
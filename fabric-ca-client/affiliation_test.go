@@ -0,0 +1,220 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAffiliations(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	tree := map[string]interface{}{
+		"name": "",
+		"affiliations": []interface{}{
+			map[string]interface{}{
+				"name": "org1",
+				"affiliations": []interface{}{
+					map[string]interface{}{
+						"name":       "org1.department1",
+						"identities": []interface{}{map[string]interface{}{"id": "user1"}},
+					},
+				},
+				"identities": []interface{}{map[string]interface{}{"id": "admin"}},
+			},
+		},
+	}
+	var method, path string
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"affiliations": func(r *http.Request, body []byte) (interface{}, int) {
+			if r.Header.Get("authorization") == "" {
+				return "Authorization failure", http.StatusUnauthorized
+			}
+			method, path = r.Method, r.URL.RequestURI()
+			switch {
+			case r.Method == "GET" && r.URL.Path == "/api/v1/cfssl/affiliations":
+				return tree, http.StatusOK
+			case r.Method == "DELETE" && r.URL.Query().Get("force") != "true":
+				return "Cannot delete affiliation with child affiliations", http.StatusBadRequest
+			default:
+				return tree["affiliations"].([]interface{})[0], http.StatusOK
+			}
+		},
+	})
+	defer ca.Close()
+
+	// Empty affiliation name
+	if _, err := ca.services.AddAffiliation(registrar, ""); err == nil {
+		t.Fatalf("Expected error with empty affiliation name")
+	}
+	// Nil registrar
+	if _, err := ca.services.GetAffiliation(nil, "org1"); err == nil {
+		t.Fatalf("Expected error with nil registrar")
+	}
+	added, err := ca.services.AddAffiliation(registrar, "org1")
+	if err != nil {
+		t.Fatalf("AddAffiliation returned error: %v", err)
+	}
+	if method != "POST" || added.Name != "org1" {
+		t.Fatalf("AddAffiliation sent %s, returned %+v", method, added)
+	}
+	affiliation, err := ca.services.GetAffiliation(registrar, "org1")
+	if err != nil {
+		t.Fatalf("GetAffiliation returned error: %v", err)
+	}
+	if method != "GET" || path != "/api/v1/cfssl/affiliations/org1" {
+		t.Fatalf("GetAffiliation sent %s %s", method, path)
+	}
+	if len(affiliation.Affiliations) != 1 || affiliation.Affiliations[0] != "org1.department1" {
+		t.Fatalf("GetAffiliation returned wrong child affiliations: %v", affiliation.Affiliations)
+	}
+	if len(affiliation.Identities) != 2 {
+		t.Fatalf("GetAffiliation returned wrong identities: %v", affiliation.Identities)
+	}
+	all, err := ca.services.GetAllAffiliations(registrar)
+	if err != nil {
+		t.Fatalf("GetAllAffiliations returned error: %v", err)
+	}
+	if len(all) != 2 || all[0].Name != "org1" || all[1].Name != "org1.department1" {
+		t.Fatalf("GetAllAffiliations returned wrong affiliations: %+v", all)
+	}
+	root, err := ca.services.GetAffiliationTree(registrar)
+	if err != nil {
+		t.Fatalf("GetAffiliationTree returned error: %v", err)
+	}
+	if fmt.Sprint(affiliationPaths(root)) != "[org1 org1.department1]" {
+		t.Fatalf("GetAffiliationTree returned wrong tree: %v", affiliationPaths(root))
+	}
+	// Remove without force
+	if _, err := ca.services.RemoveAffiliation(registrar, "org1", false); err == nil {
+		t.Fatalf("Expected error removing non empty affiliation without force")
+	}
+	removed, err := ca.services.RemoveAffiliation(registrar, "org1", true)
+	if err != nil {
+		t.Fatalf("RemoveAffiliation returned error: %v", err)
+	}
+	if method != "DELETE" || len(removed.Identities) != 2 {
+		t.Fatalf("RemoveAffiliation sent %s, returned %+v", method, removed)
+	}
+}
+
+func TestNewAffiliationTree(t *testing.T) {
+	// Children before parents, orphans and duplicates
+	root := newAffiliationTree([]string{"org2.department1", "org1.department1.team2", "org1",
+		"org1.department1.team1", "org2", "org1.department1", "org3..department1", "org2"})
+	expected := "[org1 org1.department1 org1.department1.team1 org1.department1.team2 " +
+		"org2 org2.department1 org3 org3.department1]"
+	if fmt.Sprint(affiliationPaths(root)) != expected {
+		t.Fatalf("Wrong tree %v", affiliationPaths(root))
+	}
+	if root.Name != "" || len(root.Children) != 3 || root.Children[0].Name != "org1" ||
+		root.Children[0].Children[0].Children[1].Name != "team2" {
+		t.Fatalf("Wrong node names")
+	}
+	if empty := newAffiliationTree(nil); empty.Name != "" || len(empty.Children) != 0 {
+		t.Fatalf("Expected an empty tree, got %+v", empty)
+	}
+}
+
+// affiliationPaths lists the paths of the children of node, depth first
+func affiliationPaths(node *AffiliationNode) []string {
+	var paths []string
+	for _, child := range node.Children {
+		paths = append(paths, child.Path)
+		paths = append(paths, affiliationPaths(child)...)
+	}
+	return paths
+}
+
+func TestRevokeAffiliation(t *testing.T) {
+	registrar := newTestRegistrar(t, map[string]string{RevokerAttr: "true", GenCRLAttr: "true"})
+	org1 := map[string]interface{}{
+		"name": "org1",
+		"affiliations": []interface{}{
+			map[string]interface{}{
+				"name": "org1.department1",
+				"identities": []interface{}{
+					map[string]interface{}{"id": "user1"},
+					map[string]interface{}{"id": "user2"},
+					map[string]interface{}{"id": "user3"},
+				},
+			},
+		},
+		"identities": []interface{}{map[string]interface{}{"id": "admin"}},
+	}
+	var revoked []string
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"affiliations": func(r *http.Request, body []byte) (interface{}, int) {
+			if r.URL.Path != "/api/v1/cfssl/affiliations/org1" {
+				return "Affiliation not found", http.StatusNotFound
+			}
+			return org1, http.StatusOK
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			name := request["id"].(string)
+			switch name {
+			case "user2":
+				return "Identity user2 is already revoked", http.StatusBadRequest
+			case "user3":
+				return "Failed to get user user3", http.StatusNotFound
+			}
+			if request["reason"] != float64(KeyCompromise) {
+				return fmt.Sprintf("Unexpected reason %v", request["reason"]), http.StatusBadRequest
+			}
+			revoked = append(revoked, name)
+			return map[string]interface{}{}, http.StatusOK
+		},
+		"gencrl": func(r *http.Request, body []byte) (interface{}, int) {
+			crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: []byte("crl")})
+			return map[string]interface{}{"CRL": base64.StdEncoding.EncodeToString(crlPEM)}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	summary, err := ca.services.RevokeAffiliation(registrar, "org1", KeyCompromise)
+	if err != nil {
+		t.Fatalf("RevokeAffiliation returned error: %v", err)
+	}
+	if summary.Total != 4 || strings.Join(summary.Revoked, ",") != "user1" ||
+		strings.Join(summary.AlreadyRevoked, ",") != "user2" || strings.Join(summary.Skipped, ",") != "admin" ||
+		len(summary.Errors) != 1 || !errors.Is(summary.Errors["user3"], ErrNotFound) {
+		t.Fatalf("Unexpected summary %+v", summary)
+	}
+	if string(summary.CRL) != "crl" || summary.CRLErr != nil || strings.Join(revoked, ",") != "user1" {
+		t.Fatalf("Unexpected CRL %q, error %v, revoked %v", summary.CRL, summary.CRLErr, revoked)
+	}
+
+	if _, err := ca.services.RevokeAffiliation(registrar, "org2", KeyCompromise); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for an unknown affiliation, got: %v", err)
+	}
+	var validationErr *ValidationError
+	if _, err := ca.services.RevokeAffiliation(registrar, "org1", 7); !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError for an invalid reason, got: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, as the Kind of a *CAError, for the requests
+// failed fast by an open circuit breaker without being sent, see
+// WithCircuitBreaker
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of the circuit breaker of the Services
+type BreakerState int
+
+const (
+	// BreakerClosed sends the requests to the CA
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails the requests fast with ErrCircuitOpen
+	BreakerOpen
+	// BreakerHalfOpen sends a single probe request to the CA, which closes
+	// the breaker on success and opens it again on failure
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerPolicy sets when the circuit breaker of the Services trips,
+// see WithCircuitBreaker
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive transient failures, the
+	// CA being unreachable or a 5xx status, opening the breaker. The breaker
+	// is disabled when it is 0 or less
+	FailureThreshold int
+	// Cooldown is how long the breaker stays open before half-opening to
+	// probe the CA
+	Cooldown time.Duration
+}
+
+// WithCircuitBreaker stops sending requests to a CA which is down: once
+// policy.FailureThreshold consecutive requests failed with a transient
+// error, requests fail fast with ErrCircuitOpen for policy.Cooldown. The
+// breaker then lets a single request probe the CA. Every attempt of a
+// retried request counts. There is no breaker by default
+func WithCircuitBreaker(policy CircuitBreakerPolicy) Option {
+	return func(fabricCAServices *services) {
+		if policy.FailureThreshold <= 0 {
+			fabricCAServices.breaker = nil
+			return
+		}
+		fabricCAServices.breaker = &circuitBreaker{policy: policy, now: time.Now}
+	}
+}
+
+// BreakerState returns the state of the circuit breaker, BreakerClosed
+// without breaker, e.g. to be reported by a healthcheck
+func (fabricCAServices *services) BreakerState() BreakerState {
+	if fabricCAServices.breaker == nil {
+		return BreakerClosed
+	}
+	return fabricCAServices.breaker.currentState()
+}
+
+// circuitBreaker tracks the consecutive failures of the requests to the CA
+type circuitBreaker struct {
+	policy CircuitBreakerPolicy
+	// now returns the current time, replaced by tests
+	now func() time.Time
+	// mu guards the fields below
+	mu    sync.Mutex
+	state BreakerState
+	// failures is the number of consecutive transient failures
+	failures int
+	// openedAt is when the breaker last opened
+	openedAt time.Time
+	// probing is set while the probe request of the half-open breaker is
+	// being sent
+	probing bool
+}
+
+// currentState returns the state of the breaker, half-open once the cooldown
+// of the open breaker elapsed
+func (breaker *circuitBreaker) currentState() BreakerState {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.cooledDown()
+	return breaker.state
+}
+
+// cooledDown half-opens the open breaker once the cooldown elapsed. The
+// caller holds breaker.mu
+func (breaker *circuitBreaker) cooledDown() {
+	if breaker.state == BreakerOpen && breaker.now().Sub(breaker.openedAt) >= breaker.policy.Cooldown {
+		breaker.state = BreakerHalfOpen
+		breaker.probing = false
+	}
+}
+
+// allow returns ErrCircuitOpen unless a request can be sent, the probe
+// request when the breaker is half-open
+func (breaker *circuitBreaker) allow() error {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.cooledDown()
+	switch {
+	case breaker.state == BreakerOpen:
+		retryIn := breaker.policy.Cooldown - breaker.now().Sub(breaker.openedAt)
+		return &CAError{Kind: ErrCircuitOpen, Message: "circuit breaker open after consecutive failures, " +
+			"retry in " + retryIn.String()}
+	case breaker.state == BreakerHalfOpen && breaker.probing:
+		return &CAError{Kind: ErrCircuitOpen, Message: "circuit breaker half-open, the CA is being probed"}
+	case breaker.state == BreakerHalfOpen:
+		breaker.probing = true
+	}
+	return nil
+}
+
+// record records the outcome of an allowed request and returns the state
+// the breaker changed to, if it changed. Requests interrupted by the end of
+// ctx tell nothing about the CA
+func (breaker *circuitBreaker) record(ctx context.Context, err error) (BreakerState, bool) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	previous := breaker.state
+	breaker.probing = false
+	switch {
+	case ctx.Err() != nil:
+	case isRetryable(ctx, err):
+		breaker.failures++
+		if breaker.state == BreakerHalfOpen || breaker.failures >= breaker.policy.FailureThreshold {
+			breaker.state = BreakerOpen
+			breaker.openedAt = breaker.now()
+		}
+	default:
+		breaker.failures = 0
+		breaker.state = BreakerClosed
+	}
+	return breaker.state, breaker.state != previous
+}
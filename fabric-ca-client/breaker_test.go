@@ -0,0 +1,116 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	status, calls := http.StatusServiceUnavailable, 0
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": func(r *http.Request, body []byte) (interface{}, int) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if status != http.StatusOK {
+				return "CA is down", status
+			}
+			return map[string]interface{}{"CAName": "ca-org1"}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	WithCircuitBreaker(CircuitBreakerPolicy{FailureThreshold: 3, Cooldown: time.Minute})(ca.services)
+	now := time.Now()
+	ca.services.breaker.now = func() time.Time { return now }
+	expect := func(state BreakerState, sent int, kind error) {
+		t.Helper()
+		mu.Lock()
+		before := calls
+		mu.Unlock()
+		_, err := ca.services.GetCAInfo()
+		if kind == nil && err != nil || kind != nil && !errors.Is(err, kind) {
+			t.Fatalf("Expected error %v, got: %v", kind, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if calls-before != sent || ca.services.BreakerState() != state {
+			t.Fatalf("Expected %d request sent and breaker %s, got %d and %s", sent, state,
+				calls-before, ca.services.BreakerState())
+		}
+	}
+
+	// Closed until the threshold of consecutive transient failures
+	expect(BreakerClosed, 1, ErrCAUnreachable)
+	expect(BreakerClosed, 1, ErrCAUnreachable)
+	expect(BreakerOpen, 1, ErrCAUnreachable)
+	expect(BreakerOpen, 0, ErrCircuitOpen)
+
+	// Half-open after the cooldown, the failed probe opens it again
+	now = now.Add(time.Minute)
+	if ca.services.BreakerState() != BreakerHalfOpen {
+		t.Fatalf("Expected the breaker to half-open after the cooldown, got %s", ca.services.BreakerState())
+	}
+	expect(BreakerOpen, 1, ErrCAUnreachable)
+	now = now.Add(30 * time.Second)
+	expect(BreakerOpen, 0, ErrCircuitOpen)
+
+	// A single probe at a time, whose success closes the breaker
+	now = now.Add(time.Minute)
+	if err := ca.services.breaker.allow(); err != nil {
+		t.Fatalf("Expected the probe to be allowed, got: %v", err)
+	}
+	if err := ca.services.breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected a single probe while half-open, got: %v", err)
+	}
+	ca.services.breaker.record(context.Background(), nil)
+	expect(BreakerClosed, 1, ErrCAUnreachable)
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	expect(BreakerClosed, 1, nil)
+
+	// Neither errors returned by a reachable CA nor cancelled requests count
+	mu.Lock()
+	status = http.StatusUnauthorized
+	mu.Unlock()
+	for i := 0; i < 5; i++ {
+		expect(BreakerClosed, 1, ErrInvalidCredentials)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 5; i++ {
+		ca.services.breaker.record(ctx, newUnreachableError(ctx.Err()))
+	}
+	if ca.services.BreakerState() != BreakerClosed {
+		t.Fatalf("Expected cancelled requests not to open the breaker, got %s", ca.services.BreakerState())
+	}
+
+	WithCircuitBreaker(CircuitBreakerPolicy{})(ca.services)
+	if ca.services.breaker != nil || ca.services.BreakerState() != BreakerClosed {
+		t.Fatalf("Expected no breaker without failure threshold")
+	}
+}
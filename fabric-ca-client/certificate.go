@@ -0,0 +1,278 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// RevokedFilter selects certificates by revocation status
+type RevokedFilter int
+
+const (
+	// RevokedAny includes both revoked and unrevoked certificates
+	RevokedAny RevokedFilter = iota
+	// RevokedOnly includes only revoked certificates
+	RevokedOnly
+	// RevokedExcluded includes only certificates which are not revoked
+	RevokedExcluded
+)
+
+// CertFilter selects the certificates listed by GetCertificates. Zero values
+// are ignored
+type CertFilter struct {
+	// Name includes only the certificates of this identity
+	Name string
+	// ExpireAfter includes only certificates expiring after this time
+	ExpireAfter time.Time
+	// ExpireBefore includes only certificates expiring before this time
+	ExpireBefore time.Time
+	// Revoked selects certificates by revocation status
+	Revoked RevokedFilter
+	// Serial includes only the certificate of this hex encoded serial number
+	Serial string
+	// AKI includes only the certificates of this hex encoded Authority Key
+	// Identifier
+	AKI string
+}
+
+// CertInfo describes a certificate issued by the CA, identified for Revoke by
+// its Serial and AKI
+type CertInfo struct {
+	// Name is the enrollment ID the certificate was issued to
+	Name string
+	// Serial is the hex encoded serial number of the certificate
+	Serial string
+	// AKI is the hex encoded Authority Key Identifier of the certificate
+	AKI string
+	// NotBefore is the start of the validity of the certificate
+	NotBefore time.Time
+	// NotAfter is the expiry time of the certificate
+	NotAfter time.Time
+	// Revoked is true when the certificate is revoked
+	Revoked bool
+	// Cert is the PEM encoded certificate
+	Cert []byte
+}
+
+// revokedSince is the revoked_start of the queries for revoked
+// certificates, the CA storing a zero revocation time for the others
+var revokedSince = time.Unix(0, 0).UTC()
+
+// GetCertificates lists the certificates issued by the CA which the
+// registrar is allowed to see, selected by filter, failing with
+// ErrTooManyResults beyond the maximum of WithMaxListResults
+// @param {User} registrar The User that is initiating the request
+// @param {CertFilter} filter Selects the certificates
+// @returns {[]CertInfo} The certificates
+// @returns {error} Error
+func (fabricCAServices *services) GetCertificates(registrar fabricclient.User,
+	filter CertFilter) ([]CertInfo, error) {
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	certs, err := fabricCAServices.getCertificates(ctx, identity, filter)
+	if err != nil {
+		return nil, err
+	}
+	switch filter.Revoked {
+	case RevokedOnly:
+		for i := range certs {
+			certs[i].Revoked = true
+		}
+	case RevokedAny:
+		// The CA does not send the revocation status, the revoked
+		// certificates are listed separately
+		filter.Revoked = RevokedOnly
+		revoked, err := fabricCAServices.getCertificates(ctx, identity, filter)
+		if err != nil {
+			return nil, err
+		}
+		revokedSerials := make(map[string]bool, len(revoked))
+		for _, cert := range revoked {
+			revokedSerials[cert.AKI+":"+cert.Serial] = true
+		}
+		for i := range certs {
+			certs[i].Revoked = revokedSerials[certs[i].AKI+":"+certs[i].Serial]
+		}
+	}
+	return certs, nil
+}
+
+// GetExpiringCertificates lists the unrevoked certificates issued by the CA
+// which the registrar is allowed to see and which expire within the given
+// duration from now, the soonest expiring first. The CA sends all the
+// certificates of the expiry window in a single response, unpaged
+// @param {User} registrar The User that is initiating the request
+// @param {time.Duration} within The expiry window, starting now
+// @returns {[]CertInfo} The expiring certificates
+// @returns {error} Error
+func (fabricCAServices *services) GetExpiringCertificates(registrar fabricclient.User,
+	within time.Duration) ([]CertInfo, error) {
+	if within <= 0 {
+		return nil, &ValidationError{Problems: []string{fmt.Sprintf("Expiry window %s is not positive", within)}}
+	}
+	now := time.Now()
+	certs, err := fabricCAServices.GetCertificates(registrar, CertFilter{ExpireAfter: now,
+		ExpireBefore: now.Add(within), Revoked: RevokedExcluded})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing expiring certificates: %w", err)
+	}
+	sort.SliceStable(certs, func(i, j int) bool {
+		return certs[i].NotAfter.Before(certs[j].NotAfter)
+	})
+	return certs, nil
+}
+
+// IsRevoked tells whether a certificate issued by the CA is revoked. Errors
+// match ErrNotFound with errors.Is when the CA did not issue the certificate
+// or the registrar is not allowed to see it
+// @param {User} registrar The User that is initiating the request
+// @param {string} serial The hex encoded serial number of the certificate
+// @param {string} aki The hex encoded Authority Key Identifier of the
+// certificate
+// @returns {bool} true when the certificate is revoked
+// @returns {error} Error
+func (fabricCAServices *services) IsRevoked(registrar fabricclient.User, serial string, aki string) (bool, error) {
+	serial, aki, err := revocationTarget(&RevocationRequest{Serial: serial, AKI: aki})
+	if err != nil {
+		return false, err
+	}
+	certs, err := fabricCAServices.GetCertificates(registrar, CertFilter{Serial: serial, AKI: aki})
+	if err != nil {
+		return false, err
+	}
+	// Serial numbers are compared without their leading zeros, which the CA
+	// trims
+	trimmedSerial := strings.TrimLeft(serial, "0")
+	for _, cert := range certs {
+		if strings.TrimLeft(cert.Serial, "0") == trimmedSerial && cert.AKI == aki {
+			return cert.Revoked, nil
+		}
+	}
+	return false, fmt.Errorf("%w: no certificate with serial %s and AKI %s", ErrNotFound, serial, aki)
+}
+
+// getCertificates sends a certificates request to the CA
+func (fabricCAServices *services) getCertificates(ctx context.Context, identity *signingIdentity,
+	filter CertFilter) ([]CertInfo, error) {
+	query := url.Values{}
+	if filter.Name != "" {
+		query.Set("id", filter.Name)
+	}
+	if !filter.ExpireAfter.IsZero() {
+		query.Set("expired_start", filter.ExpireAfter.UTC().Format(time.RFC3339))
+	}
+	if !filter.ExpireBefore.IsZero() {
+		query.Set("expired_end", filter.ExpireBefore.UTC().Format(time.RFC3339))
+	}
+	if filter.Serial != "" {
+		query.Set("serial", filter.Serial)
+	}
+	if filter.AKI != "" {
+		query.Set("aki", filter.AKI)
+	}
+	switch filter.Revoked {
+	case RevokedOnly:
+		query.Set("revoked_start", revokedSince.Format(time.RFC3339))
+	case RevokedExcluded:
+		query.Set("notrevoked", "true")
+	}
+	endpoint := "certificates"
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	certs := []CertInfo{}
+	err := fabricCAServices.sendStream(ctx, identity, "GET", endpoint, "certs", func(raw json.RawMessage) error {
+		if err := fabricCAServices.checkListSize(len(certs)); err != nil {
+			return err
+		}
+		var cert struct {
+			PEM string
+		}
+		if err := json.Unmarshal(raw, &cert); err != nil {
+			return fmt.Errorf("Invalid response format from server: %s", err)
+		}
+		info, err := newCertInfo([]byte(cert.PEM))
+		if err != nil {
+			return err
+		}
+		certs = append(certs, info)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetCertificates failed: %w", err)
+	}
+	return certs, nil
+}
+
+// newestCertificate returns the serial number and AKI of the unrevoked
+// certificate of the identity name of the latest NotBefore
+func (fabricCAServices *services) newestCertificate(ctx context.Context, identity *signingIdentity,
+	name string) (string, string, error) {
+	certs, err := fabricCAServices.getCertificates(ctx, identity, CertFilter{Name: name, Revoked: RevokedExcluded})
+	if err != nil {
+		return "", "", err
+	}
+	var newest *CertInfo
+	for i := range certs {
+		if newest == nil || !certs[i].NotBefore.Before(newest.NotBefore) {
+			newest = &certs[i]
+		}
+	}
+	if newest == nil {
+		return "", "", fmt.Errorf("%w: identity %s has no unrevoked certificate", ErrNoCertificates, name)
+	}
+	return newest.Serial, newest.AKI, nil
+}
+
+// newCertInfo describes a PEM encoded certificate sent by the CA
+func newCertInfo(certPEM []byte) (CertInfo, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return CertInfo{}, fmt.Errorf("Invalid certificate received from the CA: no PEM data")
+	}
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return CertInfo{}, fmt.Errorf("Invalid certificate received from the CA: %s", err)
+	}
+	return CertInfo{
+		Name:      x509Cert.Subject.CommonName,
+		Serial:    hex.EncodeToString(x509Cert.SerialNumber.Bytes()),
+		AKI:       hex.EncodeToString(x509Cert.AuthorityKeyId),
+		NotBefore: x509Cert.NotBefore,
+		NotAfter:  x509Cert.NotAfter,
+		Cert:      certPEM,
+	}, nil
+}
@@ -0,0 +1,271 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificate_test")
+	if err != nil {
+		t.Fatalf("Error creating certificate directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeTestTLSCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	valid, _ := writeTestTLSCertificate(t, dir, "user1", &x509.Certificate{}, caCert, caKey)
+	revoked, _ := writeTestTLSCertificate(t, dir, "user1", &x509.Certificate{}, caCert, caKey)
+	certPEM := func(cert *x509.Certificate) map[string]interface{} {
+		return map[string]interface{}{"PEM": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+			Bytes: cert.Raw}))}
+	}
+
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var queries []url.Values
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"certificates": func(r *http.Request, body []byte) (interface{}, int) {
+			queries = append(queries, r.URL.Query())
+			certs := []interface{}{certPEM(valid), certPEM(revoked)}
+			if r.URL.Query().Get("revoked_start") != "" {
+				certs = []interface{}{certPEM(revoked)}
+			} else if r.URL.Query().Get("notrevoked") == "true" {
+				certs = []interface{}{certPEM(valid)}
+			}
+			return map[string]interface{}{"caname": "", "certs": certs}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	expireBefore := time.Now().Add(2 * time.Hour)
+	certs, err := ca.services.GetCertificates(registrar, CertFilter{Name: "user1", ExpireBefore: expireBefore})
+	if err != nil {
+		t.Fatalf("GetCertificates returned error: %v", err)
+	}
+	if len(certs) != 2 || certs[0].Revoked || !certs[1].Revoked {
+		t.Fatalf("GetCertificates returned wrong certificates: %+v", certs)
+	}
+	if certs[0].Name != "user1" || certs[0].Serial != hex.EncodeToString(valid.SerialNumber.Bytes()) ||
+		certs[0].AKI != hex.EncodeToString(caCert.SubjectKeyId) || !certs[0].NotAfter.Equal(valid.NotAfter) {
+		t.Fatalf("GetCertificates returned wrong certificate info: %+v", certs[0])
+	}
+	if len(queries) != 2 || queries[0].Get("id") != "user1" ||
+		queries[0].Get("expired_end") != expireBefore.UTC().Format(time.RFC3339) ||
+		queries[0].Get("revoked_start") != "" || queries[1].Get("revoked_start") == "" {
+		t.Fatalf("GetCertificates sent wrong queries: %v", queries)
+	}
+
+	queries = nil
+	certs, err = ca.services.GetCertificates(registrar, CertFilter{Revoked: RevokedExcluded})
+	if err != nil {
+		t.Fatalf("GetCertificates returned error: %v", err)
+	}
+	if len(certs) != 1 || certs[0].Revoked || len(queries) != 1 || queries[0].Get("notrevoked") != "true" {
+		t.Fatalf("GetCertificates returned wrong unrevoked certificates: %+v", certs)
+	}
+
+	certs, err = ca.services.GetCertificates(registrar, CertFilter{Revoked: RevokedOnly})
+	if err != nil {
+		t.Fatalf("GetCertificates returned error: %v", err)
+	}
+	if len(certs) != 1 || !certs[0].Revoked || certs[0].Serial != hex.EncodeToString(revoked.SerialNumber.Bytes()) {
+		t.Fatalf("GetCertificates returned wrong revoked certificates: %+v", certs)
+	}
+}
+
+func TestGetExpiringCertificates(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	later := newTestUser(t, "user1", time.Now().Add(-time.Hour), time.Now().Add(48*time.Hour))
+	sooner := newTestUser(t, "user2", time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	var queries []url.Values
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"certificates": func(r *http.Request, body []byte) (interface{}, int) {
+			queries = append(queries, r.URL.Query())
+			certs := []interface{}{
+				map[string]interface{}{"PEM": string(later.GetEnrollmentCertificate())},
+				map[string]interface{}{"PEM": string(sooner.GetEnrollmentCertificate())},
+			}
+			return map[string]interface{}{"caname": "", "certs": certs}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	var validationErr *ValidationError
+	if _, err := ca.services.GetExpiringCertificates(registrar, 0); !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError for an empty window, got: %v", err)
+	}
+	start := time.Now()
+	certs, err := ca.services.GetExpiringCertificates(registrar, 72*time.Hour)
+	if err != nil {
+		t.Fatalf("GetExpiringCertificates returned error: %v", err)
+	}
+	if len(certs) != 2 || certs[0].Name != "user2" || certs[1].Name != "user1" {
+		t.Fatalf("Expected the certificates soonest expiring first, got %+v", certs)
+	}
+	if len(queries) != 1 || queries[0].Get("notrevoked") != "true" {
+		t.Fatalf("GetExpiringCertificates should only query unrevoked certificates: %v", queries)
+	}
+	expireAfter, err := time.Parse(time.RFC3339, queries[0].Get("expired_start"))
+	if err != nil || expireAfter.Before(start.Add(-time.Second)) {
+		t.Fatalf("Unexpected start of the expiry window %s", queries[0].Get("expired_start"))
+	}
+	expireBefore, err := time.Parse(time.RFC3339, queries[0].Get("expired_end"))
+	if err != nil || expireBefore.Sub(expireAfter) != 72*time.Hour {
+		t.Fatalf("Unexpected end of the expiry window %s", queries[0].Get("expired_end"))
+	}
+}
+
+func TestIsRevoked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certificate_test")
+	if err != nil {
+		t.Fatalf("Error creating certificate directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeTestTLSCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	valid, _ := writeTestTLSCertificate(t, dir, "user1", &x509.Certificate{}, caCert, caKey)
+	revoked, _ := writeTestTLSCertificate(t, dir, "user1", &x509.Certificate{}, caCert, caKey)
+	certPEM := func(cert *x509.Certificate) map[string]interface{} {
+		return map[string]interface{}{"PEM": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+			Bytes: cert.Raw}))}
+	}
+
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var queries []url.Values
+	ca := newMockCA(t, map[string]mockCAHandler{
+		// The serial and AKI filters are ignored, like older CAs do
+		"certificates": func(r *http.Request, body []byte) (interface{}, int) {
+			queries = append(queries, r.URL.Query())
+			certs := []interface{}{certPEM(valid), certPEM(revoked)}
+			if r.URL.Query().Get("revoked_start") != "" {
+				certs = []interface{}{certPEM(revoked)}
+			}
+			return map[string]interface{}{"caname": "", "certs": certs}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	aki := hex.EncodeToString(caCert.SubjectKeyId)
+
+	for _, test := range []struct {
+		cert    *x509.Certificate
+		revoked bool
+	}{{valid, false}, {revoked, true}} {
+		queries = nil
+		// Serial and AKI are normalized
+		serial := strings.ToUpper(hex.EncodeToString(test.cert.SerialNumber.Bytes()))
+		isRevoked, err := ca.services.IsRevoked(registrar, serial, strings.ToUpper(aki))
+		if err != nil {
+			t.Fatalf("IsRevoked returned error: %v", err)
+		}
+		if isRevoked != test.revoked {
+			t.Fatalf("Expected IsRevoked to return %t, got %t", test.revoked, isRevoked)
+		}
+		if queries[0].Get("serial") != strings.ToLower(serial) || queries[0].Get("aki") != aki {
+			t.Fatalf("IsRevoked sent wrong query: %v", queries[0])
+		}
+	}
+
+	if _, err := ca.services.IsRevoked(registrar, "0123", aki); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected IsRevoked to fail with ErrNotFound for an unknown certificate, got: %v", err)
+	}
+	queries = nil
+	var validationErr *ValidationError
+	if _, err := ca.services.IsRevoked(registrar, "not hex", aki); !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError for an invalid serial, got: %v", err)
+	}
+	if _, err := ca.services.IsRevoked(registrar, "0123", ""); !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError without AKI, got: %v", err)
+	}
+	if len(queries) != 0 {
+		t.Fatalf("Invalid requests should not reach the CA")
+	}
+}
+
+func TestRevokeNewestOnly(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var certs []interface{}
+	for _, age := range []time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour} {
+		user := newTestUserWithTemplate(t, &x509.Certificate{
+			Subject:        pkix.Name{CommonName: "user1"},
+			NotBefore:      time.Now().Add(-age),
+			NotAfter:       time.Now().Add(time.Hour),
+			AuthorityKeyId: []byte{0xca},
+		})
+		certs = append(certs, map[string]interface{}{"PEM": string(user.GetEnrollmentCertificate())})
+	}
+	newest, err := newCertInfo([]byte(certs[1].(map[string]interface{})["PEM"].(string)))
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	var queries []url.Values
+	var revoked []map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"certificates": func(r *http.Request, body []byte) (interface{}, int) {
+			queries = append(queries, r.URL.Query())
+			return map[string]interface{}{"caname": "", "certs": certs}, http.StatusOK
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			revoked = append(revoked, request)
+			return map[string]interface{}{}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	err = ca.services.Revoke(registrar, &RevocationRequest{Name: "user1", RevokeNewestOnly: true,
+		ReasonCode: KeyCompromise})
+	if err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if len(queries) != 1 || queries[0].Get("id") != "user1" || queries[0].Get("notrevoked") != "true" {
+		t.Fatalf("Expected the unrevoked certificates of user1 to be listed, got %v", queries)
+	}
+	if len(revoked) != 1 || revoked[0]["serial"] != newest.Serial || revoked[0]["aki"] != "ca" ||
+		revoked[0]["id"] != "user1" {
+		t.Fatalf("Expected the newest certificate %s to be revoked, got %v", newest.Serial, revoked)
+	}
+
+	certs = []interface{}{}
+	err = ca.services.Revoke(registrar, &RevocationRequest{Name: "user1", RevokeNewestOnly: true})
+	if !errors.Is(err, ErrNoCertificates) || len(revoked) != 1 {
+		t.Fatalf("Expected ErrNoCertificates without certificates, got: %v", err)
+	}
+	var validationErr *ValidationError
+	err = ca.services.Revoke(registrar, &RevocationRequest{Serial: newest.Serial, AKI: newest.AKI,
+		RevokeNewestOnly: true})
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError for RevokeNewestOnly without Name, got: %v", err)
+	}
+}
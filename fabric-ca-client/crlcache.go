@@ -0,0 +1,221 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// CRLCache caches the CRL of a CA to check the revocation of its
+// certificates without a request per check. The CRL is fetched with
+// GenerateCRL, its signature verified against the CA certificate returned by
+// GetCAInfo, and refreshed once it is older than the TTL, and periodically
+// when a refresh interval is set. Concurrent callers share a single fetch
+type CRLCache struct {
+	ca        Services
+	registrar fabricclient.User
+	ttl       time.Duration
+	// now returns the current time, replaced in tests
+	now func() time.Time
+	// mu guards crl, expires and fetch
+	mu      sync.Mutex
+	crl     *cachedCRL
+	expires time.Time
+	// fetch is the fetch in progress, nil when there is none
+	fetch *crlFetch
+	// stop stops the periodic refresh
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// cachedCRL is a CRL fetched from the CA
+type cachedCRL struct {
+	// aki is the hex encoded key identifier of the CA, the AKI of the
+	// certificates it issues
+	aki string
+	// revoked holds the lowercase hex serial numbers of the revoked
+	// certificates, without leading zeros
+	revoked map[string]bool
+}
+
+// crlFetch is a fetch of the CRL the callers meanwhile wait for
+type crlFetch struct {
+	done chan struct{}
+	crl  *cachedCRL
+	err  error
+}
+
+// NewCRLCache ...
+/**
+ * Create a CRLCache of the CRL of a CA
+ * @param {Services} ca The CA issuing the certificates
+ * @param {User} registrar The User generating the CRL, with the hf.GenCRL
+ * attribute
+ * @param {time.Duration} ttl The duration the CRL is cached for
+ * @param {time.Duration} refreshInterval The interval the CRL is refreshed
+ * at in the background, 0 to only refresh it once expired. The refresh is
+ * stopped by Close
+ * @returns {CRLCache} The cache, the CRL is fetched on first use
+ */
+func NewCRLCache(ca Services, registrar fabricclient.User, ttl time.Duration,
+	refreshInterval time.Duration) *CRLCache {
+	cache := &CRLCache{
+		ca:        ca,
+		registrar: registrar,
+		ttl:       ttl,
+		now:       time.Now,
+		stop:      make(chan struct{}),
+	}
+	if refreshInterval > 0 {
+		go cache.refreshEvery(refreshInterval)
+	}
+	return cache
+}
+
+// IsRevoked ...
+/**
+ * Check whether a certificate issued by the CA is revoked against the cached
+ * CRL, fetched first when it is missing or expired
+ * @param {string} serial The hex encoded serial number of the certificate
+ * @param {string} aki The hex encoded Authority Key Identifier of the
+ * certificate
+ * @returns {bool} true when the certificate is revoked
+ * @returns {error} Error fetching the CRL, or ErrNotFound when the
+ * certificate was not issued by the CA
+ */
+func (cache *CRLCache) IsRevoked(serial string, aki string) (bool, error) {
+	serial, aki, err := revocationTarget(&RevocationRequest{Serial: serial, AKI: aki})
+	if err != nil {
+		return false, err
+	}
+	crl, err := cache.load(false)
+	if err != nil {
+		return false, err
+	}
+	if aki != crl.aki {
+		return false, fmt.Errorf("%w: the certificate of AKI %s was not issued by the CA of AKI %s",
+			ErrNotFound, aki, crl.aki)
+	}
+	return crl.revoked[serialKey(serial)], nil
+}
+
+// Refresh fetches the CRL, regardless of its expiry
+func (cache *CRLCache) Refresh() error {
+	_, err := cache.load(true)
+	return err
+}
+
+// Close stops the periodic refresh of the CRL
+func (cache *CRLCache) Close() {
+	cache.stopOnce.Do(func() {
+		close(cache.stop)
+	})
+}
+
+// refreshEvery refreshes the CRL every interval until the cache is closed
+func (cache *CRLCache) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cache.stop:
+			return
+		case <-ticker.C:
+			cache.load(true)
+		}
+	}
+}
+
+// load returns the cached CRL unless it is missing, expired or force is set.
+// The CRL is then fetched or, when a fetch is in progress, waited for
+func (cache *CRLCache) load(force bool) (*cachedCRL, error) {
+	cache.mu.Lock()
+	if !force && cache.crl != nil && cache.now().Before(cache.expires) {
+		crl := cache.crl
+		cache.mu.Unlock()
+		return crl, nil
+	}
+	if fetch := cache.fetch; fetch != nil {
+		cache.mu.Unlock()
+		<-fetch.done
+		return fetch.crl, fetch.err
+	}
+	fetch := &crlFetch{done: make(chan struct{})}
+	cache.fetch = fetch
+	cache.mu.Unlock()
+
+	fetch.crl, fetch.err = cache.fetchCRL()
+
+	cache.mu.Lock()
+	if fetch.err == nil {
+		cache.crl = fetch.crl
+		cache.expires = cache.now().Add(cache.ttl)
+	}
+	cache.fetch = nil
+	cache.mu.Unlock()
+	close(fetch.done)
+	return fetch.crl, fetch.err
+}
+
+// fetchCRL fetches the CRL and verifies it is signed by the CA
+func (cache *CRLCache) fetchCRL() (*cachedCRL, error) {
+	info, err := cache.ca.GetCAInfo()
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching the CA certificate: %w", err)
+	}
+	caCert, err := fabric_ca.BytesToX509Cert(info.CAChain)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the CA certificate: %s", err)
+	}
+	der, err := cache.ca.GenerateCRL(cache.registrar, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching the CRL: %w", err)
+	}
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the CRL: %s", err)
+	}
+	if err := list.CheckSignatureFrom(caCert); err != nil {
+		return nil, fmt.Errorf("The CRL is not signed by the CA: %s", err)
+	}
+	crl := &cachedCRL{aki: hex.EncodeToString(caCert.SubjectKeyId), revoked: make(map[string]bool)}
+	for _, entry := range list.RevokedCertificateEntries {
+		crl.revoked[entry.SerialNumber.Text(16)] = true
+	}
+	return crl, nil
+}
+
+// serialKey returns the key of a hex encoded serial number in
+// cachedCRL.revoked
+func serialKey(serial string) string {
+	n, ok := new(big.Int).SetString(serial, 16)
+	if !ok {
+		return serial
+	}
+	return n.Text(16)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockCRLCA is a CA serving a CRL of the revoked serial numbers
+type mockCRLCA struct {
+	*mockCA
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	mu     sync.Mutex
+	// crlCert and crlKey sign the CRL, the CA's by default
+	crlCert *x509.Certificate
+	crlKey  *ecdsa.PrivateKey
+	// revoked are the revoked serial numbers
+	revoked []int64
+	// fetches counts the CRL requests
+	fetches int
+	// block, when set, is waited for before responding to CRL requests
+	block chan struct{}
+}
+
+func newMockCRLCA(t *testing.T) *mockCRLCA {
+	dir, err := ioutil.TempDir("", "crlcache_test")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeTestTLSCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+	ca := &mockCRLCA{caCert: caCert, caKey: caKey, crlCert: caCert, crlKey: caKey}
+	ca.mockCA = newMockCA(t, map[string]mockCAHandler{
+		"cainfo": func(r *http.Request, body []byte) (interface{}, int) {
+			chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+			return map[string]interface{}{"CAChain": base64.StdEncoding.EncodeToString(chain)}, http.StatusOK
+		},
+		"gencrl": func(r *http.Request, body []byte) (interface{}, int) {
+			ca.mu.Lock()
+			ca.fetches++
+			block := ca.block
+			revoked := append([]int64(nil), ca.revoked...)
+			crlCert, crlKey := ca.crlCert, ca.crlKey
+			ca.mu.Unlock()
+			if block != nil {
+				<-block
+			}
+			return map[string]interface{}{"CRL": newTestCRL(t, crlCert, crlKey, revoked)}, http.StatusOK
+		},
+	})
+	return ca
+}
+
+// newTestCRL creates the base64 encoded PEM CRL sent by the CA
+func newTestCRL(t *testing.T, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, revoked []int64) string {
+	list := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range revoked {
+		list.RevokedCertificateEntries = append(list.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, list, caCert, caKey)
+	if err != nil {
+		t.Fatalf("Error creating CRL: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+}
+
+func (ca *mockCRLCA) setRevoked(serials ...int64) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.revoked = serials
+}
+
+func (ca *mockCRLCA) fetchCount() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.fetches
+}
+
+func TestCRLCacheExpiry(t *testing.T) {
+	ca := newMockCRLCA(t)
+	defer ca.Close()
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	cache := NewCRLCache(ca.services, registrar, time.Minute, 0)
+	defer cache.Close()
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	aki := hex.EncodeToString(ca.caCert.SubjectKeyId)
+
+	ca.setRevoked(0x4a)
+	for _, test := range []struct {
+		serial  string
+		revoked bool
+	}{{"4a", true}, {"004A", true}, {"4b", false}} {
+		revoked, err := cache.IsRevoked(test.serial, aki)
+		if err != nil {
+			t.Fatalf("IsRevoked returned error: %v", err)
+		}
+		if revoked != test.revoked {
+			t.Fatalf("Expected IsRevoked(%s) to return %t", test.serial, test.revoked)
+		}
+	}
+	if ca.fetchCount() != 1 {
+		t.Fatalf("Expected the CRL to be fetched once, got %d fetches", ca.fetchCount())
+	}
+
+	// The cached CRL is used until it expires
+	ca.setRevoked(0x4a, 0x4b)
+	now = now.Add(59 * time.Second)
+	if revoked, _ := cache.IsRevoked("4b", aki); revoked || ca.fetchCount() != 1 {
+		t.Fatalf("The cached CRL should be used before it expires")
+	}
+	now = now.Add(time.Second)
+	if revoked, _ := cache.IsRevoked("4b", aki); !revoked || ca.fetchCount() != 2 {
+		t.Fatalf("The CRL should be fetched again once expired")
+	}
+	ca.setRevoked()
+	if err := cache.Refresh(); err != nil {
+		t.Fatalf("Refresh returned error: %v", err)
+	}
+	if revoked, _ := cache.IsRevoked("4b", aki); revoked || ca.fetchCount() != 3 {
+		t.Fatalf("Refresh should fetch the CRL regardless of its expiry")
+	}
+
+	if _, err := cache.IsRevoked("4b", "0102"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for a certificate of another CA, got: %v", err)
+	}
+	var validationErr *ValidationError
+	if _, err := cache.IsRevoked("not hex", aki); !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError for an invalid serial, got: %v", err)
+	}
+
+	// A CRL which is not signed by the CA is rejected
+	other := newMockCRLCA(t)
+	defer other.Close()
+	ca.mu.Lock()
+	ca.crlCert, ca.crlKey = other.caCert, other.caKey
+	ca.mu.Unlock()
+	if err := cache.Refresh(); err == nil {
+		t.Fatalf("Refresh should have failed for a CRL signed by another CA")
+	}
+	if _, err := cache.IsRevoked("4b", aki); err != nil {
+		t.Fatalf("The cached CRL should be kept when a refresh fails, got: %v", err)
+	}
+}
+
+func TestCRLCacheSingleFlight(t *testing.T) {
+	ca := newMockCRLCA(t)
+	defer ca.Close()
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	cache := NewCRLCache(ca.services, registrar, time.Minute, 0)
+	defer cache.Close()
+	aki := hex.EncodeToString(ca.caCert.SubjectKeyId)
+	ca.setRevoked(0x4a)
+	release := make(chan struct{})
+	ca.block = release
+
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			revoked, err := cache.IsRevoked("4a", aki)
+			if err == nil && !revoked {
+				err = errors.New("IsRevoked returned false for a revoked certificate")
+			}
+			errs <- err
+		}()
+	}
+	// Let the callers pile up behind the blocked fetch
+	for ca.fetchCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Concurrent IsRevoked failed: %v", err)
+		}
+	}
+	if ca.fetchCount() != 1 {
+		t.Fatalf("Concurrent callers should share a single fetch, got %d fetches", ca.fetchCount())
+	}
+}
+
+func TestCRLCacheBackgroundRefresh(t *testing.T) {
+	ca := newMockCRLCA(t)
+	defer ca.Close()
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	cache := NewCRLCache(ca.services, registrar, time.Hour, 10*time.Millisecond)
+	aki := hex.EncodeToString(ca.caCert.SubjectKeyId)
+	if revoked, err := cache.IsRevoked("4a", aki); err != nil || revoked {
+		t.Fatalf("IsRevoked returned %t, %v", revoked, err)
+	}
+	ca.setRevoked(0x4a)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if revoked, _ := cache.IsRevoked("4a", aki); revoked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The CRL was not refreshed in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cache.Close()
+	cache.Close()
+	fetches := ca.fetchCount()
+	time.Sleep(50 * time.Millisecond)
+	if ca.fetchCount() > fetches+1 {
+		t.Fatalf("The background refresh should stop on Close")
+	}
+}
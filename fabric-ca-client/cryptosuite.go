@@ -0,0 +1,370 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/mail"
+
+	"github.com/cloudflare/cfssl/csr"
+	"github.com/cloudflare/cfssl/helpers"
+	"github.com/hyperledger/fabric-sdk-go/config"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/bccsp/factory"
+	cspsigner "github.com/hyperledger/fabric/bccsp/signer"
+)
+
+const (
+	// SoftwareProvider is the name of the software BCCSP provider
+	SoftwareProvider = "SW"
+	// PKCS11Provider is the name of the PKCS11 BCCSP provider, keeping keys
+	// in an HSM
+	PKCS11Provider = "PKCS11"
+)
+
+// InitCryptoSuite initializes the BCCSP implementation of the provider
+// selected by client.security.provider, SoftwareProvider by default: the
+// software BCCSP keeping keys in client.keystore.path, or the PKCS11 BCCSP
+// keeping keys in the HSM token of client.security.pkcs11. As the BCCSP
+// factories, it can only be initialized once, later calls return the BCCSP
+// initialized first, and fail if it is not the one of the selected provider.
+// It fails with ErrPKCS11NotSupported when PKCS11 is selected but the SDK was
+// built without the pkcs11 build tag
+func InitCryptoSuite() (bccsp.BCCSP, error) {
+	opts := &factory.FactoryOpts{
+		ProviderName: SoftwareProvider,
+		SwOpts: &factory.SwOpts{
+			HashFamily:   config.GetSecurityAlgorithm(),
+			SecLevel:     config.GetSecurityLevel(),
+			FileKeystore: &factory.FileKeystoreOpts{KeyStorePath: config.GetKeyStorePath()},
+		},
+	}
+	switch provider := securityProvider(); provider {
+	case SoftwareProvider:
+	case PKCS11Provider:
+		pkcs11Opts, err := newPKCS11Opts()
+		if err != nil {
+			return nil, err
+		}
+		opts.ProviderName = PKCS11Provider
+		opts.Pkcs11Opts = pkcs11Opts
+	default:
+		return nil, fmt.Errorf("Unsupported BCCSP provider %s, supported are %s and %s",
+			provider, SoftwareProvider, PKCS11Provider)
+	}
+	if err := factory.InitFactories(opts); err != nil {
+		return nil, fmt.Errorf("Error initializing BCCSP: %s", err)
+	}
+	csp, _ := factory.GetBCCSP(opts.ProviderName)
+	if csp == nil {
+		return nil, fmt.Errorf("BCCSP provider %s is not initialized, the BCCSP factories were "+
+			"initialized before with another provider", opts.ProviderName)
+	}
+	return csp, nil
+}
+
+// securityProvider returns the name of the configured BCCSP provider
+func securityProvider() string {
+	if provider := config.GetSecurityProvider(); provider != "" {
+		return provider
+	}
+	return SoftwareProvider
+}
+
+// defaultCryptoSuite returns the BCCSP of the configured provider once
+// initialized by InitCryptoSuite, the default BCCSP otherwise
+func defaultCryptoSuite() bccsp.BCCSP {
+	if csp, _ := factory.GetBCCSP(securityProvider()); csp != nil {
+		return csp
+	}
+	return factory.GetDefault()
+}
+
+// cryptoSuite returns the BCCSP implementation keys are generated and
+// requests are signed with
+func (fabricCAServices *services) cryptoSuite() bccsp.BCCSP {
+	if fabricCAServices.csp != nil {
+		return fabricCAServices.csp
+	}
+	return defaultCryptoSuite()
+}
+
+// enrollmentLabel returns the label of the enrollment request of
+// EnrollmentOptions.Label, empty unless keys are kept in an HSM
+func (fabricCAServices *services) enrollmentLabel(label string) (string, error) {
+	if !fabricCAServices.hsm {
+		return "", nil
+	}
+	if label == "" {
+		return "", fmt.Errorf("Label is empty, it must select the HSM token the key is generated in")
+	}
+	if label != fabricCAServices.tokenLabel {
+		return "", fmt.Errorf("Label %s is not the label of the HSM token %s keys are generated in, "+
+			"set by client.security.pkcs11.label", label, fabricCAServices.tokenLabel)
+	}
+	return label, nil
+}
+
+// SignerFor ...
+/**
+ * Wrap the private key of a user as a crypto.Signer signing with the BCCSP,
+ * to use the key with the standard library, e.g. for TLS. Keys kept in an HSM
+ * are used without being exported
+ * @param {User} user The enrolled user
+ * @returns {crypto.Signer} The signer of the private key of the user
+ */
+func (fabricCAServices *services) SignerFor(user fabricclient.User) (crypto.Signer, error) {
+	if err := fabricCAServices.checkOpen(); err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("User cannot be nil")
+	}
+	key := user.GetPrivateKey()
+	if key == nil {
+		return nil, fmt.Errorf("Unable to read user private key")
+	}
+	if cert := user.GetEnrollmentCertificate(); cert != nil {
+		if err := checkKeyMatchesCert(key, cert); err != nil {
+			return nil, fmt.Errorf("Invalid enrollment of %s: %w", user.GetName(), err)
+		}
+	}
+	signer := &cspsigner.CryptoSigner{}
+	if err := signer.Init(fabricCAServices.cryptoSuite(), key); err != nil {
+		return nil, fmt.Errorf("Error creating signer: %s", err)
+	}
+	return signer, nil
+}
+
+// EnrollTLSCertificate ...
+/**
+ * Enroll a registered user with the CA's tls profile, see EnrollTLS, and
+ * return the credentials as a tls.Certificate with its leaf parsed, e.g. for
+ * outbound mutual TLS. Keys kept in an HSM are not exported: the PrivateKey
+ * of the certificate is then a crypto.Signer signing with the BCCSP, see
+ * SignerFor
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @returns {tls.Certificate} The TLS certificate, chain included, and its key,
+ * a warning is logged when it is not yet valid, see CertNotYetValid
+ */
+func (fabricCAServices *services) EnrollTLSCertificate(enrollmentID string,
+	enrollmentSecret string) (tls.Certificate, error) {
+	keyPEM, cert, err := fabricCAServices.EnrollTLS(enrollmentID, enrollmentSecret)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certificate, err := fabricCAServices.newTLSCertificate(keyPEM, cert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Invalid TLS enrollment of %s: %w", enrollmentID, err)
+	}
+	return certificate, nil
+}
+
+// newTLSCertificate creates the tls.Certificate of a PEM encoded certificate
+// chain and its PEM encoded private key, or its key kept in the BCCSP when
+// keyPEM is nil
+func (fabricCAServices *services) newTLSCertificate(keyPEM []byte, cert []byte) (tls.Certificate, error) {
+	var certificate tls.Certificate
+	if keyPEM != nil {
+		var err error
+		if certificate, err = tls.X509KeyPair(cert, keyPEM); err != nil {
+			return tls.Certificate{}, err
+		}
+	} else {
+		for rest := cert; ; {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				certificate.Certificate = append(certificate.Certificate, block.Bytes)
+			}
+		}
+		if len(certificate.Certificate) == 0 {
+			return tls.Certificate{}, fmt.Errorf("No certificate found in the enrollment certificate PEM")
+		}
+		csp := fabricCAServices.cryptoSuite()
+		key, err := importEnrollmentKey(csp, nil, cert)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("Error getting the key of the certificate: %s", err)
+		}
+		signer := &cspsigner.CryptoSigner{}
+		if err := signer.Init(csp, key); err != nil {
+			return tls.Certificate{}, fmt.Errorf("Error creating signer: %s", err)
+		}
+		certificate.PrivateKey = signer
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error parsing certificate: %s", err)
+	}
+	certificate.Leaf = leaf
+	return certificate, nil
+}
+
+// generateCSR generates a key and a CSR signed with it. Keys are generated in
+// software and returned PEM encoded, unless the services keep keys in the
+// BCCSP, like an HSM: the key is then stored in the BCCSP and no key is
+// returned
+func (fabricCAServices *services) generateCSR(cr *csr.CertificateRequest,
+	extensions []pkix.Extension) ([]byte, []byte, error) {
+	if err := fabricCAServices.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+	if !fabricCAServices.hsm && len(extensions) == 0 {
+		return csr.ParseRequest(cr)
+	}
+	if !fabricCAServices.hsm {
+		return generateSoftwareCSR(cr, extensions)
+	}
+	csp := fabricCAServices.cryptoSuite()
+	var keyGenOpts bccsp.KeyGenOpts = &bccsp.ECDSAP256KeyGenOpts{}
+	if cr.KeyRequest != nil {
+		switch {
+		case cr.KeyRequest.Algo() == "ecdsa" && cr.KeyRequest.Size() == 256:
+		case cr.KeyRequest.Algo() == "ecdsa" && cr.KeyRequest.Size() == 384:
+			keyGenOpts = &bccsp.ECDSAP384KeyGenOpts{}
+		default:
+			return nil, nil, fmt.Errorf("Unsupported key request %s-%d for keys stored in the BCCSP",
+				cr.KeyRequest.Algo(), cr.KeyRequest.Size())
+		}
+	}
+	key, err := csp.KeyGen(keyGenOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error generating key: %s", err)
+	}
+	cryptoSigner := &cspsigner.CryptoSigner{}
+	if err := cryptoSigner.Init(csp, key); err != nil {
+		return nil, nil, fmt.Errorf("Error creating signer: %s", err)
+	}
+	csrPEM, err := newCSR(cryptoSigner, cr, extensions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error generating CSR: %s", err)
+	}
+	return csrPEM, nil, nil
+}
+
+// generateSoftwareCSR generates a key and a CSR with extensions, returning
+// the PEM encoded key like csr.ParseRequest
+func generateSoftwareCSR(cr *csr.CertificateRequest, extensions []pkix.Extension) ([]byte, []byte, error) {
+	if cr.KeyRequest == nil {
+		cr.KeyRequest = csr.NewBasicKeyRequest()
+	}
+	priv, err := cr.KeyRequest.Generate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error generating key: %s", err)
+	}
+	var block *pem.Block
+	switch priv := priv.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error marshalling key: %s", err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+	default:
+		return nil, nil, fmt.Errorf("Unsupported key type %T", priv)
+	}
+	csrPEM, err := newCSR(priv.(crypto.Signer), cr, extensions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error generating CSR: %s", err)
+	}
+	return csrPEM, pem.EncodeToMemory(block), nil
+}
+
+// newCSR generates a CSR signed by signer as csr.Generate does, which
+// doesn't support extra extensions
+func newCSR(signer crypto.Signer, cr *csr.CertificateRequest, extensions []pkix.Extension) ([]byte, error) {
+	if len(extensions) == 0 {
+		return csr.Generate(signer, cr)
+	}
+	template := newCSRTemplate(cr, extensions)
+	template.SignatureAlgorithm = helpers.SignerAlgo(signer)
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// newCSRTemplate returns the template of the CSR of cr with extensions,
+// without signature algorithm
+func newCSRTemplate(cr *csr.CertificateRequest, extensions []pkix.Extension) *x509.CertificateRequest {
+	template := &x509.CertificateRequest{
+		Subject:         cr.Name(),
+		ExtraExtensions: extensions,
+	}
+	for _, host := range cr.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if email, err := mail.ParseAddress(host); err == nil && email != nil {
+			template.EmailAddresses = append(template.EmailAddresses, email.Address)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return template
+}
+
+// CSRSigner signs CSRs with a key it holds, e.g. in a separate process or a
+// remote signing service, so that the key never reaches the SDK, see
+// EnrollmentOptions.CSRSigner
+type CSRSigner interface {
+	// SignCSR signs the CSR of template, e.g. with
+	// x509.CreateCertificateRequest, and returns it DER encoded. The signature
+	// algorithm of template is not set, the signer picks the one of its key
+	SignCSR(template *x509.CertificateRequest) ([]byte, error)
+}
+
+// signCSR builds the CSR of cr with extensions and has it signed by signer.
+// The CSR returned by signer must be validly signed and keep the subject of
+// the template
+func signCSR(signer CSRSigner, cr *csr.CertificateRequest, extensions []pkix.Extension) ([]byte, error) {
+	template := newCSRTemplate(cr, extensions)
+	subject := template.Subject.String()
+	der, err := signer.SignCSR(template)
+	if err != nil {
+		return nil, fmt.Errorf("Error signing CSR: %w", err)
+	}
+	request, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the CSR of the CSR signer: %s", err)
+	}
+	if err := request.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("Invalid signature of the CSR of the CSR signer: %s", err)
+	}
+	if request.Subject.String() != subject {
+		return nil, fmt.Errorf("CSR signer changed the subject %s of the CSR to %s", subject, request.Subject)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
@@ -0,0 +1,375 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cfssl/signer"
+	"github.com/hyperledger/fabric-ca/util"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric-sdk-go/fabric-client/keyvaluestore"
+	bccspFactory "github.com/hyperledger/fabric/bccsp/factory"
+)
+
+func TestEnrollWithKeyInCryptoSuite(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": newIssuingEnrollHandler(t),
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			if _, err := util.VerifyToken(bccspFactory.GetDefault(), r.Header.Get("authorization"), body); err != nil {
+				return fmt.Sprintf("Invalid token: %s", err), http.StatusUnauthorized
+			}
+			return base64.StdEncoding.EncodeToString([]byte("secret")), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	ca.services.hsm = true
+	ca.services.tokenLabel = "ForFabric"
+
+	key, cert, err := ca.services.Enroll("hsmuser", "hsmuserpw")
+	if err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if key != nil {
+		t.Fatalf("Enroll should not return the key when keys are kept in the BCCSP")
+	}
+	_, _, err = ca.services.EnrollWithOptions("hsmuser", "hsmuserpw", &EnrollmentOptions{
+		KeyRequest: &KeyRequest{Algo: "rsa", Size: 2048}, Label: "ForFabric"})
+	if err == nil || !strings.Contains(err.Error(), "Unsupported key request rsa 2048") {
+		t.Fatalf("EnrollWithOptions should have failed for an RSA key kept in the BCCSP")
+	}
+
+	// The key is located in the BCCSP by the SKI of the certificate
+	registrar := fabricclient.NewUser("hsmuser")
+	registrar.SetEnrollmentCertificate(cert)
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1",
+		Affiliation: "org1"}); err != nil {
+		t.Fatalf("Register with a key kept in the BCCSP returned error: %v", err)
+	}
+}
+
+func TestEnrollWithLabel(t *testing.T) {
+	var labels []string
+	issue := newIssuingEnrollHandler(t)
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			var request enrollmentRequest
+			json.Unmarshal(body, &request)
+			labels = append(labels, request.Label)
+			return issue(r, body)
+		},
+	})
+	defer ca.Close()
+
+	// The label is ignored unless keys are kept in an HSM
+	if _, _, err := ca.services.EnrollWithOptions("user1", "user1pw", &EnrollmentOptions{Label: "ForFabric"}); err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	ca.services.hsm = true
+	ca.services.tokenLabel = "ForFabric"
+	for _, label := range []string{"", "OtherToken"} {
+		if _, _, err := ca.services.EnrollWithOptions("user1", "user1pw", &EnrollmentOptions{Label: label}); err == nil {
+			t.Fatalf("EnrollWithOptions should have failed for label %q", label)
+		}
+	}
+	key, _, err := ca.services.EnrollWithOptions("user1", "user1pw", &EnrollmentOptions{Label: "ForFabric"})
+	if err != nil || key != nil {
+		t.Fatalf("EnrollWithOptions returned a key or error: %v", err)
+	}
+	if _, _, err := ca.services.EnrollTLS("user1", "user1pw"); err != nil {
+		t.Fatalf("EnrollTLS should enroll in the configured token, got: %v", err)
+	}
+	if fmt.Sprint(labels) != "[ ForFabric ForFabric]" {
+		t.Fatalf("Unexpected labels of the enrollment requests %q", labels)
+	}
+}
+
+// fakeCSRSigner signs CSRs with a key the SDK never sees, as a remote signing
+// service would
+type fakeCSRSigner struct {
+	key       *ecdsa.PrivateKey
+	templates []*x509.CertificateRequest
+	subject   string
+	err       error
+}
+
+func (signer *fakeCSRSigner) SignCSR(template *x509.CertificateRequest) ([]byte, error) {
+	signer.templates = append(signer.templates, template)
+	if signer.err != nil {
+		return nil, signer.err
+	}
+	if signer.subject != "" {
+		template.Subject.CommonName = signer.subject
+	}
+	return x509.CreateCertificateRequest(rand.Reader, template, signer.key)
+}
+
+func TestEnrollWithCSRSigner(t *testing.T) {
+	var requests []enrollmentRequest
+	issue := newIssuingEnrollHandler(t)
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			var request enrollmentRequest
+			json.Unmarshal(body, &request)
+			requests = append(requests, request)
+			return issue(r, body)
+		},
+	})
+	defer ca.Close()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	signer := &fakeCSRSigner{key: key}
+	employeeOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	opts := &EnrollmentOptions{Hosts: []string{"peer0.example.com"}, CSRSigner: signer,
+		Extensions: []pkix.Extension{{Id: employeeOID, Value: []byte{0x0c, 0x01, 0x41}}}}
+
+	// The signer is used whether keys are kept in the BCCSP or not, the
+	// label of the BCCSP token does not apply
+	for _, hsm := range []bool{false, true} {
+		ca.services.hsm = hsm
+		keyPEM, certPEM, err := ca.services.EnrollWithOptions("user1", "user1pw", opts)
+		if err != nil {
+			t.Fatalf("EnrollWithOptions returned error: %v", err)
+		}
+		if keyPEM != nil {
+			t.Fatalf("No key should be returned for a key held by the CSR signer")
+		}
+		cert, err := x509.ParseCertificate(mustDecodePEM(t, certPEM))
+		if err != nil || !key.PublicKey.Equal(cert.PublicKey) {
+			t.Fatalf("The certificate should be issued for the key of the CSR signer: %v", err)
+		}
+	}
+	template := signer.templates[0]
+	if template.Subject.CommonName != "user1" || len(template.DNSNames) != 1 ||
+		len(template.ExtraExtensions) != 1 || template.SignatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		t.Fatalf("Unexpected CSR template %+v", template)
+	}
+	if len(requests) != 2 || requests[0].Label != "" {
+		t.Fatalf("Unexpected enrollment requests %+v", requests)
+	}
+
+	ca.services.hsm = false
+	requests = nil
+	errRemote := errors.New("signing service unavailable")
+	for name, test := range map[string]struct {
+		signer *fakeCSRSigner
+		opts   EnrollmentOptions
+	}{
+		"signer error":    {&fakeCSRSigner{key: key, err: errRemote}, EnrollmentOptions{}},
+		"changed subject": {&fakeCSRSigner{key: key, subject: "admin"}, EnrollmentOptions{}},
+		"key request":     {signer, EnrollmentOptions{KeyRequest: &KeyRequest{Algo: "ecdsa", Size: 256}}},
+	} {
+		test.opts.CSRSigner = test.signer
+		if _, _, err := ca.services.EnrollWithOptions("user1", "user1pw", &test.opts); err == nil {
+			t.Fatalf("EnrollWithOptions should have failed for %s", name)
+		} else if name == "signer error" && !errors.Is(err, errRemote) {
+			t.Fatalf("The error of the CSR signer should be wrapped, got: %v", err)
+		}
+	}
+	if len(requests) != 0 {
+		t.Fatalf("No enrollment request should be sent for rejected CSRs, got %d", len(requests))
+	}
+}
+
+func TestSignerFor(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{"enroll": newIssuingEnrollHandler(t)})
+	defer ca.Close()
+
+	// Keys kept in the BCCSP are used without being exported
+	for _, hsm := range []bool{false, true} {
+		ca.services.hsm = hsm
+		user, err := ca.services.EnrollAndStore("user1", "user1pw", keyvaluestore.CreateNewMemoryKeyValueStore())
+		if err != nil {
+			t.Fatalf("EnrollAndStore returned error: %v", err)
+		}
+		signer, err := ca.services.SignerFor(user)
+		if err != nil {
+			t.Fatalf("SignerFor returned error: %v", err)
+		}
+		cert, err := x509.ParseCertificate(mustDecodePEM(t, user.GetEnrollmentCertificate()))
+		if err != nil {
+			t.Fatalf("Error parsing certificate: %v", err)
+		}
+		publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+		if !ok || publicKey.X.Cmp(cert.PublicKey.(*ecdsa.PublicKey).X) != 0 {
+			t.Fatalf("The public key of the signer does not match the certificate")
+		}
+		digest := sha256.Sum256([]byte("payload"))
+		signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("Sign returned error: %v", err)
+		}
+		if !ecdsa.VerifyASN1(publicKey, digest[:], signature) {
+			t.Fatalf("The signature does not verify with the certificate")
+		}
+	}
+
+	if _, err := ca.services.SignerFor(nil); err == nil {
+		t.Fatalf("SignerFor should have failed for a nil user")
+	}
+	user := newTestUser(t, "user1", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	other := newTestUser(t, "user2", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	user.SetPrivateKey(other.GetPrivateKey())
+	if _, err := ca.services.SignerFor(user); err == nil {
+		t.Fatalf("SignerFor should have failed for a key not matching the certificate")
+	}
+	ca.services.Close()
+	if _, err := ca.services.SignerFor(other); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected SignerFor to fail with ErrClosed, got: %v", err)
+	}
+}
+
+func TestEnrollTLSCertificate(t *testing.T) {
+	var profile string
+	issue := newIssuingEnrollHandler(t)
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			var request signer.SignRequest
+			json.Unmarshal(body, &request)
+			profile = request.Profile
+			return issue(r, body)
+		},
+	})
+	defer ca.Close()
+	ca.services.tokenLabel = "ForFabric"
+
+	// The client certificate is the one enrolled, the key used for the
+	// handshake is checked by the server
+	var peerCert *x509.Certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCert = r.TLS.PeerCertificates[0]
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	// Keys kept in the BCCSP are used without being exported
+	for _, hsm := range []bool{false, true} {
+		ca.services.hsm = hsm
+		certificate, err := ca.services.EnrollTLSCertificate("user1", "user1pw")
+		if err != nil {
+			t.Fatalf("EnrollTLSCertificate returned error: %v", err)
+		}
+		if profile != TLSProfile {
+			t.Fatalf("Expected the tls profile, got %s", profile)
+		}
+		if certificate.Leaf == nil || certificate.Leaf.Subject.CommonName != "user1" {
+			t.Fatalf("Unexpected leaf %v", certificate.Leaf)
+		}
+		if _, ok := certificate.PrivateKey.(crypto.Signer); !ok {
+			t.Fatalf("Expected the private key to be a crypto.Signer, got %T", certificate.PrivateKey)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs: roots, Certificates: []tls.Certificate{certificate}}}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("TLS handshake with the enrolled certificate failed (hsm %v): %v", hsm, err)
+		}
+		resp.Body.Close()
+		if peerCert == nil || !peerCert.Equal(certificate.Leaf) {
+			t.Fatalf("The server did not receive the enrolled certificate")
+		}
+		client.CloseIdleConnections()
+	}
+
+	if _, err := ca.services.EnrollTLSCertificate("user1", ""); err == nil {
+		t.Fatalf("EnrollTLSCertificate should have failed without a secret")
+	}
+}
+
+func TestInitCryptoSuiteProviders(t *testing.T) {
+	initTestConfig(t, `client:
+ security:
+  provider: "UNKNOWN"
+`)
+	if _, err := InitCryptoSuite(); err == nil {
+		t.Fatalf("InitCryptoSuite should have failed for an unknown provider")
+	}
+	initTestConfig(t, `client:
+ security:
+  provider: "PKCS11"
+  pkcs11:
+   library: "/usr/lib/softhsm/libsofthsm2.so"
+   label: "ForFabric"
+`)
+	_, err := InitCryptoSuite()
+	if err == nil {
+		t.Fatalf("InitCryptoSuite should have failed without PKCS11 support or pin")
+	}
+	if !errors.Is(err, ErrPKCS11NotSupported) && err.Error() != "PKCS11 token pin is not configured" {
+		t.Fatalf("Unexpected InitCryptoSuite error: %v", err)
+	}
+}
+
+func TestCryptoSuiteSelection(t *testing.T) {
+	caConfig := `
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "http://localhost:7054"
+`
+	for _, security := range []string{"", " security:\n  provider: \"SW\"\n"} {
+		initTestConfig(t, "client:\n"+security+caConfig)
+		fabricCAClient, err := newServices("", WithInsecure())
+		if err != nil {
+			t.Fatalf("newServices returned error: %v", err)
+		}
+		csp, _ := bccspFactory.GetBCCSP(SoftwareProvider)
+		if csp == nil || fabricCAClient.cryptoSuite() != csp || defaultCryptoSuite() != csp {
+			t.Fatalf("Expected the software BCCSP to be selected for security %q", security)
+		}
+		fabricCAClient.Close()
+	}
+
+	// The PKCS11 BCCSP is either not compiled in, or not initialized since
+	// the BCCSP factories were initialized with the software one
+	initTestConfig(t, `client:
+ security:
+  provider: "PKCS11"
+  pkcs11:
+   library: "/usr/lib/softhsm/libsofthsm2.so"
+   label: "ForFabric"
+   pin: "98765432"
+`+caConfig)
+	_, err := newServices("", WithInsecure())
+	if !errors.Is(err, ErrPKCS11NotSupported) && (err == nil || !strings.Contains(err.Error(), "not initialized")) {
+		t.Fatalf("Expected newServices to fail for an unavailable PKCS11 provider. Got: %v", err)
+	}
+}
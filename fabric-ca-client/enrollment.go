@@ -0,0 +1,223 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+)
+
+// IdentityVersion is the version of the JSON schema written by
+// MarshalIdentity
+const IdentityVersion = 1
+
+// identityJSON is the JSON schema of a serialized enrollment:
+//
+//	{
+//	  "version": 1,
+//	  "key": "<base64 of the PEM encoded private key, omitted for HSM keys>",
+//	  "cert": "<PEM encoded X509 certificate>",
+//	  "serial": "<hex encoded serial number of the certificate>",
+//	  "notBefore": "<RFC 3339 UTC time>",
+//	  "notAfter": "<RFC 3339 UTC time>"
+//	}
+//
+// The metadata is informative, it must match the certificate
+type identityJSON struct {
+	Version   int    `json:"version"`
+	Key       string `json:"key,omitempty"`
+	Cert      string `json:"cert"`
+	Serial    string `json:"serial"`
+	NotBefore string `json:"notBefore"`
+	NotAfter  string `json:"notAfter"`
+}
+
+// PEM file names written by WritePEM
+const (
+	CertFileName = "cert.pem"
+	KeyFileName  = "key.pem"
+)
+
+// MarshalIdentity ...
+/**
+ * Serialize an enrollment in the JSON schema of identityJSON. The output is
+ * stable, unmarshalling and marshalling it again yields the same bytes
+ * @param {Enrollment} enrollment The enrollment to serialize
+ * @returns {[]byte} The JSON encoded identity
+ */
+func MarshalIdentity(enrollment *Enrollment) ([]byte, error) {
+	if enrollment == nil {
+		return nil, fmt.Errorf("Enrollment is nil")
+	}
+	if block, _ := pem.Decode(enrollment.Cert); block == nil {
+		return nil, fmt.Errorf("Enrollment certificate is not PEM encoded")
+	}
+	identity := identityJSON{
+		Version:   IdentityVersion,
+		Cert:      string(enrollment.Cert),
+		Serial:    enrollment.Serial,
+		NotBefore: enrollment.NotBefore.UTC().Format(time.RFC3339),
+		NotAfter:  enrollment.NotAfter.UTC().Format(time.RFC3339),
+	}
+	if enrollment.Key != nil {
+		identity.Key = base64.StdEncoding.EncodeToString(enrollment.Key)
+	}
+	data, err := json.Marshal(&identity)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal json return error: %v", err)
+	}
+	return data, nil
+}
+
+// UnmarshalIdentity ...
+/**
+ * Deserialize an enrollment serialized by MarshalIdentity
+ * @param {[]byte} data The JSON encoded identity
+ * @returns {Enrollment} The enrollment
+ */
+func UnmarshalIdentity(data []byte) (*Enrollment, error) {
+	var identity identityJSON
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("Error decoding identity: %s", err)
+	}
+	if identity.Version != IdentityVersion {
+		return nil, fmt.Errorf("Unsupported identity version %d", identity.Version)
+	}
+	var key []byte
+	if identity.Key != "" {
+		var err error
+		if key, err = base64.StdEncoding.DecodeString(identity.Key); err != nil {
+			return nil, fmt.Errorf("Error decoding identity key: %s", err)
+		}
+	}
+	enrollment, err := newEnrollment(key, []byte(identity.Cert))
+	if err != nil {
+		return nil, err
+	}
+	if identity.Serial != enrollment.Serial ||
+		identity.NotBefore != enrollment.NotBefore.UTC().Format(time.RFC3339) ||
+		identity.NotAfter != enrollment.NotAfter.UTC().Format(time.RFC3339) {
+		return nil, fmt.Errorf("Identity metadata does not match the certificate")
+	}
+	return enrollment, nil
+}
+
+// WritePEM ...
+/**
+ * Write the certificate and private key of an enrollment to the PEM files
+ * CertFileName and KeyFileName of a directory, created if missing. The key
+ * file is only readable by the owner and is not written for HSM keys
+ * @param {string} dir The directory to write the files to
+ * @param {Enrollment} enrollment The enrollment to write
+ */
+func WritePEM(dir string, enrollment *Enrollment) error {
+	if enrollment == nil {
+		return fmt.Errorf("Enrollment is nil")
+	}
+	if block, _ := pem.Decode(enrollment.Cert); block == nil {
+		return fmt.Errorf("Enrollment certificate is not PEM encoded")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Error creating directory %s: %s", dir, err)
+	}
+	certPath := filepath.Join(dir, CertFileName)
+	if err := ioutil.WriteFile(certPath, enrollment.Cert, 0644); err != nil {
+		return fmt.Errorf("Error writing certificate to %s: %s", certPath, err)
+	}
+	if enrollment.Key == nil {
+		return nil
+	}
+	keyPath := filepath.Join(dir, KeyFileName)
+	if err := ioutil.WriteFile(keyPath, enrollment.Key, 0600); err != nil {
+		return fmt.Errorf("Error writing private key to %s: %s", keyPath, err)
+	}
+	return nil
+}
+
+// DefaultClockSkewTolerance is the clock skew tolerance of the Services, see
+// WithClockSkewTolerance
+const DefaultClockSkewTolerance = time.Minute
+
+// CertNotYetValid details an enrollment certificate whose validity starts
+// after the local clock, beyond the clock skew tolerance. The clock of the
+// host or of the CA is then likely wrong, e.g. not synchronized with NTP,
+// and the certificate is rejected until NotBefore
+type CertNotYetValid struct {
+	// NotBefore is the start of the validity of the certificate
+	NotBefore time.Time
+	// LocalTime is the time of the local clock when it was checked
+	LocalTime time.Time
+}
+
+// Skew returns how far the validity of the certificate starts after the
+// local clock
+func (e *CertNotYetValid) Skew() time.Duration {
+	return e.NotBefore.Sub(e.LocalTime)
+}
+
+func (e *CertNotYetValid) Error() string {
+	return fmt.Sprintf("certificate is not valid before %s, %s after the local clock: check the clock "+
+		"of the host and of the CA", e.NotBefore.UTC().Format(time.RFC3339), e.Skew().Round(time.Second))
+}
+
+// WithClockSkewTolerance sets how far the validity of enrollment certificates
+// can start after the local clock before a warning is logged, see
+// CertNotYetValid. DefaultClockSkewTolerance by default, negative to disable
+// the check
+func WithClockSkewTolerance(tolerance time.Duration) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.clockSkewTolerance = tolerance
+	}
+}
+
+// notYetValid returns the details of an enrollment certificate whose
+// validity starts after the local clock beyond the clock skew tolerance, nil
+// otherwise
+func (fabricCAServices *services) notYetValid(cert []byte) *CertNotYetValid {
+	if fabricCAServices.clockSkewTolerance < 0 {
+		return nil
+	}
+	x509Cert, err := fabric_ca.BytesToX509Cert(cert)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	if !x509Cert.NotBefore.After(now.Add(fabricCAServices.clockSkewTolerance)) {
+		return nil
+	}
+	return &CertNotYetValid{NotBefore: x509Cert.NotBefore, LocalTime: now}
+}
+
+// warnIfNotYetValid logs a warning when the validity of the enrollment
+// certificate of enrollmentID starts after the local clock beyond the clock
+// skew tolerance, so that clock problems surface on enrollment
+func (fabricCAServices *services) warnIfNotYetValid(enrollmentID string, cert []byte) {
+	if notYetValid := fabricCAServices.notYetValid(cert); notYetValid != nil {
+		fabricCAServices.logger.Warnf("Enrollment certificate of %s: %s", enrollmentID, notYetValid)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-sdk-go/fabric-client/keyvaluestore"
+)
+
+func TestMarshalIdentity(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{"enroll": newIssuingEnrollHandler(t)})
+	defer ca.Close()
+	enrollment, err := ca.services.EnrollV2("user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollV2 returned error: %v", err)
+	}
+	hsmEnrollment := *enrollment
+	hsmEnrollment.Key = nil
+
+	for _, e := range []*Enrollment{enrollment, &hsmEnrollment} {
+		data, err := MarshalIdentity(e)
+		if err != nil {
+			t.Fatalf("MarshalIdentity returned error: %v", err)
+		}
+		if strings.Contains(string(data), `"key"`) != (e.Key != nil) {
+			t.Fatalf("Key should only be serialized when set: %s", data)
+		}
+		decoded, err := UnmarshalIdentity(data)
+		if err != nil {
+			t.Fatalf("UnmarshalIdentity returned error: %v", err)
+		}
+		if !bytes.Equal(decoded.Key, e.Key) || !bytes.Equal(decoded.Cert, e.Cert) ||
+			decoded.Serial != e.Serial || !decoded.NotBefore.Equal(e.NotBefore) ||
+			!decoded.NotAfter.Equal(e.NotAfter) {
+			t.Fatalf("Decoded enrollment does not match: %+v", decoded)
+		}
+		again, err := MarshalIdentity(decoded)
+		if err != nil {
+			t.Fatalf("MarshalIdentity returned error: %v", err)
+		}
+		if !bytes.Equal(again, data) {
+			t.Fatalf("Serialization is not stable:\n%s\n%s", data, again)
+		}
+	}
+
+	if _, err := MarshalIdentity(nil); err == nil {
+		t.Fatalf("MarshalIdentity should have failed for a nil enrollment")
+	}
+	if _, err := MarshalIdentity(&Enrollment{Cert: []byte("not PEM")}); err == nil {
+		t.Fatalf("MarshalIdentity should have failed for a certificate which is not PEM")
+	}
+	data, _ := MarshalIdentity(enrollment)
+	for _, invalid := range []string{
+		`not json`,
+		strings.Replace(string(data), `"version":1`, `"version":2`, 1),
+		strings.Replace(string(data), `"serial":"`, `"serial":"00`, 1),
+		strings.Replace(string(data), `"key":"`, `"key":"!`, 1),
+	} {
+		if _, err := UnmarshalIdentity([]byte(invalid)); err == nil {
+			t.Fatalf("UnmarshalIdentity should have failed for %s", invalid)
+		}
+	}
+}
+
+func TestWritePEM(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{"enroll": newIssuingEnrollHandler(t)})
+	defer ca.Close()
+	enrollment, err := ca.services.EnrollV2("user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollV2 returned error: %v", err)
+	}
+	tmp, err := ioutil.TempDir("", "enrollment_test")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dir := filepath.Join(tmp, "user1")
+	if err := WritePEM(dir, enrollment); err != nil {
+		t.Fatalf("WritePEM returned error: %v", err)
+	}
+	cert, err := ioutil.ReadFile(filepath.Join(dir, CertFileName))
+	if err != nil || !bytes.Equal(cert, enrollment.Cert) {
+		t.Fatalf("Certificate was not written: %v", err)
+	}
+	key, err := ioutil.ReadFile(filepath.Join(dir, KeyFileName))
+	if err != nil || !bytes.Equal(key, enrollment.Key) {
+		t.Fatalf("Private key was not written: %v", err)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, KeyFileName)); info.Mode().Perm() != 0600 {
+		t.Fatalf("Private key file should only be readable by the owner, got %v", info.Mode())
+	}
+
+	hsmEnrollment := *enrollment
+	hsmEnrollment.Key = nil
+	hsmDir := filepath.Join(tmp, "hsm")
+	if err := WritePEM(hsmDir, &hsmEnrollment); err != nil {
+		t.Fatalf("WritePEM returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(hsmDir, KeyFileName)); !os.IsNotExist(err) {
+		t.Fatalf("No private key file should be written for HSM keys")
+	}
+	if err := WritePEM(dir, nil); err == nil {
+		t.Fatalf("WritePEM should have failed for a nil enrollment")
+	}
+}
+
+func TestCertNotYetValid(t *testing.T) {
+	var notBefore time.Time
+	ca := newMockCA(t, map[string]mockCAHandler{"enroll": newIssuingHandler(t, func() (time.Time, time.Time) {
+		return notBefore, notBefore.Add(time.Hour)
+	})})
+	defer ca.Close()
+	recorder := &recordingLogger{}
+	ca.services.logger = recorder
+	WithClockSkewTolerance(time.Minute)(ca.services)
+
+	// Certificates valid from within the tolerance are accepted silently
+	notBefore = time.Now().Add(30 * time.Second)
+	enrollment, err := ca.services.EnrollV2("user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollV2 returned error: %v", err)
+	}
+	if enrollment.NotYetValid != nil || len(recorder.messages["warn"]) != 0 {
+		t.Fatalf("Unexpected clock skew within the tolerance: %v, %v", enrollment.NotYetValid, recorder.messages)
+	}
+
+	notBefore = time.Now().Add(10 * time.Minute)
+	enrollment, err = ca.services.EnrollV2("user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollV2 returned error: %v", err)
+	}
+	var notYetValid *CertNotYetValid
+	if !errors.As(error(enrollment.NotYetValid), &notYetValid) ||
+		notYetValid.Skew() < 9*time.Minute || notYetValid.Skew() > 10*time.Minute {
+		t.Fatalf("Expected the certificate to be reported not yet valid, got %v", enrollment.NotYetValid)
+	}
+	if len(recorder.messages["warn"]) != 1 || !strings.Contains(recorder.messages["warn"][0], "user1") ||
+		!strings.Contains(recorder.messages["warn"][0], "clock") {
+		t.Fatalf("Expected a warning about the clock, got %v", recorder.messages)
+	}
+
+	// The other enrollment results report it too
+	identity, err := ca.services.EnrollIdentity("Org1MSP", "user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollIdentity returned error: %v", err)
+	}
+	if identity.NotYetValid == nil || !identity.NotYetValid.NotBefore.Equal(notYetValid.NotBefore) {
+		t.Fatalf("Expected the identity to be reported not yet valid, got %v", identity.NotYetValid)
+	}
+	results, err := ca.services.EnrollAll("user1", "user1pw", []string{ECertProfile},
+		keyvaluestore.CreateNewMemoryKeyValueStore())
+	if err != nil {
+		t.Fatalf("EnrollAll returned error: %v", err)
+	}
+	if result := results[ECertProfile]; result.Err != nil || result.NotYetValid == nil {
+		t.Fatalf("Expected the profile enrollment to be reported not yet valid, got %+v", result)
+	}
+	warnings := len(recorder.messages["warn"])
+
+	// A negative tolerance disables the check
+	WithClockSkewTolerance(-1)(ca.services)
+	if _, _, err := ca.services.Enroll("user1", "user1pw"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if len(recorder.messages["warn"]) != warnings {
+		t.Fatalf("Unexpected warning with the check disabled: %v", recorder.messages)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Categories of the errors returned by Services. Errors returned by the CA,
+// or raised while reaching it, are *CAError values which match one of these
+// categories with errors.Is
+var (
+	// ErrCAUnreachable is returned when the CA could not be reached or is
+	// temporarily unavailable. Requests failing with it may be retried
+	ErrCAUnreachable = errors.New("CA unreachable")
+	// ErrInvalidCredentials is returned when the CA rejects the enrollment
+	// secret or the certificate used to authenticate a request
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrPermissionDenied is returned when the authenticated identity is not
+	// allowed to perform the request
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrAlreadyRegistered is returned when registering an identity which
+	// is already registered with the CA
+	ErrAlreadyRegistered = errors.New("identity already registered")
+	// ErrNotFound is returned when the identity or affiliation a request
+	// refers to is not registered with the CA, or the certificate was not
+	// issued by it
+	ErrNotFound = errors.New("not found")
+	// ErrCertificatePinMismatch is returned when the TLS certificate of the
+	// CA matches none of the pinned fingerprints
+	ErrCertificatePinMismatch = errors.New("CA certificate does not match the pinned fingerprints")
+	// ErrEnrollmentLimitReached is returned when enrolling an identity which
+	// has already enrolled MaxEnrollments times. Enrolling again fails until
+	// the identity is registered again or its MaxEnrollments is raised, so
+	// requests failing with it are not retried
+	ErrEnrollmentLimitReached = errors.New("enrollment limit reached")
+	// ErrAlreadyRevoked is returned when revoking an identity or a
+	// certificate which is already revoked, so that revocations are safe to
+	// retry
+	ErrAlreadyRevoked = errors.New("already revoked")
+)
+
+// ErrKeyNotExportable is returned when private key material of a key kept in
+// an HSM would be written outside of it, e.g. persisted in a state store
+var ErrKeyNotExportable = errors.New("HSM private key is not exportable")
+
+// ErrKeyCannotSign is returned when the private key of an enrollment, like an
+// rsa key, cannot be imported in the BCCSP to sign Fabric CA requests, e.g.
+// when storing or loading the enrolled identity
+var ErrKeyCannotSign = errors.New("private key cannot sign requests")
+
+// ErrPKCS11NotSupported is returned when the PKCS11 BCCSP provider is
+// configured but the SDK was built without the pkcs11 build tag
+var ErrPKCS11NotSupported = errors.New("PKCS11 BCCSP provider is not supported: " +
+	"the SDK must be built with the pkcs11 build tag")
+
+// CAError is an error returned by the CA or raised while reaching it
+type CAError struct {
+	// Kind is the category of the error, nil when it matches none of them
+	Kind error
+	// StatusCode is the HTTP status of the CA response, 0 when the CA
+	// could not be reached
+	StatusCode int
+	// Code is the error code sent by the CA
+	Code int
+	// Message is the error message sent by the CA, or the transport error
+	Message string
+	err     error
+}
+
+// Error returns the error message
+func (e *CAError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("Failed to reach CA: %s", e.Message)
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("Failed with server status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("Error response from server was '%s'", e.Message)
+}
+
+// Unwrap returns the transport error the CA could not be reached with
+func (e *CAError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether the error belongs to the target category
+func (e *CAError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// newUnreachableError creates the error of a CA which could not be reached
+func newUnreachableError(err error) *CAError {
+	return &CAError{Kind: ErrCAUnreachable, Message: err.Error(), err: err}
+}
+
+// ErrClosed is returned by the methods of Services called after Close
+var ErrClosed = errors.New("fabric-ca client is closed")
+
+// ErrConflict is returned by ModifyIdentity when the identity was modified
+// since the state its IfMatch refers to
+var ErrConflict = errors.New("identity modified concurrently")
+
+// ErrNotEnrolled is returned by LoadUser for stored users without an
+// enrollment certificate or private key
+var ErrNotEnrolled = errors.New("user is not enrolled")
+
+// ErrMSPIDMismatch is returned by LoadUserForMSP for stored users of another
+// MSP, or stored without MSP ID
+var ErrMSPIDMismatch = errors.New("MSP ID mismatch")
+
+// ErrNoCertificates is returned by a RevokeNewestOnly revocation of an
+// identity without unrevoked certificates
+var ErrNoCertificates = errors.New("no certificates to revoke")
+
+// ErrUnsupported is returned by VerifySecret when the CA has no way to check
+// an enrollment secret without consuming an enrollment
+var ErrUnsupported = errors.New("not supported by the CA")
+
+// newTransportError creates the error of a request which could not be sent
+// to the CA, the CA being unreachable unless its certificate failed pinning
+func newTransportError(err error) *CAError {
+	if errors.Is(err, ErrCertificatePinMismatch) {
+		return &CAError{Kind: ErrCertificatePinMismatch, Message: err.Error(), err: err}
+	}
+	return newUnreachableError(err)
+}
+
+// newServerError creates the error of a CA response, categorized from its
+// HTTP status and message, since the CA reports most failures with the same
+// error code
+func newServerError(statusCode int, code int, message string) *CAError {
+	e := &CAError{StatusCode: statusCode, Code: code, Message: message}
+	msg := strings.ToLower(message)
+	switch {
+	case statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout:
+		e.Kind = ErrCAUnreachable
+	// The limit is reported as an authentication failure, or an internal
+	// error by some CAs, and is told apart by its message
+	case strings.Contains(msg, "maximum enrollment allowance") ||
+		strings.Contains(msg, "maximum number of enrollments"):
+		e.Kind = ErrEnrollmentLimitReached
+	case strings.Contains(msg, "already revoked"):
+		e.Kind = ErrAlreadyRevoked
+	case statusCode == http.StatusConflict || strings.Contains(msg, "already registered"):
+		e.Kind = ErrAlreadyRegistered
+	case statusCode == http.StatusForbidden || strings.Contains(msg, "not authorized") ||
+		strings.Contains(msg, "does not have authority"):
+		e.Kind = ErrPermissionDenied
+	case statusCode == http.StatusUnauthorized || strings.Contains(msg, "authorization failure") ||
+		strings.Contains(msg, "authentication failure") || strings.Contains(msg, "invalid token"):
+		e.Kind = ErrInvalidCredentials
+	// A 404 without an error message is an endpoint unknown to the CA rather
+	// than a missing identity
+	case (statusCode == http.StatusNotFound && message != "") || strings.Contains(msg, "not found") ||
+		strings.Contains(msg, "does not exist"):
+		e.Kind = ErrNotFound
+	}
+	return e
+}
+
+// withEnrollmentID adds the identity name to the error of an enrollment of
+// enrollmentID which reached its enrollment limit
+func withEnrollmentID(enrollmentID string, err error) error {
+	if errors.Is(err, ErrEnrollmentLimitReached) {
+		return fmt.Errorf("identity %s has reached its maximum number of enrollments: %w", enrollmentID, err)
+	}
+	return err
+}
+
+// isUnsupportedEndpoint returns true for the errors of CAs which do not serve
+// the requested endpoint, answering with an uncategorized 404 or a 405
+func isUnsupportedEndpoint(err error) bool {
+	var caErr *CAError
+	if !errors.As(err, &caErr) || caErr.Kind != nil {
+		return false
+	}
+	return caErr.StatusCode == http.StatusNotFound || caErr.StatusCode == http.StatusMethodNotAllowed
+}
+
+// ValidationError is returned when a request fails client-side validation,
+// before being sent to the CA. It lists all the problems of the request
+type ValidationError struct {
+	Problems []string
+}
+
+// Error returns the error message
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid request: %s", strings.Join(e.Problems, "; "))
+}
+
+// wrappedError is an error with its own message wrapping the error it was
+// caused by
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string {
+	return e.msg
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// wrapError returns an error with the formatted message, wrapping err
+func wrapError(err error, format string, args ...interface{}) error {
+	return &wrappedError{msg: fmt.Sprintf(format, args...), err: err}
+}
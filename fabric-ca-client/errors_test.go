@@ -0,0 +1,130 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorCategories(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return "Authorization failure", http.StatusUnauthorized
+		},
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			return "Identity 'user1' is already registered", http.StatusInternalServerError
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			if strings.Contains(string(body), "user2") {
+				return "Identity user2 is already revoked", http.StatusBadRequest
+			}
+			return "Caller does not have authority to revoke", http.StatusForbidden
+		},
+		"gencrl": func(r *http.Request, body []byte) (interface{}, int) {
+			return "Service unavailable", http.StatusServiceUnavailable
+		},
+	})
+	defer ca.Close()
+
+	_, _, err := ca.services.Enroll("enrollmentID", "enrollmentSecret")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Enroll should have failed with ErrInvalidCredentials, got: %v", err)
+	}
+	var caErr *CAError
+	if !errors.As(err, &caErr) || caErr.StatusCode != http.StatusUnauthorized ||
+		caErr.Message != "Authorization failure" {
+		t.Fatalf("Enroll should have returned the CA response as *CAError, got: %#v", caErr)
+	}
+	_, err = ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	if !errors.Is(err, ErrAlreadyRegistered) {
+		t.Fatalf("Register should have failed with ErrAlreadyRegistered, got: %v", err)
+	}
+	err = ca.services.Revoke(registrar, &RevocationRequest{Name: "user1"})
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("Revoke should have failed with ErrPermissionDenied, got: %v", err)
+	}
+	err = ca.services.Revoke(registrar, &RevocationRequest{Name: "user2"})
+	if !errors.Is(err, ErrAlreadyRevoked) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("Revoke should have failed with ErrAlreadyRevoked, got: %v", err)
+	}
+	_, err = ca.services.GenerateCRL(registrar, &CRLRequest{})
+	if !errors.Is(err, ErrCAUnreachable) {
+		t.Fatalf("GenerateCRL should have failed with ErrCAUnreachable, got: %v", err)
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("GenerateCRL error should only match ErrCAUnreachable")
+	}
+	// An endpoint the CA does not serve is not a missing identity
+	_, err = ca.services.GetIdentity(registrar, "user1")
+	if !errors.As(err, &caErr) || caErr.StatusCode != http.StatusNotFound || errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetIdentity should have failed with an uncategorized 404, got: %v", err)
+	}
+
+	// A CA which is not listening is unreachable
+	ca.Close()
+	_, _, err = ca.services.Enroll("enrollmentID", "enrollmentSecret")
+	if !errors.Is(err, ErrCAUnreachable) {
+		t.Fatalf("Enroll should have failed with ErrCAUnreachable, got: %v", err)
+	}
+	if !errors.As(err, &caErr) || caErr.StatusCode != 0 {
+		t.Fatalf("Enroll should have returned a transport *CAError, got: %#v", caErr)
+	}
+}
+
+func TestEnrollmentLimitReached(t *testing.T) {
+	// The limit is reported with either status depending on the CA
+	for _, status := range []int{http.StatusUnauthorized, http.StatusInternalServerError} {
+		var enrollments, requests int
+		limited := newMockCA(t, map[string]mockCAHandler{
+			"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+				requests++
+				if enrollments++; enrollments > 1 {
+					return "The identity user1 has already enrolled 1 times, " +
+						"it has reached its maximum enrollment allowance", status
+				}
+				return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+			},
+		})
+		limited.services.retryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+		if _, _, err := limited.services.Enroll("user1", "user1pw"); err != nil {
+			t.Fatalf("Enroll returned error: %v", err)
+		}
+		_, _, err := limited.services.Enroll("user1", "user1pw")
+		limited.Close()
+		if !errors.Is(err, ErrEnrollmentLimitReached) || errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("Enroll past the limit should have failed with ErrEnrollmentLimitReached, got: %v", err)
+		}
+		if !strings.Contains(err.Error(), "identity user1 has reached its maximum number of enrollments") {
+			t.Fatalf("The error should name the identity, got: %v", err)
+		}
+		if requests != 2 {
+			t.Fatalf("Enroll past the limit should not be retried, got %d requests", requests)
+		}
+		if errorCategory(err) != "enrollment_limit" {
+			t.Fatalf("Unexpected error category %s", errorCategory(err))
+		}
+	}
+}
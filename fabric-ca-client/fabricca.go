@@ -20,111 +20,1522 @@ limitations under the License.
 package fabricca
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/cloudflare/cfssl/csr"
+	"github.com/cloudflare/cfssl/signer"
 	"github.com/hyperledger/fabric-ca/api"
 	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric-ca/util"
 	"github.com/hyperledger/fabric-sdk-go/config"
 	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
-
-	"github.com/op/go-logging"
+	"github.com/hyperledger/fabric/bccsp"
 )
 
-var logger = logging.MustGetLogger("fabric_sdk_go")
-
 // Services ...
+// Services is safe for concurrent use by multiple goroutines
+// Errors returned by the CA wrap a *CAError, whose category can be tested
+// with errors.Is against ErrCAUnreachable, ErrInvalidCredentials,
+// ErrPermissionDenied, ErrAlreadyRegistered, ErrNotFound,
+// ErrCertificatePinMismatch, ErrEnrollmentLimitReached and ErrCircuitOpen
 type Services interface {
+	CAName() string
 	Enroll(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error)
+	EnrollContext(ctx context.Context, enrollmentID string, enrollmentSecret string) ([]byte, []byte, error)
+	EnrollWithOptions(enrollmentID string, enrollmentSecret string, opts *EnrollmentOptions) ([]byte, []byte, error)
+	EnrollAndStore(enrollmentID string, enrollmentSecret string, store StateStore) (fabricclient.User, error)
+	EnrollIdentityAndStore(mspID string, enrollmentID string, enrollmentSecret string,
+		store StateStore) (fabricclient.User, error)
+	EnrollAll(enrollmentID string, enrollmentSecret string, profiles []string,
+		store StateStore) (map[string]*ProfileEnrollment, error)
+	EnrollTLS(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error)
+	EnrollTLSCertificate(enrollmentID string, enrollmentSecret string) (cryptotls.Certificate, error)
+	EnrollWithSecretRef(enrollmentID string, secretRef string) ([]byte, []byte, error)
+	EnrollWithCSR(enrollmentID string, enrollmentSecret string, csrPEM []byte) ([]byte, error)
+	EnrollV2(enrollmentID string, enrollmentSecret string) (*Enrollment, error)
+	EnrollIdentity(mspID string, enrollmentID string, enrollmentSecret string) (*Identity, error)
+	EnrollIdemix(enrollmentID string, enrollmentSecret string) (*IdemixCredential, error)
+	VerifySecret(enrollmentID string, enrollmentSecret string) (bool, error)
 	Register(registrar fabricclient.User, request *RegistrationRequest) (string, error)
+	RegisterContext(ctx context.Context, registrar fabricclient.User, request *RegistrationRequest) (string, error)
+	RegisterV2(registrar fabricclient.User, request *RegistrationRequest) (*RegistrationResponse, error)
+	RegisterBatch(registrar fabricclient.User, requests []*RegistrationRequest) ([]RegisterResult, error)
+	RegisterRegistrar(registrar fabricclient.User, request *RegistrarRegistrationRequest) (string, error)
 	Revoke(registrar fabricclient.User, request *RevocationRequest) error
+	RevokeContext(ctx context.Context, registrar fabricclient.User, request *RevocationRequest) error
+	RevokeWithCRL(registrar fabricclient.User, request *RevocationRequest) ([]byte, error)
+	GetCertificates(registrar fabricclient.User, filter CertFilter) ([]CertInfo, error)
+	GetExpiringCertificates(registrar fabricclient.User, within time.Duration) ([]CertInfo, error)
+	IsRevoked(registrar fabricclient.User, serial string, aki string) (bool, error)
+	Reenroll(user fabricclient.User) ([]byte, []byte, error)
+	GetCAInfo() (*CAInfo, error)
+	GetCACertPool(ctx context.Context) (*x509.CertPool, error)
+	GetTLSCACerts(ctx context.Context) ([][]byte, error)
+	Ping(ctx context.Context) error
+	GetTransactionCerts(user fabricclient.User, count int, attributes []string) ([]TCert, error)
+	GenerateCRL(registrar fabricclient.User, request *CRLRequest) ([]byte, error)
+	AddAffiliation(registrar fabricclient.User, name string) (*AffiliationResponse, error)
+	GetAffiliation(registrar fabricclient.User, name string) (*AffiliationResponse, error)
+	GetAllAffiliations(registrar fabricclient.User) ([]*AffiliationResponse, error)
+	GetAffiliationTree(registrar fabricclient.User) (*AffiliationNode, error)
+	RemoveAffiliation(registrar fabricclient.User, name string, force bool) (*AffiliationResponse, error)
+	RevokeAffiliation(registrar fabricclient.User, affiliation string, reason RevocationReason) (RevokeSummary, error)
+	GetIdentity(registrar fabricclient.User, name string) (*IdentityResponse, error)
+	GetAllIdentities(registrar fabricclient.User) ([]*IdentityResponse, error)
+	StreamIdentities(ctx context.Context, registrar fabricclient.User) (<-chan IdentityResponse, <-chan error, error)
+	FindIdentitiesByAttribute(registrar fabricclient.User, name string, value string) ([]IdentityResponse, error)
+	ModifyIdentity(registrar fabricclient.User, request *ModifyIdentityRequest) (*IdentityResponse, error)
+	ModifyEnrollmentSecret(registrar fabricclient.User, name string, newSecret string) error
+	ModifyEnrollmentSecretIfMatch(registrar fabricclient.User, name string, newSecret string, ifMatch string) error
+	ResetSecret(registrar fabricclient.User, name string) (string, error)
+	ResetSecretIfMatch(registrar fabricclient.User, name string, ifMatch string) (string, error)
+	OpenSession() (Session, error)
+	RemoveIdentity(registrar fabricclient.User, request *RemoveIdentityRequest) (*IdentityResponse, error)
+	GetRegistrarCapabilities(registrar fabricclient.User) (*RegistrarCaps, error)
+	GetRegistrationMetadata(registrar fabricclient.User) (*RegMetadata, error)
+	BreakerState() BreakerState
+	SignerFor(user fabricclient.User) (crypto.Signer, error)
+	Close() error
 }
 
 type services struct {
 	fabricCAClient *fabric_ca.Client
+	caName         string
+	// identityTypes are the types identities can be registered with
+	identityTypes []string
+	// defaultType and defaultAffiliation are the type and affiliation of
+	// the registration requests leaving them empty
+	defaultType        string
+	defaultAffiliation string
+	// hsm is set when keys are generated and kept in the BCCSP, like an HSM,
+	// rather than returned to the caller
+	hsm bool
+	// tokenLabel is the label of the HSM token keys are generated in when
+	// hsm is set
+	tokenLabel string
+	// csp is the BCCSP of the configured provider, see InitCryptoSuite
+	csp bccsp.BCCSP
+	// mu guards client, created once since the TLS file paths of the
+	// fabric-ca client configuration are rewritten in place on creation,
+	// and closed
+	mu sync.Mutex
+	// client is the HTTP client requests are sent with, see httpClient
+	client *http.Client
+	// baseTransport is the transport of client before wrapTransport, cloned
+	// by the sessions, see OpenSession
+	baseTransport *http.Transport
+	// closed is set by Close
+	closed bool
+	// connection tunes the connections of client
+	connection config.FabricCAConnectionConfig
+	// retryPolicy is the policy transient failures are retried with
+	retryPolicy RetryPolicy
+	// defaultTimeout bounds the operations of the methods taking no
+	// context, see WithDefaultTimeout
+	defaultTimeout time.Duration
+	// clockSkewTolerance is how far the validity of enrollment certificates
+	// can start after the local clock, see WithClockSkewTolerance
+	clockSkewTolerance time.Duration
+	// maxListResults is the maximum number of entries of the list methods,
+	// see WithMaxListResults
+	maxListResults int
+	// transport replaces the HTTP transport requests are sent with, for tests
+	transport http.RoundTripper
+	// customClient replaces client, see WithHTTPClient
+	customClient *http.Client
+	// wrapTransport wraps the transport of client, see WithRoundTripper
+	wrapTransport func(http.RoundTripper) http.RoundTripper
+	// serverNameOverride is the name the TLS certificate of the CA is
+	// verified against, the host of the CA URL when empty
+	serverNameOverride string
+	// pinnedSHA256 are the fingerprints the TLS certificate of the CA must
+	// match one of, unless empty
+	pinnedSHA256 [][]byte
+	// logger is the logger messages are logged with
+	logger Logger
+	// metrics measures the requests sent to the CA
+	metrics Metrics
+	// tracer traces the operations of the Services
+	tracer Tracer
+	// configDir is the directory the temporary fabric-ca client config is
+	// written to, see WithConfigDir
+	configDir string
+	// retainConfig keeps the temporary fabric-ca client config
+	retainConfig bool
+	// insecure allows http CA URLs, see WithInsecure
+	insecure bool
+	// idemix creates the credential requests of EnrollIdemix
+	idemix IdemixProvider
+	// breaker fails requests fast while the CA is down, see
+	// WithCircuitBreaker
+	breaker *circuitBreaker
+	// tlsCA are the services of the CA issuing the TLS certificates of the
+	// network, see GetTLSCACerts, nil when not configured
+	tlsCA *services
+	// hooks are called around the operations of the Services, see WithHooks
+	hooks []Hook
+	// registrarProvider refreshes the registrars whose credentials are
+	// rejected, see WithRegistrarProvider
+	registrarProvider RegistrarProvider
+	// serverCAName is the CA of the server requests without a CAName are
+	// sent to, see WithServerCAName
+	serverCAName string
 }
 
+// Values of MaxEnrollments with a special meaning
+const (
+	// EnrollmentsServerDefault limits the enrollments to the max_enrollments
+	// configured on the server
+	EnrollmentsServerDefault = 0
+	// EnrollmentsUnlimited does not limit the enrollments
+	EnrollmentsUnlimited = -1
+)
+
 type RegistrationRequest struct {
 	// Name is the unique name of the identity
 	Name string
-	// Type of identity being registered (e.g. "peer, app, user")
+	// Type of identity being registered (e.g. "peer, app, user"), one of
+	// the configured identity types. The defaultType of the CA config when
+	// empty
 	Type string
-	// MaxEnrollments is the number of times the secret can  be reused to enroll.
-	// if omitted, this defaults to max_enrollments configured on the server
+	// MaxEnrollments is the number of times the secret can be reused to
+	// enroll: EnrollmentsServerDefault (0, or omitted) for the max_enrollments
+	// configured on the server, EnrollmentsUnlimited (-1) for no limit, or a
+	// positive number of enrollments. Lower values are rejected
 	MaxEnrollments int
-	// The identity's affiliation e.g. org1.department1
+	// The identity's affiliation e.g. org1.department1. The
+	// defaultAffiliation of the CA config when empty
 	Affiliation string
 	// Optional attributes associated with this identity
 	Attributes []Attribute
+	// DryRun validates the request, locally and against the CA when it
+	// supports the checks, without registering the identity. Register then
+	// returns an empty secret and RegisterV2 the Preview of the identity
+	DryRun bool
+	// IfNotExists succeeds when the identity is already registered, rather
+	// than failing with ErrAlreadyRegistered. No secret is returned then, and
+	// RegisterV2 returns the Existing identity when the CA provides it
+	IfNotExists bool
+	// Secret is the enrollment secret to register the identity with, of at
+	// least MinSecretLength characters. The CA generates one when empty
+	Secret string
+	// CAName is the name of the CA of the server to register the identity
+	// with, the CA set with WithServerCAName when empty
+	CAName string
+}
+
+// DefaultIdentityTypes are the types identities can be registered with, unless
+// configured otherwise with client.fabricCA.identityTypes
+var DefaultIdentityTypes = []string{"peer", "app", "user", "orderer", "client"}
+
+// RegistrationResponse is the response of the CA to a registration request
+type RegistrationResponse struct {
+	// Secret is the enrollment secret of the registered identity
+	Secret string
+	// Metadata holds the other fields returned by the CA, such as the
+	// enrollment URL returned by newer CA versions
+	Metadata map[string]interface{}
+	// Preview is the identity which would be registered by a DryRun
+	// request, which has no secret
+	Preview *IdentityResponse
+	// CAChecked is true when a DryRun request was checked against the CA,
+	// false when the CA does not support the checks and only the local
+	// validation ran
+	CAChecked bool
+	// AlreadyRegistered is true when an IfNotExists request found the
+	// identity already registered
+	AlreadyRegistered bool
+	// Existing is the already registered identity, nil when the CA does not
+	// provide it
+	Existing *IdentityResponse
+}
+
+// Identity is an enrolled identity of an organization, with its certificate
+// and private key bound together, returned by EnrollIdentity
+type Identity struct {
+	// MSPID is the MSP ID of the organization of the identity
+	MSPID string
+	// Cert is the PEM encoded X509 certificate
+	Cert []byte
+	// Key is the PEM encoded private key, nil when keys are kept in an HSM
+	Key []byte
+	// NotYetValid is set when the validity of the certificate starts after
+	// the local clock beyond the clock skew tolerance, see
+	// WithClockSkewTolerance
+	NotYetValid *CertNotYetValid
+}
+
+// Enrollment is the result of an enrollment, with the validity and serial
+// number of the issued certificate. Its named fields replace the key and
+// certificate returned, in that order, by Enroll
+type Enrollment struct {
+	// Key is the PEM encoded private key, nil when keys are kept in an HSM
+	Key []byte
+	// Cert is the PEM encoded X509 certificate
+	Cert []byte
+	// Serial is the hex encoded serial number of the certificate, as
+	// expected by RevocationRequest.Serial
+	Serial string
+	// NotBefore and NotAfter bound the validity of the certificate
+	NotBefore time.Time
+	NotAfter  time.Time
+	// NotYetValid is set when the validity of the certificate starts after
+	// the local clock beyond the clock skew tolerance, see
+	// WithClockSkewTolerance
+	NotYetValid *CertNotYetValid
 }
 
 type RevocationRequest struct {
 	// Name of the identity whose certificates should be revoked
 	// If this field is omitted, then Serial and AKI must be specified.
 	Name string
-	// Serial number of the certificate to be revoked
-	// If this is omitted, then Name must be specified
+	// Serial number of the certificate to be revoked, in hex, optionally
+	// colon separated. If this is omitted, then Name must be specified
 	Serial string
-	// AKI (Authority Key Identifier) of the certificate to be revoked
+	// AKI (Authority Key Identifier) of the certificate to be revoked, in
+	// hex, optionally colon separated. It must be set with Serial
 	AKI string
-	// Reason is the reason for revocation. See https://godoc.org/golang.org/x/crypto/ocsp
-	// for valid values. The default value is 0 (ocsp.Unspecified).
+	// Reason is the OCSP code of the reason for revocation, between 0 and 10
+	// except the unused 7. The default value is 0 (Unspecified).
+	// Deprecated: set ReasonCode instead
 	Reason int
+	// ReasonCode is the reason for revocation, overriding Reason when set
+	ReasonCode RevocationReason
+	// GenCRL requests the CA to generate an updated CRL once the certificates
+	// are revoked. Only honored by RevokeWithCRL
+	GenCRL bool
+	// CAName is the name of the CA of the server the certificates were
+	// issued by, the CA set with WithServerCAName when empty
+	CAName string
+	// RevokeNewestOnly revokes only the unrevoked certificate of the
+	// identity Name of the latest NotBefore, rather than all its certificates
+	// and the identity itself, which can then still enroll. It fails with
+	// ErrNoCertificates when the identity has no unrevoked certificate
+	RevokeNewestOnly bool
 }
 
+// Attribute is an attribute of a registered identity
 type Attribute struct {
 	Key   string
 	Value string
+	// ECert embeds the attribute in the enrollment certificates of the
+	// identity when no attribute is requested at enrollment
+	ECert bool
+}
+
+// RevocationReason is the reason a certificate is revoked for, as defined by
+// RFC 5280 and used in OCSP responses
+type RevocationReason int
+
+// Revocation reasons, with the values of the golang.org/x/crypto/ocsp codes
+const (
+	Unspecified          RevocationReason = 0
+	KeyCompromise        RevocationReason = 1
+	CACompromise         RevocationReason = 2
+	AffiliationChanged   RevocationReason = 3
+	Superseded           RevocationReason = 4
+	CessationOfOperation RevocationReason = 5
+	CertificateHold      RevocationReason = 6
+	// 7 is not used
+	RemoveFromCRL      RevocationReason = 8
+	PrivilegeWithdrawn RevocationReason = 9
+	AACompromise       RevocationReason = 10
+)
+
+// valid reports whether reason is a revocation reason defined by RFC 5280
+func (reason RevocationReason) valid() bool {
+	return reason >= Unspecified && reason <= AACompromise && reason != 7
+}
+
+// revocationReason returns the reason of a revocation request, a
+// ValidationError when it is not a valid reason or Reason and ReasonCode
+// conflict
+func revocationReason(request *RevocationRequest) (RevocationReason, error) {
+	var problems []string
+	if !RevocationReason(request.Reason).valid() {
+		problems = append(problems, fmt.Sprintf("Reason %d is not a valid revocation reason", request.Reason))
+	}
+	if !request.ReasonCode.valid() {
+		problems = append(problems, fmt.Sprintf("ReasonCode %d is not a valid revocation reason",
+			request.ReasonCode))
+	}
+	if request.Reason != 0 && request.ReasonCode != Unspecified &&
+		RevocationReason(request.Reason) != request.ReasonCode {
+		problems = append(problems, fmt.Sprintf("Reason %d conflicts with ReasonCode %d", request.Reason,
+			request.ReasonCode))
+	}
+	if len(problems) > 0 {
+		return Unspecified, &ValidationError{Problems: problems}
+	}
+	if request.ReasonCode != Unspecified {
+		return request.ReasonCode, nil
+	}
+	return RevocationReason(request.Reason), nil
+}
+
+// revocationTarget validates the certificates a revocation request targets,
+// those of Name or the one of Serial and AKI, and returns Serial and AKI
+// normalized to the lowercase hex without colons the CA expects
+func revocationTarget(request *RevocationRequest) (string, string, error) {
+	var problems []string
+	serial, err := normalizeHex(request.Serial)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Serial %s is not valid hex: %s", request.Serial, err))
+	}
+	aki, err := normalizeHex(request.AKI)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("AKI %s is not valid hex: %s", request.AKI, err))
+	}
+	switch {
+	case request.Serial != "" && request.AKI == "":
+		problems = append(problems, "AKI must be set with Serial")
+	case request.Serial == "" && request.AKI != "":
+		problems = append(problems, "Serial must be set with AKI")
+	case request.Name == "" && request.Serial == "":
+		problems = append(problems, "Name or Serial and AKI must be set")
+	}
+	if request.RevokeNewestOnly && (request.Name == "" || request.Serial != "") {
+		problems = append(problems, "RevokeNewestOnly must be set with Name, without Serial and AKI")
+	}
+	if len(problems) > 0 {
+		return "", "", &ValidationError{Problems: problems}
+	}
+	return serial, aki, nil
+}
+
+// normalizeHex removes the colons of a hex string, e.g. 4A:9F, and lowercases
+// it
+func normalizeHex(value string) (string, error) {
+	normalized := strings.ToLower(strings.Replace(strings.TrimSpace(value), ":", "", -1))
+	for _, r := range normalized {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return "", fmt.Errorf("invalid character %q", r)
+		}
+	}
+	return normalized, nil
+}
+
+// CRLRequest filters the revoked certificates included in a generated CRL.
+// Zero values are ignored
+type CRLRequest struct {
+	// RevokedAfter includes only certificates revoked after this time
+	RevokedAfter time.Time
+	// RevokedBefore includes only certificates revoked before this time
+	RevokedBefore time.Time
+	// ExpireAfter includes only certificates expiring after this time
+	ExpireAfter time.Time
+	// ExpireBefore includes only certificates expiring before this time
+	ExpireBefore time.Time
+	// CAName is the name of the CA of the server the CRL is generated by,
+	// the CA set with WithServerCAName when empty
+	CAName string
+}
+
+// CAInfo is the information the CA server provides about itself
+type CAInfo struct {
+	// CAName is the name of the CA
+	CAName string
+	// CAChain is the PEM encoded certificate chain of the CA, starting with
+	// the CA's own certificate and ending with the root certificate
+	CAChain []byte
+	// Version is the version of the CA server
+	Version string
+	// IssuerPublicKey is the serialized Idemix issuer public key of the CA,
+	// empty when the CA does not issue Idemix credentials
+	IssuerPublicKey []byte
+	// IssuerRevocationPublicKey is the PEM encoded public key the Idemix
+	// credential revocation information is signed with
+	IssuerRevocationPublicKey []byte
+}
+
+// EnrollmentOptions customizes the certificate signing request generated on enrollment
+type EnrollmentOptions struct {
+	// CN is the common name of the CSR subject.
+	// If omitted, the enrollment ID is used
+	CN string
+	// Subject sets the other components of the CSR subject distinguished
+	// name. The CA copies them into the certificate only when its policy
+	// passes the subject of the CSR through, otherwise it sets its own
+	Subject *Subject
+	// Hosts is the list of SAN host names of the CSR.
+	// If omitted, the local hostname is used
+	Hosts []string
+	// KeyRequest selects the algorithm and size of the generated key.
+	// If omitted, this defaults to ecdsa 256
+	KeyRequest *KeyRequest
+	// Profile is the name of the CA signing profile used to issue the certificate,
+	// e.g. TLSProfile. If omitted, the CA's default signing profile is used
+	Profile string
+	// AttrReqs selects the registered attributes of the identity embedded
+	// in the issued certificate. If omitted, the CA's defaults apply
+	AttrReqs []AttributeRequest
+	// CAName is the name of the CA of the server issuing the certificate,
+	// for servers hosting several CAs. If omitted, the CA set with
+	// WithServerCAName issues it
+	CAName string
+	// Extensions are added to the CSR, e.g. to carry an employee ID under a
+	// custom OID. The CA copies the subject alternative names of the CSR
+	// into the certificate but drops other extensions, unless its signing
+	// profile copies them (copy_extensions of the cfssl signing profile).
+	// The subject alternative names are set with Hosts, and the attributes
+	// extension by the CA from AttrReqs, so their OIDs are rejected
+	Extensions []pkix.Extension
+	// Label is the label of the HSM token the key is generated in, sent as
+	// the label of the enrollment request. It is required when keys are kept
+	// in an HSM and ignored otherwise. The PKCS11 BCCSP opens a single token,
+	// the one of client.security.pkcs11.label logged in with
+	// client.security.pkcs11.pin, so Label must match that label: enrolling
+	// in another token requires configuring its label and PIN instead
+	Label string
+	// CSRSigner signs the CSR built from these options with a key it holds,
+	// instead of a key generated by the SDK, and no key is returned. The
+	// key is chosen by the signer, so KeyRequest cannot be set, and Label is
+	// ignored. If omitted, the CSR is signed with a key of the BCCSP
+	CSRSigner CSRSigner
+}
+
+// Subject holds the distinguished name components of the CSR subject other
+// than its common name. Empty components are omitted
+type Subject struct {
+	// Organization (O) of the subject
+	Organization string
+	// OrganizationalUnit (OU) of the subject
+	OrganizationalUnit string
+	// Locality (L) of the subject, e.g. its city
+	Locality string
+	// Province (ST) of the subject, its state or province
+	Province string
+	// Country (C) of the subject, an ISO 3166 two-letter code such as US
+	Country string
+}
+
+// AttributeRequest requests a registered attribute of the identity to be
+// embedded in the issued certificate
+type AttributeRequest struct {
+	// Name of the registered attribute
+	Name string `json:"name"`
+	// Optional tolerates the identity not having the attribute, otherwise
+	// enrollment fails
+	Optional bool `json:"optional,omitempty"`
+}
+
+// enrollmentRequest is the body of an enrollment request
+type enrollmentRequest struct {
+	signer.SignRequest
+	AttrReqs []AttributeRequest `json:"attr_reqs,omitempty"`
+	CAName   string             `json:"caname,omitempty"`
+}
+
+// TLSProfile is the CA signing profile used to issue TLS certificates
+const TLSProfile = "tls"
+
+// ECertProfile names the CA's default signing profile, which issues
+// enrollment certificates, in EnrollAll
+const ECertProfile = "ecert"
+
+// KeyRequest is the algorithm and size of a key to generate, e.g. ecdsa 384.
+// ecdsa 256, 384 and 521 and rsa 2048, 3072 and 4096 keys are supported,
+// only ecdsa 256 and 384 when keys are kept in an HSM. The BCCSP only imports
+// and signs with ecdsa keys: rsa enrollments, like TLS certificates, cannot be
+// stored or sign Fabric CA requests, see ErrKeyCannotSign
+type KeyRequest struct {
+	Algo string
+	Size int
+}
+
+// supportedKeyRequests are the key sizes the keys of each algorithm can be
+// generated with in software
+var supportedKeyRequests = map[string][]int{
+	"ecdsa": {256, 384, 521},
+	"rsa":   {2048, 3072, 4096},
+}
+
+// supportedBCCSPKeyRequests are the key sizes the keys of each algorithm can
+// be generated with in the BCCSP, like an HSM
+var supportedBCCSPKeyRequests = map[string][]int{
+	"ecdsa": {256, 384},
+}
+
+// validateKeyRequest checks a key request is one of the key requests
+// supported by the services, see KeyRequest
+func (fabricCAServices *services) validateKeyRequest(keyRequest *KeyRequest) error {
+	supported, description := supportedKeyRequests, "ecdsa 256, 384, 521 and rsa 2048, 3072, 4096"
+	if fabricCAServices.hsm {
+		supported, description = supportedBCCSPKeyRequests, "ecdsa 256, 384 for keys kept in an HSM"
+	}
+	for _, size := range supported[keyRequest.Algo] {
+		if size == keyRequest.Size {
+			return nil
+		}
+	}
+	return &ValidationError{Problems: []string{fmt.Sprintf("Unsupported key request %s %d, supported are %s",
+		keyRequest.Algo, keyRequest.Size, description)}}
+}
+
+// subjectAltNameOID is the OID of the subject alternative name extension
+var subjectAltNameOID = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// validateExtensions checks that the OIDs of the CSR extensions are
+// well-formed and unique, and their values set
+func validateExtensions(extensions []pkix.Extension) error {
+	var problems []string
+	seen := map[string]bool{}
+	for i, ext := range extensions {
+		oid := ext.Id.String()
+		switch {
+		case !wellFormedOID(ext.Id):
+			problems = append(problems, fmt.Sprintf("Extension %d has an invalid OID [%s]", i, oid))
+			continue
+		case ext.Id.Equal(subjectAltNameOID):
+			problems = append(problems, "Subject alternative names must be set with Hosts, not as an extension")
+		case ext.Id.Equal(CertAttributesOID):
+			problems = append(problems, fmt.Sprintf("Extension %s is reserved for the attributes set by the CA", oid))
+		case seen[oid]:
+			problems = append(problems, fmt.Sprintf("Extension %s is set more than once", oid))
+		}
+		if len(ext.Value) == 0 {
+			problems = append(problems, fmt.Sprintf("Extension %s has an empty value", oid))
+		}
+		seen[oid] = true
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// isCountryCode returns true for codes made of two ASCII letters
+func isCountryCode(country string) bool {
+	if len(country) != 2 {
+		return false
+	}
+	for _, c := range country {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// wellFormedOID returns true for OIDs of at least two non-negative arcs, the
+// first one being 0, 1 or 2 and the second one lower than 40 unless the
+// first one is 2, as required by their DER encoding
+func wellFormedOID(oid asn1.ObjectIdentifier) bool {
+	if len(oid) < 2 || oid[0] < 0 || oid[0] > 2 || (oid[0] < 2 && (oid[1] >= 40)) {
+		return false
+	}
+	for _, arc := range oid[1:] {
+		if arc < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WithConfigDir sets the directory the fabric-ca client config generated from
+// the SDK config is written to, the default temporary directory by default
+func WithConfigDir(dir string) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.configDir = dir
+	}
+}
+
+// WithRetainedConfig keeps the generated fabric-ca client config, whose path
+// is logged, for debugging. It is removed once the Services are created by
+// default
+func WithRetainedConfig() Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.retainConfig = true
+	}
+}
+
+// WithInsecure allows the CA URL to be http, for local development against a
+// CA serving plain HTTP: requests and enrollment secrets are then sent in
+// clear, and the CA is not authenticated. It must never be used in
+// production. Without it, creating the Services fails for http CA URLs. The
+// TLS settings still apply to https CA URLs
+func WithInsecure() Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.insecure = true
+	}
+}
+
+// WithDefaultTimeout bounds the operations of the methods taking no context,
+// like Enroll or GetIdentity, which then fail with errors matching
+// context.DeadlineExceeded with errors.Is once d has elapsed. The methods
+// taking a context, like EnrollContext, are only bounded by it. Each
+// registration of RegisterBatch is bounded separately. Operations are not
+// bounded by default, or when d is not positive
+func WithDefaultTimeout(d time.Duration) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.defaultTimeout = d
+	}
+}
+
+// WithServerCAName sets the CA of a fabric-ca server hosting several CAs that
+// GetCAInfo, Ping, Reenroll and EnrollIdemix are sent to, and the enrollment,
+// registration, revocation and CRL requests leaving their CAName empty. The
+// default CA of the server by default. GetCACertPool, VerifySecret and
+// CRLCache then rely on the information of that CA. The TLS CA, see
+// GetTLSCACerts, is reached without it
+func WithServerCAName(name string) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.serverCAName = name
+	}
+}
+
+// requestCAName returns the CA of the server a request for caName is sent
+// to, the CA set with WithServerCAName when caName is empty
+func (fabricCAServices *services) requestCAName(caName string) string {
+	if caName == "" {
+		return fabricCAServices.serverCAName
+	}
+	return caName
+}
+
+// defaultContext returns the context of the operations of the methods taking
+// no context, bounded by the default timeout
+func (fabricCAServices *services) defaultContext() (context.Context, context.CancelFunc) {
+	if fabricCAServices.defaultTimeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), fabricCAServices.defaultTimeout)
 }
 
 // NewFabricCAClient ...
 /**
  * @param {string} clientConfigFile for fabric-ca services"
+ * @param {...Option} opts configuring the services, like WithRetryPolicy or WithLogger
+ */
+func NewFabricCAClient(opts ...Option) (Services, error) {
+	return newFabricCAClient("", opts...)
+}
+
+// NewFabricCAClientForCA ...
+/**
+ * @param {string} caName The name of the fabric-ca server in the configuration,
+ * configured under client.fabricCAs.<caName>
+ * @param {...Option} opts configuring the services, like WithRetryPolicy or WithLogger
  */
-func NewFabricCAClient() (Services, error) {
-	configPath, err := config.GetFabricCAClientPath()
+func NewFabricCAClientForCA(caName string, opts ...Option) (Services, error) {
+	if caName == "" {
+		return nil, fmt.Errorf("caName is empty")
+	}
+	return newFabricCAClient(caName, opts...)
+}
+
+// NewFabricCAClientForOrg ...
+/**
+ * @param {string} orgName The name of the organization in the configuration,
+ * configured under client.organizations.<orgName>, whose fabric-ca server
+ * the services are created for
+ * @param {...Option} opts configuring the services, like WithRetryPolicy or WithLogger
+ */
+func NewFabricCAClientForOrg(orgName string, opts ...Option) (Services, error) {
+	orgConf, err := config.GetCAConfigForOrg(orgName)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up fabric-ca configurations: %s", err.Error())
+	}
+	return newFabricCAClient(orgConf.CAName, opts...)
+}
+
+// newFabricCAClient creates the Services of the fabric-ca server named caName,
+// the default server when caName is empty
+func newFabricCAClient(caName string, opts ...Option) (Services, error) {
+	if config.IsConfigValidationEnabled() {
+		if err := config.Validate(); err != nil {
+			return nil, fmt.Errorf("New fabricCAClient failed: %w", err)
+		}
+	}
+	tlsCAName, err := config.GetFabricCATLSCA(caName)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up fabric-ca configurations: %s", err.Error())
+	}
+	fabricCAClient, err := newServices(caName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCAName != "" {
+		// The TLS CA is reached with the same options, its own TLS CA is
+		// not resolved
+		if fabricCAClient.tlsCA, err = newServices(tlsCAName, opts...); err != nil {
+			return nil, err
+		}
+		fabricCAClient.tlsCA.serverCAName = ""
+	}
+	return withHooks(fabricCAClient), nil
+}
+
+// newServices creates the services of the fabric-ca server named caName,
+// without its TLS CA
+func newServices(caName string, opts ...Option) (*services, error) {
+	fabricCAClient := &services{logger: defaultLogger, metrics: nopMetrics{}, tracer: nopTracer{},
+		clockSkewTolerance: DefaultClockSkewTolerance, maxListResults: DefaultMaxListResults}
+	for _, opt := range opts {
+		opt(fabricCAClient)
+	}
+	configPath, err := config.WriteFabricCAClientConfig(caName, fabricCAClient.configDir)
 	if err != nil {
 		return nil, fmt.Errorf("error setting up fabric-ca configurations: %s", err.Error())
 	}
-	//Remove temporary config file after setup
-	defer os.Remove(configPath)
+	if fabricCAClient.retainConfig {
+		fabricCAClient.logger.Infof("Retaining fabric-ca client config %s", configPath)
+	} else {
+		//Remove temporary config file after setup
+		defer os.Remove(configPath)
+	}
 	// Create new Fabric-ca client with configs
 	c, err := fabric_ca.NewClient(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("New fabricCAClient failed: %s", err)
 	}
+	// Route requests to the server resolved from config
+	serverURL, err := config.GetFabricCAServerURL(caName)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up fabric-ca configurations: %s", err.Error())
+	}
+	if serverURL != "" {
+		c.Config.URL = serverURL
+	}
+	tlsConfig, err := config.GetFabricCATLSConfig(caName)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up fabric-ca configurations: %s", err.Error())
+	}
+	if c.Config.TLS, err = newClientTLSConfig(tlsConfig); err != nil {
+		return nil, fmt.Errorf("error setting up fabric-ca configurations: %s", err.Error())
+	}
+	var pinnedSHA256 [][]byte
+	for _, pin := range tlsConfig.PinnedSHA256 {
+		fingerprint, err := config.ParseSHA256Fingerprint(pin)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up fabric-ca configurations: %s", err.Error())
+		}
+		pinnedSHA256 = append(pinnedSHA256, fingerprint)
+	}
+	if len(pinnedSHA256) > 0 && !tlsConfig.Enabled {
+		return nil, fmt.Errorf("error setting up fabric-ca configurations: pinnedSHA256 requires an https serverURL")
+	}
+	if !tlsConfig.Enabled {
+		if !fabricCAClient.insecure {
+			return nil, fmt.Errorf("error setting up fabric-ca configurations: CA URL %s is http but TLS is "+
+				"required, use an https serverURL or WithInsecure for local development", c.Config.URL)
+		}
+		fabricCAClient.logger.Warnf("TLS is disabled for CA URL %s: requests and secrets are sent in clear "+
+			"to an unauthenticated CA, WithInsecure must never be used in production", c.Config.URL)
+	}
+	if fabricCAClient.customClient != nil && (len(c.Config.TLS.CertFilesList) > 0 ||
+		c.Config.TLS.Client.CertFile != "" || tlsConfig.ServerNameOverride != "" || len(pinnedSHA256) > 0) {
+		return nil, fmt.Errorf("error setting up fabric-ca configurations: " +
+			"the TLS settings of the CA config are not applied to a custom HTTP client, use WithRoundTripper")
+	}
+	connection, err := config.GetFabricCAConnectionConfig(caName)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up fabric-ca configurations: %s", err.Error())
+	}
+	if caName == "" {
+		caName = config.GetFabricCAID()
+	}
 
-	fabricCAClient := &services{fabricCAClient: c}
-	logger.Infof("Constructed fabricCAClient instance: %v", fabricCAClient)
+	fabricCAClient.fabricCAClient = c
+	fabricCAClient.caName = caName
+	fabricCAClient.identityTypes = config.GetFabricCAIdentityTypes()
+	fabricCAClient.defaultType, fabricCAClient.defaultAffiliation = config.GetFabricCARegistrationDefaults(caName)
+	fabricCAClient.hsm = config.GetSecurityProvider() == PKCS11Provider
+	if fabricCAClient.hsm {
+		fabricCAClient.tokenLabel = config.GetSecurityProviderLabel()
+	}
+	if fabricCAClient.csp, err = InitCryptoSuite(); err != nil {
+		return nil, fmt.Errorf("error setting up BCCSP: %w", err)
+	}
+	fabricCAClient.serverNameOverride = tlsConfig.ServerNameOverride
+	fabricCAClient.pinnedSHA256 = pinnedSHA256
+	fabricCAClient.connection = *connection
+	fabricCAClient.logger.Debugf("Constructed fabricCAClient instance: %s", redact(fabricCAClient))
 
 	return fabricCAClient, nil
 }
 
+// newClientTLSConfig converts the TLS configuration of a fabric-ca server to
+// the fabric-ca client one. Relative paths are made absolute against the
+// working directory, as the fabric-ca client would resolve them against its
+// home directory
+func newClientTLSConfig(tlsConfig *config.FabricCATLSConfig) (tls.ClientTLSConfig, error) {
+	clientTLSConfig := tls.ClientTLSConfig{Enabled: tlsConfig.Enabled}
+	for _, certFile := range tlsConfig.CertFiles {
+		certFile, err := filepath.Abs(certFile)
+		if err != nil {
+			return clientTLSConfig, err
+		}
+		clientTLSConfig.CertFilesList = append(clientTLSConfig.CertFilesList, certFile)
+	}
+	var err error
+	if tlsConfig.ClientKeyFile != "" {
+		if clientTLSConfig.Client.KeyFile, err = filepath.Abs(tlsConfig.ClientKeyFile); err != nil {
+			return clientTLSConfig, err
+		}
+		if clientTLSConfig.Client.CertFile, err = filepath.Abs(tlsConfig.ClientCertFile); err != nil {
+			return clientTLSConfig, err
+		}
+	}
+	return clientTLSConfig, nil
+}
+
+// Close releases the idle connections to the CA and its TLS CA. The
+// temporary fabric-ca client config is already removed once the Services are
+// created. Methods sending requests to the CA fail with ErrClosed once closed
+// @returns {error} Error
+func (fabricCAServices *services) Close() error {
+	fabricCAServices.mu.Lock()
+	defer fabricCAServices.mu.Unlock()
+	if fabricCAServices.closed {
+		return nil
+	}
+	fabricCAServices.closed = true
+	if fabricCAServices.client != nil {
+		fabricCAServices.client.CloseIdleConnections()
+		fabricCAServices.client = nil
+		fabricCAServices.baseTransport = nil
+	}
+	if fabricCAServices.tlsCA != nil {
+		return fabricCAServices.tlsCA.Close()
+	}
+	return nil
+}
+
+// checkOpen returns ErrClosed once the Services are closed
+func (fabricCAServices *services) checkOpen() error {
+	fabricCAServices.mu.Lock()
+	defer fabricCAServices.mu.Unlock()
+	if fabricCAServices.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// CAName returns the name of the fabric-ca server requests are sent to
+func (fabricCAServices *services) CAName() string {
+	return fabricCAServices.caName
+}
+
 // Enroll ...
+//
+// Deprecated: Enroll returns the private key first and the certificate
+// second, which are easily swapped at call sites. Use EnrollV2, whose
+// Enrollment names them, or EnrollIdentity
 /**
- * Enroll a registered user in order to receive a signed X509 certificate
+ * Enroll a registered user in order to receive a signed X509 certificate.
+ * The private key is returned first and the certificate second, both PEM
+ * encoded, as the Key and Cert of the Enrollment returned by EnrollV2
  * @param {string} enrollmentID The registered ID to use for enrollment
  * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @returns {[]byte} private key, nil when keys are kept in an HSM
  * @returns {[]byte} X509 certificate
- * @returns {[]byte} private key
  */
 func (fabricCAServices *services) Enroll(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error) {
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	return fabricCAServices.EnrollContext(ctx, enrollmentID, enrollmentSecret)
+}
+
+// EnrollContext ...
+/**
+ * Enroll a registered user in order to receive a signed X509 certificate.
+ * The private key is returned first and the certificate second, like Enroll
+ * @param {Context} ctx Context bounding the request to the CA
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @returns {[]byte} private key, nil when keys are kept in an HSM
+ * @returns {[]byte} X509 certificate
+ */
+func (fabricCAServices *services) EnrollContext(ctx context.Context, enrollmentID string,
+	enrollmentSecret string) ([]byte, []byte, error) {
+	enrollment, err := fabricCAServices.enrollContext(ctx, enrollmentID, enrollmentSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enrollment.Key, enrollment.Cert, nil
+}
+
+// enrollContext enrolls a registered user in a span. Enroll, EnrollContext
+// and EnrollV2 all return its Enrollment, or its Key and Cert in that order,
+// so that the order of the two-return forms cannot diverge
+func (fabricCAServices *services) enrollContext(ctx context.Context, enrollmentID string,
+	enrollmentSecret string) (*Enrollment, error) {
+	ctx, span := fabricCAServices.startSpan(ctx, "enroll")
+	enrollment, err := fabricCAServices.enroll(ctx, enrollmentID, enrollmentSecret)
+	endSpan(span, err)
+	return enrollment, err
+}
+
+// enroll enrolls a registered user, see EnrollContext
+func (fabricCAServices *services) enroll(ctx context.Context, enrollmentID string,
+	enrollmentSecret string) (*Enrollment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if enrollmentID == "" {
+		return nil, fmt.Errorf("enrollmentID is empty")
+	}
+	if enrollmentSecret == "" {
+		return nil, fmt.Errorf("enrollmentSecret is empty")
+	}
+	// Generate the key and CSR
+	csrPEM, key, err := fabricCAServices.generateCSR(newCertificateRequest(enrollmentID,
+		&EnrollmentOptions{}), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Enroll failed: %w", err)
+	}
+	req := &enrollmentRequest{SignRequest: signer.SignRequest{Request: string(csrPEM)}}
+	cert, err := fabricCAServices.postEnrollment(ctx, "enroll", enrollmentID, enrollmentSecret, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("Enroll failed: %w", err)
+	}
+	enrollment, err := newEnrollment(key, cert)
+	if err != nil {
+		return nil, fmt.Errorf("Enroll failed: %w", err)
+	}
+	enrollment.NotYetValid = fabricCAServices.notYetValid(cert)
+	return enrollment, nil
+}
+
+// EnrollWithOptions ...
+/**
+ * Enroll a registered user using a customized certificate signing request
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @param {EnrollmentOptions} opts CSR customization, nil behaves like Enroll
+ * @returns {[]byte} private key, nil when keys are kept in an HSM or by the
+ * CSRSigner of opts
+ * @returns {[]byte} X509 certificate, a warning is logged when it is not yet
+ * valid, see CertNotYetValid
+ */
+func (fabricCAServices *services) EnrollWithOptions(enrollmentID string, enrollmentSecret string,
+	opts *EnrollmentOptions) ([]byte, []byte, error) {
+	if opts == nil {
+		return fabricCAServices.Enroll(enrollmentID, enrollmentSecret)
+	}
 	if enrollmentID == "" {
 		return nil, nil, fmt.Errorf("enrollmentID is empty")
 	}
 	if enrollmentSecret == "" {
 		return nil, nil, fmt.Errorf("enrollmentSecret is empty")
 	}
-	req := &api.EnrollmentRequest{
-		Name:   enrollmentID,
-		Secret: enrollmentSecret,
+	for i, host := range opts.Hosts {
+		if host == "" {
+			return nil, nil, fmt.Errorf("Invalid host at index %d: host cannot be empty", i)
+		}
+	}
+	for _, attrReq := range opts.AttrReqs {
+		if attrReq.Name == "" {
+			return nil, nil, fmt.Errorf("Attribute request name cannot be empty")
+		}
+	}
+	if opts.KeyRequest != nil {
+		if opts.CSRSigner != nil {
+			return nil, nil, fmt.Errorf("KeyRequest cannot be set with a CSRSigner, which holds the key")
+		}
+		if err := fabricCAServices.validateKeyRequest(opts.KeyRequest); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := validateExtensions(opts.Extensions); err != nil {
+		return nil, nil, err
+	}
+	if opts.Subject != nil && opts.Subject.Country != "" && !isCountryCode(opts.Subject.Country) {
+		return nil, nil, &ValidationError{Problems: []string{fmt.Sprintf(
+			"Invalid subject country %s: it must be a two-letter ISO 3166 code", opts.Subject.Country)}}
 	}
-	id, err := fabricCAServices.fabricCAClient.Enroll(req)
+	var csrPEM, key []byte
+	var label string
+	var err error
+	if opts.CSRSigner != nil {
+		// The key is held by the signer
+		if err := fabricCAServices.checkOpen(); err != nil {
+			return nil, nil, err
+		}
+		csrPEM, err = signCSR(opts.CSRSigner, newCertificateRequest(enrollmentID, opts), opts.Extensions)
+	} else {
+		if label, err = fabricCAServices.enrollmentLabel(opts.Label); err != nil {
+			return nil, nil, err
+		}
+		// Generate the key and CSR
+		csrPEM, key, err = fabricCAServices.generateCSR(newCertificateRequest(enrollmentID, opts),
+			opts.Extensions)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error generating CSR: %w", err)
+	}
+	req := &enrollmentRequest{
+		SignRequest: signer.SignRequest{
+			Hosts:   opts.Hosts,
+			Request: string(csrPEM),
+			Profile: opts.Profile,
+			Label:   label,
+		},
+		AttrReqs: opts.AttrReqs,
+		CAName:   opts.CAName,
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	cert, err := fabricCAServices.postEnrollment(ctx, "enroll", enrollmentID,
+		enrollmentSecret, req)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Enroll failed: %s", err)
+		if len(opts.AttrReqs) > 0 && strings.Contains(serverErrorMessage(err), "attribute") {
+			return nil, nil, wrapError(err, "Enroll failed: attribute request rejected by CA: %s",
+				serverErrorMessage(err))
+		}
+		return nil, nil, fmt.Errorf("Enroll failed: %w", err)
 	}
-	return id.GetECert().Key(), id.GetECert().Cert(), nil
+	return key, cert, nil
+}
+
+// EnrollTLS ...
+/**
+ * Enroll a registered user in order to receive a TLS certificate issued
+ * with the CA's tls profile
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @returns {[]byte} TLS private key
+ * @returns {[]byte} TLS X509 certificate
+ */
+func (fabricCAServices *services) EnrollTLS(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error) {
+	return fabricCAServices.EnrollWithOptions(enrollmentID, enrollmentSecret,
+		&EnrollmentOptions{Profile: TLSProfile, Label: fabricCAServices.tokenLabel})
+}
+
+// EnrollWithCSR ...
+/**
+ * Enroll a registered user with a CSR generated by the caller, who keeps the
+ * private key. The common name of the CSR must be the enrollment ID
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @param {[]byte} csrPEM The PEM encoded certificate signing request
+ * @returns {[]byte} X509 certificate
+ */
+func (fabricCAServices *services) EnrollWithCSR(enrollmentID string, enrollmentSecret string,
+	csrPEM []byte) ([]byte, error) {
+	if enrollmentID == "" {
+		return nil, fmt.Errorf("enrollmentID is empty")
+	}
+	if enrollmentSecret == "" {
+		return nil, fmt.Errorf("enrollmentSecret is empty")
+	}
+	if err := checkCSR(enrollmentID, csrPEM); err != nil {
+		return nil, fmt.Errorf("Enroll failed: %w", err)
+	}
+	req := &enrollmentRequest{SignRequest: signer.SignRequest{Request: string(csrPEM)}}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	cert, err := fabricCAServices.postEnrollment(ctx, "enroll", enrollmentID,
+		enrollmentSecret, req)
+	if err != nil {
+		return nil, fmt.Errorf("Enroll failed: %w", err)
+	}
+	return cert, nil
+}
+
+// checkCSR checks that a PEM encoded CSR is signed by its key and requests a
+// certificate for enrollmentID
+func checkCSR(enrollmentID string, csrPEM []byte) error {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return &ValidationError{Problems: []string{"CSR is not a PEM encoded certificate request"}}
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return &ValidationError{Problems: []string{fmt.Sprintf("Error parsing CSR: %s", err)}}
+	}
+	if err := request.CheckSignature(); err != nil {
+		return &ValidationError{Problems: []string{fmt.Sprintf("Invalid CSR signature: %s", err)}}
+	}
+	if request.Subject.CommonName != enrollmentID {
+		return &ValidationError{Problems: []string{fmt.Sprintf(
+			"CSR common name %s does not match enrollment ID %s", request.Subject.CommonName, enrollmentID)}}
+	}
+	return nil
+}
+
+// EnrollV2 ...
+/**
+ * Enroll a registered user in order to receive a signed X509 certificate,
+ * parsed to expose its serial number and validity
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @returns {Enrollment} the private key and certificate
+ */
+func (fabricCAServices *services) EnrollV2(enrollmentID string, enrollmentSecret string) (*Enrollment, error) {
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	return fabricCAServices.enrollContext(ctx, enrollmentID, enrollmentSecret)
+}
+
+// EnrollIdentity ...
+/**
+ * Enroll a registered user and bind the issued certificate, its private key
+ * and the MSP ID of the organization in an Identity, as needed to act as a
+ * member of the organization, e.g. as a fabric-client User
+ * @param {string} mspID The MSP ID of the organization of the user
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @returns {Identity} the MSP ID, certificate and private key
+ */
+func (fabricCAServices *services) EnrollIdentity(mspID string, enrollmentID string,
+	enrollmentSecret string) (*Identity, error) {
+	if mspID == "" {
+		return nil, fmt.Errorf("MSP ID is empty")
+	}
+	enrollment, err := fabricCAServices.EnrollV2(enrollmentID, enrollmentSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{MSPID: mspID, Cert: enrollment.Cert, Key: enrollment.Key,
+		NotYetValid: enrollment.NotYetValid}, nil
+}
+
+// newEnrollment creates the Enrollment of an issued certificate
+func newEnrollment(key []byte, cert []byte) (*Enrollment, error) {
+	x509Cert, err := fabric_ca.BytesToX509Cert(cert)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing the enrollment certificate: %s", err)
+	}
+	return &Enrollment{
+		Key:       key,
+		Cert:      cert,
+		Serial:    hex.EncodeToString(x509Cert.SerialNumber.Bytes()),
+		NotBefore: x509Cert.NotBefore,
+		NotAfter:  x509Cert.NotAfter,
+	}, nil
+}
+
+// decodeCRL decodes a base64 encoded CRL sent by the CA into DER
+func decodeCRL(encoded string) ([]byte, error) {
+	crl, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding CRL: %s", err.Error())
+	}
+	// The CA sends the CRL PEM encoded
+	if block, _ := pem.Decode(crl); block != nil {
+		return block.Bytes, nil
+	}
+	return crl, nil
+}
+
+// optionalTime returns nil for the zero time so it's omitted from requests
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// newCertificateRequest creates the CSR information for an enrollment
+func newCertificateRequest(enrollmentID string, opts *EnrollmentOptions) *csr.CertificateRequest {
+	cr := csr.New()
+	cr.CN = enrollmentID
+	if opts.CN != "" {
+		cr.CN = opts.CN
+	}
+	if len(opts.Hosts) > 0 {
+		cr.Hosts = opts.Hosts
+	} else if hostname, _ := os.Hostname(); hostname != "" {
+		// Default requested hosts are local hostname
+		cr.Hosts = []string{hostname}
+	}
+	if opts.KeyRequest != nil {
+		cr.KeyRequest = &csr.BasicKeyRequest{A: opts.KeyRequest.Algo, S: opts.KeyRequest.Size}
+	}
+	if subject := opts.Subject; subject != nil {
+		cr.Names = []csr.Name{{
+			C:  subject.Country,
+			ST: subject.Province,
+			L:  subject.Locality,
+			O:  subject.Organization,
+			OU: subject.OrganizationalUnit,
+		}}
+	}
+	return cr
+}
+
+// Reenroll an enrolled user in order to receive a new signed X509 certificate
+// @param {User} user The enrolled User whose certificate is renewed
+// @returns {[]byte} private key, nil when keys are kept in an HSM
+// @returns {[]byte} X509 certificate, a warning is logged when it is not yet
+// valid, see CertNotYetValid
+// @returns {error} Error
+func (fabricCAServices *services) Reenroll(user fabricclient.User) ([]byte, []byte, error) {
+	if user == nil {
+		return nil, nil, fmt.Errorf("User cannot be nil")
+	}
+	if user.GetName() == "" {
+		return nil, nil, fmt.Errorf("User is not enrolled")
+	}
+	// The CA answers an expired certificate with a generic authorization
+	// failure, so check the validity period locally first
+	cert, err := fabric_ca.BytesToX509Cert(user.GetEnrollmentCertificate())
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing enrollment certificate: %s", err.Error())
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, nil, fmt.Errorf("Enrollment certificate for %s expired on %s, enroll again instead",
+			user.GetName(), cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	// Create request signing identity
+	identity, err := fabricCAServices.createSigningIdentity(user)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	// Generate a new key and CSR
+	csrPEM, key, err := fabricCAServices.generateCSR(newCertificateRequest(identity.name,
+		&EnrollmentOptions{}), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Reenroll failed: %w", err)
+	}
+	body, err := util.Marshal(&enrollmentRequest{SignRequest: signer.SignRequest{Request: string(csrPEM)},
+		CAName: fabricCAServices.serverCAName}, "SignRequest")
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	result, err := fabricCAServices.send(ctx, identity, "POST", "reenroll", body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Reenroll failed: %w", err)
+	}
+	reenrolledCert, err := decodeCertificate(result)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Reenroll failed: %w", err)
+	}
+	fabricCAServices.warnIfNotYetValid(user.GetName(), reenrolledCert)
+	return key, reenrolledCert, nil
+}
+
+// GetCAInfo returns the name, certificate chain and version of the CA.
+// No enrolled user is required since this is an unauthenticated request
+// @returns {CAInfo} CA information
+// @returns {error} Error
+func (fabricCAServices *services) GetCAInfo() (*CAInfo, error) {
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	return fabricCAServices.getCAInfo(ctx)
+}
+
+// getCAInfo requests the information of the CA until ctx is done
+func (fabricCAServices *services) getCAInfo(ctx context.Context) (*CAInfo, error) {
+	body, err := util.Marshal(map[string]string{"caname": fabricCAServices.serverCAName}, "GetCAInfoRequest")
+	if err != nil {
+		return nil, err
+	}
+	post, err := fabricCAServices.fabricCAClient.NewPost("cainfo", body)
+	if err != nil {
+		return nil, err
+	}
+	result, err := fabricCAServices.sendPost(ctx, post)
+	if err != nil {
+		return nil, fmt.Errorf("GetCAInfo failed: %w", err)
+	}
+	// The chain and keys are sent base64 encoded
+	var response struct {
+		CAName                    string
+		CAChain                   string
+		Version                   string
+		IssuerPublicKey           string
+		IssuerRevocationPublicKey string
+	}
+	if err := decodeResult(result, &response); err != nil {
+		return nil, err
+	}
+	chain, err := base64.StdEncoding.DecodeString(response.CAChain)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding CA chain: %s", err.Error())
+	}
+	issuerPublicKey, err := base64.StdEncoding.DecodeString(response.IssuerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Idemix issuer public key: %s", err.Error())
+	}
+	revocationPublicKey, err := base64.StdEncoding.DecodeString(response.IssuerRevocationPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Idemix issuer revocation public key: %s", err.Error())
+	}
+	return &CAInfo{CAName: response.CAName, CAChain: chain, Version: response.Version,
+		IssuerPublicKey: issuerPublicKey, IssuerRevocationPublicKey: revocationPublicKey}, nil
+}
+
+// GetCACertPool returns a pool of the certificates of the CA chain, to
+// verify TLS certificates issued by the CA. The chain is rejected unless each
+// certificate is signed by the next one and the last one is a self-signed root
+// @param {context.Context} ctx bounding the request
+// @returns {x509.CertPool} The verified CA chain
+// @returns {error} Error
+func (fabricCAServices *services) GetCACertPool(ctx context.Context) (*x509.CertPool, error) {
+	info, err := fabricCAServices.getCAInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := verifyCAChain(info.CAChain)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range chain {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// GetTLSCACerts returns the certificate chain of the TLS CA configured with
+// tlsCA, the CA issuing the TLS certificates of peers and orderers, which is
+// a different trust domain than the chain of GetCAInfo. The chain is verified
+// as by GetCACertPool
+// @param {context.Context} ctx bounding the request
+// @returns {[][]byte} The PEM encoded certificates of the chain, starting with
+// the TLS CA's own certificate
+// @returns {error} Error
+func (fabricCAServices *services) GetTLSCACerts(ctx context.Context) ([][]byte, error) {
+	if fabricCAServices.tlsCA == nil {
+		return nil, fmt.Errorf("GetTLSCACerts failed: no TLS CA is configured for CA %s", fabricCAServices.caName)
+	}
+	info, err := fabricCAServices.tlsCA.getCAInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GetTLSCACerts failed: %w", err)
+	}
+	chain, err := verifyCAChain(info.CAChain)
+	if err != nil {
+		return nil, fmt.Errorf("GetTLSCACerts failed: %w", err)
+	}
+	certs := make([][]byte, 0, len(chain))
+	for _, cert := range chain {
+		certs = append(certs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	return certs, nil
+}
+
+// verifyCAChain parses a PEM encoded CA chain, starting with the CA's own
+// certificate, and verifies that it links up to a self-signed root
+func verifyCAChain(chainPEM []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for rest := chainPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing certificate %d of the CA chain: %s", len(chain), err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("CA chain contains no certificate")
+	}
+	for i := 0; i < len(chain)-1; i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return nil, fmt.Errorf("Certificate %s of the CA chain is not signed by %s: %s",
+				chain[i].Subject.CommonName, chain[i+1].Subject.CommonName, err)
+		}
+	}
+	root := chain[len(chain)-1]
+	if !bytes.Equal(root.RawIssuer, root.RawSubject) || root.CheckSignatureFrom(root) != nil {
+		return nil, fmt.Errorf("CA chain does not end with a self-signed root, %s is issued by %s",
+			root.Subject.CommonName, root.Issuer.CommonName)
+	}
+	return chain, nil
+}
+
+// Ping checks that the CA is reachable and serving requests, with an
+// unauthenticated request for its information. Requests are not retried
+// @param {context.Context} ctx bounding the check
+// @returns {error} Error matching ErrCAUnreachable with errors.Is when the CA
+// cannot be reached before ctx is done, nil when the CA is reachable
+func (fabricCAServices *services) Ping(ctx context.Context) error {
+	body, err := util.Marshal(map[string]string{"caname": fabricCAServices.serverCAName}, "GetCAInfoRequest")
+	if err != nil {
+		return err
+	}
+	post, err := fabricCAServices.fabricCAClient.NewPost("cainfo", body)
+	if err != nil {
+		return err
+	}
+	if _, err := fabricCAServices.sendPost(ctx, post); err != nil {
+		return fmt.Errorf("Ping failed: %w", err)
+	}
+	return nil
+}
+
+// GenerateCRL generates a certificate revocation list with the Fabric CA
+// @param {User} registrar The User that is initiating the request, it must
+// have the hf.GenCRL attribute
+// @param {CRLRequest} request Optional time filters, may be nil
+// @returns {[]byte} DER encoded CRL
+// @returns {error} Error
+func (fabricCAServices *services) GenerateCRL(registrar fabricclient.User,
+	request *CRLRequest) ([]byte, error) {
+	if request == nil {
+		request = &CRLRequest{}
+	}
+	// Create request signing identity
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	var req struct {
+		RevokedAfter  *time.Time `json:"revokedafter,omitempty"`
+		RevokedBefore *time.Time `json:"revokedbefore,omitempty"`
+		ExpireAfter   *time.Time `json:"expireafter,omitempty"`
+		ExpireBefore  *time.Time `json:"expirebefore,omitempty"`
+		CAName        string     `json:"caname,omitempty"`
+	}
+	req.CAName = fabricCAServices.requestCAName(request.CAName)
+	req.RevokedAfter = optionalTime(request.RevokedAfter)
+	req.RevokedBefore = optionalTime(request.RevokedBefore)
+	req.ExpireAfter = optionalTime(request.ExpireAfter)
+	req.ExpireBefore = optionalTime(request.ExpireBefore)
+	body, err := util.Marshal(req, "GenCRLRequest")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	result, err := fabricCAServices.send(ctx, identity, "POST", "gencrl", body)
+	if err != nil {
+		if strings.Contains(err.Error(), "hf.GenCRL") {
+			return nil, wrapError(err, "Registrar %s is not authorized to generate a CRL: "+
+				"the hf.GenCRL attribute is required", registrar.GetName())
+		}
+		return nil, fmt.Errorf("GenerateCRL failed: %w", err)
+	}
+	var response struct {
+		CRL string
+	}
+	if err := decodeResult(result, &response); err != nil {
+		return nil, err
+	}
+	return decodeCRL(response.CRL)
 }
 
 // Register a User with the Fabric CA
@@ -134,39 +1545,318 @@ func (fabricCAServices *services) Enroll(enrollmentID string, enrollmentSecret s
 // @returns {error} Error
 func (fabricCAServices *services) Register(registrar fabricclient.User,
 	request *RegistrationRequest) (string, error) {
-	// Validate registration request
-	if request == nil {
-		return "", fmt.Errorf("Registration request cannot be nil")
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	return fabricCAServices.RegisterContext(ctx, registrar, request)
+}
+
+// RegisterContext registers a User with the Fabric CA
+// @param {Context} ctx Context bounding the request to the CA
+// @param {User} registrar The User that is initiating the registration
+// @param {RegistrationRequest} request Registration Request
+// @returns {string} Enrolment Secret
+// @returns {error} Error
+func (fabricCAServices *services) RegisterContext(ctx context.Context, registrar fabricclient.User,
+	request *RegistrationRequest) (string, error) {
+	ctx, span := fabricCAServices.startSpan(ctx, "register")
+	response, err := fabricCAServices.register(ctx, registrar, request)
+	endSpan(span, err)
+	if err != nil {
+		return "", err
+	}
+	return response.Secret, nil
+}
+
+// RegisterV2 registers a User with the Fabric CA and returns the whole
+// response of the CA
+// @param {User} registrar The User that is initiating the registration
+// @param {RegistrationRequest} request Registration Request
+// @returns {RegistrationResponse} Registration Response
+// @returns {error} Error
+func (fabricCAServices *services) RegisterV2(registrar fabricclient.User,
+	request *RegistrationRequest) (*RegistrationResponse, error) {
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	return fabricCAServices.register(ctx, registrar, request)
+}
+
+// RegisterResult is the result of one request of a RegisterBatch call
+type RegisterResult struct {
+	// Index of the request in the batch
+	Index int
+	// Secret is the enrollment secret of the registered identity
+	Secret string
+	// Err is the error the request failed with, nil on success
+	Err error
+}
+
+// RegisterBatch registers Users with the Fabric CA, continuing past the
+// requests which fail. The error of each request is reported in its result
+// @param {User} registrar The User that is initiating the registrations
+// @param {[]RegistrationRequest} requests Registration Requests
+// @returns {[]RegisterResult} A result per request, in the order of requests
+// @returns {error} Error preventing any registration, like an invalid registrar
+func (fabricCAServices *services) RegisterBatch(registrar fabricclient.User,
+	requests []*RegistrationRequest) ([]RegisterResult, error) {
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	results := make([]RegisterResult, len(requests))
+	for i, request := range requests {
+		results[i].Index = i
+		request, results[i].Err = fabricCAServices.checkRegistrationRequest(request)
+		if results[i].Err != nil {
+			continue
+		}
+		ctx, cancel := fabricCAServices.defaultContext()
+		response, err := fabricCAServices.sendRegistration(ctx, identity, request)
+		cancel()
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Secret = response.Secret
+	}
+	return results, nil
+}
+
+// register sends a registration request and decodes the response of the CA
+func (fabricCAServices *services) register(ctx context.Context, registrar fabricclient.User,
+	request *RegistrationRequest) (*RegistrationResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	request, err := fabricCAServices.checkRegistrationRequest(request)
+	if err != nil {
+		return nil, err
 	}
 	// Create request signing identity
-	identity, err := fabricCAServices.createSigningIdentity(registrar)
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
 	if err != nil {
-		return "", fmt.Errorf("Error creating signing identity: %s", err.Error())
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	return fabricCAServices.sendRegistration(ctx, identity, request)
+}
+
+// checkRegistrationRequest validates a registration request before it is
+// sent, returning a copy of it with the configured default type and
+// affiliation in place of the empty ones
+func (fabricCAServices *services) checkRegistrationRequest(
+	request *RegistrationRequest) (*RegistrationRequest, error) {
+	if request == nil {
+		return nil, fmt.Errorf("Registration request cannot be nil")
+	}
+	defaulted := *request
+	if defaulted.Type == "" {
+		defaulted.Type = fabricCAServices.defaultType
+	}
+	if defaulted.Affiliation == "" {
+		defaulted.Affiliation = fabricCAServices.defaultAffiliation
+	}
+	if err := validateRegistrationRequest(&defaulted, fabricCAServices.identityTypes); err != nil {
+		return nil, fmt.Errorf("Error Registering User: %w", err)
+	}
+	if defaulted.Secret != "" && isWeakSecret(defaulted.Secret) {
+		fabricCAServices.logger.Warnf("Registering %s with a weak secret: use at least %d characters "+
+			"mixing letters, digits and symbols", defaulted.Name, StrongSecretLength)
+	}
+	return &defaulted, nil
+}
+
+// sendRegistration sends a validated registration request signed by identity
+func (fabricCAServices *services) sendRegistration(ctx context.Context, identity *signingIdentity,
+	request *RegistrationRequest) (*RegistrationResponse, error) {
+	if err := identity.checkRegistrarAuthority(request); err != nil {
+		return nil, fmt.Errorf("Error Registering User: %w", err)
+	}
+	if request.DryRun {
+		response, err := fabricCAServices.previewRegistration(ctx, identity, request)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("Error Registering User: %w", err)
+		}
+		return response, nil
 	}
 	// Contruct request for Fabric CA client
-	var attributes []api.Attribute
-	for i, _ := range request.Attributes {
-		attributes = append(attributes, api.Attribute{Name: request.
-			Attributes[i].Key, Value: request.Attributes[i].Value})
-	}
-	var req = api.RegistrationRequest{
-		Name:           request.Name,
-		Type:           request.Type,
-		MaxEnrollments: request.MaxEnrollments,
-		Affiliation:    request.Affiliation,
-		Attributes:     attributes}
-	// Make registration request
-	response, err := identity.Register(&req)
-	if err != nil {
-		return "", fmt.Errorf("Error Registering User: %s", err.Error())
+	var req = struct {
+		api.RegistrationRequest
+		Attributes []caAttribute `json:"attrs,omitempty"`
+		CAName     string        `json:"caname,omitempty"`
+	}{
+		RegistrationRequest: api.RegistrationRequest{
+			Name:           request.Name,
+			Type:           request.Type,
+			MaxEnrollments: request.MaxEnrollments,
+			Affiliation:    request.Affiliation,
+			Secret:         request.Secret},
+		Attributes: toCAAttributes(request.Attributes),
+		CAName:     fabricCAServices.requestCAName(request.CAName),
+	}
+	body, err := util.Marshal(req, "RegistrationRequest")
+	if err != nil {
+		return nil, err
+	}
+	// Make registration request, only retried when not sent since the CA
+	// may have registered the identity of a failed request
+	var result interface{}
+	err = fabricCAServices.withRetryUnsent(ctx, func() error {
+		result, err = fabricCAServices.send(ctx, identity, "POST", "register", body)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if request.IfNotExists && errors.Is(err, ErrAlreadyRegistered) {
+			return fabricCAServices.existingRegistration(ctx, identity, request.Name), nil
+		}
+		return nil, fmt.Errorf("Error Registering User: %w", err)
+	}
+	return newRegistrationResponse(result)
+}
+
+// existingRegistration creates the response of an IfNotExists registration
+// request for an already registered identity, looked up on a best effort
+// basis since the CA may not provide it to the registrar
+func (fabricCAServices *services) existingRegistration(ctx context.Context, identity *signingIdentity,
+	name string) *RegistrationResponse {
+	response := &RegistrationResponse{AlreadyRegistered: true}
+	result, err := fabricCAServices.send(ctx, identity, "GET", "identities/"+url.PathEscape(name), nil)
+	if err != nil {
+		fabricCAServices.logger.Debugf("Failed to get already registered identity %s: %s", name, err)
+		return response
+	}
+	var info identityInfo
+	if err := decodeResult(result, &info); err != nil {
+		fabricCAServices.logger.Debugf("Failed to get already registered identity %s: %s", name, err)
+		return response
+	}
+	response.Existing = newIdentityResponse(info)
+	return response
+}
+
+// previewRegistration checks a DryRun registration request against the CA
+// without registering the identity: its affiliation must exist and it must
+// not be registered yet. Checks the CA does not support are skipped
+func (fabricCAServices *services) previewRegistration(ctx context.Context, identity *signingIdentity,
+	request *RegistrationRequest) (*RegistrationResponse, error) {
+	response := &RegistrationResponse{
+		Preview: &IdentityResponse{
+			Name:           request.Name,
+			Type:           request.Type,
+			Affiliation:    request.Affiliation,
+			MaxEnrollments: request.MaxEnrollments,
+			Attributes:     request.Attributes,
+		},
+		CAChecked: true,
+	}
+	var problems []string
+	_, err := fabricCAServices.send(ctx, identity, "GET", "affiliations/"+url.PathEscape(request.Affiliation), nil)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotFound):
+		problems = append(problems, fmt.Sprintf("Affiliation %s does not exist", request.Affiliation))
+	case isUnsupportedEndpoint(err):
+		response.CAChecked = false
+	default:
+		return nil, err
+	}
+	_, err = fabricCAServices.send(ctx, identity, "GET", "identities/"+url.PathEscape(request.Name), nil)
+	switch {
+	case err == nil && request.IfNotExists:
+		response.AlreadyRegistered = true
+	case err == nil:
+		problems = append(problems, fmt.Sprintf("Identity %s is already registered", request.Name))
+	case errors.Is(err, ErrNotFound):
+	case isUnsupportedEndpoint(err):
+		response.CAChecked = false
+	default:
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return response, nil
+}
+
+// validateRegistrationRequest checks the fields of a registration request and
+// returns a *ValidationError listing all of its problems. The type of the
+// identity must be one of identityTypes, DefaultIdentityTypes when empty
+func validateRegistrationRequest(request *RegistrationRequest, identityTypes []string) error {
+	if len(identityTypes) == 0 {
+		identityTypes = DefaultIdentityTypes
+	}
+	var problems []string
+	if request.Name == "" {
+		problems = append(problems, "Name is empty")
+	}
+	if request.Affiliation == "" {
+		problems = append(problems, "Affiliation is empty")
+	}
+	if request.Type != "" {
+		valid := false
+		for _, identityType := range identityTypes {
+			if request.Type == identityType {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			problems = append(problems, fmt.Sprintf("Type %s is not one of %s", request.Type,
+				strings.Join(identityTypes, ", ")))
+		}
+	}
+	if request.MaxEnrollments < EnrollmentsUnlimited {
+		problems = append(problems, fmt.Sprintf("MaxEnrollments must be %d or greater, got %d",
+			EnrollmentsUnlimited, request.MaxEnrollments))
+	}
+	if request.Secret != "" && len(request.Secret) < MinSecretLength {
+		problems = append(problems, fmt.Sprintf("Secret must be at least %d characters long", MinSecretLength))
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// newRegistrationResponse decodes the result of a registration request. Older
+// CA versions return the base64 encoded secret alone, newer ones return it in
+// plain text alongside other fields
+func newRegistrationResponse(result interface{}) (*RegistrationResponse, error) {
+	response := &RegistrationResponse{}
+	var encoded string
+	switch result := result.(type) {
+	case string:
+		encoded = result
+	case map[string]interface{}:
+		response.Metadata = make(map[string]interface{})
+		for key, value := range result {
+			switch key {
+			case "secret":
+				response.Secret, _ = value.(string)
+			case "credential":
+				encoded, _ = value.(string)
+			default:
+				response.Metadata[key] = value
+			}
+		}
+		if response.Secret != "" {
+			return response, nil
+		}
+	default:
+		return nil, fmt.Errorf("Error Registering User: invalid response format from server: %v", result)
 	}
 	// Decode enrolment secret
-	secret, err := base64.StdEncoding.DecodeString(response.Secret)
+	secret, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		return "", fmt.Errorf("Error decoding enrolment secret: %s", err.Error())
+		return nil, fmt.Errorf("Error decoding enrolment secret: %s", err.Error())
 	}
+	response.Secret = string(secret)
 
-	return string(secret), nil
+	return response, nil
 }
 
 // Revoke a User with the Fabric CA
@@ -174,45 +1864,208 @@ func (fabricCAServices *services) Register(registrar fabricclient.User,
 // @param {RevocationRequest} request Revocation Request
 // @returns {error} Error
 func (fabricCAServices *services) Revoke(registrar fabricclient.User,
+	request *RevocationRequest) error {
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	return fabricCAServices.RevokeContext(ctx, registrar, request)
+}
+
+// RevokeContext revokes a User with the Fabric CA
+// @param {Context} ctx Context bounding the request to the CA
+// @param {User} registrar The User that is initiating the revocation
+// @param {RevocationRequest} request Revocation Request
+// @returns {error} Error
+func (fabricCAServices *services) RevokeContext(ctx context.Context, registrar fabricclient.User,
 	request *RevocationRequest) error {
 	// Validate revocation request
 	if request == nil {
 		return fmt.Errorf("Revocation request cannot be nil")
 	}
+	req := *request
+	req.GenCRL = false
+	ctx, span := fabricCAServices.startSpan(ctx, "revoke")
+	_, err := fabricCAServices.revoke(ctx, registrar, &req)
+	endSpan(span, err)
+	return err
+}
+
+// RevokeWithCRL revokes a User with the Fabric CA and returns the CRL
+// generated right after the revocation when request.GenCRL is set
+// @param {User} registrar The User that is initiating the revocation
+// @param {RevocationRequest} request Revocation Request
+// @returns {[]byte} DER encoded CRL, nil unless GenCRL is set
+// @returns {error} Error
+func (fabricCAServices *services) RevokeWithCRL(registrar fabricclient.User,
+	request *RevocationRequest) ([]byte, error) {
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	return fabricCAServices.revoke(ctx, registrar, request)
+}
+
+// revoke sends a revocation request and decodes the CRL of the response
+func (fabricCAServices *services) revoke(ctx context.Context, registrar fabricclient.User,
+	request *RevocationRequest) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Validate revocation request
+	if request == nil {
+		return nil, fmt.Errorf("Revocation request cannot be nil")
+	}
+	reason, err := revocationReason(request)
+	if err != nil {
+		return nil, err
+	}
+	serial, aki, err := revocationTarget(request)
+	if err != nil {
+		return nil, err
+	}
 	// Create request signing identity
-	identity, err := fabricCAServices.createSigningIdentity(registrar)
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
 	if err != nil {
-		return fmt.Errorf("Error creating signing identity: %s", err.Error())
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	if request.RevokeNewestOnly {
+		serial, aki, err = fabricCAServices.newestCertificate(ctx, identity, request.Name)
+		if err != nil {
+			return nil, err
+		}
 	}
 	// Create revocation request
-	var req = api.RevocationRequest{
-		Name:   request.Name,
-		Serial: request.Serial,
-		AKI:    request.AKI,
-		Reason: request.Reason}
-	return identity.Revoke(&req)
+	var req = struct {
+		api.RevocationRequest
+		GenCRL bool   `json:"gencrl,omitempty"`
+		CAName string `json:"caname,omitempty"`
+	}{
+		RevocationRequest: api.RevocationRequest{
+			Name:   request.Name,
+			Serial: serial,
+			AKI:    aki,
+			Reason: int(reason)},
+		GenCRL: request.GenCRL,
+		CAName: fabricCAServices.requestCAName(request.CAName),
+	}
+	body, err := util.Marshal(req, "RevocationRequest")
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	attempt := 0
+	err = fabricCAServices.withRetry(ctx, func() error {
+		attempt++
+		result, err = fabricCAServices.send(ctx, identity, "POST", "revoke", body)
+		return err
+	})
+	// A retried revocation is already revoked when a previous attempt was
+	// applied by the CA before failing, the CRL of that attempt is lost and
+	// generated again
+	if err != nil && attempt > 1 && errors.Is(err, ErrAlreadyRevoked) {
+		fabricCAServices.logger.Debugf("Retried revocation was already applied: %s", err)
+		if !request.GenCRL {
+			return nil, nil
+		}
+		crlBody, err := util.Marshal(struct {
+			CAName string `json:"caname,omitempty"`
+		}{req.CAName}, "GenCRLRequest")
+		if err != nil {
+			return nil, err
+		}
+		result, err = fabricCAServices.send(ctx, identity, "POST", "gencrl", crlBody)
+		if err != nil {
+			return nil, fmt.Errorf("Revocation was applied, generating the CRL failed: %w", err)
+		}
+	} else if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if !request.GenCRL {
+		return nil, nil
+	}
+	var response struct {
+		CRL string
+	}
+	if err := decodeResult(result, &response); err != nil {
+		return nil, err
+	}
+	return decodeCRL(response.CRL)
 }
 
-// createSigningIdentity creates an identity to sign Fabric CA requests with
+// createSigningIdentity creates an identity to sign Fabric CA requests with.
+// The private key of the user signs requests directly, only keys which are not
+// private are looked up by SKI in the default BCCSP implementation
 func (fabricCAServices *services) createSigningIdentity(user fabricclient.
-	User) (*fabric_ca.Identity, error) {
+	User) (*signingIdentity, error) {
+	if err := fabricCAServices.checkOpen(); err != nil {
+		return nil, err
+	}
+	// Validate user
+	if user == nil {
+		return nil, fmt.Errorf("Valid user required to create signing identity")
+	}
+	var key bccsp.Key
+	if userKey := user.GetPrivateKey(); userKey != nil && userKey.Private() {
+		key = userKey
+	}
+	return fabricCAServices.createSigningIdentityWithKey(user, key)
+}
+
+// createSigningIdentityWithKey creates an identity to sign Fabric CA requests
+// with the given key, which is never exported from its BCCSP provider. When key
+// is nil the private key is looked up in the BCCSP implementation, like an HSM,
+// using the SKI of the user's key, or of the enrollment certificate when the
+// user has no key
+func (fabricCAServices *services) createSigningIdentityWithKey(user fabricclient.User,
+	key bccsp.Key) (*signingIdentity, error) {
 	// Validate user
 	if user == nil {
 		return nil, fmt.Errorf("Valid user required to create signing identity")
 	}
 	// Validate enrolment information
 	cert := user.GetEnrollmentCertificate()
-	key := user.GetPrivateKey()
-	if key == nil || cert == nil {
+	userKey := user.GetPrivateKey()
+	if cert == nil || (key == nil && userKey == nil && !fabricCAServices.hsm) {
 		return nil, fmt.Errorf(
 			"Unable to read user enrolment information to create signing identity")
 	}
-	// TODO: Right now this reads the key from a default BCCSP implementation using the SKI
-	// this method signature will change to accepting a BCCSP key soon.
-	// Track changes here: https://gerrit.hyperledger.org/r/#/c/6727/
-	ski := key.SKI()
-	if ski == nil {
-		return nil, fmt.Errorf("Unable to read private key SKI")
+	csp := fabricCAServices.cryptoSuite()
+	if key == nil {
+		var ski []byte
+		if userKey != nil {
+			ski = userKey.SKI()
+		} else {
+			x509Cert, err := fabric_ca.BytesToX509Cert(cert)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing enrollment certificate: %s", err)
+			}
+			publicKey, err := csp.KeyImport(x509Cert, &bccsp.X509PublicKeyImportOpts{Temporary: true})
+			if err != nil {
+				return nil, fmt.Errorf("Error importing enrollment certificate public key: %s", err)
+			}
+			ski = publicKey.SKI()
+		}
+		if ski == nil {
+			return nil, fmt.Errorf("Unable to read private key SKI")
+		}
+		var err error
+		key, err = csp.GetKey(ski)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get private key from SKI: %s", err)
+		}
+	}
+	name, err := util.GetEnrollmentIDFromPEM(cert)
+	if err != nil {
+		return nil, err
+	}
+	// Requests signed with another key would only be rejected by the CA
+	if err := checkKeyMatchesCert(key, cert); err != nil {
+		return nil, fmt.Errorf("Invalid enrollment of %s: %w", name, err)
+	}
+	// Attributes only serve client-side checks, the CA enforces them anyway
+	attrs, err := certAttributes(cert)
+	if err != nil {
+		fabricCAServices.logger.Debugf("Ignoring the attributes of %s: %s", name, err)
 	}
-	return fabricCAServices.fabricCAClient.NewIdentity(ski, cert)
+	return &signingIdentity{name: name, cert: cert, key: key, csp: csp, attrs: attrs}, nil
 }
@@ -20,36 +20,1533 @@ limitations under the License.
 package fabricca
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cloudflare/cfssl/signer"
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric-sdk-go/config"
 	"github.com/hyperledger/fabric-sdk-go/fabric-ca-client/mocks"
 	"github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric/bccsp"
+	bccspFactory "github.com/hyperledger/fabric/bccsp/factory"
+	bccspSigner "github.com/hyperledger/fabric/bccsp/signer"
 )
 
-func TestEnrollWithMissingParameters(t *testing.T) {
+func TestNewFabricCAClientForCA(t *testing.T) {
+	var enrolled []string
+	newEnrollHandler := func(caName string) mockCAHandler {
+		return func(r *http.Request, body []byte) (interface{}, int) {
+			enrolled = append(enrolled, caName)
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		}
+	}
+	identityCA := newMockCA(t, map[string]mockCAHandler{"enroll": newEnrollHandler("identity")})
+	defer identityCA.Close()
+	tlsCA := newMockCA(t, map[string]mockCAHandler{"enroll": newEnrollHandler("tls")})
+	defer tlsCA.Close()
+
+	initTestConfig(t, fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+ fabricCAs:
+  tlsca:
+   serverURL: "%s"
+`, identityCA.URL, tlsCA.URL))
+
+	defaultServices, err := NewFabricCAClient(WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	tlsServices, err := NewFabricCAClientForCA("tlsca", WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClientForCA returned error: %v", err)
+	}
+	if defaultServices.CAName() != "DEFAULT" || tlsServices.CAName() != "tlsca" {
+		t.Fatalf("Unexpected CA names: %s, %s", defaultServices.CAName(), tlsServices.CAName())
+	}
+	if _, _, err := tlsServices.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if _, _, err := defaultServices.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if len(enrolled) != 2 || enrolled[0] != "tls" || enrolled[1] != "identity" {
+		t.Fatalf("Enrollments were not routed to the expected CAs: %v", enrolled)
+	}
+	if _, err := NewFabricCAClientForCA("unknown"); err == nil {
+		t.Fatalf("NewFabricCAClientForCA should have failed for an unconfigured CA")
+	}
+}
+
+func TestNewFabricCAClientForOrg(t *testing.T) {
+	var enrolled []string
+	newEnrollHandler := func(org string) mockCAHandler {
+		return func(r *http.Request, body []byte) (interface{}, int) {
+			enrolled = append(enrolled, org)
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		}
+	}
+	org1CA := newMockCA(t, map[string]mockCAHandler{"enroll": newEnrollHandler("org1")})
+	defer org1CA.Close()
+	org2CA := newMockCA(t, map[string]mockCAHandler{"enroll": newEnrollHandler("org2")})
+	defer org2CA.Close()
+
+	initTestConfig(t, fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+ fabricCAs:
+  ca-org2:
+   serverURL: "%s"
+ organizations:
+  org1:
+   mspID: "Org1MSP"
+  org2:
+   mspID: "Org2MSP"
+   ca: "ca-org2"
+`, org1CA.URL, org2CA.URL))
+
+	org1Services, err := NewFabricCAClientForOrg("org1", WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClientForOrg returned error: %v", err)
+	}
+	org2Services, err := NewFabricCAClientForOrg("org2", WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClientForOrg returned error: %v", err)
+	}
+	if org1Services.CAName() != "DEFAULT" || org2Services.CAName() != "ca-org2" {
+		t.Fatalf("Unexpected CA names: %s, %s", org1Services.CAName(), org2Services.CAName())
+	}
+	if _, _, err := org2Services.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if _, _, err := org1Services.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if len(enrolled) != 2 || enrolled[0] != "org2" || enrolled[1] != "org1" {
+		t.Fatalf("Enrollments were not routed to the expected CAs: %v", enrolled)
+	}
+	if _, err := NewFabricCAClientForOrg("org3"); err == nil || !strings.Contains(err.Error(), "org org3 is not configured") {
+		t.Fatalf("NewFabricCAClientForOrg should have failed for an unconfigured org, got: %v", err)
+	}
+}
+
+func TestNewFabricCAClientValidatesConfig(t *testing.T) {
+	initTestConfig(t, `client:
+ validateConfig: true
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "http://localhost:7054"
+  certfiles:
+    - "/nonexistent/root.pem"
+ keystore:
+  path: "/tmp/keystore"
+`)
+	_, err := NewFabricCAClient()
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("NewFabricCAClient should have failed with a config ValidationError, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "/nonexistent/root.pem does not exist") {
+		t.Fatalf("Unexpected error message: %s", err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabricca_test_mtls")
+	if err != nil {
+		t.Fatalf("Error creating TLS directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeTestTLSCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCert, serverKey := writeTestTLSCertificate(t, dir, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	writeTestTLSCertificate(t, dir, "client", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, caKey)
+
+	var clientCerts int
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			clientCerts = len(r.TLS.PeerCertificates)
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	ca.Server.Close()
+	ca.Server = httptest.NewUnstartedServer(ca.Server.Config.Handler)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	ca.Server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ca.Server.StartTLS()
+	defer ca.Close()
+
+	caConfig := func(client string) string {
+		return fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+  certfiles:
+    - "%s"
+  client:
+%s`, ca.Server.URL, filepath.Join(dir, "ca-cert.pem"), client)
+	}
+
+	initTestConfig(t, caConfig(fmt.Sprintf("   keyfile: \"%s\"\n   certfile: \"%s\"\n",
+		filepath.Join(dir, "client-key.pem"), filepath.Join(dir, "client-cert.pem"))))
+	fabricCAClient, err := NewFabricCAClient()
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if clientCerts != 1 {
+		t.Fatalf("Expected the client certificate to be presented, got %d certificates", clientCerts)
+	}
+
+	initTestConfig(t, caConfig(""))
+	fabricCAClient, err = NewFabricCAClient()
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); !errors.Is(err, ErrCAUnreachable) {
+		t.Fatalf("Enroll should have failed the handshake without a client certificate, got: %v", err)
+	}
+
+	initTestConfig(t, caConfig(fmt.Sprintf("   keyfile: \"%s\"\n", filepath.Join(dir, "client-key.pem"))))
+	if _, err := NewFabricCAClient(); err == nil || !strings.Contains(err.Error(), "client keyfile and certfile must be set together") {
+		t.Fatalf("NewFabricCAClient should have failed with only a client keyfile, got: %v", err)
+	}
+}
+
+func TestServerNameOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabricca_test_tls")
+	if err != nil {
+		t.Fatalf("Error creating TLS directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeTestTLSCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	// The server certificate only matches the name behind the load balancer
+	serverCert, serverKey := writeTestTLSCertificate(t, dir, "server", &x509.Certificate{
+		DNSNames:    []string{"ca.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+
+	var serverName string
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			serverName = r.TLS.ServerName
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	ca.Server.Close()
+	ca.Server = httptest.NewUnstartedServer(ca.Server.Config.Handler)
+	ca.Server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+	}
+	ca.Server.StartTLS()
+	defer ca.Close()
+
+	caConfig := func(serverNameOverride string) string {
+		return fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+  serverNameOverride: "%s"
+  certfiles:
+    - "%s"
+`, ca.Server.URL, serverNameOverride, filepath.Join(dir, "ca-cert.pem"))
+	}
+
+	initTestConfig(t, caConfig(""))
 	fabricCAClient, err := NewFabricCAClient()
 	if err != nil {
-		t.Fatalf("NewFabricCAClient return error: %v", err)
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); !errors.Is(err, ErrCAUnreachable) {
+		t.Fatalf("Enroll should have failed to verify the server certificate, got: %v", err)
+	}
+
+	initTestConfig(t, caConfig("ca.example.com"))
+	fabricCAClient, err = NewFabricCAClient()
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if serverName != "ca.example.com" {
+		t.Fatalf("Expected ca.example.com to be sent for SNI, got %s", serverName)
+	}
+}
+
+func TestPinnedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabricca_test_tls")
+	if err != nil {
+		t.Fatalf("Error creating TLS directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeTestTLSCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCert, serverKey := writeTestTLSCertificate(t, dir, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	ca.Server.Close()
+	ca.Server = httptest.NewUnstartedServer(ca.Server.Config.Handler)
+	ca.Server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+	}
+	ca.Server.StartTLS()
+	defer ca.Close()
+
+	caConfig := func(pin string) string {
+		return fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+  pinnedSHA256:
+    - "%s"
+  certfiles:
+    - "%s"
+`, ca.Server.URL, pin, filepath.Join(dir, "ca-cert.pem"))
+	}
+
+	// The chain validates but the pin is the one of the CA certificate
+	caFingerprint := sha256.Sum256(caCert.Raw)
+	initTestConfig(t, caConfig(hex.EncodeToString(caFingerprint[:])))
+	fabricCAClient, err := NewFabricCAClient()
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	_, _, err = fabricCAClient.Enroll("enrollmentID", "enrollmentSecret")
+	if !errors.Is(err, ErrCertificatePinMismatch) {
+		t.Fatalf("Enroll should have failed pinning, got: %v", err)
+	}
+	if errors.Is(err, ErrCAUnreachable) {
+		t.Fatalf("Pinning failure should not be reported as unreachable: %v", err)
+	}
+
+	serverFingerprint := sha256.Sum256(serverCert.Raw)
+	pin := strings.ToUpper(hex.EncodeToString(serverFingerprint[:]))
+	var colonSeparated []string
+	for i := 0; i < len(pin); i += 2 {
+		colonSeparated = append(colonSeparated, pin[i:i+2])
+	}
+	initTestConfig(t, caConfig(strings.Join(colonSeparated, ":")))
+	fabricCAClient, err = NewFabricCAClient()
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+
+	initTestConfig(t, caConfig("not a fingerprint"))
+	if _, err := NewFabricCAClient(); err == nil {
+		t.Fatalf("NewFabricCAClient should have rejected an invalid pin")
+	}
+}
+
+// writeTestTLSCertificate issues a certificate from template, self-signed
+// when parent is nil, and writes it with its key to <name>-cert.pem and
+// <name>-key.pem in dir
+func writeTestTLSCertificate(t *testing.T, dir string, name string, template *x509.Certificate,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-cert.pem"), certPEM, 0600); err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	return cert, key
+}
+
+func TestEnrollWithMissingParameters(t *testing.T) {
+	fabricCAClient, err := NewFabricCAClient(WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient return error: %v", err)
+	}
+	_, _, err = fabricCAClient.Enroll("", "user1")
+	if err == nil {
+		t.Fatalf("Enroll didn't return error")
+	}
+	if err.Error() != "enrollmentID is empty" {
+		t.Fatalf("Enroll didn't return right error")
+	}
+	_, _, err = fabricCAClient.Enroll("test", "")
+	if err == nil {
+		t.Fatalf("Enroll didn't return error")
+	}
+	if err.Error() != "enrollmentSecret is empty" {
+		t.Fatalf("Enroll didn't return right error")
+	}
+}
+
+func TestEnrollWithOptions(t *testing.T) {
+	var request signer.SignRequest
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			if name, secret, ok := r.BasicAuth(); !ok || name != "test" || secret != "testpw" {
+				return "Authorization failure", http.StatusUnauthorized
+			}
+			json.Unmarshal(body, &request)
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	opts := &EnrollmentOptions{
+		CN:         "custom",
+		Hosts:      []string{"peer0.example.com", "10.0.0.1"},
+		KeyRequest: &KeyRequest{Algo: "ecdsa", Size: 384},
+	}
+	key, cert, err := ca.services.EnrollWithOptions("test", "testpw", opts)
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	if key == nil || cert == nil {
+		t.Fatalf("EnrollWithOptions returned empty key or cert")
+	}
+	block, _ := pem.Decode([]byte(request.Request))
+	if block == nil {
+		t.Fatalf("Expected PEM encoded CSR in sign request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatalf("Error parsing CSR: %v", err)
+	}
+	if csr.Subject.CommonName != "custom" {
+		t.Fatalf("Expected CSR common name custom. Got: %s", csr.Subject.CommonName)
+	}
+	if len(csr.DNSNames) != 1 || csr.DNSNames[0] != "peer0.example.com" || len(csr.IPAddresses) != 1 {
+		t.Fatalf("Expected CSR hosts to match options. Got: %v %v", csr.DNSNames, csr.IPAddresses)
+	}
+	if pub, ok := csr.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P384() {
+		t.Fatalf("Expected ecdsa P-384 public key in CSR")
+	}
+	// Invalid host
+	_, _, err = ca.services.EnrollWithOptions("test", "testpw", &EnrollmentOptions{Hosts: []string{"a", ""}})
+	if err == nil || !strings.Contains(err.Error(), "index 1") {
+		t.Fatalf("Expected invalid host error. Got: %v", err)
+	}
+	// Wrong secret
+	_, _, err = ca.services.EnrollWithOptions("test", "wrong", &EnrollmentOptions{})
+	if err == nil {
+		t.Fatalf("Expected error with wrong secret")
+	}
+}
+
+func TestEnrollWithExtensions(t *testing.T) {
+	var requests []signer.SignRequest
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			var request signer.SignRequest
+			json.Unmarshal(body, &request)
+			requests = append(requests, request)
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	employeeID, err := asn1.Marshal("E12345")
+	if err != nil {
+		t.Fatalf("Error marshalling extension value: %v", err)
+	}
+	employeeOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	opts := &EnrollmentOptions{
+		Hosts:      []string{"peer0.example.com", "10.0.0.1"},
+		Extensions: []pkix.Extension{{Id: employeeOID, Value: employeeID}},
+		Label:      "ForFabric",
+	}
+	ca.services.tokenLabel = "ForFabric"
+	for _, hsm := range []bool{false, true} {
+		ca.services.hsm = hsm
+		requests = nil
+		key, _, err := ca.services.EnrollWithOptions("test", "testpw", opts)
+		if err != nil {
+			t.Fatalf("EnrollWithOptions returned error: %v", err)
+		}
+		if len(requests) != 1 {
+			t.Fatalf("Expected a single enrollment request, got %d", len(requests))
+		}
+		csr, err := x509.ParseCertificateRequest(mustDecodePEM(t, []byte(requests[0].Request)))
+		if err != nil || csr.CheckSignature() != nil {
+			t.Fatalf("Invalid CSR: %v", err)
+		}
+		var found bool
+		for _, ext := range csr.Extensions {
+			found = found || ext.Id.Equal(employeeOID) && bytes.Equal(ext.Value, employeeID)
+		}
+		if !found || csr.Subject.CommonName != "test" || len(csr.DNSNames) != 1 || len(csr.IPAddresses) != 1 {
+			t.Fatalf("Expected the extension, common name and hosts in the CSR, got %+v", csr)
+		}
+		if hsm != (key == nil) {
+			t.Fatalf("Expected a private key unless kept in the BCCSP")
+		}
+		if !hsm {
+			ecKey, err := x509.ParseECPrivateKey(mustDecodePEM(t, key))
+			if err != nil || !ecKey.PublicKey.Equal(csr.PublicKey) {
+				t.Fatalf("Expected the private key of the CSR: %v", err)
+			}
+		}
+	}
+	ca.services.hsm = false
+
+	requests = nil
+	_, _, err = ca.services.EnrollWithOptions("test", "testpw", &EnrollmentOptions{Extensions: []pkix.Extension{
+		{Value: employeeID},
+		{Id: asn1.ObjectIdentifier{3, 1}, Value: employeeID},
+		{Id: asn1.ObjectIdentifier{1, 40}, Value: employeeID},
+		{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: employeeID},
+		{Id: CertAttributesOID, Value: employeeID},
+		{Id: employeeOID, Value: employeeID},
+		{Id: employeeOID},
+	}})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 7 || len(requests) != 0 {
+		t.Fatalf("Expected invalid extensions to be rejected before enrolling, got: %v", err)
+	}
+}
+
+func TestEnrollWithKeyRequests(t *testing.T) {
+	var enrollments int
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			enrollments++
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	for _, keyRequest := range []*KeyRequest{{"ecdsa", 224}, {"rsa", 1024}, {"rsa", 256}, {"dsa", 2048}, {"", 0}} {
+		_, _, err := ca.services.EnrollWithOptions("test", "testpw", &EnrollmentOptions{KeyRequest: keyRequest})
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("EnrollWithOptions should have rejected key request %v, got: %v", keyRequest, err)
+		}
+	}
+	if enrollments != 0 {
+		t.Fatalf("Unsupported key requests should not be sent to the CA")
+	}
+
+	key, _, err := ca.services.EnrollWithOptions("test", "testpw",
+		&EnrollmentOptions{KeyRequest: &KeyRequest{Algo: "ecdsa", Size: 521}})
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	ecKey, err := x509.ParseECPrivateKey(mustDecodePEM(t, key))
+	if err != nil || ecKey.Curve != elliptic.P521() {
+		t.Fatalf("Expected an ecdsa P-521 private key: %v", err)
+	}
+	key, _, err = ca.services.EnrollWithOptions("test", "testpw",
+		&EnrollmentOptions{KeyRequest: &KeyRequest{Algo: "rsa", Size: 2048}, Profile: TLSProfile})
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	rsaKey, err := x509.ParsePKCS1PrivateKey(mustDecodePEM(t, key))
+	if err != nil || rsaKey.N.BitLen() != 2048 {
+		t.Fatalf("Expected an rsa 2048 private key: %v", err)
+	}
+
+	// Keys kept in an HSM cannot be ecdsa 521 or rsa
+	ca.services.hsm = true
+	for _, keyRequest := range []*KeyRequest{{"ecdsa", 521}, {"rsa", 2048}} {
+		_, _, err = ca.services.EnrollWithOptions("test", "testpw", &EnrollmentOptions{KeyRequest: keyRequest})
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) || enrollments != 2 {
+			t.Fatalf("EnrollWithOptions should have rejected %v for keys kept in an HSM, got: %v", keyRequest, err)
+		}
+	}
+}
+
+func TestEnrollTLS(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			var request signer.SignRequest
+			json.Unmarshal(body, &request)
+			if request.Profile != TLSProfile && request.Profile != "" {
+				return "Invalid profile " + request.Profile, http.StatusBadRequest
+			}
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	key, cert, err := ca.services.EnrollTLS("test", "testpw")
+	if err != nil {
+		t.Fatalf("EnrollTLS returned error: %v", err)
+	}
+	if key == nil || cert == nil {
+		t.Fatalf("EnrollTLS returned empty key or cert")
+	}
+	// Unknown profile
+	_, _, err = ca.services.EnrollWithOptions("test", "testpw", &EnrollmentOptions{Profile: "unknown"})
+	if err == nil || !strings.Contains(err.Error(), "Invalid profile unknown") {
+		t.Fatalf("Expected CA error for unknown profile. Got: %v", err)
+	}
+}
+
+func TestEnrollWithCSR(t *testing.T) {
+	issue := newIssuingEnrollHandler(t)
+	calls := 0
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			calls++
+			return issue(r, body)
+		},
+	})
+	defer ca.Close()
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	newCSR := func(cn string) []byte {
+		der, err := x509.CreateCertificateRequest(rand.Reader,
+			&x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, privateKey)
+		if err != nil {
+			t.Fatalf("Error creating CSR: %v", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	}
+
+	certPEM, err := ca.services.EnrollWithCSR("user1", "user1pw", newCSR("user1"))
+	if err != nil {
+		t.Fatalf("EnrollWithCSR returned error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(mustDecodePEM(t, certPEM))
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	if cert.Subject.CommonName != "user1" || cert.PublicKey.(*ecdsa.PublicKey).X.Cmp(privateKey.X) != 0 {
+		t.Fatalf("The certificate was not issued for the CSR")
+	}
+
+	calls = 0
+	for _, csrPEM := range [][]byte{newCSR("user2"), []byte("not a CSR"), certPEM} {
+		_, err := ca.services.EnrollWithCSR("user1", "user1pw", csrPEM)
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("Expected a ValidationError for CSR %s, got: %v", csrPEM, err)
+		}
+	}
+	_, err = ca.services.EnrollWithCSR("user1", "user1pw", newCSR("user2"))
+	if err == nil || !strings.Contains(err.Error(), "does not match enrollment ID user1") {
+		t.Fatalf("Expected a common name mismatch error, got: %v", err)
+	}
+	if _, err := ca.services.EnrollWithCSR("user1", "", newCSR("user1")); err == nil {
+		t.Fatalf("EnrollWithCSR should have failed without secret")
+	}
+	if calls != 0 {
+		t.Fatalf("Invalid CSRs should not reach the CA, got %d requests", calls)
+	}
+}
+
+func TestEnrollV2(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	enrollment, err := ca.services.EnrollV2("test", "testpw")
+	if err != nil {
+		t.Fatalf("EnrollV2 returned error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(mustDecodePEM(t, readCert(t)))
+	if err != nil {
+		t.Fatalf("Error parsing cert: %v", err)
+	}
+	if enrollment.Key == nil || string(enrollment.Cert) != string(readCert(t)) {
+		t.Fatalf("EnrollV2 returned unexpected key or cert")
+	}
+	if enrollment.Serial != fmt.Sprintf("%x", cert.SerialNumber.Bytes()) {
+		t.Fatalf("EnrollV2 returned unexpected serial %s", enrollment.Serial)
+	}
+	if !enrollment.NotBefore.Equal(cert.NotBefore) || !enrollment.NotAfter.Equal(cert.NotAfter) {
+		t.Fatalf("EnrollV2 returned unexpected validity %v - %v", enrollment.NotBefore, enrollment.NotAfter)
+	}
+	if _, err := ca.services.EnrollV2("", "testpw"); err == nil {
+		t.Fatalf("EnrollV2 should have failed for an empty enrollment ID")
+	}
+}
+
+func TestEnrollReturnOrder(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{"enroll": newIssuingEnrollHandler(t)})
+	defer ca.Close()
+
+	enrollment, err := ca.services.EnrollV2("user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollV2 returned error: %v", err)
+	}
+	key, cert, err := ca.services.Enroll("user1", "user1pw")
+	if err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	for name, issued := range map[string]*Enrollment{"EnrollV2": enrollment, "Enroll": {Key: key, Cert: cert}} {
+		x509Cert, err := x509.ParseCertificate(mustDecodePEM(t, issued.Cert))
+		if err != nil {
+			t.Fatalf("The certificate returned by %s does not parse as a certificate: %v", name, err)
+		}
+		privateKey, err := x509.ParseECPrivateKey(mustDecodePEM(t, issued.Key))
+		if err != nil {
+			t.Fatalf("The key returned by %s does not parse as a private key: %v", name, err)
+		}
+		if x509Cert.PublicKey.(*ecdsa.PublicKey).X.Cmp(privateKey.X) != 0 {
+			t.Fatalf("The certificate returned by %s is not issued for its key", name)
+		}
+	}
+}
+
+func TestEnrollIdentity(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{"enroll": newIssuingEnrollHandler(t)})
+	defer ca.Close()
+
+	if _, err := ca.services.EnrollIdentity("", "user1", "user1pw"); err == nil {
+		t.Fatalf("EnrollIdentity should have failed without an MSP ID")
+	}
+	identity, err := ca.services.EnrollIdentity("Org1MSP", "user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollIdentity returned error: %v", err)
+	}
+	if identity.MSPID != "Org1MSP" {
+		t.Fatalf("Unexpected MSP ID %s", identity.MSPID)
+	}
+	cert, err := x509.ParseCertificate(mustDecodePEM(t, identity.Cert))
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	key, err := x509.ParseECPrivateKey(mustDecodePEM(t, identity.Key))
+	if err != nil {
+		t.Fatalf("Error parsing private key: %v", err)
+	}
+	if cert.Subject.CommonName != "user1" || cert.PublicKey.(*ecdsa.PublicKey).X.Cmp(key.X) != 0 {
+		t.Fatalf("The certificate is not bound to the private key")
+	}
+}
+
+func TestEnrollWithSubject(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{"enroll": newIssuingEnrollHandler(t)})
+	defer ca.Close()
+
+	subject := &Subject{
+		Organization:       "Org1",
+		OrganizationalUnit: "peer",
+		Locality:           "San Francisco",
+		Province:           "California",
+		Country:            "US",
+	}
+	_, certPEM, err := ca.services.EnrollWithOptions("user1", "user1pw", &EnrollmentOptions{Subject: subject})
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(mustDecodePEM(t, certPEM))
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	name := cert.Subject
+	if name.CommonName != "user1" || !reflect.DeepEqual(name.Organization, []string{"Org1"}) ||
+		!reflect.DeepEqual(name.OrganizationalUnit, []string{"peer"}) ||
+		!reflect.DeepEqual(name.Locality, []string{"San Francisco"}) ||
+		!reflect.DeepEqual(name.Province, []string{"California"}) ||
+		!reflect.DeepEqual(name.Country, []string{"US"}) {
+		t.Fatalf("Expected the subject of the options in the certificate. Got: %s", name)
+	}
+
+	// Empty components are omitted
+	_, certPEM, err = ca.services.EnrollWithOptions("user1", "user1pw",
+		&EnrollmentOptions{Subject: &Subject{Organization: "Org1"}})
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	if cert, err = x509.ParseCertificate(mustDecodePEM(t, certPEM)); err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	if len(cert.Subject.Country) != 0 || len(cert.Subject.OrganizationalUnit) != 0 {
+		t.Fatalf("Expected only the organization in the subject. Got: %s", cert.Subject)
+	}
+
+	for _, country := range []string{"USA", "U", "1A", "É"} {
+		_, _, err := ca.services.EnrollWithOptions("user1", "user1pw",
+			&EnrollmentOptions{Subject: &Subject{Country: country}})
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("Expected a validation error for country %s. Got: %v", country, err)
+		}
+	}
+}
+
+func TestEnrollWithAttributeRequests(t *testing.T) {
+	var request enrollmentRequest
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			request = enrollmentRequest{}
+			json.Unmarshal(body, &request)
+			for _, attrReq := range request.AttrReqs {
+				if attrReq.Name == "missing" && !attrReq.Optional {
+					return "Identity 'test' does not have attribute 'missing'", http.StatusBadRequest
+				}
+			}
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	attrReqs := []AttributeRequest{{Name: "role"}, {Name: "missing", Optional: true}}
+	_, _, err := ca.services.EnrollWithOptions("test", "testpw", &EnrollmentOptions{AttrReqs: attrReqs})
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	if len(request.AttrReqs) != 2 || request.AttrReqs[0].Name != "role" || !request.AttrReqs[1].Optional {
+		t.Fatalf("Expected attribute requests to be sent. Got: %+v", request.AttrReqs)
+	}
+	// Required attribute missing on the identity
+	attrReqs = []AttributeRequest{{Name: "missing"}}
+	_, _, err = ca.services.EnrollWithOptions("test", "testpw", &EnrollmentOptions{AttrReqs: attrReqs})
+	if err == nil {
+		t.Fatalf("Expected error for missing required attribute")
+	}
+	if err.Error() != "Enroll failed: attribute request rejected by CA: "+
+		"Identity 'test' does not have attribute 'missing'" {
+		t.Fatalf("Expected clear attribute error. Got: %s", err.Error())
+	}
+}
+
+func TestPing(t *testing.T) {
+	release := make(chan struct{})
+	var slow int32
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": func(r *http.Request, body []byte) (interface{}, int) {
+			if atomic.LoadInt32(&slow) == 1 {
+				<-release
+			}
+			return map[string]interface{}{"CAName": "ca-org1"}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	defer close(release)
+
+	if err := ca.services.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping returned error: %v", err)
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := ca.services.Ping(ctx)
+	if !errors.Is(err, ErrCAUnreachable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Ping to fail as unreachable on timeout, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Ping did not respect the context timeout")
+	}
+
+	down := newMockCA(t, nil)
+	down.Close()
+	if err := down.services.Ping(context.Background()); !errors.Is(err, ErrCAUnreachable) {
+		t.Fatalf("Expected Ping to fail as unreachable for a stopped CA, got: %v", err)
+	}
+}
+
+func TestWithDefaultTimeout(t *testing.T) {
+	slow := func(r *http.Request, body []byte) (interface{}, int) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		return map[string]interface{}{"CAName": "ca-org1"}, http.StatusOK
+	}
+	ca := newMockCA(t, map[string]mockCAHandler{"cainfo": slow, "enroll": slow})
+	defer ca.Close()
+	WithDefaultTimeout(50 * time.Millisecond)(ca.services)
+
+	start := time.Now()
+	if _, err := ca.services.GetCAInfo(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected GetCAInfo to trip the default timeout, got: %v", err)
+	}
+	if _, _, err := ca.services.Enroll("user1", "user1pw"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Enroll to trip the default timeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Fatalf("Operations were not bounded by the default timeout, took %s", elapsed)
+	}
+	// An explicit context overrides the default timeout
+	if err := ca.services.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping returned error: %v", err)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabricca_test_tls")
+	if err != nil {
+		t.Fatalf("Error creating TLS directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert, caKey := writeTestTLSCertificate(t, dir, "ca", &x509.Certificate{
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCert, serverKey := writeTestTLSCertificate(t, dir, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	ca.Server.Close()
+	ca.Server = httptest.NewUnstartedServer(ca.Server.Config.Handler)
+	ca.Server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+	}
+	ca.Server.StartTLS()
+	defer ca.Close()
+
+	withCertFiles := fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+  certfiles:
+    - "%s"
+`, ca.Server.URL, filepath.Join(dir, "ca-cert.pem"))
+	initTestConfig(t, withCertFiles)
+	var wrapped http.RoundTripper
+	var calls int
+	fabricCAClient, err := NewFabricCAClient(WithRoundTripper(func(transport http.RoundTripper) http.RoundTripper {
+		wrapped = transport
+		return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			calls++
+			return transport.RoundTrip(r)
+		})
+	}))
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Expected the request to go through the wrapper, got %d calls", calls)
+	}
+	if transport, ok := wrapped.(*http.Transport); !ok || transport.Proxy == nil {
+		t.Fatalf("The wrapped transport should honor the proxy environment variables")
+	}
+
+	// A custom client conflicts with the TLS settings of the CA config
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if _, err := NewFabricCAClient(WithHTTPClient(client)); err == nil {
+		t.Fatalf("NewFabricCAClient should have failed with TLS settings ignored by the custom client")
+	}
+
+	initTestConfig(t, fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+`, ca.Server.URL))
+	fabricCAClient, err = NewFabricCAClient(WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	fabricCAClient.Close()
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected Enroll to fail with ErrClosed, got: %v", err)
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			<-release
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	defer close(release)
+	initTestConfig(t, `client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "`+ca.Server.URL+`"
+  requestTimeout: "100ms"
+`)
+	fabricCAClient, err := NewFabricCAClient(WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+
+	start := time.Now()
+	_, _, err = fabricCAClient.Enroll("enrollmentID", "enrollmentSecret")
+	var netErr net.Error
+	if !errors.Is(err, ErrCAUnreachable) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("Expected Enroll to time out, got: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Enroll did not time out promptly")
+	}
+}
+
+func TestWithInsecure(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	initTestConfig(t, `client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "`+ca.Server.URL+`"
+`)
+
+	// http CA URLs are rejected unless explicitly allowed
+	recorder := &recordingLogger{}
+	if _, err := NewFabricCAClient(WithLogger(recorder)); err == nil ||
+		!strings.Contains(err.Error(), "CA URL "+ca.Server.URL+" is http but TLS is required") {
+		t.Fatalf("Expected NewFabricCAClient to require TLS, got: %v", err)
+	}
+	fabricCAClient, err := NewFabricCAClient(WithLogger(recorder), WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	defer fabricCAClient.Close()
+	if len(recorder.messages["warn"]) != 1 ||
+		!strings.Contains(recorder.messages["warn"][0], "never be used in production") {
+		t.Fatalf("Expected a warning that TLS is disabled, got %v", recorder.messages)
+	}
+	if _, cert, err := fabricCAClient.Enroll("enrollmentID", "enrollmentSecret"); err != nil ||
+		string(cert) != string(readCert(t)) {
+		t.Fatalf("Enroll over http returned error: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"CAName": "ca-org1"}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	if err := ca.services.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping returned error: %v", err)
+	}
+
+	if err := ca.services.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if err := ca.services.Close(); err != nil {
+		t.Fatalf("Close should be idempotent, got: %v", err)
+	}
+	if err := ca.services.Ping(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected Ping to fail with ErrClosed, got: %v", err)
+	}
+	if _, _, err := ca.services.Enroll("enrollmentID", "enrollmentSecret"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected Enroll to fail with ErrClosed, got: %v", err)
+	}
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1",
+		Affiliation: "org1"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected Register to fail with ErrClosed, got: %v", err)
+	}
+	if _, err := ca.services.GetAllIdentities(registrar); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected GetAllIdentities to fail with ErrClosed, got: %v", err)
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabricca_test_config_dir")
+	if err != nil {
+		t.Fatalf("Error creating config directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewFabricCAClient(WithConfigDir(dir), WithInsecure()); err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected the client config to be removed, found %d files", len(files))
+	}
+
+	if _, err := NewFabricCAClient(WithConfigDir(dir), WithRetainedConfig(), WithInsecure()); err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("client-config-%d-*.json", os.Getpid())))
+	if len(files) != 1 {
+		t.Fatalf("Expected the client config to be retained, found %v", files)
+	}
+
+	missing := filepath.Join(dir, "missing")
+	if _, err := NewFabricCAClient(WithConfigDir(missing), WithInsecure()); err == nil ||
+		!strings.Contains(err.Error(), missing) {
+		t.Fatalf("Expected the config directory in the error, got: %v", err)
+	}
+}
+
+func TestGetCAInfo(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": func(r *http.Request, body []byte) (interface{}, int) {
+			if r.Header.Get("authorization") != "" {
+				t.Fatalf("Expected cainfo request to be unauthenticated")
+			}
+			return map[string]interface{}{
+				"CAName":  "ca-org1",
+				"CAChain": base64.StdEncoding.EncodeToString(readCert(t)),
+				"Version": "1.0.0",
+			}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	info, err := ca.services.GetCAInfo()
+	if err != nil {
+		t.Fatalf("GetCAInfo returned error: %v", err)
+	}
+	if info.CAName != "ca-org1" || info.Version != "1.0.0" {
+		t.Fatalf("GetCAInfo returned wrong info: %+v", info)
+	}
+	if string(info.CAChain) != string(readCert(t)) {
+		t.Fatalf("GetCAInfo returned wrong CA chain")
+	}
+}
+
+func TestWithServerCAName(t *testing.T) {
+	caNames := map[string]string{}
+	record := func(endpoint string, handler mockCAHandler) mockCAHandler {
+		return func(r *http.Request, body []byte) (interface{}, int) {
+			var request struct {
+				CAName string `json:"caname"`
+			}
+			json.Unmarshal(body, &request)
+			caNames[endpoint] = request.CAName
+			return handler(r, body)
+		}
+	}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": record("cainfo", func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"CAName": "ca-org1",
+				"CAChain": base64.StdEncoding.EncodeToString(readCert(t))}, http.StatusOK
+		}),
+		"enroll": record("enroll", newIssuingEnrollHandler(t)),
+		"register": record("register", func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"credential": base64.StdEncoding.EncodeToString([]byte("user1pw"))},
+				http.StatusOK
+		}),
+		"revoke": record("revoke", func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{}, http.StatusOK
+		}),
+		"gencrl": record("gencrl", func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"CRL": base64.StdEncoding.EncodeToString([]byte("crl"))}, http.StatusOK
+		}),
+	})
+	defer ca.Close()
+	WithServerCAName("ca-org1")(ca.services)
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+
+	if _, err := ca.services.GetCAInfo(); err != nil {
+		t.Fatalf("GetCAInfo returned error: %v", err)
+	}
+	if err := ca.services.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping returned error: %v", err)
+	}
+	if caNames["cainfo"] != "ca-org1" {
+		t.Fatalf("Expected the CA information of ca-org1 to be requested, got %q", caNames["cainfo"])
+	}
+	if _, _, err := ca.services.Enroll("user1", "user1pw"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1",
+		Affiliation: "org1"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if _, err := ca.services.GenerateCRL(registrar, nil); err != nil {
+		t.Fatalf("GenerateCRL returned error: %v", err)
+	}
+	for _, endpoint := range []string{"enroll", "register", "gencrl"} {
+		if caNames[endpoint] != "ca-org1" {
+			t.Fatalf("Expected the %s request to be sent to ca-org1, got %q", endpoint, caNames[endpoint])
+		}
+	}
+
+	// The CAName of a request takes precedence
+	if err := ca.services.Revoke(registrar, &RevocationRequest{Name: "user1", CAName: "ca-org2"}); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if _, err := ca.services.GenerateCRL(registrar, &CRLRequest{CAName: "ca-org2"}); err != nil {
+		t.Fatalf("GenerateCRL returned error: %v", err)
+	}
+	if caNames["revoke"] != "ca-org2" || caNames["gencrl"] != "ca-org2" {
+		t.Fatalf("Expected the requests to be sent to ca-org2, got %v", caNames)
+	}
+}
+
+func TestGetCACertPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabricca_test_chain")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caTemplate := func() *x509.Certificate {
+		return &x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	}
+	root, rootKey := writeTestTLSCertificate(t, dir, "root", caTemplate(), nil, nil)
+	other, _ := writeTestTLSCertificate(t, dir, "other", caTemplate(), nil, nil)
+	intermediate, intermediateKey := writeTestTLSCertificate(t, dir, "intermediate", caTemplate(), root, rootKey)
+	peer, _ := writeTestTLSCertificate(t, dir, "peer", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, intermediate, intermediateKey)
+	encode := func(certs ...*x509.Certificate) string {
+		var chain []byte
+		for _, cert := range certs {
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		return base64.StdEncoding.EncodeToString(chain)
+	}
+	var chain string
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"CAName": "ca-org1", "CAChain": chain}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	chain = encode(intermediate, root)
+	pool, err := ca.services.GetCACertPool(context.Background())
+	if err != nil {
+		t.Fatalf("GetCACertPool returned error: %v", err)
+	}
+	if _, err := peer.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Fatalf("Expected the peer certificate to verify with the CA pool: %v", err)
+	}
+
+	for name, invalid := range map[string]string{
+		"broken link":         encode(intermediate, other),
+		"no self-signed root": encode(intermediate),
+		"no certificate":      "",
+	} {
+		chain = invalid
+		if _, err := ca.services.GetCACertPool(context.Background()); err == nil {
+			t.Fatalf("Expected GetCACertPool to reject a chain with %s", name)
+		}
+	}
+}
+
+func TestGetTLSCACerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabricca_test_tlsca")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caTemplate := func() *x509.Certificate {
+		return &x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	}
+	signingRoot, _ := writeTestTLSCertificate(t, dir, "signing", caTemplate(), nil, nil)
+	tlsRoot, tlsRootKey := writeTestTLSCertificate(t, dir, "tlsroot", caTemplate(), nil, nil)
+	tlsIntermediate, _ := writeTestTLSCertificate(t, dir, "tlsintermediate", caTemplate(), tlsRoot, tlsRootKey)
+	encode := func(cert *x509.Certificate) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	newCAInfoHandler := func(caName string, chain []byte) mockCAHandler {
+		return func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"CAName": caName,
+				"CAChain": base64.StdEncoding.EncodeToString(chain)}, http.StatusOK
+		}
+	}
+	enrollmentCA := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": newCAInfoHandler("ca-org1", encode(signingRoot)),
+	})
+	defer enrollmentCA.Close()
+	tlsCA := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": newCAInfoHandler("tlsca-org1", append(encode(tlsIntermediate), encode(tlsRoot)...)),
+	})
+	defer tlsCA.Close()
+
+	initTestConfig(t, fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+  tlsCA: "tlsca"
+ fabricCAs:
+  tlsca:
+   serverURL: "%s"
+`, enrollmentCA.URL, tlsCA.URL))
+
+	ca, err := NewFabricCAClient(WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	certs, err := ca.GetTLSCACerts(context.Background())
+	if err != nil {
+		t.Fatalf("GetTLSCACerts returned error: %v", err)
+	}
+	if len(certs) != 2 || !bytes.Equal(certs[0], encode(tlsIntermediate)) || !bytes.Equal(certs[1], encode(tlsRoot)) {
+		t.Fatalf("GetTLSCACerts did not return the chain of the TLS CA")
+	}
+	info, err := ca.GetCAInfo()
+	if err != nil {
+		t.Fatalf("GetCAInfo returned error: %v", err)
+	}
+	if info.CAName != "ca-org1" || !bytes.Equal(info.CAChain, encode(signingRoot)) {
+		t.Fatalf("GetCAInfo did not return the signing chain of the enrollment CA: %+v", info)
+	}
+	if err := ca.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, err := ca.GetTLSCACerts(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("GetTLSCACerts should have failed with ErrClosed once closed, got: %v", err)
+	}
+
+	tlsServices, err := NewFabricCAClientForCA("tlsca", WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClientForCA returned error: %v", err)
+	}
+	if _, err := tlsServices.GetTLSCACerts(context.Background()); err == nil ||
+		!strings.Contains(err.Error(), "no TLS CA is configured for CA tlsca") {
+		t.Fatalf("GetTLSCACerts should have failed without a configured TLS CA, got: %v", err)
+	}
+}
+
+func TestPerCallCAName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fabricca_test_multica")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
 	}
-	_, _, err = fabricCAClient.Enroll("", "user1")
-	if err == nil {
-		t.Fatalf("Enroll didn't return error")
+	defer os.RemoveAll(dir)
+	type testCA struct {
+		cert *x509.Certificate
+		key  *ecdsa.PrivateKey
 	}
-	if err.Error() != "enrollmentID is empty" {
-		t.Fatalf("Enroll didn't return right error")
+	cas := map[string]testCA{}
+	for _, name := range []string{"", "ca2"} {
+		cert, key := writeTestTLSCertificate(t, dir, "root"+name, &x509.Certificate{
+			IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+		}, nil, nil)
+		cas[name] = testCA{cert: cert, key: key}
 	}
-	_, _, err = fabricCAClient.Enroll("test", "")
+	var caNames []string
+	// lookup returns the CA named by the caname of a request
+	lookup := func(body []byte) (testCA, bool) {
+		var request struct {
+			CAName string `json:"caname"`
+		}
+		json.Unmarshal(body, &request)
+		caNames = append(caNames, request.CAName)
+		ca, ok := cas[request.CAName]
+		return ca, ok
+	}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			issuer, ok := lookup(body)
+			if !ok {
+				return "CA 'unknown' does not exist", http.StatusNotFound
+			}
+			var request signer.SignRequest
+			json.Unmarshal(body, &request)
+			csr, err := x509.ParseCertificateRequest(mustDecodePEM(t, []byte(request.Request)))
+			if err != nil {
+				return fmt.Sprintf("Invalid CSR: %v", err), http.StatusBadRequest
+			}
+			template := &x509.Certificate{
+				Subject:      csr.Subject,
+				SerialNumber: big.NewInt(time.Now().UnixNano()),
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, issuer.cert, csr.PublicKey, issuer.key)
+			if err != nil {
+				return fmt.Sprintf("Error issuing certificate: %v", err), http.StatusInternalServerError
+			}
+			certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+			return base64.StdEncoding.EncodeToString(certPEM), http.StatusOK
+		},
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			lookup(body)
+			return map[string]interface{}{"credential": base64.StdEncoding.EncodeToString([]byte("user1pw"))},
+				http.StatusOK
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			lookup(body)
+			return map[string]interface{}{}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	issuedBy := func(caName string) *x509.Certificate {
+		_, certPEM, err := ca.services.EnrollWithOptions("user1", "user1pw", &EnrollmentOptions{CAName: caName})
+		if err != nil {
+			t.Fatalf("EnrollWithOptions returned error for CA %q: %v", caName, err)
+		}
+		cert, err := x509.ParseCertificate(mustDecodePEM(t, certPEM))
+		if err != nil {
+			t.Fatalf("Error parsing certificate: %v", err)
+		}
+		return cert
+	}
+	for name, issuer := range cas {
+		cert := issuedBy(name)
+		for other, otherIssuer := range cas {
+			roots := x509.NewCertPool()
+			roots.AddCert(otherIssuer.cert)
+			if _, err := cert.Verify(x509.VerifyOptions{Roots: roots}); (err == nil) != (other == name) {
+				t.Fatalf("Certificate issued by CA %q verified against CA %q: %v", name, other, err)
+			}
+		}
+		if cert.CheckSignatureFrom(issuer.cert) != nil {
+			t.Fatalf("Certificate not issued by CA %q", name)
+		}
+	}
+	if _, _, err := ca.services.EnrollWithOptions("user1", "user1pw",
+		&EnrollmentOptions{CAName: "unknown"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for an unknown CA, got: %v", err)
+	}
+
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	caNames = nil
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user2", Type: "user",
+		Affiliation: "org1", CAName: "ca2"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if err := ca.services.Revoke(registrar, &RevocationRequest{Name: "user2", CAName: "ca2"}); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if err := ca.services.Revoke(registrar, &RevocationRequest{Name: "user2"}); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if strings.Join(caNames, ",") != "ca2,ca2," {
+		t.Fatalf("Unexpected CA names sent: %v", caNames)
+	}
+}
+
+func TestGenerateCRL(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	notAllowed := newTestUser(t, "user", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	crlDER := []byte("crl")
+	var request map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"gencrl": func(r *http.Request, body []byte) (interface{}, int) {
+			if strings.HasPrefix(r.Header.Get("authorization"),
+				base64.StdEncoding.EncodeToString(notAllowed.GetEnrollmentCertificate())) {
+				return "Caller does not have attribute hf.GenCRL", http.StatusUnauthorized
+			}
+			json.Unmarshal(body, &request)
+			crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+			return map[string]interface{}{"CRL": base64.StdEncoding.EncodeToString(crlPEM)}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	// Generate CRL with nil user
+	_, err := ca.services.GenerateCRL(nil, nil)
 	if err == nil {
-		t.Fatalf("Enroll didn't return error")
+		t.Fatalf("Expected error with nil user")
 	}
-	if err.Error() != "enrollmentSecret is empty" {
-		t.Fatalf("Enroll didn't return right error")
+	revokedAfter := time.Now().Add(-time.Hour)
+	crl, err := ca.services.GenerateCRL(registrar, &CRLRequest{RevokedAfter: revokedAfter})
+	if err != nil {
+		t.Fatalf("GenerateCRL returned error: %v", err)
+	}
+	if string(crl) != string(crlDER) {
+		t.Fatalf("GenerateCRL returned wrong CRL: %s", crl)
+	}
+	if _, ok := request["revokedafter"]; !ok {
+		t.Fatalf("Expected revokedafter in request: %v", request)
+	}
+	if _, ok := request["expirebefore"]; ok {
+		t.Fatalf("Expected unset filters to be omitted: %v", request)
+	}
+	// Registrar without hf.GenCRL
+	_, err = ca.services.GenerateCRL(notAllowed, nil)
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("Expected permission error. Got: %v", err)
 	}
 }
 
 func TestRegister(t *testing.T) {
-	fabricCAClient, err := NewFabricCAClient()
+	fabricCAClient, err := NewFabricCAClient(WithInsecure())
 	if err != nil {
 		t.Fatalf("NewFabricCAClient returned error: %v", err)
 	}
@@ -73,13 +1570,13 @@ func TestRegister(t *testing.T) {
 	user.SetEnrollmentCertificate(readCert(t))
 	user.SetPrivateKey(mockKey)
 	// Register without registration name paramter
-	_, err = fabricCAClient.Register(user, &RegistrationRequest{})
-	if err.Error() != "Error Registering User: Register was called without a Name set" {
+	_, err = fabricCAClient.Register(user, &RegistrationRequest{Affiliation: "test"})
+	if err.Error() != "Error Registering User: Invalid request: Name is empty" {
 		t.Fatalf("Expected error without registration information. Got: %s", err.Error())
 	}
 	// Register without registration affiliation paramter
 	_, err = fabricCAClient.Register(user, &RegistrationRequest{Name: "test"})
-	if err.Error() != "Error Registering User: Registration request does not have an affiliation" {
+	if err.Error() != "Error Registering User: Invalid request: Affiliation is empty" {
 		t.Fatalf("Expected error without registration information. Got: %s", err.Error())
 	}
 	// Register with valid request
@@ -93,8 +1590,497 @@ func TestRegister(t *testing.T) {
 	}
 }
 
+func TestRegisterValidation(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var calls int32
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			atomic.AddInt32(&calls, 1)
+			return base64.StdEncoding.EncodeToString([]byte("secret")), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	tests := []struct {
+		request  RegistrationRequest
+		problems []string
+	}{
+		{RegistrationRequest{Affiliation: "org1"}, []string{"Name is empty"}},
+		{RegistrationRequest{Name: "user1"}, []string{"Affiliation is empty"}},
+		{RegistrationRequest{Name: "user1", Affiliation: "org1", Type: "admin"},
+			[]string{"Type admin is not one of peer, app, user, orderer, client"}},
+		{RegistrationRequest{Name: "user1", Affiliation: "org1", MaxEnrollments: -2},
+			[]string{"MaxEnrollments must be -1 or greater, got -2"}},
+		{RegistrationRequest{Type: "admin", MaxEnrollments: -2}, []string{"Name is empty",
+			"Affiliation is empty", "Type admin is not one of peer, app, user, orderer, client",
+			"MaxEnrollments must be -1 or greater, got -2"}},
+	}
+	for _, test := range tests {
+		_, err := ca.services.Register(registrar, &test.request)
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("Expected a validation error for %v, got: %v", test.request, err)
+		}
+		if strings.Join(validationErr.Problems, "; ") != strings.Join(test.problems, "; ") {
+			t.Fatalf("Unexpected validation problems for %v: %v", test.request, validationErr.Problems)
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("Invalid requests should not reach the CA, got %d requests", calls)
+	}
+
+	// Valid requests and configured identity types
+	for _, request := range []RegistrationRequest{
+		{Name: "user1", Affiliation: "org1"},
+		{Name: "user1", Affiliation: "org1", Type: "peer", MaxEnrollments: -1},
+	} {
+		if _, err := ca.services.Register(registrar, &request); err != nil {
+			t.Fatalf("Register returned error for %v: %v", request, err)
+		}
+	}
+	ca.services.identityTypes = []string{"admin"}
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1",
+		Type: "admin"}); err != nil {
+		t.Fatalf("Register returned error for a configured identity type: %v", err)
+	}
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1",
+		Type: "peer"}); err == nil {
+		t.Fatalf("Register should have failed for an identity type which is not configured")
+	}
+}
+
+func TestRegisterDefaults(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var registered []map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			registered = append(registered, request)
+			return map[string]interface{}{"secret": "userpw"}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	ca.services.defaultType, ca.services.defaultAffiliation = "user", "org1.department1"
+
+	request := &RegistrationRequest{Name: "user1"}
+	if _, err := ca.services.Register(registrar, request); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if request.Type != "" || request.Affiliation != "" {
+		t.Fatalf("Expected the request not to be modified, got %+v", request)
+	}
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "peer1", Type: "peer",
+		Affiliation: "org2"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	results, err := ca.services.RegisterBatch(registrar, []*RegistrationRequest{{Name: "user2", Type: "client"}})
+	if err != nil || results[0].Err != nil {
+		t.Fatalf("RegisterBatch returned error: %v, %v", err, results)
+	}
+	expected := []string{"user1 user org1.department1", "peer1 peer org2", "user2 client org1.department1"}
+	for i, request := range registered {
+		actual := fmt.Sprintf("%s %s %s", request["id"], request["type"], request["affiliation"])
+		if actual != expected[i] {
+			t.Fatalf("Expected registration %s, got %s", expected[i], actual)
+		}
+	}
+
+	// Without defaults, the affiliation is still required
+	ca.services.defaultAffiliation = ""
+	var validationErr *ValidationError
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user3"}); !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError without affiliation, got: %v", err)
+	}
+}
+
+func TestRegisterECertAttributes(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var attrs []interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			attrs, _ = request["attrs"].([]interface{})
+			return map[string]interface{}{"secret": "user1pw"}, http.StatusOK
+		},
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"id": "user1", "type": "user", "affiliation": "org1",
+				"attrs": attrs, "max_enrollments": -1}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	_, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1",
+		Attributes: []Attribute{{Key: "role", Value: "auditor", ECert: true}, {Key: "dept", Value: "hr"}}})
+	if err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	encoded, _ := json.Marshal(attrs)
+	if string(encoded) != `[{"ecert":true,"name":"role","value":"auditor"},{"name":"dept","value":"hr"}]` {
+		t.Fatalf("Unexpected attributes sent to the CA: %s", encoded)
+	}
+	identity, err := ca.services.GetIdentity(registrar, "user1")
+	if err != nil {
+		t.Fatalf("GetIdentity returned error: %v", err)
+	}
+	if len(identity.Attributes) != 2 || !identity.Attributes[0].ECert || identity.Attributes[1].ECert {
+		t.Fatalf("Expected the ecert flags to be returned, got %+v", identity.Attributes)
+	}
+}
+
+func TestRegisterMaxEnrollments(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var maxEnrollments interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			maxEnrollments = request["max_enrollments"]
+			return map[string]interface{}{"credential": base64.StdEncoding.EncodeToString([]byte("user1pw"))},
+				http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	for _, test := range []struct {
+		maxEnrollments int
+		sent           interface{}
+	}{
+		{EnrollmentsUnlimited, float64(-1)},
+		{EnrollmentsServerDefault, nil},
+		{5, float64(5)},
+	} {
+		maxEnrollments = nil
+		if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1",
+			MaxEnrollments: test.maxEnrollments}); err != nil {
+			t.Fatalf("Register returned error: %v", err)
+		}
+		if maxEnrollments != test.sent {
+			t.Fatalf("Expected max_enrollments %v to be sent for %d, got %v", test.sent,
+				test.maxEnrollments, maxEnrollments)
+		}
+	}
+}
+
+func TestRegisterSecret(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var sent []interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			sent = append(sent, request["secret"])
+			secret, ok := request["secret"].(string)
+			if !ok {
+				secret = "generatedpw"
+			}
+			return map[string]interface{}{"credential": base64.StdEncoding.EncodeToString([]byte(secret))},
+				http.StatusOK
+		},
+	})
+	defer ca.Close()
+	recorder := &recordingLogger{}
+	WithLogger(recorder)(ca.services)
+
+	for _, test := range []struct {
+		secret   string
+		expected string
+		weak     bool
+	}{
+		{"", "generatedpw", false},
+		{"Str0ng-Secret!", "Str0ng-Secret!", false},
+		{"12345678", "12345678", true},
+		{"alllowercaseletters", "alllowercaseletters", true},
+	} {
+		sent, recorder.messages = nil, nil
+		secret, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1",
+			Secret: test.secret})
+		if err != nil {
+			t.Fatalf("Register returned error: %v", err)
+		}
+		if secret != test.expected {
+			t.Fatalf("Register returned secret %s, expected %s", secret, test.expected)
+		}
+		if test.secret == "" && sent[0] != nil {
+			t.Fatalf("No secret should be sent when none is set, got %v", sent[0])
+		}
+		if warned := len(recorder.messages["warn"]) == 1; warned != test.weak {
+			t.Fatalf("Expected weak secret warning %t for %s, got %v", test.weak, test.secret, recorder.messages)
+		}
+		for _, message := range recorder.messages["warn"] {
+			if strings.Contains(message, test.secret) {
+				t.Fatalf("The secret was logged: %s", message)
+			}
+		}
+	}
+
+	sent = nil
+	_, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1",
+		Secret: "short"})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(sent) != 0 {
+		t.Fatalf("Expected a ValidationError for a short secret, got: %v", err)
+	}
+}
+
+func TestConcurrentRegister(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	handlers := map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			secret := base64.StdEncoding.EncodeToString([]byte(request["id"].(string) + "pw"))
+			return map[string]interface{}{"credential": secret}, http.StatusOK
+		},
+	}
+	for _, tlsEnabled := range []bool{false, true} {
+		var ca *mockCA
+		if tlsEnabled {
+			ca = newMockTLSCA(t, handlers)
+		} else {
+			ca = newMockCA(t, handlers)
+		}
+		errs := make(chan error, 50)
+		for i := 0; i < 50; i++ {
+			go func(i int) {
+				name := fmt.Sprintf("user%d", i)
+				secret, err := ca.services.Register(registrar, &RegistrationRequest{Name: name,
+					Affiliation: "org1"})
+				if err == nil && secret != name+"pw" {
+					err = fmt.Errorf("Register returned wrong secret %s for %s", secret, name)
+				}
+				errs <- err
+			}(i)
+		}
+		for i := 0; i < 50; i++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("Concurrent Register with TLS %t failed: %v", tlsEnabled, err)
+			}
+		}
+		ca.Close()
+	}
+}
+
+func TestRegisterV2(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var result interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			return result, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	request := &RegistrationRequest{Name: "user1", Affiliation: "org1"}
+
+	// Newer CA versions return the secret in plain text with other fields
+	result = map[string]interface{}{"secret": "user1pw", "enrollmentURL": "http://localhost:7054"}
+	response, err := ca.services.RegisterV2(registrar, request)
+	if err != nil {
+		t.Fatalf("RegisterV2 returned error: %v", err)
+	}
+	if response.Secret != "user1pw" || response.Metadata["enrollmentURL"] != "http://localhost:7054" {
+		t.Fatalf("RegisterV2 returned unexpected response: %v", response)
+	}
+	// Older CA versions return the base64 encoded secret alone
+	result = base64.StdEncoding.EncodeToString([]byte("user1pw"))
+	response, err = ca.services.RegisterV2(registrar, request)
+	if err != nil {
+		t.Fatalf("RegisterV2 returned error: %v", err)
+	}
+	if response.Secret != "user1pw" || len(response.Metadata) != 0 {
+		t.Fatalf("RegisterV2 returned unexpected response: %v", response)
+	}
+	secret, err := ca.services.Register(registrar, request)
+	if err != nil || secret != "user1pw" {
+		t.Fatalf("Register returned unexpected secret %s: %v", secret, err)
+	}
+}
+
+func TestRegisterDryRun(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var registrations int
+	handlers := map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			registrations++
+			return base64.StdEncoding.EncodeToString([]byte("user1pw")), http.StatusOK
+		},
+		"affiliations": func(r *http.Request, body []byte) (interface{}, int) {
+			if r.URL.Path != "/api/v1/cfssl/affiliations/org1" {
+				return "Failed to get affiliation: affiliation does not exist", http.StatusNotFound
+			}
+			return map[string]interface{}{"name": "org1"}, http.StatusOK
+		},
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			if r.URL.Path != "/api/v1/cfssl/identities/admin" {
+				return "Failed to get identity: user does not exist", http.StatusNotFound
+			}
+			return map[string]interface{}{"id": "admin"}, http.StatusOK
+		},
+	}
+	ca := newMockCA(t, handlers)
+	defer ca.Close()
+
+	request := &RegistrationRequest{Name: "user1", Type: "user", Affiliation: "org1", DryRun: true}
+	response, err := ca.services.RegisterV2(registrar, request)
+	if err != nil {
+		t.Fatalf("RegisterV2 returned error: %v", err)
+	}
+	if !response.CAChecked || response.Secret != "" || response.Preview == nil ||
+		response.Preview.Name != "user1" || response.Preview.Affiliation != "org1" {
+		t.Fatalf("RegisterV2 returned unexpected preview: %+v", response)
+	}
+	// Typo in the affiliation and an existing identity
+	_, err = ca.services.RegisterV2(registrar, &RegistrationRequest{Name: "admin", Affiliation: "orgl", DryRun: true})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 ||
+		validationErr.Problems[0] != "Affiliation orgl does not exist" ||
+		validationErr.Problems[1] != "Identity admin is already registered" {
+		t.Fatalf("RegisterV2 should have reported the CA problems, got: %v", err)
+	}
+	// Local validation still runs first
+	_, err = ca.services.RegisterV2(registrar, &RegistrationRequest{Name: "user1", DryRun: true})
+	if !errors.As(err, &validationErr) || validationErr.Problems[0] != "Affiliation is empty" {
+		t.Fatalf("RegisterV2 should have failed local validation, got: %v", err)
+	}
+	if registrations != 0 {
+		t.Fatalf("Dry runs should not register identities")
+	}
+
+	// CAs without the affiliation and identity endpoints only get the local validation
+	delete(handlers, "affiliations")
+	delete(handlers, "identities")
+	response, err = ca.services.RegisterV2(registrar, request)
+	if err != nil {
+		t.Fatalf("RegisterV2 returned error: %v", err)
+	}
+	if response.CAChecked {
+		t.Fatalf("RegisterV2 should not report CA checks the CA does not support")
+	}
+	if secret, err := ca.services.Register(registrar, request); err != nil || secret != "" {
+		t.Fatalf("Register should have returned an empty secret for a dry run, got %s: %v", secret, err)
+	}
+	if registrations != 0 {
+		t.Fatalf("Dry runs should not register identities")
+	}
+}
+
+func TestRegisterBatch(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	registered := make(map[string]bool)
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			name, _ := request["id"].(string)
+			if registered[name] {
+				return fmt.Sprintf("Identity '%s' is already registered", name), http.StatusInternalServerError
+			}
+			registered[name] = true
+			return base64.StdEncoding.EncodeToString([]byte(name + "pw")), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	requests := []*RegistrationRequest{
+		{Name: "user1", Affiliation: "org1"},
+		{Name: "user1", Affiliation: "org1"},
+		{Name: "user2"},
+		nil,
+		{Name: "user3", Affiliation: "org1"},
+	}
+	results, err := ca.services.RegisterBatch(registrar, requests)
+	if err != nil {
+		t.Fatalf("RegisterBatch returned error: %v", err)
+	}
+	if len(results) != len(requests) {
+		t.Fatalf("Expected %d results, got %d", len(requests), len(results))
+	}
+	for i, result := range results {
+		if result.Index != i {
+			t.Fatalf("Result %d has index %d", i, result.Index)
+		}
+	}
+	if results[0].Err != nil || results[0].Secret != "user1pw" {
+		t.Fatalf("Expected user1 to be registered: %+v", results[0])
+	}
+	if !errors.Is(results[1].Err, ErrAlreadyRegistered) || results[1].Secret != "" {
+		t.Fatalf("Expected the duplicate user1 to fail with ErrAlreadyRegistered: %+v", results[1])
+	}
+	var validationErr *ValidationError
+	if !errors.As(results[2].Err, &validationErr) {
+		t.Fatalf("Expected user2 to fail validation: %+v", results[2])
+	}
+	if results[3].Err == nil {
+		t.Fatalf("Expected the nil request to fail")
+	}
+	if results[4].Err != nil || results[4].Secret != "user3pw" {
+		t.Fatalf("Expected user3 to be registered past the failures: %+v", results[4])
+	}
+
+	if _, err := ca.services.RegisterBatch(nil, requests); err == nil {
+		t.Fatalf("RegisterBatch should have failed without a registrar")
+	}
+}
+
+func TestRegisterIfNotExists(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	registerStatus := http.StatusOK
+	var registerResult interface{} = base64.StdEncoding.EncodeToString([]byte("user1pw"))
+	handlers := map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			return registerResult, registerStatus
+		},
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"id": "user1", "type": "user", "affiliation": "org1"}, http.StatusOK
+		},
+	}
+	ca := newMockCA(t, handlers)
+	defer ca.Close()
+	request := &RegistrationRequest{Name: "user1", Affiliation: "org1", IfNotExists: true}
+
+	response, err := ca.services.RegisterV2(registrar, request)
+	if err != nil || response.Secret != "user1pw" || response.AlreadyRegistered {
+		t.Fatalf("RegisterV2 should have registered user1, got %+v: %v", response, err)
+	}
+
+	registerStatus, registerResult = http.StatusInternalServerError, "Identity 'user1' is already registered"
+	response, err = ca.services.RegisterV2(registrar, request)
+	if err != nil {
+		t.Fatalf("RegisterV2 should have tolerated the registered identity, got: %v", err)
+	}
+	if !response.AlreadyRegistered || response.Secret != "" || response.Existing == nil ||
+		response.Existing.Name != "user1" || response.Existing.Affiliation != "org1" {
+		t.Fatalf("RegisterV2 returned unexpected response: %+v", response)
+	}
+	// Dry runs don't report the registered identity as a problem
+	response, err = ca.services.RegisterV2(registrar,
+		&RegistrationRequest{Name: "user1", Affiliation: "org1", IfNotExists: true, DryRun: true})
+	if err != nil || !response.AlreadyRegistered {
+		t.Fatalf("RegisterV2 dry run returned unexpected response %+v: %v", response, err)
+	}
+	// The existing identity is optional
+	delete(handlers, "identities")
+	response, err = ca.services.RegisterV2(registrar, request)
+	if err != nil || !response.AlreadyRegistered || response.Existing != nil {
+		t.Fatalf("RegisterV2 returned unexpected response %+v: %v", response, err)
+	}
+	if secret, err := ca.services.Register(registrar, request); err != nil || secret != "" {
+		t.Fatalf("Register should have returned an empty secret, got %s: %v", secret, err)
+	}
+	// Only already registered errors are tolerated
+	_, err = ca.services.RegisterV2(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	if !errors.Is(err, ErrAlreadyRegistered) {
+		t.Fatalf("RegisterV2 without IfNotExists should have failed with ErrAlreadyRegistered, got: %v", err)
+	}
+	registerStatus, registerResult = http.StatusForbidden, "Caller is not authorized to register"
+	if _, err := ca.services.RegisterV2(registrar, request); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("RegisterV2 should have failed with ErrPermissionDenied, got: %v", err)
+	}
+}
+
 func TestRevoke(t *testing.T) {
-	fabricCAClient, err := NewFabricCAClient()
+	fabricCAClient, err := NewFabricCAClient(WithInsecure())
 	if err != nil {
 		t.Fatalf("NewFabricCAClient returned error: %v", err)
 	}
@@ -112,12 +2098,322 @@ func TestRevoke(t *testing.T) {
 	}
 	user.SetEnrollmentCertificate(readCert(t))
 	user.SetPrivateKey(mockKey)
-	err = fabricCAClient.Revoke(user, &RevocationRequest{})
+	err = fabricCAClient.Revoke(user, &RevocationRequest{Name: "test"})
 	if err == nil {
 		t.Fatalf("Expected decoding error with test cert")
 	}
 }
 
+func TestRevocationReason(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var reason interface{}
+	calls := 0
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			calls++
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			reason = request["reason"]
+			return map[string]interface{}{}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	for _, test := range []struct {
+		request RevocationRequest
+		sent    interface{}
+	}{
+		{RevocationRequest{Name: "user1"}, nil},
+		{RevocationRequest{Name: "user1", ReasonCode: KeyCompromise}, float64(1)},
+		{RevocationRequest{Name: "user1", Reason: 4}, float64(4)},
+		{RevocationRequest{Name: "user1", Reason: 10, ReasonCode: AACompromise}, float64(10)},
+	} {
+		reason = nil
+		if err := ca.services.Revoke(registrar, &test.request); err != nil {
+			t.Fatalf("Revoke returned error for %+v: %v", test.request, err)
+		}
+		if reason != test.sent {
+			t.Fatalf("Expected reason %v to be sent for %+v, got %v", test.sent, test.request, reason)
+		}
+	}
+
+	calls = 0
+	for _, request := range []RevocationRequest{
+		{Name: "user1", Reason: 7},
+		{Name: "user1", Reason: -1},
+		{Name: "user1", Reason: 11},
+		{Name: "user1", ReasonCode: 7},
+		{Name: "user1", Reason: 1, ReasonCode: Superseded},
+	} {
+		var validationErr *ValidationError
+		if err := ca.services.Revoke(registrar, &request); !errors.As(err, &validationErr) {
+			t.Fatalf("Expected a ValidationError for %+v, got: %v", request, err)
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("Invalid revocation reasons should not reach the CA, got %d requests", calls)
+	}
+}
+
+func TestRevocationTarget(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var sent map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			sent = nil
+			json.Unmarshal(body, &sent)
+			return map[string]interface{}{}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	for _, test := range []struct {
+		name    string
+		request RevocationRequest
+		serial  interface{}
+		aki     interface{}
+		valid   bool
+	}{
+		{"name", RevocationRequest{Name: "user1"}, nil, nil, true},
+		{"lowercase hex", RevocationRequest{Serial: "4a9f", AKI: "0b1c"}, "4a9f", "0b1c", true},
+		{"uppercase hex", RevocationRequest{Serial: "4A9F", AKI: "0B1C"}, "4a9f", "0b1c", true},
+		{"colon separated", RevocationRequest{Serial: "4A:9F", AKI: "0B:1C"}, "4a9f", "0b1c", true},
+		{"name with serial", RevocationRequest{Name: "user1", Serial: "4a9f", AKI: "0b1c"}, "4a9f", "0b1c", true},
+		{"empty", RevocationRequest{}, nil, nil, false},
+		{"serial without aki", RevocationRequest{Serial: "4a9f"}, nil, nil, false},
+		{"aki without serial", RevocationRequest{AKI: "0b1c"}, nil, nil, false},
+		{"name with serial only", RevocationRequest{Name: "user1", Serial: "4a9f"}, nil, nil, false},
+		{"invalid serial", RevocationRequest{Serial: "4g9f", AKI: "0b1c"}, nil, nil, false},
+		{"invalid aki", RevocationRequest{Serial: "4a9f", AKI: "0b-1c"}, nil, nil, false},
+	} {
+		sent = nil
+		err := ca.services.Revoke(registrar, &test.request)
+		if !test.valid {
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || sent != nil {
+				t.Fatalf("%s: expected a ValidationError before reaching the CA, got: %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Revoke returned error: %v", test.name, err)
+		}
+		if sent["serial"] != test.serial || sent["aki"] != test.aki {
+			t.Fatalf("%s: expected serial %v and AKI %v to be sent, got %v", test.name, test.serial,
+				test.aki, sent)
+		}
+	}
+}
+
+func TestReenroll(t *testing.T) {
+	fabricCAClient, err := NewFabricCAClient(WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	// Reenroll with nil user
+	_, _, err = fabricCAClient.Reenroll(nil)
+	if err == nil {
+		t.Fatalf("Expected error with nil user")
+	}
+	// Reenroll with user without enrolment information
+	_, _, err = fabricCAClient.Reenroll(fabricclient.NewUser("test"))
+	if err == nil {
+		t.Fatalf("Expected error without user enrolment information")
+	}
+	// Reenroll with an expired certificate
+	expired := newTestUser(t, "expired", time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))
+	_, _, err = fabricCAClient.Reenroll(expired)
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("Expected expired certificate error. Got: %v", err)
+	}
+}
+
+func TestReenrollWithMockCA(t *testing.T) {
+	user := newTestUser(t, "reenroll", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"reenroll": func(r *http.Request, body []byte) (interface{}, int) {
+			if r.Header.Get("authorization") == "" {
+				t.Fatalf("Expected reenroll request to carry an authorization token")
+			}
+			return base64.StdEncoding.EncodeToString(user.GetEnrollmentCertificate()), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	key, cert, err := ca.services.Reenroll(user)
+	if err != nil {
+		t.Fatalf("Reenroll returned error: %v", err)
+	}
+	if key == nil || cert == nil {
+		t.Fatalf("Reenroll returned empty key or cert")
+	}
+}
+
+func TestRevokeWithCRL(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	crlDER := []byte("crl")
+	var requests []map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			requests = append(requests, request)
+			response := map[string]interface{}{"RevokedCerts": []interface{}{}}
+			if request["gencrl"] == true {
+				crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+				response["CRL"] = base64.StdEncoding.EncodeToString(crlPEM)
+			}
+			return response, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	crl, err := ca.services.RevokeWithCRL(registrar, &RevocationRequest{Name: "user1", GenCRL: true})
+	if err != nil {
+		t.Fatalf("RevokeWithCRL returned error: %v", err)
+	}
+	if string(crl) != string(crlDER) {
+		t.Fatalf("RevokeWithCRL returned wrong CRL: %s", crl)
+	}
+	// Revoke never requests a CRL
+	err = ca.services.Revoke(registrar, &RevocationRequest{Name: "user1", GenCRL: true})
+	if err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if len(requests) != 2 || requests[0]["id"] != "user1" || requests[1]["gencrl"] != nil {
+		t.Fatalf("Unexpected revocation requests: %v", requests)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var calls int32
+	handler := func(r *http.Request, body []byte) (interface{}, int) {
+		atomic.AddInt32(&calls, 1)
+		return "", http.StatusOK
+	}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll":   handler,
+		"register": handler,
+		"revoke":   handler,
+	})
+	defer ca.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := ca.services.EnrollContext(ctx, "enrollmentID", "enrollmentSecret"); err != context.Canceled {
+		t.Fatalf("EnrollContext should have returned context.Canceled, got: %v", err)
+	}
+	if _, err := ca.services.RegisterContext(ctx, registrar,
+		&RegistrationRequest{Name: "test", Affiliation: "test"}); err != context.Canceled {
+		t.Fatalf("RegisterContext should have returned context.Canceled, got: %v", err)
+	}
+	if err := ca.services.RevokeContext(ctx, registrar, &RevocationRequest{Name: "test"}); err != context.Canceled {
+		t.Fatalf("RevokeContext should have returned context.Canceled, got: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("Expected no request to reach the CA, got %d", calls)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	release := make(chan struct{})
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			<-release
+			return "", http.StatusOK
+		},
+	})
+	defer ca.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := ca.services.EnrollContext(ctx, "enrollmentID", "enrollmentSecret")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("EnrollContext should have returned context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("EnrollContext did not honor the deadline, returned after %s", elapsed)
+	}
+}
+
+func TestCreateSigningIdentityWithKey(t *testing.T) {
+	// A temporary key never reaches the key store and can't be looked up by SKI
+	csp := bccspFactory.GetDefault()
+	key, err := csp.KeyGen(&bccsp.ECDSAP256KeyGenOpts{Temporary: true})
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	cryptoSigner := &bccspSigner.CryptoSigner{}
+	if err := cryptoSigner.Init(csp, key); err != nil {
+		t.Fatalf("Error creating signer: %v", err)
+	}
+	template := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "hsm"},
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, cryptoSigner.Public(), cryptoSigner)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	registrar := fabricclient.NewUser("hsm")
+	registrar.SetEnrollmentCertificate(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	registrar.SetPrivateKey(key)
+
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			if _, err := util.VerifyToken(csp, r.Header.Get("authorization"), body); err != nil {
+				return fmt.Sprintf("Invalid token: %s", err), http.StatusUnauthorized
+			}
+			return base64.StdEncoding.EncodeToString([]byte("secret")), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1",
+		Affiliation: "org1"}); err != nil {
+		t.Fatalf("Register with a loaded key returned error: %v", err)
+	}
+	if _, err := ca.services.createSigningIdentityWithKey(registrar, nil); err == nil {
+		t.Fatalf("Expected SKI lookup of a temporary key to fail")
+	}
+
+	// Without a key, stored keys are looked up by SKI
+	user := newTestUser(t, "user", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	identity, err := ca.services.createSigningIdentityWithKey(user, nil)
+	if err != nil {
+		t.Fatalf("createSigningIdentityWithKey returned error: %v", err)
+	}
+	if identity.name != "user" || string(identity.key.SKI()) != string(user.GetPrivateKey().SKI()) {
+		t.Fatalf("Unexpected signing identity %s", identity.name)
+	}
+}
+
+func TestSigningIdentityKeyMismatch(t *testing.T) {
+	calls := 0
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			calls++
+			return base64.StdEncoding.EncodeToString([]byte("secret")), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	other := newTestUser(t, "other", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	registrar.SetPrivateKey(other.GetPrivateKey())
+
+	_, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	if err == nil || !strings.Contains(err.Error(), "private key does not match certificate") {
+		t.Fatalf("Expected a key mismatch error, got: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("Requests signed with a mismatched key should not reach the CA")
+	}
+}
+
 // Reads a random cert for testing
 func readCert(t *testing.T) []byte {
 	cert, err := ioutil.ReadFile("../test/fixtures/root.pem")
@@ -126,3 +2422,226 @@ func readCert(t *testing.T) []byte {
 	}
 	return cert
 }
+
+func TestMain(m *testing.M) {
+	keyStorePath, err := ioutil.TempDir("", "fabricca_test")
+	if err != nil {
+		fmt.Printf("Error creating keystore directory: %s\n", err)
+		os.Exit(1)
+	}
+	err = bccspFactory.InitFactories(&bccspFactory.FactoryOpts{
+		ProviderName: "SW",
+		SwOpts: &bccspFactory.SwOpts{
+			HashFamily:   "SHA2",
+			SecLevel:     256,
+			FileKeystore: &bccspFactory.FileKeystoreOpts{KeyStorePath: keyStorePath},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Error initializing BCCSP: %s\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(keyStorePath)
+	os.Exit(code)
+}
+
+// newTestUser creates a user with a self-signed certificate and a private key
+// held by the default BCCSP, so that it can sign requests to a mock CA
+func newTestUser(t testing.TB, name string, notBefore, notAfter time.Time) fabricclient.User {
+	return newTestUserWithTemplate(t, &x509.Certificate{
+		Subject:   pkix.Name{CommonName: name},
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+	})
+}
+
+// newTestUserWithTemplate creates a user from the given certificate template
+func newTestUserWithTemplate(t testing.TB, template *x509.Certificate) fabricclient.User {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err.Error())
+	}
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err.Error())
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %s", err.Error())
+	}
+	key, err := bccspFactory.GetDefault().KeyImport(keyDER, &bccsp.ECDSAPrivateKeyImportOpts{Temporary: false})
+	if err != nil {
+		t.Fatalf("Error importing key: %s", err.Error())
+	}
+	user := fabricclient.NewUser(template.Subject.CommonName)
+	user.SetEnrollmentCertificate(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	user.SetPrivateKey(key)
+	return user
+}
+
+// initTestConfig initializes the SDK configuration with the given yaml content
+// for the duration of the test
+func initTestConfig(t *testing.T, content string) {
+	configDir, err := ioutil.TempDir("", "fabricca_test_config")
+	if err != nil {
+		t.Fatalf("Error creating config directory: %v", err)
+	}
+	configFile := filepath.Join(configDir, "config.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing config file: %v", err)
+		}
+		if err := config.InitConfig(configFile); err != nil {
+			t.Fatalf("InitConfig returned error: %v", err)
+		}
+	}
+	write(content)
+	t.Cleanup(func() {
+		write("client:\n")
+		os.RemoveAll(configDir)
+	})
+}
+
+// newIssuingEnrollHandler creates an enroll handler issuing certificates for
+// the CSR of the requests
+func newIssuingEnrollHandler(t *testing.T) mockCAHandler {
+	return newIssuingHandler(t, func() (time.Time, time.Time) {
+		return time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	})
+}
+
+// newIssuingHandler creates an enroll handler issuing certificates for the
+// CSR it receives, valid for the period returned by validity
+func newIssuingHandler(t *testing.T, validity func() (time.Time, time.Time)) mockCAHandler {
+	issuer := newTestUser(t, "ca", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	issuerCert, err := x509.ParseCertificate(mustDecodePEM(t, issuer.GetEnrollmentCertificate()))
+	if err != nil {
+		t.Fatalf("Error parsing issuer certificate: %v", err)
+	}
+	issuerSigner := newCryptoSigner(t, issuer)
+	return func(r *http.Request, body []byte) (interface{}, int) {
+		var request signer.SignRequest
+		json.Unmarshal(body, &request)
+		csr, err := x509.ParseCertificateRequest(mustDecodePEM(t, []byte(request.Request)))
+		if err != nil || csr.CheckSignature() != nil {
+			return fmt.Sprintf("Invalid CSR: %v", err), http.StatusBadRequest
+		}
+		template := &x509.Certificate{
+			Subject:      csr.Subject,
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+		}
+		template.NotBefore, template.NotAfter = validity()
+		der, err := x509.CreateCertificate(rand.Reader, template, issuerCert, csr.PublicKey, issuerSigner)
+		if err != nil {
+			return fmt.Sprintf("Error issuing certificate: %v", err), http.StatusInternalServerError
+		}
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		return base64.StdEncoding.EncodeToString(certPEM), http.StatusOK
+	}
+}
+
+// mustDecodePEM returns the DER bytes of a PEM block
+func mustDecodePEM(t *testing.T, data []byte) []byte {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("Error decoding PEM block")
+	}
+	return block.Bytes
+}
+
+// newCryptoSigner wraps the private key of a user as a crypto.Signer
+func newCryptoSigner(t *testing.T, user fabricclient.User) *bccspSigner.CryptoSigner {
+	cryptoSigner := &bccspSigner.CryptoSigner{}
+	if err := cryptoSigner.Init(bccspFactory.GetDefault(), user.GetPrivateKey()); err != nil {
+		t.Fatalf("Error creating signer: %v", err)
+	}
+	return cryptoSigner
+}
+
+// mockCAHandler serves a fabric-ca endpoint and its sub paths. It returns the result to be
+// wrapped in a cfssl response and the HTTP status code
+type mockCAHandler func(r *http.Request, body []byte) (interface{}, int)
+
+// mockCA is a fake fabric-ca server together with a Services instance
+// pointing at it
+type mockCA struct {
+	*httptest.Server
+	services *services
+	// files are removed on Close
+	files []string
+}
+
+// Close shuts down the fake server and removes its files
+func (ca *mockCA) Close() {
+	ca.Server.Close()
+	for _, file := range ca.files {
+		os.Remove(file)
+	}
+}
+
+// newMockCA starts a fake fabric-ca server serving the given endpoints
+func newMockCA(t testing.TB, handlers map[string]mockCAHandler) *mockCA {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Handlers are looked up by the first segment of the endpoint path
+		endpoint := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/v1/cfssl/"), "/", 2)[0]
+		handler, ok := handlers[endpoint]
+		if !ok {
+			writeMockCAResponse(w, nil, http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		result, status := handler(r, body)
+		writeMockCAResponse(w, result, status)
+	}))
+	c, err := fabric_ca.NewClient("")
+	if err != nil {
+		t.Fatalf("fabric_ca.NewClient returned error: %v", err)
+	}
+	c.Config.URL = server.URL
+	return &mockCA{Server: server,
+		services: &services{fabricCAClient: c, logger: defaultLogger, metrics: nopMetrics{},
+			tracer: nopTracer{}}}
+}
+
+// newMockTLSCA starts a fake fabric-ca server over TLS, trusted by the
+// fabric-ca client of the returned Services
+func newMockTLSCA(t testing.TB, handlers map[string]mockCAHandler) *mockCA {
+	ca := newMockCA(t, handlers)
+	ca.Server.Close()
+	ca.Server = httptest.NewTLSServer(ca.Server.Config.Handler)
+	certFile, err := ioutil.TempFile("", "mockca")
+	if err != nil {
+		t.Fatalf("Error creating CA certificate file: %v", err)
+	}
+	defer certFile.Close()
+	pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Server.Certificate().Raw})
+	config := ca.services.fabricCAClient.Config
+	config.URL = ca.Server.URL
+	config.TLS.Enabled = true
+	config.TLS.CertFilesList = []string{certFile.Name()}
+	ca.files = append(ca.files, certFile.Name())
+	return ca
+}
+
+// writeMockCAResponse writes a cfssl formatted response. Results for error
+// status codes are sent as the error message
+func writeMockCAResponse(w http.ResponseWriter, result interface{}, status int) {
+	response := map[string]interface{}{
+		"success":  status < 400,
+		"result":   nil,
+		"errors":   []interface{}{},
+		"messages": []interface{}{},
+	}
+	if status < 400 {
+		response["result"] = result
+	} else if result != nil {
+		response["errors"] = []interface{}{map[string]interface{}{"code": status, "message": result}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
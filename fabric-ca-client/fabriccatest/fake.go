@@ -0,0 +1,431 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabriccatest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	fabricca "github.com/hyperledger/fabric-sdk-go/fabric-ca-client"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric/bccsp/factory"
+	cspsigner "github.com/hyperledger/fabric/bccsp/signer"
+)
+
+// DefaultCAName is the name of the CA of the FakeServices created without a
+// name
+const DefaultCAName = "fakeca"
+
+// Version is the CA version returned by GetCAInfo
+const Version = "fabriccatest"
+
+// AnyMethod is the method name SetError fails all the methods with
+const AnyMethod = "*"
+
+// certValidity is the validity of the certificates issued by FakeServices
+const certValidity = 365 * 24 * time.Hour
+
+// Call is a call made to FakeServices: the name of the method and its
+// arguments, in order
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Identity is an identity registered with FakeServices
+type Identity struct {
+	Name           string
+	Secret         string
+	Type           string
+	Affiliation    string
+	MaxEnrollments int
+	Attributes     []fabricca.Attribute
+}
+
+// identity is a registered Identity and its enrollment state
+type identity struct {
+	Identity
+	enrollments int
+	// revoked is set when the identity is revoked, it can't enroll anymore
+	revoked bool
+}
+
+// issuedCert is a certificate issued by FakeServices
+type issuedCert struct {
+	info      fabricca.CertInfo
+	serial    *big.Int
+	revokedAt time.Time
+	reason    fabricca.RevocationReason
+}
+
+// FakeServices is an in-memory fabricca.Services for the unit tests of code
+// using the SDK. It keeps registered identities and affiliations, issues
+// real certificates signed by a CA key of its own and records every call,
+// see Calls. Requests are not authorized, any registrar is accepted: use
+// SetError to simulate failures
+type FakeServices struct {
+	mu           sync.Mutex
+	caName       string
+	caCert       *x509.Certificate
+	caCertPEM    []byte
+	caKey        *ecdsa.PrivateKey
+	identities   map[string]*identity
+	affiliations map[string]bool
+	certs        []*issuedCert
+	errs         map[string]error
+	calls        []Call
+	closed       bool
+	// revision is the last RevisionAttr value set by a secret rotation or a
+	// conditional modification
+	revision int
+	// tlsCA is the TLS CA of GetTLSCACerts, see SetTLSCA
+	tlsCA *FakeServices
+}
+
+var _ fabricca.Services = (*FakeServices)(nil)
+
+// NewFakeServices ...
+/**
+ * @param {string} caName The name of the CA, DefaultCAName when empty
+ * @returns {FakeServices} services without identities or affiliations
+ */
+func NewFakeServices(caName string) (*FakeServices, error) {
+	if caName == "" {
+		caName = DefaultCAName
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating CA key: %s", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: caName},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(10 * certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          subjectKeyID(&caKey.PublicKey),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating CA certificate: %s", err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &FakeServices{
+		caName:       caName,
+		caCert:       caCert,
+		caCertPEM:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		caKey:        caKey,
+		identities:   make(map[string]*identity),
+		affiliations: make(map[string]bool),
+		errs:         make(map[string]error),
+	}, nil
+}
+
+// PreloadIdentity registers an identity, as if registered before the test.
+// Its affiliation and their parents are added when missing
+func (f *FakeServices) PreloadIdentity(id Identity) error {
+	if id.Name == "" || id.Secret == "" {
+		return fmt.Errorf("Identity name and secret cannot be empty")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.identities[id.Name] != nil {
+		return fmt.Errorf("Identity %s is already registered", id.Name)
+	}
+	if id.Affiliation != "" {
+		f.addAffiliation(id.Affiliation)
+	}
+	id.Attributes = append([]fabricca.Attribute(nil), id.Attributes...)
+	f.identities[id.Name] = &identity{Identity: id}
+	return nil
+}
+
+// PreloadAffiliations adds affiliations, e.g. org1.department1, and their
+// parents, as if added before the test
+func (f *FakeServices) PreloadAffiliations(names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range names {
+		f.addAffiliation(name)
+	}
+}
+
+// GetRegisteredIdentity returns the identity registered under name
+func (f *FakeServices) GetRegisteredIdentity(name string) (Identity, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.identities[name]
+	if id == nil {
+		return Identity{}, false
+	}
+	registered := id.Identity
+	registered.Attributes = append([]fabricca.Attribute(nil), id.Attributes...)
+	return registered, true
+}
+
+// SetError makes the calls to method, e.g. "Register" or AnyMethod for all
+// of them, fail with err, e.g. UnreachableError(). Errors set for a method
+// take precedence over the AnyMethod one. A nil err removes the error
+func (f *FakeServices) SetError(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errs, method)
+		return
+	}
+	f.errs[method] = err
+}
+
+// SetTLSCA makes the certificate of tlsCA the chain returned by
+// GetTLSCACerts, which fails until a TLS CA is set
+func (f *FakeServices) SetTLSCA(tlsCA *FakeServices) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tlsCA = tlsCA
+}
+
+// Calls returns the calls made so far, in order
+func (f *FakeServices) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// CallsTo returns the calls made so far to method, in order
+func (f *FakeServices) CallsTo(method string) []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []Call
+	for _, call := range f.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// UnreachableError returns the error of a CA which can't be reached, which
+// matches fabricca.ErrCAUnreachable
+func UnreachableError() error {
+	return &fabricca.CAError{Kind: fabricca.ErrCAUnreachable, Message: "connection refused"}
+}
+
+// InvalidCredentialsError returns the error of the CA rejecting a secret or
+// certificate, which matches fabricca.ErrInvalidCredentials
+func InvalidCredentialsError() error {
+	return &fabricca.CAError{Kind: fabricca.ErrInvalidCredentials, StatusCode: 401, Code: 20,
+		Message: "Authentication failure"}
+}
+
+// PermissionDeniedError returns the error of the CA refusing a request of a
+// registrar, which matches fabricca.ErrPermissionDenied
+func PermissionDeniedError() error {
+	return &fabricca.CAError{Kind: fabricca.ErrPermissionDenied, StatusCode: 403, Code: 71,
+		Message: "Authorization failure"}
+}
+
+// notFoundError returns the error of a request referring to an identity,
+// affiliation or certificate unknown to the CA
+func notFoundError(format string, args ...interface{}) error {
+	return &fabricca.CAError{Kind: fabricca.ErrNotFound, StatusCode: 404, Code: 63,
+		Message: fmt.Sprintf(format, args...)}
+}
+
+// checkCAName fails like a server hosting a single CA when caName, set by a
+// request, is not the name of the CA
+func (f *FakeServices) checkCAName(caName string) error {
+	if caName != "" && caName != f.caName {
+		return notFoundError("CA '%s' does not exist", caName)
+	}
+	return nil
+}
+
+// record records a call to method and returns the error it fails with:
+// fabricca.ErrClosed once closed, or the error set with SetError
+func (f *FakeServices) record(method string, args ...interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, Call{Method: method, Args: args})
+	if f.closed {
+		return fabricca.ErrClosed
+	}
+	if err, ok := f.errs[method]; ok {
+		return err
+	}
+	return f.errs[AnyMethod]
+}
+
+// CAName returns the name of the CA
+func (f *FakeServices) CAName() string {
+	return f.caName
+}
+
+// GetCAInfo returns the name and certificate of the CA
+func (f *FakeServices) GetCAInfo() (*fabricca.CAInfo, error) {
+	if err := f.record("GetCAInfo"); err != nil {
+		return nil, err
+	}
+	return &fabricca.CAInfo{CAName: f.caName, CAChain: append([]byte(nil), f.caCertPEM...),
+		Version: Version}, nil
+}
+
+// GetCACertPool returns a pool of the self-signed certificate of the CA
+func (f *FakeServices) GetCACertPool(ctx context.Context) (*x509.CertPool, error) {
+	if err := f.record("GetCACertPool", ctx); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(f.caCert)
+	return pool, nil
+}
+
+// GetTLSCACerts returns the self-signed certificate of the TLS CA set with
+// SetTLSCA
+func (f *FakeServices) GetTLSCACerts(ctx context.Context) ([][]byte, error) {
+	if err := f.record("GetTLSCACerts", ctx); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	tlsCA := f.tlsCA
+	f.mu.Unlock()
+	if tlsCA == nil {
+		return nil, fmt.Errorf("GetTLSCACerts failed: no TLS CA is configured for CA %s", f.caName)
+	}
+	return [][]byte{append([]byte(nil), tlsCA.caCertPEM...)}, nil
+}
+
+// Ping succeeds unless an error is set, failing once ctx is done
+func (f *FakeServices) Ping(ctx context.Context) error {
+	if err := f.record("Ping", ctx); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// BreakerState returns fabricca.BreakerClosed, the fake has no circuit
+// breaker
+func (f *FakeServices) BreakerState() fabricca.BreakerState {
+	return fabricca.BreakerClosed
+}
+
+// SignerFor returns a crypto.Signer backed by the user's private key in the
+// default BCCSP
+func (f *FakeServices) SignerFor(user fabricclient.User) (crypto.Signer, error) {
+	if err := f.record("SignerFor", user); err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("User cannot be nil")
+	}
+	if user.GetPrivateKey() == nil {
+		return nil, fmt.Errorf("Unable to read user private key")
+	}
+	signer := &cspsigner.CryptoSigner{}
+	if err := signer.Init(factory.GetDefault(), user.GetPrivateKey()); err != nil {
+		return nil, fmt.Errorf("Error creating signer: %s", err)
+	}
+	return signer, nil
+}
+
+// OpenSession returns a Session performing its operations with the
+// FakeServices
+func (f *FakeServices) OpenSession() (fabricca.Session, error) {
+	if err := f.record("OpenSession"); err != nil {
+		return nil, err
+	}
+	return &fakeSession{fake: f}, nil
+}
+
+// fakeSession is the Session of fake
+type fakeSession struct {
+	fake   *FakeServices
+	closed bool
+}
+
+func (s *fakeSession) Enroll(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error) {
+	if s.closed {
+		return nil, nil, fabricca.ErrClosed
+	}
+	return s.fake.Enroll(enrollmentID, enrollmentSecret)
+}
+
+func (s *fakeSession) Register(registrar fabricclient.User,
+	request *fabricca.RegistrationRequest) (string, error) {
+	if s.closed {
+		return "", fabricca.ErrClosed
+	}
+	return s.fake.Register(registrar, request)
+}
+
+func (s *fakeSession) Close() error {
+	s.closed = true
+	return nil
+}
+
+// Close makes the calls which follow fail with fabricca.ErrClosed
+func (f *FakeServices) Close() error {
+	f.record("Close")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// newSerial returns a random certificate serial number
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Error generating serial number: %s", err)
+	}
+	return serial, nil
+}
+
+// subjectKeyID returns the SHA-1 hash of the public key, as used as subject
+// key identifier by the CA
+func subjectKeyID(publicKey *ecdsa.PublicKey) []byte {
+	hash := sha1.Sum(elliptic.Marshal(publicKey.Curve, publicKey.X, publicKey.Y))
+	return hash[:]
+}
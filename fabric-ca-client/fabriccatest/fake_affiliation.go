@@ -0,0 +1,235 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabriccatest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	fabricca "github.com/hyperledger/fabric-sdk-go/fabric-ca-client"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// AddAffiliation adds an affiliation whose parent exists
+func (f *FakeServices) AddAffiliation(registrar fabricclient.User,
+	name string) (*fabricca.AffiliationResponse, error) {
+	if err := f.record("AddAffiliation", registrar, name); err != nil {
+		return nil, err
+	}
+	if err := checkAffiliationRequest(registrar, name); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.affiliations[name] {
+		return nil, &fabricca.CAError{StatusCode: 400,
+			Message: fmt.Sprintf("Affiliation '%s' already exists", name)}
+	}
+	if parent := parentAffiliation(name); parent != "" && !f.affiliations[parent] {
+		return nil, notFoundError("Parent affiliation '%s' does not exist", parent)
+	}
+	f.addAffiliation(name)
+	return &fabricca.AffiliationResponse{Name: name}, nil
+}
+
+// GetAffiliation returns an affiliation with its children and identities
+func (f *FakeServices) GetAffiliation(registrar fabricclient.User,
+	name string) (*fabricca.AffiliationResponse, error) {
+	if err := f.record("GetAffiliation", registrar, name); err != nil {
+		return nil, err
+	}
+	if err := checkAffiliationRequest(registrar, name); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.affiliations[name] {
+		return nil, notFoundError("Affiliation '%s' does not exist", name)
+	}
+	return f.affiliationResponse(name), nil
+}
+
+// GetAllAffiliations returns all affiliations, parents before children
+func (f *FakeServices) GetAllAffiliations(registrar fabricclient.User) ([]*fabricca.AffiliationResponse, error) {
+	if err := f.record("GetAllAffiliations", registrar); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var affiliations []*fabricca.AffiliationResponse
+	for _, name := range f.sortedAffiliations() {
+		affiliations = append(affiliations, f.affiliationResponse(name))
+	}
+	return affiliations, nil
+}
+
+// GetAffiliationTree returns all affiliations as a tree
+func (f *FakeServices) GetAffiliationTree(registrar fabricclient.User) (*fabricca.AffiliationNode, error) {
+	if err := f.record("GetAffiliationTree", registrar); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	root := &fabricca.AffiliationNode{}
+	nodes := map[string]*fabricca.AffiliationNode{"": root}
+	for _, name := range f.sortedAffiliations() {
+		node := &fabricca.AffiliationNode{Name: name[strings.LastIndex(name, ".")+1:], Path: name}
+		parent := nodes[parentAffiliation(name)]
+		parent.Children = append(parent.Children, node)
+		nodes[name] = node
+	}
+	return root, nil
+}
+
+// RemoveAffiliation removes an affiliation. Unless force is set, it must
+// have no child affiliation or identity
+func (f *FakeServices) RemoveAffiliation(registrar fabricclient.User, name string,
+	force bool) (*fabricca.AffiliationResponse, error) {
+	if err := f.record("RemoveAffiliation", registrar, name, force); err != nil {
+		return nil, err
+	}
+	if err := checkAffiliationRequest(registrar, name); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.affiliations[name] {
+		return nil, notFoundError("Affiliation '%s' does not exist", name)
+	}
+	response := f.affiliationResponse(name)
+	if !force && (len(response.Affiliations) > 0 || len(response.Identities) > 0) {
+		return nil, &fabricca.CAError{StatusCode: 400, Message: fmt.Sprintf(
+			"Cannot delete affiliation '%s' which has child affiliations or identities, unless forced", name)}
+	}
+	delete(f.affiliations, name)
+	for _, child := range response.Affiliations {
+		delete(f.affiliations, child)
+	}
+	for _, id := range response.Identities {
+		delete(f.identities, id)
+	}
+	return response, nil
+}
+
+// RevokeAffiliation revokes the identities of an affiliation and its child
+// affiliations but the registrar, then generates the CRL when the registrar
+// has the hf.GenCRL attribute
+func (f *FakeServices) RevokeAffiliation(registrar fabricclient.User, affiliation string,
+	reason fabricca.RevocationReason) (fabricca.RevokeSummary, error) {
+	summary := fabricca.RevokeSummary{Affiliation: affiliation, Errors: map[string]error{}}
+	if err := f.record("RevokeAffiliation", registrar, affiliation, reason); err != nil {
+		return summary, err
+	}
+	if err := checkAffiliationRequest(registrar, affiliation); err != nil {
+		return summary, err
+	}
+	caps, err := registrarCaps(registrar)
+	if err != nil {
+		return summary, err
+	}
+	f.mu.Lock()
+	exists := f.affiliations[affiliation]
+	response := f.affiliationResponse(affiliation)
+	f.mu.Unlock()
+	if !exists {
+		return summary, notFoundError("Affiliation '%s' does not exist", affiliation)
+	}
+	summary.Total = len(response.Identities)
+	for _, name := range response.Identities {
+		if name == registrar.GetName() {
+			summary.Skipped = append(summary.Skipped, name)
+			continue
+		}
+		if err := f.revoke(registrar, &fabricca.RevocationRequest{Name: name, ReasonCode: reason}); err != nil {
+			summary.Errors[name] = err
+			continue
+		}
+		summary.Revoked = append(summary.Revoked, name)
+	}
+	if caps.GenCRL {
+		summary.CRL, summary.CRLErr = f.generateCRL(&fabricca.CRLRequest{})
+	}
+	return summary, nil
+}
+
+// checkAffiliationRequest checks the registrar and name of an affiliation
+// request are set
+func checkAffiliationRequest(registrar fabricclient.User, name string) error {
+	if registrar == nil {
+		return fmt.Errorf("Registrar cannot be nil")
+	}
+	if name == "" {
+		return fmt.Errorf("Affiliation name cannot be empty")
+	}
+	return nil
+}
+
+// addAffiliation adds an affiliation and its missing parents. The caller
+// holds f.mu
+func (f *FakeServices) addAffiliation(name string) {
+	for ; name != ""; name = parentAffiliation(name) {
+		f.affiliations[name] = true
+	}
+}
+
+// parentAffiliation returns the path of the parent of an affiliation, empty
+// for a top level affiliation
+func parentAffiliation(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// sortedAffiliations returns the paths of the affiliations, sorted so that
+// parents come before their children. The caller holds f.mu
+func (f *FakeServices) sortedAffiliations() []string {
+	names := make([]string, 0, len(f.affiliations))
+	for name := range f.affiliations {
+		names = append(names, name)
+	}
+	// A path sorts before the paths it prefixes
+	sort.Strings(names)
+	return names
+}
+
+// affiliationResponse returns an affiliation with its child affiliations
+// and identities. The caller holds f.mu
+func (f *FakeServices) affiliationResponse(name string) *fabricca.AffiliationResponse {
+	response := &fabricca.AffiliationResponse{Name: name}
+	for _, child := range f.sortedAffiliations() {
+		if strings.HasPrefix(child, name+".") {
+			response.Affiliations = append(response.Affiliations, child)
+		}
+	}
+	for _, id := range f.sortedIdentities() {
+		if id.Affiliation == name || strings.HasPrefix(id.Affiliation, name+".") {
+			response.Identities = append(response.Identities, id.Name)
+		}
+	}
+	return response
+}
@@ -0,0 +1,286 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabriccatest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	fabricca "github.com/hyperledger/fabric-sdk-go/fabric-ca-client"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// Revoke revokes the certificates of an identity, or the certificate of
+// request.Serial and request.AKI
+func (f *FakeServices) Revoke(registrar fabricclient.User, request *fabricca.RevocationRequest) error {
+	if err := f.record("Revoke", registrar, request); err != nil {
+		return err
+	}
+	return f.revoke(registrar, request)
+}
+
+// RevokeContext revokes like Revoke, failing once ctx is done
+func (f *FakeServices) RevokeContext(ctx context.Context, registrar fabricclient.User,
+	request *fabricca.RevocationRequest) error {
+	if err := f.record("RevokeContext", ctx, registrar, request); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return f.revoke(registrar, request)
+}
+
+// RevokeWithCRL revokes like Revoke, returning the DER encoded CRL when
+// request.GenCRL is set
+func (f *FakeServices) RevokeWithCRL(registrar fabricclient.User,
+	request *fabricca.RevocationRequest) ([]byte, error) {
+	if err := f.record("RevokeWithCRL", registrar, request); err != nil {
+		return nil, err
+	}
+	if err := f.revoke(registrar, request); err != nil {
+		return nil, err
+	}
+	if !request.GenCRL {
+		return nil, nil
+	}
+	return f.generateCRL(&fabricca.CRLRequest{})
+}
+
+// revoke revokes the certificates selected by request
+func (f *FakeServices) revoke(registrar fabricclient.User, request *fabricca.RevocationRequest) error {
+	if registrar == nil {
+		return fmt.Errorf("Registrar cannot be nil")
+	}
+	if request == nil {
+		return fmt.Errorf("Revocation request cannot be nil")
+	}
+	serial, aki := normalizeHex(request.Serial), normalizeHex(request.AKI)
+	if (serial == "") != (aki == "") || (request.Name == "" && serial == "") {
+		return &fabricca.ValidationError{Problems: []string{"Name, or Serial and AKI, must be set"}}
+	}
+	if request.RevokeNewestOnly && (request.Name == "" || serial != "") {
+		return &fabricca.ValidationError{Problems: []string{
+			"RevokeNewestOnly must be set with Name, without Serial and AKI"}}
+	}
+	if err := f.checkCAName(request.CAName); err != nil {
+		return err
+	}
+	reason := request.ReasonCode
+	if reason == fabricca.Unspecified {
+		reason = fabricca.RevocationReason(request.Reason)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if serial != "" {
+		issued := f.findCert(serial, aki)
+		if issued == nil || (request.Name != "" && issued.info.Name != request.Name) {
+			return notFoundError("Certificate with serial %s and AKI %s was not found", serial, aki)
+		}
+		issued.revoke(reason)
+		return nil
+	}
+	id := f.identities[request.Name]
+	if id == nil {
+		return notFoundError("Identity '%s' was not found", request.Name)
+	}
+	if request.RevokeNewestOnly {
+		var newest *issuedCert
+		for _, issued := range f.certs {
+			if issued.info.Name == request.Name && !issued.info.Revoked &&
+				(newest == nil || !issued.info.NotBefore.Before(newest.info.NotBefore)) {
+				newest = issued
+			}
+		}
+		if newest == nil {
+			return fmt.Errorf("%w: identity %s has no unrevoked certificate", fabricca.ErrNoCertificates,
+				request.Name)
+		}
+		newest.revoke(reason)
+		return nil
+	}
+	id.revoked = true
+	for _, issued := range f.certs {
+		if issued.info.Name == request.Name {
+			issued.revoke(reason)
+		}
+	}
+	return nil
+}
+
+// revoke revokes the certificate, unless it is already revoked
+func (issued *issuedCert) revoke(reason fabricca.RevocationReason) {
+	if issued.info.Revoked {
+		return
+	}
+	issued.info.Revoked = true
+	issued.revokedAt = time.Now()
+	issued.reason = reason
+}
+
+// findCert returns the certificate of the hex encoded serial and AKI, nil
+// when it was not issued. The caller holds f.mu
+func (f *FakeServices) findCert(serial string, aki string) *issuedCert {
+	serial = strings.TrimLeft(normalizeHex(serial), "0")
+	for _, issued := range f.certs {
+		if strings.TrimLeft(issued.info.Serial, "0") == serial && issued.info.AKI == normalizeHex(aki) {
+			return issued
+		}
+	}
+	return nil
+}
+
+// normalizeHex strips the colons of a hex string and lowercases it
+func normalizeHex(value string) string {
+	return strings.ToLower(strings.Replace(value, ":", "", -1))
+}
+
+// GetCertificates lists the issued certificates selected by filter
+func (f *FakeServices) GetCertificates(registrar fabricclient.User,
+	filter fabricca.CertFilter) ([]fabricca.CertInfo, error) {
+	if err := f.record("GetCertificates", registrar, filter); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.selectCerts(filter), nil
+}
+
+// GetExpiringCertificates lists the unrevoked issued certificates expiring
+// within the given duration from now, the soonest expiring first
+func (f *FakeServices) GetExpiringCertificates(registrar fabricclient.User,
+	within time.Duration) ([]fabricca.CertInfo, error) {
+	if err := f.record("GetExpiringCertificates", registrar, within); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	if within <= 0 {
+		return nil, &fabricca.ValidationError{Problems: []string{fmt.Sprintf("Expiry window %s is not positive",
+			within)}}
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	certs := f.selectCerts(fabricca.CertFilter{ExpireAfter: now, ExpireBefore: now.Add(within),
+		Revoked: fabricca.RevokedExcluded})
+	sort.SliceStable(certs, func(i, j int) bool {
+		return certs[i].NotAfter.Before(certs[j].NotAfter)
+	})
+	return certs, nil
+}
+
+// selectCerts returns copies of the issued certificates selected by filter,
+// f.mu must be held
+func (f *FakeServices) selectCerts(filter fabricca.CertFilter) []fabricca.CertInfo {
+	var certs []fabricca.CertInfo
+	for _, issued := range f.certs {
+		info := issued.info
+		switch {
+		case filter.Name != "" && info.Name != filter.Name,
+			!filter.ExpireAfter.IsZero() && !info.NotAfter.After(filter.ExpireAfter),
+			!filter.ExpireBefore.IsZero() && !info.NotAfter.Before(filter.ExpireBefore),
+			filter.Revoked == fabricca.RevokedOnly && !info.Revoked,
+			filter.Revoked == fabricca.RevokedExcluded && info.Revoked,
+			filter.Serial != "" && strings.TrimLeft(info.Serial, "0") != strings.TrimLeft(normalizeHex(filter.Serial), "0"),
+			filter.AKI != "" && info.AKI != normalizeHex(filter.AKI):
+			continue
+		}
+		info.Cert = append([]byte(nil), info.Cert...)
+		certs = append(certs, info)
+	}
+	return certs
+}
+
+// IsRevoked returns true when the certificate of the hex encoded serial and
+// AKI is revoked, an error matching fabricca.ErrNotFound when it was not
+// issued
+func (f *FakeServices) IsRevoked(registrar fabricclient.User, serial string, aki string) (bool, error) {
+	if err := f.record("IsRevoked", registrar, serial, aki); err != nil {
+		return false, err
+	}
+	if registrar == nil {
+		return false, fmt.Errorf("Registrar cannot be nil")
+	}
+	if serial == "" || aki == "" {
+		return false, &fabricca.ValidationError{Problems: []string{"Serial and AKI must be set"}}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	issued := f.findCert(serial, aki)
+	if issued == nil {
+		return false, fmt.Errorf("Certificate with serial %s and AKI %s: %w", serial, aki, fabricca.ErrNotFound)
+	}
+	return issued.info.Revoked, nil
+}
+
+// GenerateCRL returns the DER encoded CRL of the revoked certificates
+// selected by request
+func (f *FakeServices) GenerateCRL(registrar fabricclient.User, request *fabricca.CRLRequest) ([]byte, error) {
+	if err := f.record("GenerateCRL", registrar, request); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	if request == nil {
+		request = &fabricca.CRLRequest{}
+	}
+	return f.generateCRL(request)
+}
+
+// generateCRL creates the CRL of the revoked certificates selected by request
+func (f *FakeServices) generateCRL(request *fabricca.CRLRequest) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(24 * time.Hour),
+	}
+	for _, issued := range f.certs {
+		switch {
+		case !issued.info.Revoked,
+			!request.RevokedAfter.IsZero() && !issued.revokedAt.After(request.RevokedAfter),
+			!request.RevokedBefore.IsZero() && !issued.revokedAt.Before(request.RevokedBefore),
+			!request.ExpireAfter.IsZero() && !issued.info.NotAfter.After(request.ExpireAfter),
+			!request.ExpireBefore.IsZero() && !issued.info.NotAfter.Before(request.ExpireBefore):
+			continue
+		}
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: issued.serial, RevocationTime: issued.revokedAt,
+				ReasonCode: int(issued.reason)})
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, template, f.caCert, f.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating CRL: %s", err)
+	}
+	return crl, nil
+}
@@ -0,0 +1,644 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabriccatest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	fabricca "github.com/hyperledger/fabric-sdk-go/fabric-ca-client"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric/bccsp"
+	"github.com/hyperledger/fabric/bccsp/factory"
+)
+
+// Enroll enrolls a registered identity with a generated ecdsa P-256 key
+func (f *FakeServices) Enroll(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error) {
+	if err := f.record("Enroll", enrollmentID, enrollmentSecret); err != nil {
+		return nil, nil, err
+	}
+	return f.enrollWithKey(enrollmentID, enrollmentSecret, &fabricca.EnrollmentOptions{})
+}
+
+// EnrollContext enrolls like Enroll, failing once ctx is done
+func (f *FakeServices) EnrollContext(ctx context.Context, enrollmentID string,
+	enrollmentSecret string) ([]byte, []byte, error) {
+	if err := f.record("EnrollContext", ctx, enrollmentID, enrollmentSecret); err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return f.enrollWithKey(enrollmentID, enrollmentSecret, &fabricca.EnrollmentOptions{})
+}
+
+// EnrollWithOptions enrolls with the CN, hosts, key and attributes of opts
+func (f *FakeServices) EnrollWithOptions(enrollmentID string, enrollmentSecret string,
+	opts *fabricca.EnrollmentOptions) ([]byte, []byte, error) {
+	if err := f.record("EnrollWithOptions", enrollmentID, enrollmentSecret, opts); err != nil {
+		return nil, nil, err
+	}
+	if opts == nil {
+		opts = &fabricca.EnrollmentOptions{}
+	}
+	if opts.CSRSigner != nil {
+		return f.enrollWithSigner(enrollmentID, enrollmentSecret, opts)
+	}
+	return f.enrollWithKey(enrollmentID, enrollmentSecret, opts)
+}
+
+// enrollWithSigner enrolls with the key of the CSR signed by the CSRSigner of
+// opts, returning no key
+func (f *FakeServices) enrollWithSigner(enrollmentID string, enrollmentSecret string,
+	opts *fabricca.EnrollmentOptions) ([]byte, []byte, error) {
+	if enrollmentID == "" {
+		return nil, nil, fmt.Errorf("enrollmentID is empty")
+	}
+	if enrollmentSecret == "" {
+		return nil, nil, fmt.Errorf("enrollmentSecret is empty")
+	}
+	if opts.KeyRequest != nil {
+		return nil, nil, fmt.Errorf("KeyRequest cannot be set with a CSRSigner, which holds the key")
+	}
+	cn := opts.CN
+	if cn == "" {
+		cn = enrollmentID
+	}
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}, DNSNames: opts.Hosts,
+		ExtraExtensions: opts.Extensions}
+	der, err := opts.CSRSigner.SignCSR(template)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error signing CSR: %w", err)
+	}
+	request, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing the CSR of the CSR signer: %s", err)
+	}
+	if err := request.CheckSignature(); err != nil {
+		return nil, nil, fmt.Errorf("Invalid signature of the CSR of the CSR signer: %s", err)
+	}
+	cert, _, err := f.enroll(enrollmentID, enrollmentSecret, opts, request.PublicKey)
+	return nil, cert, err
+}
+
+// EnrollAndStore enrolls and persists the identity in the store under the
+// enrollment ID, in the format of fabricca.LoadUser
+func (f *FakeServices) EnrollAndStore(enrollmentID string, enrollmentSecret string,
+	store fabricca.StateStore) (fabricclient.User, error) {
+	if err := f.record("EnrollAndStore", enrollmentID, enrollmentSecret, store); err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf("State store is nil")
+	}
+	keyPEM, cert, err := f.enrollWithKey(enrollmentID, enrollmentSecret, &fabricca.EnrollmentOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return storeUser(enrollmentID, enrollmentID, "", keyPEM, cert, store)
+}
+
+// EnrollIdentityAndStore enrolls and persists the identity of the MSP mspID
+// in the store under the enrollment ID, in the format of
+// fabricca.LoadUserForMSP
+func (f *FakeServices) EnrollIdentityAndStore(mspID string, enrollmentID string, enrollmentSecret string,
+	store fabricca.StateStore) (fabricclient.User, error) {
+	if err := f.record("EnrollIdentityAndStore", mspID, enrollmentID, enrollmentSecret, store); err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf("State store is nil")
+	}
+	if mspID == "" {
+		return nil, fmt.Errorf("MSP ID is empty")
+	}
+	keyPEM, cert, err := f.enrollWithKey(enrollmentID, enrollmentSecret, &fabricca.EnrollmentOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return storeUser(enrollmentID, enrollmentID, mspID, keyPEM, cert, store)
+}
+
+// EnrollAll enrolls once per profile and persists each identity in the
+// store under its fabricca.ProfileKey
+func (f *FakeServices) EnrollAll(enrollmentID string, enrollmentSecret string, profiles []string,
+	store fabricca.StateStore) (map[string]*fabricca.ProfileEnrollment, error) {
+	if err := f.record("EnrollAll", enrollmentID, enrollmentSecret, profiles, store); err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf("State store is nil")
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("No profile to enroll with")
+	}
+	results := make(map[string]*fabricca.ProfileEnrollment, len(profiles))
+	for _, profile := range profiles {
+		if profile == "" || results[profile] != nil {
+			return nil, fmt.Errorf("Profile %q is empty or listed more than once", profile)
+		}
+		results[profile] = &fabricca.ProfileEnrollment{Key: fabricca.ProfileKey(enrollmentID, profile)}
+	}
+	for _, profile := range profiles {
+		result := results[profile]
+		keyPEM, cert, err := f.enrollWithKey(enrollmentID, enrollmentSecret,
+			&fabricca.EnrollmentOptions{Profile: profile})
+		if err != nil {
+			result.Err = fmt.Errorf("Enrollment with profile %s failed: %w", profile, err)
+			continue
+		}
+		result.User, result.Err = storeUser(enrollmentID, result.Key, "", keyPEM, cert, store)
+	}
+	return results, nil
+}
+
+// EnrollTLS enrolls with the fabricca.TLSProfile
+func (f *FakeServices) EnrollTLS(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error) {
+	if err := f.record("EnrollTLS", enrollmentID, enrollmentSecret); err != nil {
+		return nil, nil, err
+	}
+	return f.enrollWithKey(enrollmentID, enrollmentSecret,
+		&fabricca.EnrollmentOptions{Profile: fabricca.TLSProfile})
+}
+
+// EnrollTLSCertificate enrolls with the tls profile and returns the
+// certificate and its key as a tls.Certificate
+func (f *FakeServices) EnrollTLSCertificate(enrollmentID string, enrollmentSecret string) (tls.Certificate, error) {
+	if err := f.record("EnrollTLSCertificate", enrollmentID, enrollmentSecret); err != nil {
+		return tls.Certificate{}, err
+	}
+	key, cert, err := f.enrollWithKey(enrollmentID, enrollmentSecret,
+		&fabricca.EnrollmentOptions{Profile: fabricca.TLSProfile})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certificate, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	return certificate, err
+}
+
+// EnrollWithSecretRef enrolls with the secret secretRef resolves to, see
+// fabricca.ResolveSecret
+func (f *FakeServices) EnrollWithSecretRef(enrollmentID string, secretRef string) ([]byte, []byte, error) {
+	if err := f.record("EnrollWithSecretRef", enrollmentID, secretRef); err != nil {
+		return nil, nil, err
+	}
+	secret, err := fabricca.ResolveSecret(secretRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.enrollWithKey(enrollmentID, secret, &fabricca.EnrollmentOptions{})
+}
+
+// EnrollWithCSR enrolls with a PEM encoded CSR whose CN is the enrollment ID
+func (f *FakeServices) EnrollWithCSR(enrollmentID string, enrollmentSecret string,
+	csrPEM []byte) ([]byte, error) {
+	if err := f.record("EnrollWithCSR", enrollmentID, enrollmentSecret, csrPEM); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return nil, &fabricca.ValidationError{Problems: []string{"CSR is not PEM encoded"}}
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, &fabricca.ValidationError{Problems: []string{"Invalid CSR: " + err.Error()}}
+	}
+	if err := request.CheckSignature(); err != nil {
+		return nil, &fabricca.ValidationError{Problems: []string{"Invalid CSR signature: " + err.Error()}}
+	}
+	if request.Subject.CommonName != enrollmentID {
+		return nil, &fabricca.ValidationError{Problems: []string{fmt.Sprintf(
+			"CSR common name %s is not the enrollment ID %s", request.Subject.CommonName, enrollmentID)}}
+	}
+	opts := &fabricca.EnrollmentOptions{Hosts: request.DNSNames}
+	for _, ip := range request.IPAddresses {
+		opts.Hosts = append(opts.Hosts, ip.String())
+	}
+	cert, _, err := f.enroll(enrollmentID, enrollmentSecret, opts, request.PublicKey)
+	return cert, err
+}
+
+// EnrollV2 enrolls like Enroll, returning the serial and validity of the
+// certificate
+func (f *FakeServices) EnrollV2(enrollmentID string, enrollmentSecret string) (*fabricca.Enrollment, error) {
+	if err := f.record("EnrollV2", enrollmentID, enrollmentSecret); err != nil {
+		return nil, err
+	}
+	keyPEM, cert, err := f.enrollWithKey(enrollmentID, enrollmentSecret, &fabricca.EnrollmentOptions{})
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(cert)
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &fabricca.Enrollment{Key: keyPEM, Cert: cert, Serial: hex.EncodeToString(x509Cert.SerialNumber.Bytes()),
+		NotBefore: x509Cert.NotBefore, NotAfter: x509Cert.NotAfter}, nil
+}
+
+// EnrollIdentity enrolls like Enroll, binding the certificate and key with
+// the MSP ID
+func (f *FakeServices) EnrollIdentity(mspID string, enrollmentID string,
+	enrollmentSecret string) (*fabricca.Identity, error) {
+	if err := f.record("EnrollIdentity", mspID, enrollmentID, enrollmentSecret); err != nil {
+		return nil, err
+	}
+	if mspID == "" {
+		return nil, fmt.Errorf("MSP ID is empty")
+	}
+	keyPEM, cert, err := f.enrollWithKey(enrollmentID, enrollmentSecret, &fabricca.EnrollmentOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &fabricca.Identity{MSPID: mspID, Cert: cert, Key: keyPEM}, nil
+}
+
+// enrollWithKey generates the key requested by opts and enrolls with it,
+// returning the PEM encoded key and certificate
+func (f *FakeServices) enrollWithKey(enrollmentID string, enrollmentSecret string,
+	opts *fabricca.EnrollmentOptions) ([]byte, []byte, error) {
+	if enrollmentID == "" {
+		return nil, nil, fmt.Errorf("enrollmentID is empty")
+	}
+	if enrollmentSecret == "" {
+		return nil, nil, fmt.Errorf("enrollmentSecret is empty")
+	}
+	key, keyPEM, err := generateKey(opts.KeyRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, _, err := f.enroll(enrollmentID, enrollmentSecret, opts, key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyPEM, cert, nil
+}
+
+// enroll authenticates an identity with its secret and issues it a
+// certificate for publicKey
+func (f *FakeServices) enroll(enrollmentID string, enrollmentSecret string,
+	opts *fabricca.EnrollmentOptions, publicKey crypto.PublicKey) ([]byte, *issuedCert, error) {
+	if err := f.checkCAName(opts.CAName); err != nil {
+		return nil, nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.identities[enrollmentID]
+	if id == nil || id.revoked || id.Secret != enrollmentSecret {
+		return nil, nil, InvalidCredentialsError()
+	}
+	if id.MaxEnrollments > 0 && id.enrollments >= id.MaxEnrollments {
+		return nil, nil, &fabricca.CAError{Kind: fabricca.ErrEnrollmentLimitReached, StatusCode: 401, Code: 20,
+			Message: "The identity " + enrollmentID + " has already enrolled " +
+				strconv.Itoa(id.MaxEnrollments) + " times, it has reached its maximum enrollment allowance"}
+	}
+	attrs, err := id.certAttributes(opts.AttrReqs)
+	if err != nil {
+		return nil, nil, err
+	}
+	cn := opts.CN
+	if cn == "" {
+		cn = enrollmentID
+	}
+	cert, issued, err := f.issue(enrollmentID, cn, opts.Hosts, attrs, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	id.enrollments++
+	return cert, issued, nil
+}
+
+// defaultAttributes returns the hf.EnrollmentID, hf.Type and hf.Affiliation
+// attributes the CA registers every identity with
+func (id *identity) defaultAttributes() map[string]string {
+	return map[string]string{
+		"hf.EnrollmentID": id.Name,
+		"hf.Type":         id.Type,
+		"hf.Affiliation":  id.Affiliation,
+	}
+}
+
+// registeredAttributes returns the default and registered attributes of the
+// identity
+func (id *identity) registeredAttributes() map[string]string {
+	registered := id.defaultAttributes()
+	for _, attr := range id.Attributes {
+		registered[attr.Key] = attr.Value
+	}
+	return registered
+}
+
+// certAttributes returns the attributes embedded in the certificates of the
+// identity: those requested by attrReqs or, without requests, its default
+// attributes and the attributes registered with ECert
+func (id *identity) certAttributes(attrReqs []fabricca.AttributeRequest) (map[string]string, error) {
+	if attrReqs == nil {
+		attrs := id.defaultAttributes()
+		for _, attr := range id.Attributes {
+			if attr.ECert {
+				attrs[attr.Key] = attr.Value
+			}
+		}
+		return attrs, nil
+	}
+	registered := id.registeredAttributes()
+	attrs := make(map[string]string)
+	for _, attrReq := range attrReqs {
+		value, ok := registered[attrReq.Name]
+		if !ok {
+			if attrReq.Optional {
+				continue
+			}
+			return nil, &fabricca.CAError{StatusCode: 500, Code: 0,
+				Message: fmt.Sprintf("Identity '%s' does not have attribute '%s'", id.Name, attrReq.Name)}
+		}
+		attrs[attrReq.Name] = value
+	}
+	return attrs, nil
+}
+
+// issue issues a certificate to the identity name, embedding attrs. The
+// caller holds f.mu
+func (f *FakeServices) issue(name string, cn string, hosts []string, attrs map[string]string,
+	publicKey crypto.PublicKey) ([]byte, *issuedCert, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if attrs != nil {
+		value, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+		if err != nil {
+			return nil, nil, err
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: fabricca.CertAttributesOID, Value: value}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.caCert, publicKey, f.caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error issuing certificate: %s", err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	issued := &issuedCert{
+		info: fabricca.CertInfo{
+			Name:      name,
+			Serial:    hex.EncodeToString(serial.Bytes()),
+			AKI:       hex.EncodeToString(f.caCert.SubjectKeyId),
+			NotBefore: template.NotBefore,
+			NotAfter:  template.NotAfter,
+			Cert:      cert,
+		},
+		serial: serial,
+	}
+	f.certs = append(f.certs, issued)
+	return cert, issued, nil
+}
+
+// EnrollIdemix fails with fabricca.ErrIdemixNotSupported, the fake CA does
+// not issue Idemix credentials
+func (f *FakeServices) EnrollIdemix(enrollmentID string,
+	enrollmentSecret string) (*fabricca.IdemixCredential, error) {
+	if err := f.record("EnrollIdemix", enrollmentID, enrollmentSecret); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("CA %s has no Idemix issuer public key: %w", f.caName, fabricca.ErrIdemixNotSupported)
+}
+
+// VerifySecret checks the secret like enroll does, without counting an
+// enrollment
+func (f *FakeServices) VerifySecret(enrollmentID string, enrollmentSecret string) (bool, error) {
+	if err := f.record("VerifySecret", enrollmentID, enrollmentSecret); err != nil {
+		return false, err
+	}
+	if enrollmentID == "" {
+		return false, fmt.Errorf("enrollmentID is empty")
+	}
+	if enrollmentSecret == "" {
+		return false, fmt.Errorf("enrollmentSecret is empty")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.identities[enrollmentID]
+	if id == nil || id.revoked || id.Secret != enrollmentSecret {
+		return false, nil
+	}
+	return id.MaxEnrollments <= 0 || id.enrollments < id.MaxEnrollments, nil
+}
+
+// Reenroll issues a new certificate, with a new key, to a user enrolled with
+// a certificate issued by the FakeServices which is not revoked
+func (f *FakeServices) Reenroll(user fabricclient.User) ([]byte, []byte, error) {
+	if err := f.record("Reenroll", user); err != nil {
+		return nil, nil, err
+	}
+	if user == nil {
+		return nil, nil, fmt.Errorf("User does not exist")
+	}
+	if user.GetName() == "" {
+		return nil, nil, fmt.Errorf("User is empty")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	issued, err := f.authenticate(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, keyPEM, err := generateKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(issued.info.Cert)
+	previous, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs, err := f.identities[issued.info.Name].certAttributes(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts := previous.DNSNames
+	for _, ip := range previous.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	cert, _, err := f.issue(issued.info.Name, previous.Subject.CommonName, hosts, attrs, key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyPEM, cert, nil
+}
+
+// authenticate returns the issued certificate of user, an error matching
+// fabricca.ErrInvalidCredentials when it was not issued by the FakeServices,
+// is revoked or its identity was removed. The caller holds f.mu
+func (f *FakeServices) authenticate(user fabricclient.User) (*issuedCert, error) {
+	block, _ := pem.Decode(user.GetEnrollmentCertificate())
+	if block == nil {
+		return nil, fmt.Errorf("Unable to read user enrollment certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid user enrollment certificate: %s", err)
+	}
+	issued := f.findCert(hex.EncodeToString(cert.SerialNumber.Bytes()), hex.EncodeToString(cert.AuthorityKeyId))
+	if issued == nil || issued.info.Revoked || f.identities[issued.info.Name] == nil {
+		return nil, InvalidCredentialsError()
+	}
+	return issued, nil
+}
+
+// GetTransactionCerts issues count transaction certificates to an enrolled
+// user, whose keys are imported in the default BCCSP
+func (f *FakeServices) GetTransactionCerts(user fabricclient.User, count int,
+	attributes []string) ([]fabricca.TCert, error) {
+	if err := f.record("GetTransactionCerts", user, count, attributes); err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("User does not exist")
+	}
+	if count < 1 || count > fabricca.MaxTCertBatchSize {
+		return nil, &fabricca.ValidationError{Problems: []string{fmt.Sprintf(
+			"Count must be between 1 and %d, got %d", fabricca.MaxTCertBatchSize, count)}}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	issued, err := f.authenticate(user)
+	if err != nil {
+		return nil, err
+	}
+	registered := f.identities[issued.info.Name].registeredAttributes()
+	attrs := make(map[string]string)
+	for _, name := range attributes {
+		value, ok := registered[name]
+		if !ok {
+			return nil, &fabricca.CAError{StatusCode: 500,
+				Message: fmt.Sprintf("Identity '%s' does not have attribute '%s'", issued.info.Name, name)}
+		}
+		attrs[name] = value
+	}
+	tcerts := make([]fabricca.TCert, count)
+	for i := range tcerts {
+		key, keyPEM, err := generateKey(nil)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(keyPEM)
+		tcerts[i].Key, err = factory.GetDefault().KeyImport(block.Bytes,
+			&bccsp.ECDSAPrivateKeyImportOpts{Temporary: true})
+		if err != nil {
+			return nil, fmt.Errorf("Error importing transaction certificate key: %s", err)
+		}
+		if tcerts[i].Cert, _, err = f.issue(issued.info.Name, issued.info.Name, nil, attrs, key.Public()); err != nil {
+			return nil, err
+		}
+	}
+	return tcerts, nil
+}
+
+// storeUser imports the key of an enrollment in the default BCCSP and
+// persists the enrolled identity of the MSP mspID, empty when unknown, in the
+// store under key
+func storeUser(enrollmentID string, key string, mspID string, keyPEM []byte, cert []byte,
+	store fabricca.StateStore) (fabricclient.User, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("Error decoding private key PEM")
+	}
+	privateKey, err := factory.GetDefault().KeyImport(block.Bytes,
+		&bccsp.ECDSAPrivateKeyImportOpts{Temporary: false})
+	if err != nil {
+		return nil, fmt.Errorf("Error importing enrollment key: %s", err)
+	}
+	user := fabricclient.NewUser(enrollmentID)
+	user.SetMspID(mspID)
+	user.SetEnrollmentCertificate(cert)
+	user.SetPrivateKey(privateKey)
+	data, err := json.Marshal(&fabricclient.UserJSON{PrivateKeySKI: privateKey.SKI(),
+		EnrollmentCertificate: cert, PrivateKey: keyPEM, MspID: mspID})
+	if err != nil {
+		return nil, fmt.Errorf("Marshal json return error: %v", err)
+	}
+	if err := store.SetValue(key, data); err != nil {
+		return nil, fmt.Errorf("Error storing identity of %s: %s", enrollmentID, err)
+	}
+	return user, nil
+}
+
+// generateKey generates the key of keyRequest, an ecdsa P-256 key when nil,
+// and returns it PEM encoded
+func generateKey(keyRequest *fabricca.KeyRequest) (crypto.Signer, []byte, error) {
+	if keyRequest == nil {
+		keyRequest = &fabricca.KeyRequest{Algo: "ecdsa", Size: 256}
+	}
+	curves := map[int]elliptic.Curve{256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+	switch {
+	case keyRequest.Algo == "ecdsa" && curves[keyRequest.Size] != nil:
+		key, err := ecdsa.GenerateKey(curves[keyRequest.Size], rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error generating key: %s", err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case keyRequest.Algo == "rsa" && (keyRequest.Size == 2048 || keyRequest.Size == 3072 || keyRequest.Size == 4096):
+		key, err := rsa.GenerateKey(rand.Reader, keyRequest.Size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error generating key: %s", err)
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	}
+	return nil, nil, &fabricca.ValidationError{Problems: []string{fmt.Sprintf(
+		"Unsupported key request %s %d, supported are ecdsa 256, 384, 521 and rsa 2048, 3072, 4096",
+		keyRequest.Algo, keyRequest.Size)}}
+}
@@ -0,0 +1,595 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabriccatest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	fabricca "github.com/hyperledger/fabric-sdk-go/fabric-ca-client"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// Register registers an identity, returning its secret
+func (f *FakeServices) Register(registrar fabricclient.User,
+	request *fabricca.RegistrationRequest) (string, error) {
+	if err := f.record("Register", registrar, request); err != nil {
+		return "", err
+	}
+	response, err := f.register(registrar, request)
+	if err != nil {
+		return "", err
+	}
+	return response.Secret, nil
+}
+
+// RegisterContext registers like Register, failing once ctx is done
+func (f *FakeServices) RegisterContext(ctx context.Context, registrar fabricclient.User,
+	request *fabricca.RegistrationRequest) (string, error) {
+	if err := f.record("RegisterContext", ctx, registrar, request); err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	response, err := f.register(registrar, request)
+	if err != nil {
+		return "", err
+	}
+	return response.Secret, nil
+}
+
+// RegisterV2 registers an identity, returning the response of the CA
+func (f *FakeServices) RegisterV2(registrar fabricclient.User,
+	request *fabricca.RegistrationRequest) (*fabricca.RegistrationResponse, error) {
+	if err := f.record("RegisterV2", registrar, request); err != nil {
+		return nil, err
+	}
+	return f.register(registrar, request)
+}
+
+// RegisterRegistrar registers an identity which can itself register
+// identities, if the capabilities of the registrar allow granting those of
+// the request
+func (f *FakeServices) RegisterRegistrar(registrar fabricclient.User,
+	request *fabricca.RegistrarRegistrationRequest) (string, error) {
+	if err := f.record("RegisterRegistrar", registrar, request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", fmt.Errorf("Registration request cannot be nil")
+	}
+	registration, err := request.ToRegistrationRequest()
+	if err != nil {
+		return "", err
+	}
+	caps, err := registrarCaps(registrar)
+	if err != nil {
+		return "", err
+	}
+	if err := request.CheckDelegation(caps); err != nil {
+		return "", fmt.Errorf("Error Registering User: %w", err)
+	}
+	response, err := f.register(registrar, registration)
+	if err != nil {
+		return "", err
+	}
+	return response.Secret, nil
+}
+
+// RegisterBatch registers identities, continuing past the requests which
+// fail
+func (f *FakeServices) RegisterBatch(registrar fabricclient.User,
+	requests []*fabricca.RegistrationRequest) ([]fabricca.RegisterResult, error) {
+	if err := f.record("RegisterBatch", registrar, requests); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	results := make([]fabricca.RegisterResult, len(requests))
+	for i, request := range requests {
+		results[i].Index = i
+		response, err := f.register(registrar, request)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Secret = response.Secret
+	}
+	return results, nil
+}
+
+// register validates and registers an identity
+func (f *FakeServices) register(registrar fabricclient.User,
+	request *fabricca.RegistrationRequest) (*fabricca.RegistrationResponse, error) {
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	if request == nil {
+		return nil, fmt.Errorf("Registration request cannot be nil")
+	}
+	if err := validateRegistrationRequest(request); err != nil {
+		return nil, err
+	}
+	if err := f.checkCAName(request.CAName); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.affiliations[request.Affiliation] {
+		return nil, notFoundError("Failed getting affiliation '%s'", request.Affiliation)
+	}
+	if existing := f.identities[request.Name]; existing != nil {
+		if request.IfNotExists {
+			return &fabricca.RegistrationResponse{AlreadyRegistered: true,
+				Existing: existing.response()}, nil
+		}
+		return nil, &fabricca.CAError{Kind: fabricca.ErrAlreadyRegistered, StatusCode: 409, Code: 0,
+			Message: fmt.Sprintf("Identity '%s' is already registered", request.Name)}
+	}
+	id := &identity{Identity: Identity{
+		Name:           request.Name,
+		Secret:         request.Secret,
+		Type:           request.Type,
+		Affiliation:    request.Affiliation,
+		MaxEnrollments: request.MaxEnrollments,
+		Attributes:     append([]fabricca.Attribute(nil), request.Attributes...),
+	}}
+	if id.Type == "" {
+		id.Type = "user"
+	}
+	if request.DryRun {
+		preview := id.response()
+		return &fabricca.RegistrationResponse{Preview: preview, CAChecked: true}, nil
+	}
+	if id.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			return nil, err
+		}
+		id.Secret = secret
+	}
+	f.identities[id.Name] = id
+	return &fabricca.RegistrationResponse{Secret: id.Secret}, nil
+}
+
+// validateRegistrationRequest checks the registration request is complete
+func validateRegistrationRequest(request *fabricca.RegistrationRequest) error {
+	var problems []string
+	if request.Name == "" {
+		problems = append(problems, "Name is empty")
+	}
+	if request.Affiliation == "" {
+		problems = append(problems, "Affiliation is empty")
+	}
+	if request.Type != "" && !contains(fabricca.DefaultIdentityTypes, request.Type) {
+		problems = append(problems, fmt.Sprintf("Type %s is not one of %s", request.Type,
+			strings.Join(fabricca.DefaultIdentityTypes, ", ")))
+	}
+	if request.MaxEnrollments < fabricca.EnrollmentsUnlimited {
+		problems = append(problems, fmt.Sprintf("MaxEnrollments must be %d or greater, got %d",
+			fabricca.EnrollmentsUnlimited, request.MaxEnrollments))
+	}
+	if request.Secret != "" && len(request.Secret) < fabricca.MinSecretLength {
+		problems = append(problems, fmt.Sprintf("Secret must be at least %d characters long",
+			fabricca.MinSecretLength))
+	}
+	if len(problems) > 0 {
+		return &fabricca.ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// response returns the identity as returned by GetIdentity
+func (id *identity) response() *fabricca.IdentityResponse {
+	maxEnrollments := id.MaxEnrollments
+	if maxEnrollments == fabricca.EnrollmentsServerDefault {
+		maxEnrollments = fabricca.EnrollmentsUnlimited
+	}
+	return &fabricca.IdentityResponse{
+		Name:           id.Name,
+		Type:           id.Type,
+		Affiliation:    id.Affiliation,
+		MaxEnrollments: maxEnrollments,
+		Attributes:     append([]fabricca.Attribute(nil), id.Attributes...),
+	}
+}
+
+// setAttribute sets the value of the attribute named key
+func (id *identity) setAttribute(key string, value string) {
+	for i := range id.Attributes {
+		if id.Attributes[i].Key == key {
+			id.Attributes[i].Value = value
+			return
+		}
+	}
+	id.Attributes = append(id.Attributes, fabricca.Attribute{Key: key, Value: value})
+}
+
+// nextRevision sets the RevisionAttr of id to a new value, as secret
+// rotations and conditional modifications do. The caller holds f.mu
+func (f *FakeServices) nextRevision(id *identity) {
+	f.revision++
+	id.setAttribute(fabricca.RevisionAttr, strconv.Itoa(f.revision))
+}
+
+// sortedIdentities returns the registered identities sorted by name. The
+// caller holds f.mu
+func (f *FakeServices) sortedIdentities() []*identity {
+	identities := make([]*identity, 0, len(f.identities))
+	for _, id := range f.identities {
+		identities = append(identities, id)
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Name < identities[j].Name })
+	return identities
+}
+
+// GetIdentity returns a registered identity
+func (f *FakeServices) GetIdentity(registrar fabricclient.User, name string) (*fabricca.IdentityResponse, error) {
+	if err := f.record("GetIdentity", registrar, name); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Identity name cannot be empty")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.identities[name]
+	if id == nil {
+		return nil, notFoundError("Identity '%s' was not found", name)
+	}
+	return id.response(), nil
+}
+
+// GetAllIdentities returns the registered identities, sorted by name
+func (f *FakeServices) GetAllIdentities(registrar fabricclient.User) ([]*fabricca.IdentityResponse, error) {
+	if err := f.record("GetAllIdentities", registrar); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var identities []*fabricca.IdentityResponse
+	for _, id := range f.sortedIdentities() {
+		identities = append(identities, id.response())
+	}
+	return identities, nil
+}
+
+// StreamIdentities sends the registered identities, sorted by name, on the
+// identities channel until ctx is done
+func (f *FakeServices) StreamIdentities(ctx context.Context,
+	registrar fabricclient.User) (<-chan fabricca.IdentityResponse, <-chan error, error) {
+	if err := f.record("StreamIdentities", registrar); err != nil {
+		return nil, nil, err
+	}
+	if registrar == nil {
+		return nil, nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	f.mu.Lock()
+	var responses []fabricca.IdentityResponse
+	for _, id := range f.sortedIdentities() {
+		responses = append(responses, *id.response())
+	}
+	f.mu.Unlock()
+	identities := make(chan fabricca.IdentityResponse)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(identities)
+		for _, response := range responses {
+			if err := ctx.Err(); err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case identities <- response:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return identities, errs, nil
+}
+
+// FindIdentitiesByAttribute returns the registered identities, sorted by
+// name, which have the attribute name set to value
+func (f *FakeServices) FindIdentitiesByAttribute(registrar fabricclient.User, name string,
+	value string) ([]fabricca.IdentityResponse, error) {
+	if err := f.record("FindIdentitiesByAttribute", registrar, name, value); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Attribute name cannot be empty")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	identities := []fabricca.IdentityResponse{}
+	for _, id := range f.sortedIdentities() {
+		response := id.response()
+		for _, attr := range response.Attributes {
+			if attr.Key == name && attr.Value == value {
+				identities = append(identities, *response)
+				break
+			}
+		}
+	}
+	return identities, nil
+}
+
+// ModifyIdentity modifies the fields set by request of a registered identity
+func (f *FakeServices) ModifyIdentity(registrar fabricclient.User,
+	request *fabricca.ModifyIdentityRequest) (*fabricca.IdentityResponse, error) {
+	if err := f.record("ModifyIdentity", registrar, request); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	if request == nil || request.Name == "" {
+		return nil, fmt.Errorf("Identity name cannot be empty")
+	}
+	if request.Secret != "" && len(request.Secret) < fabricca.MinSecretLength {
+		return nil, &fabricca.ValidationError{Problems: []string{fmt.Sprintf(
+			"Secret must be at least %d characters long", fabricca.MinSecretLength)}}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.identities[request.Name]
+	if id == nil {
+		return nil, notFoundError("Identity '%s' was not found", request.Name)
+	}
+	if request.Affiliation != "" && !f.affiliations[request.Affiliation] {
+		return nil, notFoundError("Failed getting affiliation '%s'", request.Affiliation)
+	}
+	if request.IfMatch != "" && request.IfMatch != id.response().ETag() {
+		return nil, fmt.Errorf("Identity %s was modified since it was read: %w", request.Name, fabricca.ErrConflict)
+	}
+	if request.Type != "" {
+		id.Type = request.Type
+	}
+	if request.Affiliation != "" {
+		id.Affiliation = request.Affiliation
+	}
+	if request.MaxEnrollments != fabricca.EnrollmentsServerDefault {
+		id.MaxEnrollments = request.MaxEnrollments
+	}
+	if request.Attributes != nil {
+		id.Attributes = append([]fabricca.Attribute(nil), request.Attributes...)
+	}
+	if request.Secret != "" {
+		id.Secret = request.Secret
+	}
+	if request.Secret != "" || request.IfMatch != "" {
+		f.nextRevision(id)
+	}
+	return id.response(), nil
+}
+
+// ModifyEnrollmentSecret sets the enrollment secret of a registered identity
+func (f *FakeServices) ModifyEnrollmentSecret(registrar fabricclient.User, name string, newSecret string) error {
+	if err := f.record("ModifyEnrollmentSecret", registrar, name, newSecret); err != nil {
+		return err
+	}
+	return f.modifyEnrollmentSecret(registrar, name, newSecret, "")
+}
+
+// ModifyEnrollmentSecretIfMatch sets the enrollment secret of a registered
+// identity if its ETag is ifMatch
+func (f *FakeServices) ModifyEnrollmentSecretIfMatch(registrar fabricclient.User, name string, newSecret string,
+	ifMatch string) error {
+	if err := f.record("ModifyEnrollmentSecretIfMatch", registrar, name, newSecret, ifMatch); err != nil {
+		return err
+	}
+	if ifMatch == "" {
+		return &fabricca.ValidationError{Problems: []string{"IfMatch cannot be empty"}}
+	}
+	return f.modifyEnrollmentSecret(registrar, name, newSecret, ifMatch)
+}
+
+// modifyEnrollmentSecret sets the enrollment secret of a registered identity,
+// if its ETag is ifMatch when set
+func (f *FakeServices) modifyEnrollmentSecret(registrar fabricclient.User, name string, newSecret string,
+	ifMatch string) error {
+	if registrar == nil {
+		return fmt.Errorf("Registrar cannot be nil")
+	}
+	if name == "" {
+		return fmt.Errorf("Identity name cannot be empty")
+	}
+	if len(newSecret) < fabricca.MinSecretLength {
+		return &fabricca.ValidationError{Problems: []string{fmt.Sprintf(
+			"Secret must be at least %d characters long", fabricca.MinSecretLength)}}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.identities[name]
+	if id == nil {
+		return notFoundError("Identity '%s' was not found", name)
+	}
+	if ifMatch != "" && ifMatch != id.response().ETag() {
+		return fmt.Errorf("Identity %s was modified since it was read: %w", name, fabricca.ErrConflict)
+	}
+	id.Secret = newSecret
+	f.nextRevision(id)
+	return nil
+}
+
+// ResetSecret sets a new random enrollment secret for a registered identity
+// and returns it
+func (f *FakeServices) ResetSecret(registrar fabricclient.User, name string) (string, error) {
+	if err := f.record("ResetSecret", registrar, name); err != nil {
+		return "", err
+	}
+	return f.resetSecret(registrar, name, "")
+}
+
+// ResetSecretIfMatch sets a new random enrollment secret for a registered
+// identity if its ETag is ifMatch, and returns it
+func (f *FakeServices) ResetSecretIfMatch(registrar fabricclient.User, name string, ifMatch string) (string, error) {
+	if err := f.record("ResetSecretIfMatch", registrar, name, ifMatch); err != nil {
+		return "", err
+	}
+	if ifMatch == "" {
+		return "", fmt.Errorf("IfMatch cannot be empty")
+	}
+	return f.resetSecret(registrar, name, ifMatch)
+}
+
+// resetSecret sets a new random enrollment secret for a registered identity,
+// if its ETag is ifMatch when set
+func (f *FakeServices) resetSecret(registrar fabricclient.User, name string, ifMatch string) (string, error) {
+	if registrar == nil {
+		return "", fmt.Errorf("Registrar cannot be nil")
+	}
+	if name == "" {
+		return "", fmt.Errorf("Identity name cannot be empty")
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.identities[name]
+	if id == nil {
+		return "", notFoundError("Identity '%s' was not found", name)
+	}
+	if ifMatch != "" && ifMatch != id.response().ETag() {
+		return "", fmt.Errorf("Identity %s was modified since it was read: %w", name, fabricca.ErrConflict)
+	}
+	id.Secret = secret
+	f.nextRevision(id)
+	return secret, nil
+}
+
+// RemoveIdentity removes a registered identity, revoking its certificates
+// when request.RevokeCertificates is set
+func (f *FakeServices) RemoveIdentity(registrar fabricclient.User,
+	request *fabricca.RemoveIdentityRequest) (*fabricca.IdentityResponse, error) {
+	if err := f.record("RemoveIdentity", registrar, request); err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	if request == nil || request.Name == "" {
+		return nil, fmt.Errorf("Identity name cannot be empty")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.identities[request.Name]
+	if id == nil {
+		return nil, notFoundError("Identity '%s' was not found", request.Name)
+	}
+	if request.RevokeCertificates {
+		for _, issued := range f.certs {
+			if issued.info.Name == request.Name {
+				issued.revoke(fabricca.CessationOfOperation)
+			}
+		}
+	}
+	delete(f.identities, request.Name)
+	return id.response(), nil
+}
+
+// GetRegistrarCapabilities returns the capabilities granted by the
+// attributes of the registrar's certificate, see fabricca.RegistrarCaps
+func (f *FakeServices) GetRegistrarCapabilities(registrar fabricclient.User) (*fabricca.RegistrarCaps, error) {
+	if err := f.record("GetRegistrarCapabilities", registrar); err != nil {
+		return nil, err
+	}
+	return registrarCaps(registrar)
+}
+
+// GetRegistrationMetadata returns the default identity types and the
+// affiliations the capabilities of the registrar allow registering with
+func (f *FakeServices) GetRegistrationMetadata(registrar fabricclient.User) (*fabricca.RegMetadata, error) {
+	if err := f.record("GetRegistrationMetadata", registrar); err != nil {
+		return nil, err
+	}
+	caps, err := registrarCaps(registrar)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &fabricca.RegMetadata{Registrar: registrar.GetName(), Capabilities: *caps,
+		IdentityTypes: []string{}, Affiliations: []string{}}
+	for _, identityType := range fabricca.DefaultIdentityTypes {
+		if !caps.HasAttributes || caps.CanRegisterType(identityType) {
+			metadata.IdentityTypes = append(metadata.IdentityTypes, identityType)
+		}
+	}
+	f.mu.Lock()
+	for _, name := range f.sortedAffiliations() {
+		if len(caps.Affiliations) == 0 || caps.CanRegisterAffiliation(name) {
+			metadata.Affiliations = append(metadata.Affiliations, name)
+		}
+	}
+	f.mu.Unlock()
+	sort.Strings(metadata.IdentityTypes)
+	sort.Strings(metadata.Affiliations)
+	return metadata, nil
+}
+
+// registrarCaps parses the capabilities of the registrar's certificate
+func registrarCaps(registrar fabricclient.User) (*fabricca.RegistrarCaps, error) {
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	attrs, err := fabricca.GetCertAttributes(registrar.GetEnrollmentCertificate())
+	if err != nil {
+		return nil, err
+	}
+	return fabricca.NewRegistrarCaps(attrs), nil
+}
+
+// newSecret returns a random enrollment secret, as generated by the CA
+func newSecret() (string, error) {
+	secret := make([]byte, 9)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("Error generating secret: %s", err)
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// contains returns true when values contains value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
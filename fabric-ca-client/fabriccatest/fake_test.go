@@ -0,0 +1,723 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabriccatest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	fabricca "github.com/hyperledger/fabric-sdk-go/fabric-ca-client"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+	bccspFactory "github.com/hyperledger/fabric/bccsp/factory"
+)
+
+// memoryStore is an in-memory fabricca.StateStore
+type memoryStore map[string][]byte
+
+func (store memoryStore) SetValue(key string, value []byte) error {
+	store[key] = value
+	return nil
+}
+
+func (store memoryStore) GetValue(key string) ([]byte, error) {
+	value, ok := store[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	return value, nil
+}
+
+// newTestServices creates FakeServices with the org1.department1
+// affiliation and an enrolled admin registrar
+func newTestServices(t *testing.T) (*FakeServices, fabricclient.User) {
+	fake, err := NewFakeServices("")
+	if err != nil {
+		t.Fatalf("NewFakeServices returned error: %v", err)
+	}
+	fake.PreloadAffiliations("org1.department1")
+	err = fake.PreloadIdentity(Identity{Name: "admin", Secret: "adminpw", Type: "client", Affiliation: "org1",
+		Attributes: []fabricca.Attribute{
+			{Key: fabricca.RegistrarRolesAttr, Value: "client,user", ECert: true},
+			{Key: fabricca.RevokerAttr, Value: "true", ECert: true},
+		}})
+	if err != nil {
+		t.Fatalf("PreloadIdentity returned error: %v", err)
+	}
+	admin, err := fake.EnrollAndStore("admin", "adminpw", memoryStore{})
+	if err != nil {
+		t.Fatalf("EnrollAndStore returned error: %v", err)
+	}
+	return fake, admin
+}
+
+func TestRegisterAndEnroll(t *testing.T) {
+	fake, admin := newTestServices(t)
+
+	secret, err := fake.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Affiliation: "org1.department1"})
+	if err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	calls := fake.CallsTo("Register")
+	if len(calls) != 1 || calls[0].Args[0] != admin ||
+		calls[0].Args[1].(*fabricca.RegistrationRequest).Affiliation != "org1.department1" {
+		t.Fatalf("Unexpected recorded Register calls: %v", calls)
+	}
+	if id, ok := fake.GetRegisteredIdentity("user1"); !ok || id.Secret != secret || id.Type != "user" {
+		t.Fatalf("Unexpected registered identity: %+v", id)
+	}
+
+	keyPEM, certPEM, err := fake.Enroll("user1", secret)
+	if err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Enroll returned an invalid certificate: %v", err)
+	}
+	caInfo, err := fake.GetCAInfo()
+	if err != nil {
+		t.Fatalf("GetCAInfo returned error: %v", err)
+	}
+	block, _ = pem.Decode(caInfo.CAChain)
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("GetCAInfo returned an invalid CA chain: %v", err)
+	}
+	if cert.Subject.CommonName != "user1" || cert.CheckSignatureFrom(caCert) != nil || len(keyPEM) == 0 {
+		t.Fatalf("Expected a certificate of user1 issued by the CA")
+	}
+
+	if _, _, err := fake.Enroll("user1", "wrongpw"); !errors.Is(err, fabricca.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials for a wrong secret, got: %v", err)
+	}
+	if _, _, err := fake.EnrollWithOptions("user1", secret,
+		&fabricca.EnrollmentOptions{CAName: "ca2"}); !errors.Is(err, fabricca.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for an unknown CA name, got: %v", err)
+	}
+	_, err = fake.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	if !errors.Is(err, fabricca.ErrAlreadyRegistered) {
+		t.Fatalf("Expected ErrAlreadyRegistered, got: %v", err)
+	}
+	_, err = fake.Register(admin, &fabricca.RegistrationRequest{Name: "user2", Affiliation: "org2"})
+	if !errors.Is(err, fabricca.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for an unknown affiliation, got: %v", err)
+	}
+	var validationErr *fabricca.ValidationError
+	if _, err = fake.Register(admin, &fabricca.RegistrationRequest{Name: "user2"}); !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError without an affiliation, got: %v", err)
+	}
+
+	if _, err := fake.Register(admin, &fabricca.RegistrationRequest{Name: "user2", Affiliation: "org1",
+		MaxEnrollments: 1, Secret: "user2secret"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	for _, secret := range []string{"wrong", "user2secret", "user2secret"} {
+		if ok, err := fake.VerifySecret("user2", secret); err != nil || ok != (secret == "user2secret") {
+			t.Fatalf("VerifySecret(%s) returned %t, %v", secret, ok, err)
+		}
+	}
+	if _, _, err := fake.Enroll("user2", "user2secret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if ok, err := fake.VerifySecret("user2", "user2secret"); err != nil || ok {
+		t.Fatalf("Expected the secret to be rejected past MaxEnrollments, got %t, %v", ok, err)
+	}
+	if _, _, err := fake.Enroll("user2", "user2secret"); !errors.Is(err, fabricca.ErrEnrollmentLimitReached) {
+		t.Fatalf("Expected ErrEnrollmentLimitReached past MaxEnrollments, got: %v", err)
+	}
+}
+
+func TestECertAttributes(t *testing.T) {
+	fake, admin := newTestServices(t)
+	secret, err := fake.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Affiliation: "org1",
+		Attributes: []fabricca.Attribute{{Key: "role", Value: "auditor", ECert: true}, {Key: "dept", Value: "hr"}}})
+	if err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	certAttrs := func(cert []byte) map[string]string {
+		attrs, err := fabricca.GetCertAttributes(cert)
+		if err != nil {
+			t.Fatalf("GetCertAttributes returned error: %v", err)
+		}
+		return attrs
+	}
+	_, cert, err := fake.Enroll("user1", secret)
+	if err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if attrs := certAttrs(cert); attrs["role"] != "auditor" || attrs["hf.EnrollmentID"] != "user1" ||
+		attrs["dept"] != "" {
+		t.Fatalf("Expected only the ECert attributes without attribute requests, got %v", attrs)
+	}
+	_, cert, err = fake.EnrollWithOptions("user1", secret, &fabricca.EnrollmentOptions{
+		AttrReqs: []fabricca.AttributeRequest{{Name: "dept"}}})
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	if attrs := certAttrs(cert); len(attrs) != 1 || attrs["dept"] != "hr" {
+		t.Fatalf("Expected only the requested attributes, got %v", attrs)
+	}
+}
+
+func TestSetError(t *testing.T) {
+	fake, admin := newTestServices(t)
+
+	fake.SetError(AnyMethod, UnreachableError())
+	fake.SetError("GetIdentity", PermissionDeniedError())
+	if _, _, err := fake.Enroll("admin", "adminpw"); !errors.Is(err, fabricca.ErrCAUnreachable) {
+		t.Fatalf("Expected ErrCAUnreachable, got: %v", err)
+	}
+	if _, err := fake.GetIdentity(admin, "admin"); !errors.Is(err, fabricca.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied, got: %v", err)
+	}
+	fake.SetError(AnyMethod, nil)
+	if _, err := fake.GetIdentity(admin, "admin"); !errors.Is(err, fabricca.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied, got: %v", err)
+	}
+	fake.SetError("GetIdentity", nil)
+	if _, err := fake.GetIdentity(admin, "admin"); err != nil {
+		t.Fatalf("GetIdentity returned error: %v", err)
+	}
+	if calls := fake.CallsTo("GetIdentity"); len(calls) != 3 {
+		t.Fatalf("Expected the failed calls to be recorded, got %v", calls)
+	}
+
+	if err := fake.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if _, _, err := fake.Enroll("admin", "adminpw"); !errors.Is(err, fabricca.ErrClosed) {
+		t.Fatalf("Expected ErrClosed, got: %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	fake, admin := newTestServices(t)
+	if err := fake.PreloadIdentity(Identity{Name: "user1", Secret: "user1pw", Affiliation: "org1"}); err != nil {
+		t.Fatalf("PreloadIdentity returned error: %v", err)
+	}
+	enrollment, err := fake.EnrollV2("user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollV2 returned error: %v", err)
+	}
+	certs, err := fake.GetCertificates(admin, fabricca.CertFilter{Name: "user1"})
+	if err != nil || len(certs) != 1 || certs[0].Serial != enrollment.Serial {
+		t.Fatalf("Unexpected certificates of user1: %v, %v", certs, err)
+	}
+
+	if err := fake.Revoke(admin, &fabricca.RevocationRequest{Name: "user1",
+		ReasonCode: fabricca.KeyCompromise}); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if revoked, err := fake.IsRevoked(admin, certs[0].Serial, certs[0].AKI); err != nil || !revoked {
+		t.Fatalf("Expected the certificate to be revoked: %v, %v", revoked, err)
+	}
+	if _, err := fake.IsRevoked(admin, "01", certs[0].AKI); !errors.Is(err, fabricca.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for an unknown certificate, got: %v", err)
+	}
+	if _, _, err := fake.Enroll("user1", "user1pw"); !errors.Is(err, fabricca.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials for a revoked identity, got: %v", err)
+	}
+
+	der, err := fake.GenerateCRL(admin, nil)
+	if err != nil {
+		t.Fatalf("GenerateCRL returned error: %v", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("GenerateCRL returned an invalid CRL: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 ||
+		fmt.Sprintf("%x", crl.RevokedCertificateEntries[0].SerialNumber.Bytes()) != enrollment.Serial ||
+		crl.RevokedCertificateEntries[0].ReasonCode != int(fabricca.KeyCompromise) {
+		t.Fatalf("Unexpected CRL entries: %+v", crl.RevokedCertificateEntries)
+	}
+	if err := fake.Revoke(admin, &fabricca.RevocationRequest{Name: "user2"}); !errors.Is(err, fabricca.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for an unknown identity, got: %v", err)
+	}
+}
+
+func TestRevokeNewestOnly(t *testing.T) {
+	fake, admin := newTestServices(t)
+	if err := fake.PreloadIdentity(Identity{Name: "user1", Secret: "user1pw", Affiliation: "org1"}); err != nil {
+		t.Fatalf("PreloadIdentity returned error: %v", err)
+	}
+	var enrollments []*fabricca.Enrollment
+	for i := 0; i < 2; i++ {
+		enrollment, err := fake.EnrollV2("user1", "user1pw")
+		if err != nil {
+			t.Fatalf("EnrollV2 returned error: %v", err)
+		}
+		enrollments = append(enrollments, enrollment)
+	}
+	certs, err := fake.GetCertificates(admin, fabricca.CertFilter{Name: "user1"})
+	if err != nil || len(certs) != 2 {
+		t.Fatalf("Unexpected certificates of user1: %v, %v", certs, err)
+	}
+	request := &fabricca.RevocationRequest{Name: "user1", RevokeNewestOnly: true}
+	if err := fake.Revoke(admin, request); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	for i, expected := range []bool{false, true} {
+		revoked, err := fake.IsRevoked(admin, enrollments[i].Serial, certs[0].AKI)
+		if err != nil || revoked != expected {
+			t.Fatalf("Expected certificate %d to be revoked: %t, got %t, %v", i, expected, revoked, err)
+		}
+	}
+	if _, _, err := fake.Enroll("user1", "user1pw"); err != nil {
+		t.Fatalf("Expected the identity to still enroll, got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := fake.Revoke(admin, request); err != nil {
+			t.Fatalf("Revoke returned error: %v", err)
+		}
+	}
+	if err := fake.Revoke(admin, request); !errors.Is(err, fabricca.ErrNoCertificates) {
+		t.Fatalf("Expected ErrNoCertificates once all certificates are revoked, got: %v", err)
+	}
+}
+
+func TestRevokeAffiliation(t *testing.T) {
+	fake, admin := newTestServices(t)
+	for _, name := range []string{"user1", "user2"} {
+		err := fake.PreloadIdentity(Identity{Name: name, Secret: name + "pw", Affiliation: "org1.department1"})
+		if err != nil {
+			t.Fatalf("PreloadIdentity returned error: %v", err)
+		}
+	}
+	summary, err := fake.RevokeAffiliation(admin, "org1", fabricca.KeyCompromise)
+	if err != nil {
+		t.Fatalf("RevokeAffiliation returned error: %v", err)
+	}
+	if summary.Total != 3 || len(summary.Revoked) != 2 || !reflect.DeepEqual(summary.Skipped, []string{"admin"}) ||
+		len(summary.Errors) != 0 || summary.CRL != nil {
+		t.Fatalf("Unexpected summary %+v", summary)
+	}
+	if _, _, err := fake.Enroll("user1", "user1pw"); !errors.Is(err, fabricca.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials for a revoked identity, got: %v", err)
+	}
+	if _, err := fake.RevokeAffiliation(admin, "org2", fabricca.KeyCompromise); !errors.Is(err, fabricca.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for an unknown affiliation, got: %v", err)
+	}
+}
+
+func TestAffiliations(t *testing.T) {
+	fake, admin := newTestServices(t)
+	if _, err := fake.AddAffiliation(admin, "org2.department1"); !errors.Is(err, fabricca.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound without the parent affiliation, got: %v", err)
+	}
+	for _, name := range []string{"org2", "org2.department1", "org1.department2"} {
+		if _, err := fake.AddAffiliation(admin, name); err != nil {
+			t.Fatalf("AddAffiliation returned error: %v", err)
+		}
+	}
+	tree, err := fake.GetAffiliationTree(admin)
+	if err != nil {
+		t.Fatalf("GetAffiliationTree returned error: %v", err)
+	}
+	var paths []string
+	var walk func(node *fabricca.AffiliationNode)
+	walk = func(node *fabricca.AffiliationNode) {
+		for _, child := range node.Children {
+			paths = append(paths, child.Path)
+			walk(child)
+		}
+	}
+	walk(tree)
+	expected := []string{"org1", "org1.department1", "org1.department2", "org2", "org2.department1"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Unexpected affiliation tree %v", paths)
+	}
+
+	org1, err := fake.GetAffiliation(admin, "org1")
+	if err != nil || !reflect.DeepEqual(org1.Identities, []string{"admin"}) {
+		t.Fatalf("Unexpected org1 affiliation: %+v, %v", org1, err)
+	}
+	if _, err := fake.RemoveAffiliation(admin, "org1", false); err == nil {
+		t.Fatalf("RemoveAffiliation should have failed for a non empty affiliation")
+	}
+	removed, err := fake.RemoveAffiliation(admin, "org1", true)
+	if err != nil || len(removed.Affiliations) != 2 {
+		t.Fatalf("Unexpected removed affiliation: %+v, %v", removed, err)
+	}
+	if _, ok := fake.GetRegisteredIdentity("admin"); ok {
+		t.Fatalf("Expected the identities of the removed affiliation to be removed")
+	}
+}
+
+func TestModifyIdentityIfMatch(t *testing.T) {
+	fake, admin := newTestServices(t)
+	identity, err := fake.GetIdentity(admin, "admin")
+	if err != nil {
+		t.Fatalf("GetIdentity returned error: %v", err)
+	}
+	request := &fabricca.ModifyIdentityRequest{Name: "admin", Secret: "newadminpw", IfMatch: identity.ETag()}
+	modified, err := fake.ModifyIdentity(admin, request)
+	if err != nil {
+		t.Fatalf("ModifyIdentity returned error: %v", err)
+	}
+	if modified.ETag() == identity.ETag() {
+		t.Fatalf("Expected the ETag to change after the secret rotation")
+	}
+	request = &fabricca.ModifyIdentityRequest{Name: "admin", Type: "peer", IfMatch: modified.ETag()}
+	if modified, err = fake.ModifyIdentity(admin, request); err != nil {
+		t.Fatalf("ModifyIdentity returned error: %v", err)
+	}
+	request.Type = "user"
+	if _, err := fake.ModifyIdentity(admin, request); !errors.Is(err, fabricca.ErrConflict) {
+		t.Fatalf("Expected ErrConflict with a stale IfMatch, got: %v", err)
+	}
+	if _, err := fake.ResetSecretIfMatch(admin, "admin", identity.ETag()); !errors.Is(err, fabricca.ErrConflict) {
+		t.Fatalf("Expected ErrConflict resetting the secret with a stale IfMatch, got: %v", err)
+	}
+	err = fake.ModifyEnrollmentSecretIfMatch(admin, "admin", "otheradminpw", modified.ETag())
+	if err != nil {
+		t.Fatalf("ModifyEnrollmentSecretIfMatch returned error: %v", err)
+	}
+	err = fake.ModifyEnrollmentSecretIfMatch(admin, "admin", "newadminpw", modified.ETag())
+	if !errors.Is(err, fabricca.ErrConflict) {
+		t.Fatalf("Expected ErrConflict rotating the secret with a stale IfMatch, got: %v", err)
+	}
+	if registered, _ := fake.GetRegisteredIdentity("admin"); registered.Secret != "otheradminpw" ||
+		registered.Type != "peer" {
+		t.Fatalf("Unexpected identity %+v", registered)
+	}
+}
+
+func TestResetSecret(t *testing.T) {
+	fake, admin := newTestServices(t)
+	secret, err := fake.ResetSecret(admin, "admin")
+	if err != nil {
+		t.Fatalf("ResetSecret returned error: %v", err)
+	}
+	if _, _, err := fake.Enroll("admin", "adminpw"); err == nil {
+		t.Fatalf("Enroll should have failed with the previous secret")
+	}
+	if _, _, err := fake.Enroll("admin", secret); err != nil {
+		t.Fatalf("Enroll returned error with the new secret: %v", err)
+	}
+	fake.SetError("ResetSecret", PermissionDeniedError())
+	if _, err := fake.ResetSecret(admin, "admin"); !errors.Is(err, fabricca.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied, got: %v", err)
+	}
+}
+
+func TestOpenSession(t *testing.T) {
+	fake, admin := newTestServices(t)
+	session, err := fake.OpenSession()
+	if err != nil {
+		t.Fatalf("OpenSession returned error: %v", err)
+	}
+	secret, err := session.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	if err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if _, _, err := session.Enroll("user1", secret); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	session.Close()
+	if _, _, err := session.Enroll("user1", secret); !errors.Is(err, fabricca.ErrClosed) {
+		t.Fatalf("Expected ErrClosed once the session is closed, got: %v", err)
+	}
+}
+
+func TestEnrollTLSCertificate(t *testing.T) {
+	fake, admin := newTestServices(t)
+	secret, err := fake.Register(admin, &fabricca.RegistrationRequest{Name: "peer1", Affiliation: "org1"})
+	if err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	certificate, err := fake.EnrollTLSCertificate("peer1", secret)
+	if err != nil {
+		t.Fatalf("EnrollTLSCertificate returned error: %v", err)
+	}
+	if certificate.Leaf == nil || certificate.Leaf.Subject.CommonName != "peer1" || certificate.PrivateKey == nil {
+		t.Fatalf("Unexpected TLS certificate %+v", certificate)
+	}
+}
+
+func TestGetExpiringCertificates(t *testing.T) {
+	fake, admin := newTestServices(t)
+	if err := fake.PreloadIdentity(Identity{Name: "user1", Secret: "user1pw", Affiliation: "org1"}); err != nil {
+		t.Fatalf("PreloadIdentity returned error: %v", err)
+	}
+	if _, err := fake.EnrollV2("user1", "user1pw"); err != nil {
+		t.Fatalf("EnrollV2 returned error: %v", err)
+	}
+	expiring := func(within time.Duration) bool {
+		certs, err := fake.GetExpiringCertificates(admin, within)
+		if err != nil {
+			t.Fatalf("GetExpiringCertificates returned error: %v", err)
+		}
+		for _, cert := range certs {
+			if cert.Name == "user1" {
+				return true
+			}
+		}
+		return false
+	}
+	if expiring(24*time.Hour) || !expiring(2*365*24*time.Hour) {
+		t.Fatalf("Only the windows covering the certificate expiry should list it")
+	}
+	if err := fake.Revoke(admin, &fabricca.RevocationRequest{Name: "user1"}); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if expiring(2 * 365 * 24 * time.Hour) {
+		t.Fatalf("Revoked certificates should not be listed")
+	}
+	if _, err := fake.GetExpiringCertificates(admin, -time.Hour); err == nil {
+		t.Fatalf("GetExpiringCertificates should have failed for a negative window")
+	}
+}
+
+func TestStreamIdentities(t *testing.T) {
+	fake, admin := newTestServices(t)
+	for _, name := range []string{"user2", "user1"} {
+		if _, err := fake.Register(admin, &fabricca.RegistrationRequest{Name: name, Affiliation: "org1"}); err != nil {
+			t.Fatalf("Register returned error: %v", err)
+		}
+	}
+	all, err := fake.GetAllIdentities(admin)
+	if err != nil {
+		t.Fatalf("GetAllIdentities returned error: %v", err)
+	}
+	identities, errs, err := fake.StreamIdentities(context.Background(), admin)
+	if err != nil {
+		t.Fatalf("StreamIdentities returned error: %v", err)
+	}
+	var streamed []string
+	for identity := range identities {
+		streamed = append(streamed, identity.Name)
+	}
+	if err := <-errs; err != nil || len(streamed) != len(all) {
+		t.Fatalf("Expected the %d identities to be streamed, got %q: %v", len(all), streamed, err)
+	}
+	for i, identity := range all {
+		if streamed[i] != identity.Name {
+			t.Fatalf("Expected the identities in the order of GetAllIdentities, got %q", streamed)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	identities, errs, _ = fake.StreamIdentities(ctx, admin)
+	for range identities {
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestEnrollIdentityAndStore(t *testing.T) {
+	fake, admin := newTestServices(t)
+	secret, err := fake.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	if err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	store := memoryStore{}
+	if _, err := fake.EnrollIdentityAndStore("", "user1", secret, store); err == nil {
+		t.Fatalf("EnrollIdentityAndStore should have failed without an MSP ID")
+	}
+	user, err := fake.EnrollIdentityAndStore("Org1MSP", "user1", secret, store)
+	if err != nil || user.GetMspID() != "Org1MSP" {
+		t.Fatalf("EnrollIdentityAndStore returned error: %v", err)
+	}
+	if loaded, err := fabricca.LoadUserForMSP("Org1MSP", "user1", store); err != nil || loaded.GetMspID() != "Org1MSP" {
+		t.Fatalf("LoadUserForMSP returned error: %v", err)
+	}
+	if _, err := fabricca.LoadUserForMSP("Org2MSP", "user1", store); !errors.Is(err, fabricca.ErrMSPIDMismatch) {
+		t.Fatalf("Expected ErrMSPIDMismatch, got: %v", err)
+	}
+}
+
+func TestFindIdentitiesByAttribute(t *testing.T) {
+	fake, admin := newTestServices(t)
+	for _, name := range []string{"auditor2", "user1", "auditor1"} {
+		request := &fabricca.RegistrationRequest{Name: name, Affiliation: "org1"}
+		if name != "user1" {
+			request.Attributes = []fabricca.Attribute{{Key: "role", Value: "auditor"}}
+		}
+		if _, err := fake.Register(admin, request); err != nil {
+			t.Fatalf("Register returned error: %v", err)
+		}
+	}
+	auditors, err := fake.FindIdentitiesByAttribute(admin, "role", "auditor")
+	if err != nil {
+		t.Fatalf("FindIdentitiesByAttribute returned error: %v", err)
+	}
+	if len(auditors) != 2 || auditors[0].Name != "auditor1" || auditors[1].Name != "auditor2" {
+		t.Fatalf("Expected the auditors sorted by name, got %+v", auditors)
+	}
+	if none, err := fake.FindIdentitiesByAttribute(admin, "role", "admin"); err != nil || none == nil || len(none) != 0 {
+		t.Fatalf("Expected an empty slice when no identity matches, got %v: %v", none, err)
+	}
+}
+
+func TestEnrollIdentity(t *testing.T) {
+	fake, admin := newTestServices(t)
+	secret, err := fake.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	if err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if _, err := fake.EnrollIdentity("", "user1", secret); err == nil {
+		t.Fatalf("EnrollIdentity should have failed without an MSP ID")
+	}
+	identity, err := fake.EnrollIdentity("Org1MSP", "user1", secret)
+	if err != nil {
+		t.Fatalf("EnrollIdentity returned error: %v", err)
+	}
+	if identity.MSPID != "Org1MSP" || identity.Cert == nil || identity.Key == nil {
+		t.Fatalf("Unexpected identity %+v", identity)
+	}
+}
+
+func TestRegisterRegistrar(t *testing.T) {
+	fake, admin := newTestServices(t)
+	request := &fabricca.RegistrarRegistrationRequest{
+		RegistrationRequest: fabricca.RegistrationRequest{Name: "registrar1", Type: "client", Affiliation: "org1"},
+		AllowedRoles:        []string{"user"},
+	}
+	if _, err := fake.RegisterRegistrar(admin, request); err != nil {
+		t.Fatalf("RegisterRegistrar returned error: %v", err)
+	}
+	registered, _ := fake.GetRegisteredIdentity("registrar1")
+	if len(registered.Attributes) == 0 || registered.Attributes[0].Key != fabricca.RegistrarRolesAttr ||
+		registered.Attributes[0].Value != "user" {
+		t.Fatalf("Unexpected attributes %v", registered.Attributes)
+	}
+	request.Name, request.CanGenCRL = "registrar2", true
+	if _, err := fake.RegisterRegistrar(admin, request); !errors.Is(err, fabricca.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied granting GenCRL, got: %v", err)
+	}
+}
+
+func TestGetRegistrarCapabilities(t *testing.T) {
+	fake, admin := newTestServices(t)
+	caps, err := fake.GetRegistrarCapabilities(admin)
+	if err != nil {
+		t.Fatalf("GetRegistrarCapabilities returned error: %v", err)
+	}
+	if !caps.HasAttributes || !caps.CanRegisterType("user") || caps.CanRegisterType("peer") ||
+		!caps.Revoker || caps.GenCRL {
+		t.Fatalf("Unexpected capabilities %+v", caps)
+	}
+	if _, err := fake.SignerFor(admin); err != nil {
+		t.Fatalf("SignerFor returned error: %v", err)
+	}
+}
+
+func TestGetRegistrationMetadata(t *testing.T) {
+	fake, admin := newTestServices(t)
+	metadata, err := fake.GetRegistrationMetadata(admin)
+	if err != nil {
+		t.Fatalf("GetRegistrationMetadata returned error: %v", err)
+	}
+	if !reflect.DeepEqual(metadata.IdentityTypes, []string{"client", "user"}) ||
+		!reflect.DeepEqual(metadata.Affiliations, []string{"org1", "org1.department1"}) {
+		t.Fatalf("Unexpected metadata %+v", metadata)
+	}
+}
+
+func TestGetTLSCACerts(t *testing.T) {
+	fake, _ := newTestServices(t)
+	if _, err := fake.GetTLSCACerts(context.Background()); err == nil {
+		t.Fatalf("GetTLSCACerts should have failed without a TLS CA")
+	}
+	tlsCA, err := NewFakeServices("tlsca")
+	if err != nil {
+		t.Fatalf("NewFakeServices returned error: %v", err)
+	}
+	fake.SetTLSCA(tlsCA)
+	certs, err := fake.GetTLSCACerts(context.Background())
+	if err != nil {
+		t.Fatalf("GetTLSCACerts returned error: %v", err)
+	}
+	tlsInfo, _ := tlsCA.GetCAInfo()
+	caInfo, _ := fake.GetCAInfo()
+	if len(certs) != 1 || !bytes.Equal(certs[0], tlsInfo.CAChain) || bytes.Equal(certs[0], caInfo.CAChain) {
+		t.Fatalf("GetTLSCACerts did not return the chain of the TLS CA")
+	}
+}
+
+// keySigner signs CSRs with its key
+type keySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+func (signer keySigner) SignCSR(template *x509.CertificateRequest) ([]byte, error) {
+	return x509.CreateCertificateRequest(rand.Reader, template, signer.key)
+}
+
+func TestEnrollWithCSRSigner(t *testing.T) {
+	fake, admin := newTestServices(t)
+	secret, err := fake.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Affiliation: "org1"})
+	if err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	keyPEM, certPEM, err := fake.EnrollWithOptions("user1", secret,
+		&fabricca.EnrollmentOptions{CSRSigner: keySigner{key: key}})
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || keyPEM != nil || !key.PublicKey.Equal(cert.PublicKey) || cert.Subject.CommonName != "user1" {
+		t.Fatalf("Expected a certificate of the key of the CSR signer and no key, error: %v", err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	keyStorePath, err := ioutil.TempDir("", "fabriccatest")
+	if err != nil {
+		fmt.Printf("Error creating keystore directory: %s\n", err)
+		os.Exit(1)
+	}
+	err = bccspFactory.InitFactories(&bccspFactory.FactoryOpts{
+		ProviderName: "SW",
+		SwOpts: &bccspFactory.SwOpts{
+			HashFamily:   "SHA2",
+			SecLevel:     256,
+			FileKeystore: &bccspFactory.FileKeystoreOpts{KeyStorePath: keyStorePath},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Error initializing BCCSP: %s\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(keyStorePath)
+	os.Exit(code)
+}
@@ -0,0 +1,187 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabriccatest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+)
+
+// Credentials of the bootstrap admin of the CAs started by StartTestCA
+const (
+	TestCAAdminID     = "admin"
+	TestCAAdminSecret = "adminpw"
+)
+
+// TestCAAffiliations are the affiliations of the CAs started by StartTestCA
+var TestCAAffiliations = []string{"org1.department1", "org1.department2", "org2.department1"}
+
+// testCAMu serializes the CAs started by StartTestCA: the fabric-ca server
+// keeps its state, like its user registry, in package variables so that a
+// single CA can run in a process at a time
+var testCAMu sync.Mutex
+
+// TestCA is an ephemeral fabric-ca server started by StartTestCA
+type TestCA struct {
+	// URL is the http URL the CA listens at, on the loopback interface.
+	// Clients connect to it with fabricca.WithInsecure
+	URL string
+	// AdminID and AdminSecret are the credentials of the bootstrap admin,
+	// who can register and revoke identities of any affiliation
+	AdminID     string
+	AdminSecret string
+	// HomeDir is the directory of the CA key, certificate and database,
+	// removed on cleanup
+	HomeDir string
+}
+
+// StartTestCA ...
+/**
+ * Start a fabric-ca server, in process, on a free port of the loopback
+ * interface with a bootstrap admin and the TestCAAffiliations. The CA is
+ * stopped and its home directory removed when the test and its subtests
+ * complete. A single CA runs at a time: StartTestCA waits for the CA of
+ * another test to be stopped, a test must not start two of them
+ * @param {testing.TB} t The test the CA is started for
+ * @returns {TestCA} The started CA
+ */
+func StartTestCA(t testing.TB) *TestCA {
+	t.Helper()
+	testCAMu.Lock()
+	t.Cleanup(testCAMu.Unlock)
+
+	homeDir, err := ioutil.TempDir("", "fabriccatest-ca")
+	if err != nil {
+		t.Fatalf("Error creating the test CA home directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(homeDir) })
+
+	// The CA serves on a listener of the harness rather than with
+	// Server.Start, so that it is closed, and the CA stopped serving, before
+	// the home directory is removed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening for the test CA: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	server := &fabric_ca.Server{
+		HomeDir: homeDir,
+		Config: &fabric_ca.ServerConfig{
+			Address:      "127.0.0.1",
+			Port:         port,
+			Affiliations: testCAAffiliationsConfig(),
+		},
+	}
+	if err := server.RegisterBootstrapUser(TestCAAdminID, TestCAAdminSecret, ""); err != nil {
+		listener.Close()
+		t.Fatalf("Error registering the test CA admin: %s", err)
+	}
+	handler, err := initTestCAServer(server)
+	if err != nil {
+		listener.Close()
+		t.Fatalf("Error starting the test CA: %s", err)
+	}
+	httpServer := &http.Server{Handler: handler}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		httpServer.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		httpServer.Close()
+		<-served
+	})
+	return &TestCA{
+		URL:         fmt.Sprintf("http://127.0.0.1:%d", port),
+		AdminID:     TestCAAdminID,
+		AdminSecret: TestCAAdminSecret,
+		HomeDir:     homeDir,
+	}
+}
+
+// testCAEndpoints are the endpoints of the fabric-ca server, as registered
+// by Server.Start
+var testCAEndpoints = map[string]func() (http.Handler, error){
+	"register": fabric_ca.NewRegisterHandler,
+	"enroll":   fabric_ca.NewEnrollHandler,
+	"reenroll": fabric_ca.NewReenrollHandler,
+	"revoke":   fabric_ca.NewRevokeHandler,
+	"tcert":    fabric_ca.NewTCertHandler,
+}
+
+// initTestCAServer initializes the fabric-ca server like Server.Start does,
+// without listening, and returns the handler of its endpoints
+func initTestCAServer(server *fabric_ca.Server) (http.Handler, error) {
+	if err := server.Init(false); err != nil {
+		return nil, err
+	}
+	fabric_ca.CAKeyFile = server.Config.CA.Keyfile
+	fabric_ca.CACertFile = server.Config.CA.Certfile
+	mux := http.NewServeMux()
+	for name, newHandler := range testCAEndpoints {
+		handler, err := newHandler()
+		path, handler, err := fabric_ca.NewAuthWrapper(name, handler, err)
+		if err != nil {
+			// Like Server.Start, endpoints which cannot be created are
+			// disabled
+			continue
+		}
+		mux.Handle(path, handler)
+	}
+	return mux, nil
+}
+
+// ConfigYAML returns the SDK config of a client of the CA, whose key store
+// is in the CA home directory, for config.InitConfigFromReader
+func (ca *TestCA) ConfigYAML() string {
+	return fmt.Sprintf(`client:
+ fabricCA:
+  id: "testca"
+  serverURL: "%s"
+ keystore:
+  path: "%s/msp"
+`, ca.URL, ca.HomeDir)
+}
+
+// testCAAffiliationsConfig returns the TestCAAffiliations as configured on
+// the fabric-ca server, a tree of maps
+func testCAAffiliationsConfig() map[string]interface{} {
+	affiliations := make(map[string]interface{})
+	for _, path := range TestCAAffiliations {
+		parent := affiliations
+		for _, name := range strings.Split(path, ".") {
+			child, ok := parent[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[name] = child
+			}
+			parent = child
+		}
+	}
+	return affiliations
+}
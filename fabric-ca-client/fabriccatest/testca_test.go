@@ -0,0 +1,67 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabriccatest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-sdk-go/config"
+	fabricca "github.com/hyperledger/fabric-sdk-go/fabric-ca-client"
+)
+
+func TestStartTestCA(t *testing.T) {
+	ca := StartTestCA(t)
+	if err := config.InitConfigFromReader(strings.NewReader(ca.ConfigYAML()), "yaml"); err != nil {
+		t.Fatalf("InitConfigFromReader returned error: %v", err)
+	}
+	t.Cleanup(func() { config.InitConfigFromReader(strings.NewReader(""), "yaml") })
+	services, err := fabricca.NewFabricCAClient(fabricca.WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	defer services.Close()
+
+	admin, err := services.EnrollAndStore(ca.AdminID, ca.AdminSecret, memoryStore{})
+	if err != nil {
+		t.Fatalf("Enrolling the admin returned error: %v", err)
+	}
+	// The vendored fabric-ca server returns the enrollment secret unencoded
+	// while Register decodes the base64 encoded secrets of the CA versions
+	// the SDK targets, so user1 is not enrolled with it
+	if _, err := services.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Type: "user",
+		Affiliation: "org1.department1"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if _, err := services.Register(admin, &fabricca.RegistrationRequest{Name: "user1", Type: "user",
+		Affiliation: "org1.department1"}); !errors.Is(err, fabricca.ErrAlreadyRegistered) {
+		t.Fatalf("Expected ErrAlreadyRegistered, got: %v", err)
+	}
+	if _, _, err := services.Reenroll(admin); err != nil {
+		t.Fatalf("Reenroll returned error: %v", err)
+	}
+	if err := services.Revoke(admin, &fabricca.RevocationRequest{Name: "user1"}); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if _, _, err := services.Enroll(ca.AdminID, "wrongpw"); !errors.Is(err, fabricca.ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials for a wrong secret, got: %v", err)
+	}
+}
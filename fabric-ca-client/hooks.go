@@ -0,0 +1,735 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// Hook is called around the operations of the Services sending requests to
+// the CA, e.g. to emit audit events, see WithHooks. op is the name of the
+// Services method, e.g. "Register" or "RevokeContext", and meta its
+// non-sensitive metadata, keyed by the HookMeta constants. Secrets, keys and
+// CSRs are never part of meta. Hooks are called synchronously, in the order
+// they are set, and must not modify meta
+type Hook interface {
+	// BeforeRequest is called before the operation is performed
+	BeforeRequest(op string, meta map[string]string)
+	// AfterResponse is called once the operation is done, with the error it
+	// failed with, nil on success. meta also holds the outcome of the
+	// operation
+	AfterResponse(op string, meta map[string]string, err error)
+}
+
+// Metadata of the operations passed to the hooks, set when relevant to the
+// operation
+const (
+	// HookMetaCAName is the name of the CA the operation is performed with
+	HookMetaCAName = "ca.name"
+	// HookMetaRegistrar is the name of the user initiating the operation
+	HookMetaRegistrar = "registrar"
+	// HookMetaRegistrarSubject is the subject of the enrollment certificate
+	// of the registrar
+	HookMetaRegistrarSubject = "registrar.subject"
+	// HookMetaTarget is the name of the identity the operation applies to,
+	// comma separated for batches
+	HookMetaTarget = "target"
+	// HookMetaType is the type of the registered or modified identity
+	HookMetaType = "type"
+	// HookMetaAffiliation is the affiliation the operation applies to
+	HookMetaAffiliation = "affiliation"
+	// HookMetaSerial and HookMetaAKI identify the certificate the operation
+	// applies to
+	HookMetaSerial = "serial"
+	HookMetaAKI    = "aki"
+	// HookMetaProfile is the signing profiles of an enrollment, comma
+	// separated
+	HookMetaProfile = "profile"
+	// HookMetaCount is the number of requests of a batch or certificates
+	// requested
+	HookMetaCount = "count"
+	// HookMetaOutcome is the outcome of the operation passed to
+	// AfterResponse, ok or error, or partial for a batch which failed for
+	// some of its targets only
+	HookMetaOutcome = "outcome"
+	// HookMetaSucceeded, HookMetaFailed and HookMetaSkipped are the targets
+	// of a batch, comma separated, passed to AfterResponse: those the
+	// operation succeeded for, failed for, and skipped, like the registrar
+	// itself or the identities already revoked by RevokeAffiliation
+	HookMetaSucceeded = "target.succeeded"
+	HookMetaFailed    = "target.failed"
+	HookMetaSkipped   = "target.skipped"
+	// HookMetaErrorCategory is the category of the error of a failed
+	// operation, see Metrics
+	HookMetaErrorCategory = "error.category"
+)
+
+// WithHooks adds hooks called around the operations of the Services. It can
+// be set several times, the hooks are called in the order they are added
+func WithHooks(hooks ...Hook) Option {
+	return func(fabricCAServices *services) {
+		for _, hook := range hooks {
+			if hook != nil {
+				fabricCAServices.hooks = append(fabricCAServices.hooks, hook)
+			}
+		}
+	}
+}
+
+// withHooks returns the Services calling the hooks of fabricCAServices
+// around its operations, fabricCAServices itself when it has none
+func withHooks(fabricCAServices *services) Services {
+	if len(fabricCAServices.hooks) == 0 {
+		return fabricCAServices
+	}
+	return &hookedServices{services: fabricCAServices, hooks: fabricCAServices.hooks}
+}
+
+// hookedServices calls hooks around the operations of services. CAName,
+// BreakerState, SignerFor, OpenSession and Close do not reach the CA and are
+// not hooked, the operations of the sessions are
+type hookedServices struct {
+	services Services
+	hooks    []Hook
+}
+
+var _ Services = (*hookedServices)(nil)
+
+// call performs an operation with the hooks called around it
+func (h *hookedServices) call(op string, meta map[string]string, operation func() error) error {
+	return h.callBatch(op, meta, func() (map[string]string, error) {
+		return nil, operation()
+	})
+}
+
+// callBatch performs an operation on several targets with the hooks called
+// around it, the operation returning the metadata of its outcome, like the
+// targets it failed for, see HookMetaFailed
+func (h *hookedServices) callBatch(op string, meta map[string]string,
+	operation func() (map[string]string, error)) error {
+	meta[HookMetaCAName] = h.services.CAName()
+	for _, hook := range h.hooks {
+		hook.BeforeRequest(op, meta)
+	}
+	targets, err := operation()
+	// The metadata passed to BeforeRequest is left unchanged, hooks may keep it
+	outcome := make(map[string]string, len(meta)+len(targets)+2)
+	for key, value := range meta {
+		outcome[key] = value
+	}
+	for key, value := range targets {
+		outcome[key] = value
+	}
+	switch {
+	case err != nil:
+		outcome[HookMetaOutcome] = "error"
+		outcome[HookMetaErrorCategory] = errorCategory(err)
+	case outcome[HookMetaFailed] != "":
+		outcome[HookMetaOutcome] = "partial"
+	default:
+		outcome[HookMetaOutcome] = "ok"
+	}
+	for _, hook := range h.hooks {
+		hook.AfterResponse(op, outcome, err)
+	}
+	return err
+}
+
+// hookMeta returns the metadata made of key and value pairs, skipping the
+// empty values
+func hookMeta(keyValues ...string) map[string]string {
+	meta := make(map[string]string)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if keyValues[i+1] != "" {
+			meta[keyValues[i]] = keyValues[i+1]
+		}
+	}
+	return meta
+}
+
+// registrarMeta returns the metadata of an operation initiated by registrar
+func registrarMeta(registrar fabricclient.User, keyValues ...string) map[string]string {
+	meta := hookMeta(keyValues...)
+	if registrar == nil {
+		return meta
+	}
+	meta[HookMetaRegistrar] = registrar.GetName()
+	if block, _ := pem.Decode(registrar.GetEnrollmentCertificate()); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			meta[HookMetaRegistrarSubject] = cert.Subject.String()
+		}
+	}
+	return meta
+}
+
+func (h *hookedServices) CAName() string {
+	return h.services.CAName()
+}
+
+func (h *hookedServices) Enroll(enrollmentID string, enrollmentSecret string) (key []byte, cert []byte, err error) {
+	err = h.call("Enroll", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		key, cert, err = h.services.Enroll(enrollmentID, enrollmentSecret)
+		return err
+	})
+	return key, cert, err
+}
+
+func (h *hookedServices) EnrollContext(ctx context.Context, enrollmentID string,
+	enrollmentSecret string) (key []byte, cert []byte, err error) {
+	err = h.call("EnrollContext", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		key, cert, err = h.services.EnrollContext(ctx, enrollmentID, enrollmentSecret)
+		return err
+	})
+	return key, cert, err
+}
+
+func (h *hookedServices) EnrollWithOptions(enrollmentID string, enrollmentSecret string,
+	opts *EnrollmentOptions) (key []byte, cert []byte, err error) {
+	var profile string
+	if opts != nil {
+		profile = opts.Profile
+	}
+	err = h.call("EnrollWithOptions", hookMeta(HookMetaTarget, enrollmentID, HookMetaProfile, profile), func() error {
+		key, cert, err = h.services.EnrollWithOptions(enrollmentID, enrollmentSecret, opts)
+		return err
+	})
+	return key, cert, err
+}
+
+func (h *hookedServices) EnrollAndStore(enrollmentID string, enrollmentSecret string,
+	store StateStore) (user fabricclient.User, err error) {
+	err = h.call("EnrollAndStore", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		user, err = h.services.EnrollAndStore(enrollmentID, enrollmentSecret, store)
+		return err
+	})
+	return user, err
+}
+
+func (h *hookedServices) EnrollIdentityAndStore(mspID string, enrollmentID string, enrollmentSecret string,
+	store StateStore) (user fabricclient.User, err error) {
+	err = h.call("EnrollIdentityAndStore", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		user, err = h.services.EnrollIdentityAndStore(mspID, enrollmentID, enrollmentSecret, store)
+		return err
+	})
+	return user, err
+}
+
+func (h *hookedServices) EnrollAll(enrollmentID string, enrollmentSecret string, profiles []string,
+	store StateStore) (enrollments map[string]*ProfileEnrollment, err error) {
+	meta := hookMeta(HookMetaTarget, enrollmentID, HookMetaProfile, strings.Join(profiles, ","))
+	err = h.call("EnrollAll", meta, func() error {
+		enrollments, err = h.services.EnrollAll(enrollmentID, enrollmentSecret, profiles, store)
+		return err
+	})
+	return enrollments, err
+}
+
+func (h *hookedServices) EnrollTLS(enrollmentID string, enrollmentSecret string) (key []byte, cert []byte, err error) {
+	err = h.call("EnrollTLS", hookMeta(HookMetaTarget, enrollmentID, HookMetaProfile, TLSProfile), func() error {
+		key, cert, err = h.services.EnrollTLS(enrollmentID, enrollmentSecret)
+		return err
+	})
+	return key, cert, err
+}
+
+func (h *hookedServices) EnrollTLSCertificate(enrollmentID string,
+	enrollmentSecret string) (certificate tls.Certificate, err error) {
+	err = h.call("EnrollTLSCertificate", hookMeta(HookMetaTarget, enrollmentID, HookMetaProfile, TLSProfile),
+		func() error {
+			certificate, err = h.services.EnrollTLSCertificate(enrollmentID, enrollmentSecret)
+			return err
+		})
+	return certificate, err
+}
+
+func (h *hookedServices) EnrollWithSecretRef(enrollmentID string, secretRef string) (key []byte, cert []byte, err error) {
+	err = h.call("EnrollWithSecretRef", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		key, cert, err = h.services.EnrollWithSecretRef(enrollmentID, secretRef)
+		return err
+	})
+	return key, cert, err
+}
+
+func (h *hookedServices) EnrollWithCSR(enrollmentID string, enrollmentSecret string,
+	csrPEM []byte) (cert []byte, err error) {
+	err = h.call("EnrollWithCSR", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		cert, err = h.services.EnrollWithCSR(enrollmentID, enrollmentSecret, csrPEM)
+		return err
+	})
+	return cert, err
+}
+
+func (h *hookedServices) EnrollV2(enrollmentID string, enrollmentSecret string) (enrollment *Enrollment, err error) {
+	err = h.call("EnrollV2", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		enrollment, err = h.services.EnrollV2(enrollmentID, enrollmentSecret)
+		return err
+	})
+	return enrollment, err
+}
+
+func (h *hookedServices) EnrollIdentity(mspID string, enrollmentID string,
+	enrollmentSecret string) (identity *Identity, err error) {
+	err = h.call("EnrollIdentity", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		identity, err = h.services.EnrollIdentity(mspID, enrollmentID, enrollmentSecret)
+		return err
+	})
+	return identity, err
+}
+
+func (h *hookedServices) EnrollIdemix(enrollmentID string,
+	enrollmentSecret string) (credential *IdemixCredential, err error) {
+	err = h.call("EnrollIdemix", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		credential, err = h.services.EnrollIdemix(enrollmentID, enrollmentSecret)
+		return err
+	})
+	return credential, err
+}
+
+func (h *hookedServices) VerifySecret(enrollmentID string, enrollmentSecret string) (valid bool, err error) {
+	err = h.call("VerifySecret", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		valid, err = h.services.VerifySecret(enrollmentID, enrollmentSecret)
+		return err
+	})
+	return valid, err
+}
+
+// registrationMeta returns the metadata of the registration of request
+func registrationMeta(registrar fabricclient.User, request *RegistrationRequest) map[string]string {
+	if request == nil {
+		return registrarMeta(registrar)
+	}
+	return registrarMeta(registrar, HookMetaTarget, request.Name, HookMetaType, request.Type,
+		HookMetaAffiliation, request.Affiliation)
+}
+
+func (h *hookedServices) Register(registrar fabricclient.User, request *RegistrationRequest) (secret string, err error) {
+	err = h.call("Register", registrationMeta(registrar, request), func() error {
+		secret, err = h.services.Register(registrar, request)
+		return err
+	})
+	return secret, err
+}
+
+func (h *hookedServices) RegisterContext(ctx context.Context, registrar fabricclient.User,
+	request *RegistrationRequest) (secret string, err error) {
+	err = h.call("RegisterContext", registrationMeta(registrar, request), func() error {
+		secret, err = h.services.RegisterContext(ctx, registrar, request)
+		return err
+	})
+	return secret, err
+}
+
+func (h *hookedServices) RegisterV2(registrar fabricclient.User,
+	request *RegistrationRequest) (response *RegistrationResponse, err error) {
+	err = h.call("RegisterV2", registrationMeta(registrar, request), func() error {
+		response, err = h.services.RegisterV2(registrar, request)
+		return err
+	})
+	return response, err
+}
+
+func (h *hookedServices) RegisterRegistrar(registrar fabricclient.User,
+	request *RegistrarRegistrationRequest) (secret string, err error) {
+	meta := registrarMeta(registrar)
+	if request != nil {
+		meta = registrationMeta(registrar, &request.RegistrationRequest)
+	}
+	err = h.call("RegisterRegistrar", meta, func() error {
+		secret, err = h.services.RegisterRegistrar(registrar, request)
+		return err
+	})
+	return secret, err
+}
+
+func (h *hookedServices) RegisterBatch(registrar fabricclient.User,
+	requests []*RegistrationRequest) (results []RegisterResult, err error) {
+	var names []string
+	for _, request := range requests {
+		if request != nil {
+			names = append(names, request.Name)
+		}
+	}
+	meta := registrarMeta(registrar, HookMetaTarget, strings.Join(names, ","),
+		HookMetaCount, strconv.Itoa(len(requests)))
+	err = h.callBatch("RegisterBatch", meta, func() (map[string]string, error) {
+		results, err = h.services.RegisterBatch(registrar, requests)
+		var succeeded, failed []string
+		for _, result := range results {
+			if result.Index < 0 || result.Index >= len(requests) || requests[result.Index] == nil {
+				continue
+			}
+			if result.Err != nil {
+				failed = append(failed, requests[result.Index].Name)
+			} else {
+				succeeded = append(succeeded, requests[result.Index].Name)
+			}
+		}
+		return hookMeta(HookMetaSucceeded, strings.Join(succeeded, ","),
+			HookMetaFailed, strings.Join(failed, ",")), err
+	})
+	return results, err
+}
+
+// revocationMeta returns the metadata of the revocation of request
+func revocationMeta(registrar fabricclient.User, request *RevocationRequest) map[string]string {
+	if request == nil {
+		return registrarMeta(registrar)
+	}
+	return registrarMeta(registrar, HookMetaTarget, request.Name, HookMetaSerial, request.Serial,
+		HookMetaAKI, request.AKI)
+}
+
+func (h *hookedServices) Revoke(registrar fabricclient.User, request *RevocationRequest) error {
+	return h.call("Revoke", revocationMeta(registrar, request), func() error {
+		return h.services.Revoke(registrar, request)
+	})
+}
+
+func (h *hookedServices) RevokeContext(ctx context.Context, registrar fabricclient.User,
+	request *RevocationRequest) error {
+	return h.call("RevokeContext", revocationMeta(registrar, request), func() error {
+		return h.services.RevokeContext(ctx, registrar, request)
+	})
+}
+
+func (h *hookedServices) RevokeWithCRL(registrar fabricclient.User,
+	request *RevocationRequest) (crl []byte, err error) {
+	err = h.call("RevokeWithCRL", revocationMeta(registrar, request), func() error {
+		crl, err = h.services.RevokeWithCRL(registrar, request)
+		return err
+	})
+	return crl, err
+}
+
+func (h *hookedServices) GetCertificates(registrar fabricclient.User,
+	filter CertFilter) (certs []CertInfo, err error) {
+	meta := registrarMeta(registrar, HookMetaTarget, filter.Name, HookMetaSerial, filter.Serial,
+		HookMetaAKI, filter.AKI)
+	err = h.call("GetCertificates", meta, func() error {
+		certs, err = h.services.GetCertificates(registrar, filter)
+		return err
+	})
+	return certs, err
+}
+
+func (h *hookedServices) GetExpiringCertificates(registrar fabricclient.User,
+	within time.Duration) (certs []CertInfo, err error) {
+	err = h.call("GetExpiringCertificates", registrarMeta(registrar), func() error {
+		certs, err = h.services.GetExpiringCertificates(registrar, within)
+		return err
+	})
+	return certs, err
+}
+
+func (h *hookedServices) IsRevoked(registrar fabricclient.User, serial string, aki string) (revoked bool, err error) {
+	err = h.call("IsRevoked", registrarMeta(registrar, HookMetaSerial, serial, HookMetaAKI, aki), func() error {
+		revoked, err = h.services.IsRevoked(registrar, serial, aki)
+		return err
+	})
+	return revoked, err
+}
+
+func (h *hookedServices) Reenroll(user fabricclient.User) (key []byte, cert []byte, err error) {
+	var name string
+	if user != nil {
+		name = user.GetName()
+	}
+	err = h.call("Reenroll", hookMeta(HookMetaTarget, name), func() error {
+		key, cert, err = h.services.Reenroll(user)
+		return err
+	})
+	return key, cert, err
+}
+
+func (h *hookedServices) GetCAInfo() (info *CAInfo, err error) {
+	err = h.call("GetCAInfo", hookMeta(), func() error {
+		info, err = h.services.GetCAInfo()
+		return err
+	})
+	return info, err
+}
+
+func (h *hookedServices) GetCACertPool(ctx context.Context) (pool *x509.CertPool, err error) {
+	err = h.call("GetCACertPool", hookMeta(), func() error {
+		pool, err = h.services.GetCACertPool(ctx)
+		return err
+	})
+	return pool, err
+}
+
+func (h *hookedServices) GetTLSCACerts(ctx context.Context) (certs [][]byte, err error) {
+	err = h.call("GetTLSCACerts", hookMeta(), func() error {
+		certs, err = h.services.GetTLSCACerts(ctx)
+		return err
+	})
+	return certs, err
+}
+
+func (h *hookedServices) Ping(ctx context.Context) error {
+	return h.call("Ping", hookMeta(), func() error {
+		return h.services.Ping(ctx)
+	})
+}
+
+func (h *hookedServices) GetTransactionCerts(user fabricclient.User, count int,
+	attributes []string) (tcerts []TCert, err error) {
+	var name string
+	if user != nil {
+		name = user.GetName()
+	}
+	err = h.call("GetTransactionCerts", hookMeta(HookMetaTarget, name, HookMetaCount, strconv.Itoa(count)), func() error {
+		tcerts, err = h.services.GetTransactionCerts(user, count, attributes)
+		return err
+	})
+	return tcerts, err
+}
+
+func (h *hookedServices) GenerateCRL(registrar fabricclient.User, request *CRLRequest) (crl []byte, err error) {
+	err = h.call("GenerateCRL", registrarMeta(registrar), func() error {
+		crl, err = h.services.GenerateCRL(registrar, request)
+		return err
+	})
+	return crl, err
+}
+
+func (h *hookedServices) AddAffiliation(registrar fabricclient.User,
+	name string) (response *AffiliationResponse, err error) {
+	err = h.call("AddAffiliation", registrarMeta(registrar, HookMetaAffiliation, name), func() error {
+		response, err = h.services.AddAffiliation(registrar, name)
+		return err
+	})
+	return response, err
+}
+
+func (h *hookedServices) GetAffiliation(registrar fabricclient.User,
+	name string) (response *AffiliationResponse, err error) {
+	err = h.call("GetAffiliation", registrarMeta(registrar, HookMetaAffiliation, name), func() error {
+		response, err = h.services.GetAffiliation(registrar, name)
+		return err
+	})
+	return response, err
+}
+
+func (h *hookedServices) GetAllAffiliations(registrar fabricclient.User) (responses []*AffiliationResponse, err error) {
+	err = h.call("GetAllAffiliations", registrarMeta(registrar), func() error {
+		responses, err = h.services.GetAllAffiliations(registrar)
+		return err
+	})
+	return responses, err
+}
+
+func (h *hookedServices) GetAffiliationTree(registrar fabricclient.User) (tree *AffiliationNode, err error) {
+	err = h.call("GetAffiliationTree", registrarMeta(registrar), func() error {
+		tree, err = h.services.GetAffiliationTree(registrar)
+		return err
+	})
+	return tree, err
+}
+
+func (h *hookedServices) RemoveAffiliation(registrar fabricclient.User, name string,
+	force bool) (response *AffiliationResponse, err error) {
+	err = h.call("RemoveAffiliation", registrarMeta(registrar, HookMetaAffiliation, name), func() error {
+		response, err = h.services.RemoveAffiliation(registrar, name, force)
+		return err
+	})
+	return response, err
+}
+
+func (h *hookedServices) RevokeAffiliation(registrar fabricclient.User, affiliation string,
+	reason RevocationReason) (summary RevokeSummary, err error) {
+	meta := registrarMeta(registrar, HookMetaAffiliation, affiliation)
+	err = h.callBatch("RevokeAffiliation", meta, func() (map[string]string, error) {
+		summary, err = h.services.RevokeAffiliation(registrar, affiliation, reason)
+		failed := make([]string, 0, len(summary.Errors))
+		for name := range summary.Errors {
+			failed = append(failed, name)
+		}
+		sort.Strings(failed)
+		skipped := append(append([]string(nil), summary.Skipped...), summary.AlreadyRevoked...)
+		return hookMeta(HookMetaSucceeded, strings.Join(summary.Revoked, ","),
+			HookMetaFailed, strings.Join(failed, ","), HookMetaSkipped, strings.Join(skipped, ",")), err
+	})
+	return summary, err
+}
+
+func (h *hookedServices) GetIdentity(registrar fabricclient.User, name string) (response *IdentityResponse, err error) {
+	err = h.call("GetIdentity", registrarMeta(registrar, HookMetaTarget, name), func() error {
+		response, err = h.services.GetIdentity(registrar, name)
+		return err
+	})
+	return response, err
+}
+
+func (h *hookedServices) GetAllIdentities(registrar fabricclient.User) (responses []*IdentityResponse, err error) {
+	err = h.call("GetAllIdentities", registrarMeta(registrar), func() error {
+		responses, err = h.services.GetAllIdentities(registrar)
+		return err
+	})
+	return responses, err
+}
+
+func (h *hookedServices) StreamIdentities(ctx context.Context,
+	registrar fabricclient.User) (identities <-chan IdentityResponse, errs <-chan error, err error) {
+	err = h.call("StreamIdentities", registrarMeta(registrar), func() error {
+		identities, errs, err = h.services.StreamIdentities(ctx, registrar)
+		return err
+	})
+	return identities, errs, err
+}
+
+func (h *hookedServices) FindIdentitiesByAttribute(registrar fabricclient.User, name string,
+	value string) (responses []IdentityResponse, err error) {
+	err = h.call("FindIdentitiesByAttribute", registrarMeta(registrar), func() error {
+		responses, err = h.services.FindIdentitiesByAttribute(registrar, name, value)
+		return err
+	})
+	return responses, err
+}
+
+func (h *hookedServices) ModifyIdentity(registrar fabricclient.User,
+	request *ModifyIdentityRequest) (response *IdentityResponse, err error) {
+	meta := registrarMeta(registrar)
+	if request != nil {
+		meta = registrarMeta(registrar, HookMetaTarget, request.Name, HookMetaType, request.Type,
+			HookMetaAffiliation, request.Affiliation)
+	}
+	err = h.call("ModifyIdentity", meta, func() error {
+		response, err = h.services.ModifyIdentity(registrar, request)
+		return err
+	})
+	return response, err
+}
+
+func (h *hookedServices) ModifyEnrollmentSecret(registrar fabricclient.User, name string, newSecret string) error {
+	return h.call("ModifyEnrollmentSecret", registrarMeta(registrar, HookMetaTarget, name), func() error {
+		return h.services.ModifyEnrollmentSecret(registrar, name, newSecret)
+	})
+}
+
+func (h *hookedServices) ModifyEnrollmentSecretIfMatch(registrar fabricclient.User, name string, newSecret string,
+	ifMatch string) error {
+	return h.call("ModifyEnrollmentSecretIfMatch", registrarMeta(registrar, HookMetaTarget, name), func() error {
+		return h.services.ModifyEnrollmentSecretIfMatch(registrar, name, newSecret, ifMatch)
+	})
+}
+
+func (h *hookedServices) ResetSecret(registrar fabricclient.User, name string) (secret string, err error) {
+	err = h.call("ResetSecret", registrarMeta(registrar, HookMetaTarget, name), func() error {
+		secret, err = h.services.ResetSecret(registrar, name)
+		return err
+	})
+	return secret, err
+}
+
+func (h *hookedServices) ResetSecretIfMatch(registrar fabricclient.User, name string,
+	ifMatch string) (secret string, err error) {
+	err = h.call("ResetSecretIfMatch", registrarMeta(registrar, HookMetaTarget, name), func() error {
+		secret, err = h.services.ResetSecretIfMatch(registrar, name, ifMatch)
+		return err
+	})
+	return secret, err
+}
+
+func (h *hookedServices) RemoveIdentity(registrar fabricclient.User,
+	request *RemoveIdentityRequest) (response *IdentityResponse, err error) {
+	meta := registrarMeta(registrar)
+	if request != nil {
+		meta = registrarMeta(registrar, HookMetaTarget, request.Name)
+	}
+	err = h.call("RemoveIdentity", meta, func() error {
+		response, err = h.services.RemoveIdentity(registrar, request)
+		return err
+	})
+	return response, err
+}
+
+// OpenSession opens a Session whose operations are hooked like those of the
+// Services
+func (h *hookedServices) OpenSession() (Session, error) {
+	session, err := h.services.OpenSession()
+	if err != nil {
+		return nil, err
+	}
+	return &hookedSession{session: session, hooked: h}, nil
+}
+
+// hookedSession calls the hooks of hooked around the operations of session
+type hookedSession struct {
+	session Session
+	hooked  *hookedServices
+}
+
+func (h *hookedSession) Enroll(enrollmentID string, enrollmentSecret string) (key []byte, cert []byte, err error) {
+	err = h.hooked.call("Enroll", hookMeta(HookMetaTarget, enrollmentID), func() error {
+		key, cert, err = h.session.Enroll(enrollmentID, enrollmentSecret)
+		return err
+	})
+	return key, cert, err
+}
+
+func (h *hookedSession) Register(registrar fabricclient.User, request *RegistrationRequest) (secret string, err error) {
+	err = h.hooked.call("Register", registrationMeta(registrar, request), func() error {
+		secret, err = h.session.Register(registrar, request)
+		return err
+	})
+	return secret, err
+}
+
+func (h *hookedSession) Close() error {
+	return h.session.Close()
+}
+
+func (h *hookedServices) GetRegistrarCapabilities(registrar fabricclient.User) (caps *RegistrarCaps, err error) {
+	err = h.call("GetRegistrarCapabilities", registrarMeta(registrar), func() error {
+		caps, err = h.services.GetRegistrarCapabilities(registrar)
+		return err
+	})
+	return caps, err
+}
+
+func (h *hookedServices) GetRegistrationMetadata(registrar fabricclient.User) (metadata *RegMetadata, err error) {
+	err = h.call("GetRegistrationMetadata", registrarMeta(registrar), func() error {
+		metadata, err = h.services.GetRegistrationMetadata(registrar)
+		return err
+	})
+	return metadata, err
+}
+
+func (h *hookedServices) BreakerState() BreakerState {
+	return h.services.BreakerState()
+}
+
+func (h *hookedServices) SignerFor(user fabricclient.User) (crypto.Signer, error) {
+	return h.services.SignerFor(user)
+}
+
+func (h *hookedServices) Close() error {
+	return h.services.Close()
+}
@@ -0,0 +1,223 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// recordingHook records the calls it receives
+type recordingHook struct {
+	name  string
+	calls *[]string
+	metas []map[string]string
+	errs  []error
+}
+
+func (hook *recordingHook) BeforeRequest(op string, meta map[string]string) {
+	*hook.calls = append(*hook.calls, fmt.Sprintf("%s before %s", hook.name, op))
+	hook.metas = append(hook.metas, meta)
+}
+
+func (hook *recordingHook) AfterResponse(op string, meta map[string]string, err error) {
+	*hook.calls = append(*hook.calls, fmt.Sprintf("%s after %s", hook.name, op))
+	hook.metas = append(hook.metas, meta)
+	hook.errs = append(hook.errs, err)
+}
+
+func TestWithHooks(t *testing.T) {
+	registrar := newTestRegistrar(t, nil)
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString([]byte("user1password")), http.StatusOK
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			return "Authorization failure", http.StatusUnauthorized
+		},
+	})
+	defer ca.Close()
+	ca.services.caName = "ca1"
+	if withHooks(ca.services) != Services(ca.services) {
+		t.Fatalf("Services without hooks should not be wrapped")
+	}
+	var calls []string
+	first := &recordingHook{name: "first", calls: &calls}
+	second := &recordingHook{name: "second", calls: &calls}
+	WithHooks(first, nil)(ca.services)
+	WithHooks(second)(ca.services)
+	services := withHooks(ca.services)
+
+	secret, err := services.Register(registrar, &RegistrationRequest{Name: "user1", Type: "client",
+		Affiliation: "org1", Secret: "user1password"})
+	if err != nil || secret != "user1password" {
+		t.Fatalf("Register returned %s, error: %v", secret, err)
+	}
+	if err := services.Revoke(registrar, &RevocationRequest{Name: "user1"}); err == nil {
+		t.Fatalf("Revoke should have failed")
+	}
+	if services.CAName() != "ca1" {
+		t.Fatalf("Unexpected CA name %s", services.CAName())
+	}
+
+	expected := "[first before Register second before Register first after Register second after Register " +
+		"first before Revoke second before Revoke first after Revoke second after Revoke]"
+	if fmt.Sprint(calls) != expected {
+		t.Fatalf("Hooks were not called in order around each operation: %v", calls)
+	}
+	if len(second.metas) != 4 || len(second.errs) != 2 {
+		t.Fatalf("Unexpected calls of the second hook %v", second.metas)
+	}
+	before, after := first.metas[0], first.metas[1]
+	if before[HookMetaCAName] != "ca1" || before[HookMetaRegistrar] != "admin" ||
+		before[HookMetaRegistrarSubject] != "CN=admin" || before[HookMetaTarget] != "user1" ||
+		before[HookMetaType] != "client" || before[HookMetaAffiliation] != "org1" {
+		t.Fatalf("Unexpected metadata of Register %v", before)
+	}
+	if _, ok := before[HookMetaOutcome]; ok {
+		t.Fatalf("The metadata passed to BeforeRequest should not be modified: %v", before)
+	}
+	if after[HookMetaOutcome] != "ok" || after[HookMetaTarget] != "user1" || first.errs[0] != nil {
+		t.Fatalf("Unexpected outcome of Register %v, error: %v", after, first.errs[0])
+	}
+	revoked := first.metas[3]
+	if revoked[HookMetaOutcome] != "error" || revoked[HookMetaErrorCategory] != "invalid_credentials" ||
+		revoked[HookMetaTarget] != "user1" || first.errs[1] == nil {
+		t.Fatalf("Unexpected outcome of Revoke %v, error: %v", revoked, first.errs[1])
+	}
+	for _, meta := range append(first.metas, second.metas...) {
+		for key, value := range meta {
+			if strings.Contains(value, "user1password") {
+				t.Fatalf("The secret was passed to the hooks in %s", key)
+			}
+		}
+	}
+}
+
+func TestHookedSession(t *testing.T) {
+	registrar := newTestRegistrar(t, nil)
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString([]byte("user1password")), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	var calls []string
+	WithHooks(&recordingHook{name: "hook", calls: &calls})(ca.services)
+	session, err := withHooks(ca.services).OpenSession()
+	if err != nil {
+		t.Fatalf("OpenSession returned error: %v", err)
+	}
+	defer session.Close()
+	if _, err := session.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if fmt.Sprint(calls) != "[hook before Register hook after Register]" {
+		t.Fatalf("Hooks were not called around the operation of the session: %v", calls)
+	}
+}
+
+func TestNewFabricCAClientWithHooks(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	initTestConfig(t, fmt.Sprintf(`client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "%s"
+`, ca.URL))
+
+	var calls []string
+	hook := &recordingHook{name: "audit", calls: &calls}
+	services, err := NewFabricCAClient(WithHooks(hook), WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	defer services.Close()
+	if _, _, err := services.Enroll("user1", "user1password"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if fmt.Sprint(calls) != "[audit before Enroll audit after Enroll]" ||
+		hook.metas[1][HookMetaTarget] != "user1" || hook.metas[1][HookMetaCAName] != "DEFAULT" {
+		t.Fatalf("Unexpected hook calls %v, metadata %v", calls, hook.metas)
+	}
+}
+
+func TestHookedBatches(t *testing.T) {
+	registrar := newTestRegistrar(t, map[string]string{RevokerAttr: "true"})
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			if strings.Contains(string(body), "user2") {
+				return "Identity 'user2' is already registered", http.StatusBadRequest
+			}
+			return base64.StdEncoding.EncodeToString([]byte("userpassword")), http.StatusOK
+		},
+		"affiliations": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"name": "org1", "identities": []interface{}{
+				map[string]interface{}{"id": "admin"}, map[string]interface{}{"id": "user1"},
+				map[string]interface{}{"id": "user2"}, map[string]interface{}{"id": "user3"}}}, http.StatusOK
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			switch {
+			case strings.Contains(string(body), "user2"):
+				return "Identity user2 is already revoked", http.StatusBadRequest
+			case strings.Contains(string(body), "user3"):
+				return "Failed to get user user3", http.StatusNotFound
+			}
+			return map[string]interface{}{}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	var calls []string
+	hook := &recordingHook{name: "hook", calls: &calls}
+	WithHooks(hook)(ca.services)
+	services := withHooks(ca.services)
+
+	results, err := services.RegisterBatch(registrar, []*RegistrationRequest{
+		{Name: "user1", Affiliation: "org1"}, {Name: "user2", Affiliation: "org1"}})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("RegisterBatch returned %v, error: %v", results, err)
+	}
+	registered := hook.metas[1]
+	if registered[HookMetaOutcome] != "partial" || registered[HookMetaSucceeded] != "user1" ||
+		registered[HookMetaFailed] != "user2" || hook.errs[0] != nil {
+		t.Fatalf("Unexpected outcome of RegisterBatch %v", registered)
+	}
+
+	if _, err := services.RevokeAffiliation(registrar, "org1", Unspecified); err != nil {
+		t.Fatalf("RevokeAffiliation returned error: %v", err)
+	}
+	revoked := hook.metas[3]
+	if revoked[HookMetaOutcome] != "partial" || revoked[HookMetaSucceeded] != "user1" ||
+		revoked[HookMetaFailed] != "user3" || revoked[HookMetaSkipped] != "admin,user2" {
+		t.Fatalf("Unexpected outcome of RevokeAffiliation %v", revoked)
+	}
+
+	if _, err := services.RegisterBatch(registrar, []*RegistrationRequest{
+		{Name: "user1", Affiliation: "org1"}}); err != nil || hook.metas[5][HookMetaOutcome] != "ok" {
+		t.Fatalf("Unexpected outcome of RegisterBatch %v, error: %v", hook.metas[5], err)
+	}
+}
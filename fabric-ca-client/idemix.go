@@ -0,0 +1,229 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-ca/util"
+)
+
+// ErrIdemixNotSupported is returned by EnrollIdemix when the CA does not
+// issue Idemix credentials, or no IdemixProvider is set
+var ErrIdemixNotSupported = errors.New("Idemix enrollment is not supported")
+
+// IdemixProvider creates Idemix credential requests, see WithIdemixProvider.
+// The SDK implements the enrollment protocol with the CA but not the
+// pairing-based cryptography of Idemix, which can be provided by the idemix
+// package of Fabric
+type IdemixProvider interface {
+	// NewCredentialRequest creates a credential request for the nonce sent
+	// by the CA, with a new user secret key. The request is sent to the CA
+	// encoded as JSON
+	NewCredentialRequest(nonce []byte, issuerPublicKey []byte) (request interface{}, secretKey []byte, err error)
+}
+
+// WithIdemixProvider sets the IdemixProvider EnrollIdemix creates credential
+// requests with. EnrollIdemix fails with ErrIdemixNotSupported without one
+func WithIdemixProvider(provider IdemixProvider) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.idemix = provider
+	}
+}
+
+// IdemixCredential is an anonymous credential issued by the CA. Unlike an
+// enrollment certificate it does not identify its holder: it is used to
+// prove possession of its attributes with zero-knowledge proofs, signed with
+// SecretKey, which verifiers check against the IssuerPublicKey. Transactions
+// signed with it can't be linked to each other or to the enrollment ID
+type IdemixCredential struct {
+	// EnrollmentID is the ID the credential was issued to
+	EnrollmentID string
+	// Credential is the serialized credential
+	Credential []byte
+	// SecretKey is the user secret key the credential is bound to, it must
+	// be kept private
+	SecretKey []byte
+	// Attributes are the attributes certified by the credential, such as
+	// OU, Role and EnrollmentID
+	Attributes map[string]interface{}
+	// CRI is the serialized credential revocation information
+	CRI []byte
+	// IssuerPublicKey is the serialized public key of the CA as Idemix
+	// issuer
+	IssuerPublicKey []byte
+	// IssuerRevocationPublicKey is the PEM encoded public key the CRI is
+	// signed with
+	IssuerRevocationPublicKey []byte
+}
+
+// idemixRequest is a request to the idemix/credential endpoint, without
+// credential request to get a nonce
+type idemixRequest struct {
+	CredRequest interface{} `json:"request"`
+	CAName      string      `json:"caname"`
+}
+
+// EnrollIdemix ...
+/**
+ * Enroll a registered user in order to receive an Idemix credential rather
+ * than an X509 certificate. The CA is asked for a nonce, then for a
+ * credential for the request created by the IdemixProvider
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @returns {IdemixCredential} The credential and the issuer public key
+ * @returns {error} Error matching ErrIdemixNotSupported with errors.Is when the
+ * CA has no Idemix issuer key or no IdemixProvider is set
+ */
+func (fabricCAServices *services) EnrollIdemix(enrollmentID string,
+	enrollmentSecret string) (*IdemixCredential, error) {
+	if enrollmentID == "" {
+		return nil, fmt.Errorf("enrollmentID is empty")
+	}
+	if enrollmentSecret == "" {
+		return nil, fmt.Errorf("enrollmentSecret is empty")
+	}
+	if fabricCAServices.idemix == nil {
+		return nil, fmt.Errorf("No IdemixProvider set: %w", ErrIdemixNotSupported)
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	info, err := fabricCAServices.getCAInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("EnrollIdemix failed: %w", err)
+	}
+	if len(info.IssuerPublicKey) == 0 {
+		return nil, fmt.Errorf("CA %s has no Idemix issuer public key: %w", info.CAName, ErrIdemixNotSupported)
+	}
+	var nonce struct {
+		Nonce string
+	}
+	err = fabricCAServices.postIdemix(ctx, enrollmentID, enrollmentSecret, &idemixRequest{}, &nonce)
+	if err != nil {
+		return nil, fmt.Errorf("EnrollIdemix failed: %w", err)
+	}
+	nonceBytes, err := base64.StdEncoding.DecodeString(nonce.Nonce)
+	if err != nil || len(nonceBytes) == 0 {
+		return nil, fmt.Errorf("Invalid nonce sent by the CA: %q", nonce.Nonce)
+	}
+	credRequest, secretKey, err := fabricCAServices.idemix.NewCredentialRequest(nonceBytes, info.IssuerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Idemix credential request: %w", err)
+	}
+	var response struct {
+		Credential string
+		Attrs      map[string]interface{}
+		CRI        string
+	}
+	err = fabricCAServices.postIdemix(ctx, enrollmentID, enrollmentSecret,
+		&idemixRequest{CredRequest: credRequest}, &response)
+	if err != nil {
+		return nil, fmt.Errorf("EnrollIdemix failed: %w", err)
+	}
+	credential, err := base64.StdEncoding.DecodeString(response.Credential)
+	if err != nil || len(credential) == 0 {
+		return nil, fmt.Errorf("Invalid Idemix credential sent by the CA")
+	}
+	cri, err := base64.StdEncoding.DecodeString(response.CRI)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid credential revocation information sent by the CA: %s", err)
+	}
+	return &IdemixCredential{
+		EnrollmentID:              enrollmentID,
+		Credential:                credential,
+		SecretKey:                 secretKey,
+		Attributes:                response.Attrs,
+		CRI:                       cri,
+		IssuerPublicKey:           info.IssuerPublicKey,
+		IssuerRevocationPublicKey: info.IssuerRevocationPublicKey,
+	}, nil
+}
+
+/**
+ * VerifySecret checks an enrollment secret with the CA without issuing a
+ * certificate or consuming an enrollment of the identity. The enroll
+ * endpoint counts an enrollment as soon as the secret is accepted, so the
+ * secret is checked with the nonce request of Idemix enrollment, which CAs
+ * serving an Idemix issuer public key authenticate without counting it.
+ * A secret is rejected for revoked identities and identities which reached
+ * their maximum number of enrollments too
+ * @param {string} enrollmentID The registered ID of the identity
+ * @param {string} enrollmentSecret The secret to check
+ * @returns {bool} Whether the CA accepted the secret
+ * @returns {error} Error matching ErrUnsupported with errors.Is when the CA
+ * has no Idemix issuer key; the secret should then be checked by enrolling
+ */
+func (fabricCAServices *services) VerifySecret(enrollmentID string, enrollmentSecret string) (bool, error) {
+	if enrollmentID == "" {
+		return false, fmt.Errorf("enrollmentID is empty")
+	}
+	if enrollmentSecret == "" {
+		return false, fmt.Errorf("enrollmentSecret is empty")
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	info, err := fabricCAServices.getCAInfo(ctx)
+	if err != nil {
+		return false, fmt.Errorf("VerifySecret failed: %w", err)
+	}
+	if len(info.IssuerPublicKey) == 0 {
+		return false, fmt.Errorf("CA %s cannot verify a secret without enrolling: %w", info.CAName, ErrUnsupported)
+	}
+	var nonce struct {
+		Nonce string
+	}
+	err = fabricCAServices.postIdemix(ctx, enrollmentID, enrollmentSecret, &idemixRequest{}, &nonce)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("VerifySecret failed: %w", err)
+	}
+	return true, nil
+}
+
+// postIdemix sends a request to the idemix/credential endpoint with basic
+// auth and decodes its result. Transient failures are retried with the retry
+// policy
+func (fabricCAServices *services) postIdemix(ctx context.Context, enrollmentID string,
+	enrollmentSecret string, req *idemixRequest, v interface{}) error {
+	req.CAName = fabricCAServices.serverCAName
+	body, err := util.Marshal(req, "IdemixEnrollmentRequest")
+	if err != nil {
+		return err
+	}
+	var result interface{}
+	err = fabricCAServices.withRetry(ctx, func() error {
+		post, err := fabricCAServices.fabricCAClient.NewPost("idemix/credential", body)
+		if err != nil {
+			return err
+		}
+		post.SetBasicAuth(enrollmentID, enrollmentSecret)
+		result, err = fabricCAServices.sendPost(ctx, post)
+		return err
+	})
+	if err != nil {
+		return withEnrollmentID(enrollmentID, err)
+	}
+	return decodeResult(result, v)
+}
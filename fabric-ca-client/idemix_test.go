@@ -0,0 +1,145 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// mockIdemixProvider creates credential requests holding the nonce
+type mockIdemixProvider struct {
+	nonce           []byte
+	issuerPublicKey []byte
+}
+
+func (p *mockIdemixProvider) NewCredentialRequest(nonce []byte,
+	issuerPublicKey []byte) (interface{}, []byte, error) {
+	p.nonce, p.issuerPublicKey = nonce, issuerPublicKey
+	return map[string]string{"Nonce": base64.StdEncoding.EncodeToString(nonce)}, []byte("secretkey"), nil
+}
+
+func TestEnrollIdemix(t *testing.T) {
+	issuerPublicKey := base64.StdEncoding.EncodeToString([]byte("ipk"))
+	var requests []map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"CAName": "ca-org1", "IssuerPublicKey": issuerPublicKey,
+				"IssuerRevocationPublicKey": base64.StdEncoding.EncodeToString([]byte("rpk"))}, http.StatusOK
+		},
+		"idemix": func(r *http.Request, body []byte) (interface{}, int) {
+			if user, secret, ok := r.BasicAuth(); !ok || user != "user1" || secret != "user1pw" {
+				return "Authorization failure", http.StatusUnauthorized
+			}
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			requests = append(requests, request)
+			if request["request"] == nil {
+				return map[string]interface{}{"Nonce": base64.StdEncoding.EncodeToString([]byte("nonce"))},
+					http.StatusOK
+			}
+			return map[string]interface{}{
+				"Credential": base64.StdEncoding.EncodeToString([]byte("credential")),
+				"Attrs":      map[string]interface{}{"EnrollmentID": "user1", "Role": 1},
+				"CRI":        base64.StdEncoding.EncodeToString([]byte("cri")),
+			}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	if _, err := ca.services.EnrollIdemix("user1", "user1pw"); !errors.Is(err, ErrIdemixNotSupported) {
+		t.Fatalf("Expected ErrIdemixNotSupported without IdemixProvider, got: %v", err)
+	}
+	provider := &mockIdemixProvider{}
+	ca.services.idemix = provider
+	if _, err := ca.services.EnrollIdemix("user1", "wrongpw"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials for a wrong secret, got: %v", err)
+	}
+	requests = nil
+	credential, err := ca.services.EnrollIdemix("user1", "user1pw")
+	if err != nil {
+		t.Fatalf("EnrollIdemix returned error: %v", err)
+	}
+	if len(requests) != 2 || string(provider.nonce) != "nonce" || string(provider.issuerPublicKey) != "ipk" {
+		t.Fatalf("Unexpected credential request for requests %v", requests)
+	}
+	if string(credential.Credential) != "credential" || string(credential.SecretKey) != "secretkey" ||
+		string(credential.CRI) != "cri" || !bytes.Equal(credential.IssuerPublicKey, []byte("ipk")) ||
+		string(credential.IssuerRevocationPublicKey) != "rpk" || credential.Attributes["EnrollmentID"] != "user1" {
+		t.Fatalf("Unexpected credential %+v", credential)
+	}
+
+	issuerPublicKey = ""
+	if _, err := ca.services.EnrollIdemix("user1", "user1pw"); !errors.Is(err, ErrIdemixNotSupported) {
+		t.Fatalf("Expected ErrIdemixNotSupported for a CA without issuer public key, got: %v", err)
+	}
+}
+
+func TestVerifySecret(t *testing.T) {
+	issuerPublicKey := ""
+	var enrolls, nonces int
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"cainfo": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"CAName": "ca-org1", "IssuerPublicKey": issuerPublicKey}, http.StatusOK
+		},
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			enrolls++
+			return "Unexpected enrollment", http.StatusInternalServerError
+		},
+		"idemix": func(r *http.Request, body []byte) (interface{}, int) {
+			if user, secret, ok := r.BasicAuth(); !ok || user != "user1" || secret != "user1pw" {
+				return "Authorization failure", http.StatusUnauthorized
+			}
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			if request["request"] != nil {
+				return "Unexpected credential request", http.StatusInternalServerError
+			}
+			nonces++
+			return map[string]interface{}{"Nonce": base64.StdEncoding.EncodeToString([]byte("nonce"))},
+				http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	if _, err := ca.services.VerifySecret("user1", "user1pw"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Expected ErrUnsupported without Idemix issuer public key, got: %v", err)
+	}
+	if nonces != 0 {
+		t.Fatalf("Expected no request to the CA without Idemix issuer public key")
+	}
+	issuerPublicKey = base64.StdEncoding.EncodeToString([]byte("ipk"))
+	if ok, err := ca.services.VerifySecret("user1", "wrongpw"); err != nil || ok {
+		t.Fatalf("Expected a wrong secret to be rejected, got %t, %v", ok, err)
+	}
+	if ok, err := ca.services.VerifySecret("user1", "user1pw"); err != nil || !ok {
+		t.Fatalf("Expected the secret to be accepted, got %t, %v", ok, err)
+	}
+	if nonces != 1 || enrolls != 0 {
+		t.Fatalf("Expected a single nonce request and no enrollment, got %d and %d", nonces, enrolls)
+	}
+	if _, err := ca.services.VerifySecret("user1", ""); err == nil {
+		t.Fatalf("Expected an error for an empty secret")
+	}
+}
@@ -0,0 +1,559 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"unicode"
+
+	"github.com/hyperledger/fabric-ca/util"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// MinSecretLength is the minimum length of the enrollment secrets set with
+// ModifyEnrollmentSecret or RegistrationRequest.Secret
+const MinSecretLength = 8
+
+// StrongSecretLength is the length under which enrollment secrets are
+// logged as weak, see isWeakSecret
+const StrongSecretLength = 12
+
+// RevisionAttr is the attribute ModifyIdentity sets to a new random value on
+// each secret rotation and conditional modification, so that they change the
+// ETag of the identity even when they only rotate its secret
+const RevisionAttr = "sdk.revision"
+
+// isWeakSecret returns true for secrets shorter than StrongSecretLength or
+// using a single class of characters, e.g. only digits
+func isWeakSecret(secret string) bool {
+	if len(secret) < StrongSecretLength {
+		return true
+	}
+	var lower, upper, digit, other bool
+	for _, r := range secret {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, used := range []bool{lower, upper, digit, other} {
+		if used {
+			classes++
+		}
+	}
+	return classes < 2
+}
+
+// IdentityResponse describes an identity registered with the CA
+type IdentityResponse struct {
+	// Name is the unique name of the identity
+	Name string
+	// Type of the identity (e.g. "peer, app, user")
+	Type string
+	// The identity's affiliation e.g. org1.department1
+	Affiliation string
+	// MaxEnrollments is the number of times the secret can be reused to
+	// enroll, EnrollmentsUnlimited for no limit
+	MaxEnrollments int
+	// Attributes associated with this identity
+	Attributes []Attribute
+}
+
+// ETag returns a tag of the current state of the identity, to be set as the
+// IfMatch of a ModifyIdentityRequest. The tag changes when the type,
+// affiliation, max enrollments or attributes of the identity change, which
+// includes the RevisionAttr of secret rotations
+func (identity *IdentityResponse) ETag() string {
+	attributes := append([]Attribute(nil), identity.Attributes...)
+	sort.Slice(attributes, func(i, j int) bool {
+		return attributes[i].Key < attributes[j].Key
+	})
+	state, _ := json.Marshal(struct {
+		Type           string      `json:"type"`
+		Affiliation    string      `json:"affiliation"`
+		MaxEnrollments int         `json:"max_enrollments"`
+		Attributes     []Attribute `json:"attrs"`
+	}{identity.Type, identity.Affiliation, identity.MaxEnrollments, attributes})
+	sum := sha256.Sum256(state)
+	return hex.EncodeToString(sum[:])
+}
+
+// revision returns the RevisionAttr value of the identity
+func (identity *IdentityResponse) revision() string {
+	for _, attr := range identity.Attributes {
+		if attr.Key == RevisionAttr {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// ModifyIdentityRequest modifies a registered identity.
+// Fields left empty are not modified
+type ModifyIdentityRequest struct {
+	// Name of the identity to modify
+	Name string
+	// Type of the identity (e.g. "peer, app, user")
+	Type string
+	// The identity's affiliation e.g. org1.department1
+	Affiliation string
+	// MaxEnrollments is the number of times the secret can be reused to
+	// enroll, EnrollmentsUnlimited for no limit. It is not modified when
+	// EnrollmentsServerDefault
+	MaxEnrollments int
+	// Attributes replace the attributes associated with this identity
+	Attributes []Attribute
+	// Secret is the new enrollment secret of the identity
+	Secret string
+	// IfMatch, when set, is the ETag of the identity the modification is
+	// based on. The modification fails with ErrConflict if the identity was
+	// modified since, see ModifyIdentity
+	IfMatch string
+}
+
+// RemoveIdentityRequest removes a registered identity
+type RemoveIdentityRequest struct {
+	// Name of the identity to remove
+	Name string
+	// RevokeCertificates revokes the certificates of the identity before
+	// removing it, so that they can't be used anymore
+	RevokeCertificates bool
+}
+
+// identityInfo is an identity as sent by the CA
+type identityInfo struct {
+	ID             string        `json:"id"`
+	Type           string        `json:"type"`
+	Affiliation    string        `json:"affiliation"`
+	Attributes     []caAttribute `json:"attrs"`
+	MaxEnrollments int           `json:"max_enrollments"`
+}
+
+// GetIdentity returns an identity registered with the Fabric CA
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Name of the identity
+// @returns {IdentityResponse} The identity
+// @returns {error} Error
+func (fabricCAServices *services) GetIdentity(registrar fabricclient.User,
+	name string) (*IdentityResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Identity name cannot be empty")
+	}
+	return fabricCAServices.identityRequest(registrar, "GET", "identities/"+url.PathEscape(name), nil)
+}
+
+// GetAllIdentities returns all identities the registrar is allowed to see,
+// failing with ErrTooManyResults beyond the maximum of WithMaxListResults
+// @param {User} registrar The User that is initiating the request
+// @returns {[]IdentityResponse} The identities
+// @returns {error} Error
+func (fabricCAServices *services) GetAllIdentities(registrar fabricclient.
+	User) ([]*IdentityResponse, error) {
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	identities := []*IdentityResponse{}
+	err = fabricCAServices.sendStream(ctx, identity, "GET", "identities", "identities",
+		func(raw json.RawMessage) error {
+			if err := fabricCAServices.checkListSize(len(identities)); err != nil {
+				return err
+			}
+			var info identityInfo
+			if err := json.Unmarshal(raw, &info); err != nil {
+				return fmt.Errorf("Invalid response format from server: %s", err)
+			}
+			identities = append(identities, newIdentityResponse(info))
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting identities: %w", err)
+	}
+	return identities, nil
+}
+
+// FindIdentitiesByAttribute returns the identities the registrar is allowed
+// to see which have the attribute name set to value. The CA does not filter
+// identities by attribute, so all of them are fetched and filtered as they
+// are received: only the matches are kept, up to the maximum of
+// WithMaxListResults
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Name of the attribute
+// @param {string} value Value of the attribute
+// @returns {[]IdentityResponse} The matching identities, empty when none match
+// @returns {error} Error
+func (fabricCAServices *services) FindIdentitiesByAttribute(registrar fabricclient.User,
+	name string, value string) ([]IdentityResponse, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Attribute name cannot be empty")
+	}
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	identities := []IdentityResponse{}
+	err = fabricCAServices.sendStream(ctx, identity, "GET", "identities", "identities",
+		func(raw json.RawMessage) error {
+			var info identityInfo
+			if err := json.Unmarshal(raw, &info); err != nil {
+				return fmt.Errorf("Invalid response format from server: %s", err)
+			}
+			if !hasAttribute(info, name, value) {
+				return nil
+			}
+			if err := fabricCAServices.checkListSize(len(identities)); err != nil {
+				return err
+			}
+			identities = append(identities, *newIdentityResponse(info))
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("Error finding identities: %w", err)
+	}
+	return identities, nil
+}
+
+// hasAttribute returns true when the identity has the attribute name set to
+// value
+func hasAttribute(info identityInfo, name string, value string) bool {
+	for _, attr := range info.Attributes {
+		if attr.Name == name && attr.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ModifyIdentity modifies an identity registered with the Fabric CA.
+// Secret rotations and modifications with request.IfMatch set read the
+// identity first and set its RevisionAttr to a new value, the attributes
+// being kept unless request.Attributes replaces them. With IfMatch, errors
+// match ErrConflict with errors.Is, the identity being left unmodified, when
+// its ETag differs. The CA has no conditional updates, so the identity is
+// read back after the write: errors also match ErrConflict when another
+// modification was written concurrently, this modification then having been
+// applied but possibly overwritten
+// @param {User} registrar The User that is initiating the request
+// @param {ModifyIdentityRequest} request Modify Identity Request
+// @returns {IdentityResponse} The modified identity
+// @returns {error} Error
+func (fabricCAServices *services) ModifyIdentity(registrar fabricclient.User,
+	request *ModifyIdentityRequest) (*IdentityResponse, error) {
+	if request == nil {
+		return nil, fmt.Errorf("Modify identity request cannot be nil")
+	}
+	if request.Name == "" {
+		return nil, fmt.Errorf("Identity name cannot be empty")
+	}
+	if request.MaxEnrollments < EnrollmentsUnlimited {
+		return nil, &ValidationError{Problems: []string{fmt.Sprintf("MaxEnrollments must be %d or greater, got %d",
+			EnrollmentsUnlimited, request.MaxEnrollments)}}
+	}
+	endpoint := "identities/" + url.PathEscape(request.Name)
+	attributes := request.Attributes
+	var revision string
+	if request.IfMatch != "" || request.Secret != "" {
+		current, err := fabricCAServices.identityRequest(registrar, "GET", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if request.IfMatch != "" && current.ETag() != request.IfMatch {
+			return nil, fmt.Errorf("Identity %s was modified since it was read: %w", request.Name, ErrConflict)
+		}
+		if attributes == nil {
+			attributes = current.Attributes
+		}
+		if revision, err = newRevision(); err != nil {
+			return nil, err
+		}
+		attributes = withRevision(attributes, revision)
+	}
+	var req = struct {
+		Type           string        `json:"type,omitempty"`
+		Affiliation    string        `json:"affiliation,omitempty"`
+		Attributes     []caAttribute `json:"attrs,omitempty"`
+		MaxEnrollments int           `json:"max_enrollments,omitempty"`
+		Secret         string        `json:"secret,omitempty"`
+	}{
+		Type:           request.Type,
+		Affiliation:    request.Affiliation,
+		Attributes:     toCAAttributes(attributes),
+		MaxEnrollments: request.MaxEnrollments,
+		Secret:         request.Secret,
+	}
+	body, err := util.Marshal(req, "ModifyIdentityRequest")
+	if err != nil {
+		return nil, err
+	}
+	modified, err := fabricCAServices.identityRequest(registrar, "PUT", endpoint, body)
+	if err != nil || request.IfMatch == "" {
+		return modified, err
+	}
+	// Another modification based on the same state may have been written
+	// between the check and ours, the last one written wins
+	modified, err = fabricCAServices.identityRequest(registrar, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if modified.revision() != revision {
+		return nil, fmt.Errorf("Identity %s was modified concurrently, the modification may have been "+
+			"overwritten: %w", request.Name, ErrConflict)
+	}
+	return modified, nil
+}
+
+// newRevision returns a random RevisionAttr value
+func newRevision() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("Error generating identity revision: %w", err)
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// withRevision returns attributes with RevisionAttr set to revision
+func withRevision(attributes []Attribute, revision string) []Attribute {
+	result := []Attribute{{Key: RevisionAttr, Value: revision}}
+	for _, attr := range attributes {
+		if attr.Key != RevisionAttr {
+			result = append(result, attr)
+		}
+	}
+	return result
+}
+
+// ModifyEnrollmentSecret sets a new enrollment secret for an identity
+// registered with the Fabric CA. Errors match ErrNotFound with errors.Is when
+// the identity is not registered. Use ModifyEnrollmentSecretIfMatch to rotate
+// the secret only if the identity was not modified concurrently
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Name of the identity
+// @param {string} newSecret The new enrollment secret, of at least
+// MinSecretLength characters
+// @returns {error} Error
+func (fabricCAServices *services) ModifyEnrollmentSecret(registrar fabricclient.User,
+	name string, newSecret string) error {
+	return fabricCAServices.modifyEnrollmentSecret(registrar, name, newSecret, "", nil)
+}
+
+// ModifyEnrollmentSecretIfMatch sets a new enrollment secret for an identity
+// like ModifyEnrollmentSecret, if the identity was not modified since its
+// ETag ifMatch was read. Errors match ErrConflict with errors.Is otherwise,
+// see ModifyIdentity
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Name of the identity
+// @param {string} newSecret The new enrollment secret, of at least
+// MinSecretLength characters
+// @param {string} ifMatch The ETag of the identity the rotation is based on
+// @returns {error} Error
+func (fabricCAServices *services) ModifyEnrollmentSecretIfMatch(registrar fabricclient.User,
+	name string, newSecret string, ifMatch string) error {
+	var problems []string
+	if ifMatch == "" {
+		problems = append(problems, "IfMatch cannot be empty")
+	}
+	return fabricCAServices.modifyEnrollmentSecret(registrar, name, newSecret, ifMatch, problems)
+}
+
+// modifyEnrollmentSecret validates and sends a secret rotation, conditional
+// when ifMatch is set, along with the problems found by the caller
+func (fabricCAServices *services) modifyEnrollmentSecret(registrar fabricclient.User,
+	name string, newSecret string, ifMatch string, problems []string) error {
+	if name == "" {
+		problems = append(problems, "Identity name cannot be empty")
+	}
+	if len(newSecret) < MinSecretLength {
+		problems = append(problems, fmt.Sprintf("Secret must be at least %d characters long", MinSecretLength))
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	_, err := fabricCAServices.ModifyIdentity(registrar,
+		&ModifyIdentityRequest{Name: name, Secret: newSecret, IfMatch: ifMatch})
+	return err
+}
+
+// ResetSecret assigns a new random enrollment secret to an identity
+// registered with the Fabric CA, leaving its type, affiliation and attributes
+// unchanged. The CA only generates secrets on registration, so the secret is
+// generated here; use ModifyEnrollmentSecret to set a chosen secret. The
+// identity is read first to check the registrar's roles and affiliations
+// authorize its modification: errors match ErrPermissionDenied with
+// errors.Is when they do not, and ErrNotFound when the identity is not
+// registered
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Name of the identity
+// @returns {string} The new enrollment secret
+// @returns {error} Error
+func (fabricCAServices *services) ResetSecret(registrar fabricclient.User, name string) (string, error) {
+	return fabricCAServices.resetSecret(registrar, name, "")
+}
+
+// ResetSecretIfMatch assigns a new random enrollment secret to an identity
+// like ResetSecret, if the identity was not modified since its ETag ifMatch
+// was read. Errors match ErrConflict with errors.Is otherwise, see
+// ModifyIdentity
+// @param {User} registrar The User that is initiating the request
+// @param {string} name Name of the identity
+// @param {string} ifMatch The ETag of the identity the reset is based on
+// @returns {string} The new enrollment secret
+// @returns {error} Error
+func (fabricCAServices *services) ResetSecretIfMatch(registrar fabricclient.User, name string,
+	ifMatch string) (string, error) {
+	if ifMatch == "" {
+		return "", fmt.Errorf("IfMatch cannot be empty")
+	}
+	return fabricCAServices.resetSecret(registrar, name, ifMatch)
+}
+
+// resetSecret assigns a new random enrollment secret to an identity, if its
+// ETag is ifMatch when set
+func (fabricCAServices *services) resetSecret(registrar fabricclient.User, name string,
+	ifMatch string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("Identity name cannot be empty")
+	}
+	current, err := fabricCAServices.GetIdentity(registrar, name)
+	if err != nil {
+		return "", fmt.Errorf("Error resetting secret of %s: %w", name, err)
+	}
+	if ifMatch != "" && current.ETag() != ifMatch {
+		return "", fmt.Errorf("Identity %s was modified since it was read: %w", name, ErrConflict)
+	}
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return "", fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	err = identity.checkRegistrarAuthority(&RegistrationRequest{Type: current.Type, Affiliation: current.Affiliation})
+	if err != nil {
+		return "", fmt.Errorf("Error resetting secret of %s: %w", name, err)
+	}
+	secret, err := newEnrollmentSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = fabricCAServices.ModifyIdentity(registrar,
+		&ModifyIdentityRequest{Name: name, Secret: secret, IfMatch: ifMatch})
+	if err != nil {
+		return "", fmt.Errorf("Error resetting secret of %s: %w", name, err)
+	}
+	return secret, nil
+}
+
+// newEnrollmentSecret returns a random enrollment secret, longer than
+// StrongSecretLength
+func newEnrollmentSecret() (string, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("Error generating enrollment secret: %w", err)
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// RemoveIdentity removes an identity registered with the Fabric CA
+// @param {User} registrar The User that is initiating the request
+// @param {RemoveIdentityRequest} request Remove Identity Request
+// @returns {IdentityResponse} The removed identity
+// @returns {error} Error
+func (fabricCAServices *services) RemoveIdentity(registrar fabricclient.User,
+	request *RemoveIdentityRequest) (*IdentityResponse, error) {
+	if request == nil {
+		return nil, fmt.Errorf("Remove identity request cannot be nil")
+	}
+	if request.Name == "" {
+		return nil, fmt.Errorf("Identity name cannot be empty")
+	}
+	if request.RevokeCertificates {
+		err := fabricCAServices.Revoke(registrar, &RevocationRequest{Name: request.Name})
+		if err != nil {
+			return nil, fmt.Errorf("Error revoking certificates of %s: %w", request.Name, err)
+		}
+	}
+	return fabricCAServices.identityRequest(registrar, "DELETE", "identities/"+url.PathEscape(request.Name), nil)
+}
+
+// identityRequest sends an identity request signed by the registrar
+func (fabricCAServices *services) identityRequest(registrar fabricclient.User,
+	method string, endpoint string, body []byte) (*IdentityResponse, error) {
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	result, err := fabricCAServices.send(ctx, identity, method, endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("Identity request failed: %w", err)
+	}
+	var info identityInfo
+	if err := decodeResult(result, &info); err != nil {
+		return nil, err
+	}
+	return newIdentityResponse(info), nil
+}
+
+// newIdentityResponse converts an identity sent by the CA
+func newIdentityResponse(info identityInfo) *IdentityResponse {
+	response := &IdentityResponse{
+		Name:           info.ID,
+		Type:           info.Type,
+		Affiliation:    info.Affiliation,
+		MaxEnrollments: info.MaxEnrollments,
+	}
+	for _, attr := range info.Attributes {
+		response.Attributes = append(response.Attributes,
+			Attribute{Key: attr.Name, Value: attr.Value, ECert: attr.ECert})
+	}
+	return response
+}
+
+// caAttribute is an attribute as sent to and by the CA. The ecert flag is
+// missing from the vendored fabric-ca API
+type caAttribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	ECert bool   `json:"ecert,omitempty"`
+}
+
+// toCAAttributes converts attributes to the fabric-ca representation
+func toCAAttributes(attributes []Attribute) []caAttribute {
+	var attrs []caAttribute
+	for _, attr := range attributes {
+		attrs = append(attrs, caAttribute{Name: attr.Key, Value: attr.Value, ECert: attr.ECert})
+	}
+	return attrs
+}
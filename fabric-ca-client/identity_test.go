@@ -0,0 +1,386 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdentities(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	user1 := map[string]interface{}{
+		"id":              "user1",
+		"type":            "user",
+		"affiliation":     "org1.department1",
+		"attrs":           []interface{}{map[string]interface{}{"name": "role", "value": "auditor"}},
+		"max_enrollments": 2,
+	}
+	var requests []string
+	var modification map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch {
+			case r.URL.Path == "/api/v1/cfssl/identities":
+				return map[string]interface{}{"identities": []interface{}{user1}}, http.StatusOK
+			case r.URL.Path != "/api/v1/cfssl/identities/user1":
+				return "Identity not found", http.StatusNotFound
+			case r.Method == "PUT":
+				json.Unmarshal(body, &modification)
+			}
+			return user1, http.StatusOK
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			return map[string]interface{}{}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	identity, err := ca.services.GetIdentity(registrar, "user1")
+	if err != nil {
+		t.Fatalf("GetIdentity returned error: %v", err)
+	}
+	if identity.Name != "user1" || identity.Type != "user" || identity.Affiliation != "org1.department1" ||
+		identity.MaxEnrollments != 2 || len(identity.Attributes) != 1 || identity.Attributes[0].Key != "role" {
+		t.Fatalf("GetIdentity returned wrong identity: %+v", identity)
+	}
+	if _, err := ca.services.GetIdentity(registrar, "unknown"); err == nil {
+		t.Fatalf("Expected error for unknown identity")
+	}
+	identities, err := ca.services.GetAllIdentities(registrar)
+	if err != nil {
+		t.Fatalf("GetAllIdentities returned error: %v", err)
+	}
+	if len(identities) != 1 || identities[0].Name != "user1" {
+		t.Fatalf("GetAllIdentities returned wrong identities: %+v", identities)
+	}
+	// Modify
+	if _, err := ca.services.ModifyIdentity(registrar, &ModifyIdentityRequest{}); err == nil {
+		t.Fatalf("Expected error without identity name")
+	}
+	_, err = ca.services.ModifyIdentity(registrar, &ModifyIdentityRequest{Name: "user1", Type: "peer"})
+	if err != nil {
+		t.Fatalf("ModifyIdentity returned error: %v", err)
+	}
+	if modification["type"] != "peer" || modification["affiliation"] != nil {
+		t.Fatalf("ModifyIdentity sent wrong modification: %v", modification)
+	}
+	_, err = ca.services.ModifyIdentity(registrar, &ModifyIdentityRequest{Name: "user1", MaxEnrollments: -2})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a ValidationError for MaxEnrollments below EnrollmentsUnlimited, got: %v", err)
+	}
+	// Remove with revocation
+	requests = nil
+	_, err = ca.services.RemoveIdentity(registrar, &RemoveIdentityRequest{Name: "user1", RevokeCertificates: true})
+	if err != nil {
+		t.Fatalf("RemoveIdentity returned error: %v", err)
+	}
+	if len(requests) != 2 || requests[0] != "POST /api/v1/cfssl/revoke" ||
+		requests[1] != "DELETE /api/v1/cfssl/identities/user1" {
+		t.Fatalf("RemoveIdentity sent wrong requests: %v", requests)
+	}
+}
+
+func TestModifyEnrollmentSecret(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var modification map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			if r.URL.Path != "/api/v1/cfssl/identities/user1" {
+				return "Failed to get identity: user 'unknown' does not exist", http.StatusNotFound
+			}
+			json.Unmarshal(body, &modification)
+			return map[string]interface{}{"id": "user1"}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	if err := ca.services.ModifyEnrollmentSecret(registrar, "user1", "newuser1pw"); err != nil {
+		t.Fatalf("ModifyEnrollmentSecret returned error: %v", err)
+	}
+	// The rotation sets a new revision
+	attrs, _ := modification["attrs"].([]interface{})
+	if len(modification) != 2 || modification["secret"] != "newuser1pw" || len(attrs) != 1 ||
+		attrs[0].(map[string]interface{})["name"] != RevisionAttr {
+		t.Fatalf("ModifyEnrollmentSecret sent wrong modification: %v", modification)
+	}
+
+	err := ca.services.ModifyEnrollmentSecret(registrar, "unknown", "newuser1pw")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ModifyEnrollmentSecret should have failed with ErrNotFound, got: %v", err)
+	}
+
+	err = ca.services.ModifyEnrollmentSecret(registrar, "", "short")
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 {
+		t.Fatalf("ModifyEnrollmentSecret should have failed validation, got: %v", err)
+	}
+}
+
+func TestResetSecret(t *testing.T) {
+	var modification map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			if r.URL.Path != "/api/v1/cfssl/identities/peer1" {
+				return "Failed to get identity: user 'unknown' does not exist", http.StatusNotFound
+			}
+			if r.Method == "PUT" {
+				json.Unmarshal(body, &modification)
+			}
+			return map[string]interface{}{"id": "peer1", "type": "peer", "affiliation": "org1.department1",
+				"attrs": []map[string]string{{"name": "role", "value": "endorser"}}}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	registrar := newTestRegistrar(t, map[string]string{
+		RegistrarRolesAttr:        "client,peer",
+		RegistrarAffiliationsAttr: "org1",
+	})
+	secret, err := ca.services.ResetSecret(registrar, "peer1")
+	if err != nil {
+		t.Fatalf("ResetSecret returned error: %v", err)
+	}
+	if isWeakSecret(secret) {
+		t.Fatalf("ResetSecret returned a weak secret %s", secret)
+	}
+	// Only the secret and revision are modified, the attributes and
+	// affiliation are kept
+	attrs, _ := modification["attrs"].([]interface{})
+	if len(modification) != 2 || modification["secret"] != secret || len(attrs) != 2 ||
+		attrs[0].(map[string]interface{})["name"] != RevisionAttr ||
+		attrs[1].(map[string]interface{})["name"] != "role" {
+		t.Fatalf("ResetSecret sent wrong modification: %v", modification)
+	}
+	if other, err := ca.services.ResetSecret(registrar, "peer1"); err != nil || other == secret {
+		t.Fatalf("ResetSecret should have returned a new secret, got %s: %v", other, err)
+	}
+
+	modification = nil
+	unauthorized := newTestRegistrar(t, map[string]string{RegistrarRolesAttr: "client"})
+	_, err = ca.services.ResetSecret(unauthorized, "peer1")
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("ResetSecret should have failed with ErrPermissionDenied, got: %v", err)
+	}
+	if modification != nil {
+		t.Fatalf("ResetSecret should not have modified the identity: %v", modification)
+	}
+
+	if _, err := ca.services.ResetSecret(registrar, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ResetSecret should have failed with ErrNotFound, got: %v", err)
+	}
+}
+
+func TestModifyIdentityIfMatch(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var mu sync.Mutex
+	user1 := identityInfo{ID: "user1", Type: "user", Affiliation: "org1.department1",
+		Attributes: []caAttribute{{Name: "role", Value: "auditor"}}, MaxEnrollments: -1}
+	var gets, puts int
+	var modification map[string]interface{}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			mu.Lock()
+			defer mu.Unlock()
+			if r.Method == "PUT" {
+				puts++
+				var info identityInfo
+				json.Unmarshal(body, &info)
+				modification = nil
+				json.Unmarshal(body, &modification)
+				if info.Type != "" {
+					user1.Type = info.Type
+				}
+				if info.Attributes != nil {
+					user1.Attributes = info.Attributes
+				}
+				return user1, http.StatusOK
+			}
+			gets++
+			return user1, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	identity := newIdentityResponse(user1)
+	reordered := *identity
+	reordered.Attributes = []Attribute{{Key: "b", Value: "1"}, {Key: "a", Value: "2"}}
+	identity.Attributes = []Attribute{{Key: "a", Value: "2"}, {Key: "b", Value: "1"}}
+	if identity.ETag() != reordered.ETag() {
+		t.Fatalf("ETag should not depend on the order of the attributes")
+	}
+	etag := newIdentityResponse(user1).ETag()
+
+	// The identity is checked, modified with a new revision keeping its
+	// attributes, and read back
+	modified, err := ca.services.ModifyIdentity(registrar,
+		&ModifyIdentityRequest{Name: "user1", Type: "peer", IfMatch: etag})
+	if err != nil {
+		t.Fatalf("ModifyIdentity returned error: %v", err)
+	}
+	if gets != 2 || puts != 1 {
+		t.Fatalf("Expected the identity to be read twice and written once, got %d reads, %d writes", gets, puts)
+	}
+	if attrs, _ := modification["attrs"].([]interface{}); len(attrs) != 2 || modified.Type != "peer" ||
+		modified.revision() == "" || modified.ETag() == etag {
+		t.Fatalf("Expected the type and revision to be modified, got %v", modification)
+	}
+
+	gets, puts = 0, 0
+	_, err = ca.services.ModifyIdentity(registrar, &ModifyIdentityRequest{Name: "user1", Type: "orderer", IfMatch: etag})
+	if !errors.Is(err, ErrConflict) || puts != 0 || user1.Type != "peer" {
+		t.Fatalf("Expected ErrConflict without modification for a stale IfMatch, got: %v", err)
+	}
+
+	// Secret rotations change the ETag
+	etag = modified.ETag()
+	if err := ca.services.ModifyEnrollmentSecret(registrar, "user1", "newuser1pw"); err != nil {
+		t.Fatalf("ModifyEnrollmentSecret returned error: %v", err)
+	}
+	if newIdentityResponse(user1).ETag() == etag {
+		t.Fatalf("Expected the ETag to change with the secret")
+	}
+	if err := ca.services.ModifyEnrollmentSecretIfMatch(registrar, "user1", "newuser1pw2",
+		etag); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict rotating the secret with a stale IfMatch, got: %v", err)
+	}
+	if _, err := ca.services.ResetSecretIfMatch(registrar, "user1", etag); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict resetting the secret with a stale IfMatch, got: %v", err)
+	}
+	err = ca.services.ModifyEnrollmentSecretIfMatch(registrar, "user1", "newuser1pw2", "")
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("ModifyEnrollmentSecretIfMatch should have failed validation, got: %v", err)
+	}
+}
+
+func TestConcurrentSecretRotations(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var mu sync.Mutex
+	user1 := identityInfo{ID: "user1", Type: "user", Affiliation: "org1.department1",
+		Attributes: []caAttribute{{Name: "role", Value: "auditor"}}, MaxEnrollments: -1}
+	var gets, puts int
+	// Both rotations read the identity before either is written, and read it
+	// back once both are written
+	read, written := make(chan struct{}), make(chan struct{})
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			mu.Lock()
+			if r.Method == "PUT" {
+				defer mu.Unlock()
+				var modification identityInfo
+				json.Unmarshal(body, &modification)
+				user1.Attributes = modification.Attributes
+				if puts++; puts == 2 {
+					close(written)
+				}
+				return user1, http.StatusOK
+			}
+			gets++
+			if gets == 2 {
+				close(read)
+			}
+			wait := read
+			if gets > 2 {
+				wait = written
+			}
+			mu.Unlock()
+			<-wait
+			mu.Lock()
+			defer mu.Unlock()
+			return user1, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	etag := newIdentityResponse(user1).ETag()
+
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i, secret := range []string{"newuser1pw1", "newuser1pw2"} {
+		wg.Add(1)
+		go func(i int, secret string) {
+			defer wg.Done()
+			errs[i] = ca.services.ModifyEnrollmentSecretIfMatch(registrar, "user1", secret, etag)
+		}(i, secret)
+	}
+	wg.Wait()
+	var conflicts int
+	for _, err := range errs {
+		if errors.Is(err, ErrConflict) {
+			conflicts++
+		} else if err != nil {
+			t.Fatalf("ModifyEnrollmentSecretIfMatch returned error: %v", err)
+		}
+	}
+	if conflicts != 1 {
+		t.Fatalf("Expected exactly one of the concurrent rotations to conflict, got errors: %v", errs)
+	}
+	modified := newIdentityResponse(user1)
+	if len(modified.Attributes) != 2 || modified.revision() == "" || modified.ETag() == etag {
+		t.Fatalf("Expected the role attribute to be kept and the revision set, got %+v", modified)
+	}
+}
+
+func TestFindIdentitiesByAttribute(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	// Every tenth of the 1000 identities is an admin
+	ca := newStreamingCA(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"result":{"identities":[`)
+		for i := 0; i < 1000; i++ {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `{"id":"user%d","type":"client","affiliation":"org1","attrs":[`+
+				`{"name":"admin","value":"%t"}],"max_enrollments":-1}`, i, i%10 == 0)
+		}
+		fmt.Fprint(w, `]},"errors":[],"messages":[],"success":true}`)
+	})
+	defer ca.Close()
+	// Only the matches count towards the maximum
+	ca.services.maxListResults = 150
+
+	admins, err := ca.services.FindIdentitiesByAttribute(registrar, "admin", "true")
+	if err != nil {
+		t.Fatalf("FindIdentitiesByAttribute returned error: %v", err)
+	}
+	if len(admins) != 100 || admins[0].Name != "user0" || admins[99].Name != "user990" {
+		t.Fatalf("Expected the 100 admins, got %d", len(admins))
+	}
+	none, err := ca.services.FindIdentitiesByAttribute(registrar, "admin", "yes")
+	if err != nil || none == nil || len(none) != 0 {
+		t.Fatalf("Expected an empty slice when no identity matches, got %v: %v", none, err)
+	}
+	ca.services.maxListResults = 50
+	if _, err := ca.services.FindIdentitiesByAttribute(registrar, "admin", "true"); !errors.Is(err, ErrTooManyResults) {
+		t.Fatalf("Expected ErrTooManyResults beyond the maximum, got: %v", err)
+	}
+	if _, err := ca.services.FindIdentitiesByAttribute(registrar, "", "true"); err == nil {
+		t.Fatalf("FindIdentitiesByAttribute should have failed without attribute name")
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	cfsslapi "github.com/cloudflare/cfssl/api"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// DefaultMaxListResults is the maximum number of entries returned by the list
+// methods of the Services, see WithMaxListResults
+const DefaultMaxListResults = 100000
+
+// ErrTooManyResults is returned by GetAllIdentities, GetAllAffiliations,
+// GetCertificates and GetExpiringCertificates when the CA sends more entries
+// than the maximum set by WithMaxListResults. The CA sends all the entries in
+// a single response, unpaged: the list fails rather than being truncated, use
+// StreamIdentities or narrower filters instead
+var ErrTooManyResults = errors.New("too many results")
+
+// WithMaxListResults sets the maximum number of entries returned by the list
+// methods of the Services, bounding the memory they use, see
+// ErrTooManyResults. DefaultMaxListResults by default, zero or negative for
+// no maximum
+func WithMaxListResults(max int) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.maxListResults = max
+	}
+}
+
+// checkListSize returns an error matching ErrTooManyResults when a list
+// already holding size entries can not take one more
+func (fabricCAServices *services) checkListSize(size int) error {
+	if max := fabricCAServices.maxListResults; max > 0 && size >= max {
+		return fmt.Errorf("%w: the CA sent more than %d entries", ErrTooManyResults, max)
+	}
+	return nil
+}
+
+// StreamIdentities ...
+/**
+ * Stream the identities the registrar is allowed to see as the CA sends
+ * them, for sets too large for GetAllIdentities. The identities channel is
+ * closed once all the identities are received, or when the stream fails:
+ * the error channel then receives the error, it is closed without error
+ * otherwise. Cancel ctx to stop receiving early
+ * @param {Context} ctx Context bounding the request to the CA
+ * @param {User} registrar The User that is initiating the request
+ * @returns {<-chan IdentityResponse} The identities
+ * @returns {<-chan error} The error the stream failed with, if any
+ * @returns {error} Error sending the request, e.g. rejected by the CA
+ */
+func (fabricCAServices *services) StreamIdentities(ctx context.Context,
+	registrar fabricclient.User) (<-chan IdentityResponse, <-chan error, error) {
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	identities := make(chan IdentityResponse)
+	errs := make(chan error, 1)
+	// started is closed once the first identity is received, the failures
+	// before it, e.g. rejected requests, are returned rather than streamed
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(identities)
+		first := true
+		err := fabricCAServices.sendStream(ctx, identity, "GET", "identities", "identities",
+			func(raw json.RawMessage) error {
+				if first {
+					first = false
+					close(started)
+				}
+				var info identityInfo
+				if err := json.Unmarshal(raw, &info); err != nil {
+					return fmt.Errorf("Invalid response format from server: %s", err)
+				}
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				select {
+				case identities <- *newIdentityResponse(info):
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		if first {
+			done <- err
+			return
+		}
+		if err != nil {
+			errs <- fmt.Errorf("Error streaming identities: %w", err)
+		}
+	}()
+	select {
+	case <-started:
+		return identities, errs, nil
+	case err := <-done:
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error getting identities: %w", err)
+		}
+		return identities, errs, nil
+	}
+}
+
+// decodeStream decodes a cfssl formatted response of the CA as it is read
+// from body, passing each element of the array field of its result to each.
+// The errors returned by each are returned as is
+func decodeStream(status int, body io.Reader, field string, each func(json.RawMessage) error) error {
+	decoder := json.NewDecoder(body)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+	success := false
+	for decoder.More() {
+		key, err := nextToken(decoder)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "result":
+			if err := decodeStreamResult(decoder, field, each); err != nil {
+				return err
+			}
+			continue
+		case "errors":
+			var messages []cfsslapi.ResponseMessage
+			if err = decoder.Decode(&messages); err == nil && len(messages) > 0 {
+				return newServerError(status, messages[0].Code, messages[0].Message)
+			}
+		case "success":
+			err = decoder.Decode(&success)
+		default:
+			err = skipValue(decoder)
+		}
+		if err != nil {
+			return streamError(err)
+		}
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return err
+	}
+	if !success {
+		return newServerError(status, 0, "Server returned failure")
+	}
+	return nil
+}
+
+// decodeStreamResult decodes the result object of a response streamed by
+// decodeStream, null when the CA sends no result
+func decodeStreamResult(decoder *json.Decoder, field string, each func(json.RawMessage) error) error {
+	if isNull, err := openValue(decoder, '{'); err != nil || isNull {
+		return err
+	}
+	for decoder.More() {
+		key, err := nextToken(decoder)
+		if err != nil {
+			return err
+		}
+		if key != field {
+			if err := skipValue(decoder); err != nil {
+				return streamError(err)
+			}
+			continue
+		}
+		isNull, err := openValue(decoder, '[')
+		if err != nil {
+			return err
+		}
+		if isNull {
+			continue
+		}
+		for decoder.More() {
+			var element json.RawMessage
+			if err := decoder.Decode(&element); err != nil {
+				return streamError(err)
+			}
+			if err := each(element); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(decoder, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, '}')
+}
+
+// openValue reads the opening delimiter of the next value of a streamed
+// response, true when the value is null instead
+func openValue(decoder *json.Decoder, delim json.Delim) (bool, error) {
+	token, err := nextToken(decoder)
+	if err != nil || token == nil {
+		return token == nil && err == nil, err
+	}
+	if token != delim {
+		return false, fmt.Errorf("Failed to parse response: expected %s, got %v", delim, token)
+	}
+	return false, nil
+}
+
+// expectDelim reads the next token of a streamed response, which must be the
+// given delimiter
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := nextToken(decoder)
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("Failed to parse response: expected %s, got %v", delim, token)
+	}
+	return nil
+}
+
+// nextToken reads the next token of a streamed response
+func nextToken(decoder *json.Decoder) (json.Token, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, streamError(err)
+	}
+	return token, nil
+}
+
+// skipValue reads the next value of a streamed response, which is ignored
+func skipValue(decoder *json.Decoder) error {
+	var skipped json.RawMessage
+	return decoder.Decode(&skipped)
+}
+
+// streamError converts an error reading a streamed response: malformed
+// responses fail to parse, the others interrupted the connection to the CA
+func streamError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return fmt.Errorf("Failed to parse response: %s", err)
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return err
+	}
+	return newUnreachableError(fmt.Errorf("response interrupted: %s", err))
+}
@@ -0,0 +1,201 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// streamTrailer ends the identities streamed by streamIdentities
+const streamTrailer = `],"caname":""},"errors":[],"messages":[],"success":true}`
+
+// streamIdentities writes an identities response in chunks, like the CA
+// streaming large sets, ended by trailer
+func streamIdentities(w http.ResponseWriter, count int, trailer string) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"result":{"identities":[`)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprintf(w, `{"id":"user%d","type":"client","affiliation":"org1","attrs":[],"max_enrollments":-1}`, i)
+		if i%10 == 0 {
+			w.(http.Flusher).Flush()
+		}
+	}
+	fmt.Fprint(w, trailer)
+}
+
+// newStreamingCA starts a fake fabric-ca server serving every request with
+// handler
+func newStreamingCA(t *testing.T, handler http.HandlerFunc) *mockCA {
+	ca := newMockCA(t, nil)
+	ca.Server.Close()
+	ca.Server = httptest.NewServer(handler)
+	ca.services.fabricCAClient.Config.URL = ca.Server.URL
+	return ca
+}
+
+func TestStreamIdentities(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var count int
+	var trailer string
+	ca := newStreamingCA(t, func(w http.ResponseWriter, r *http.Request) {
+		if count < 0 {
+			writeMockCAResponse(w, "Authorization failure", http.StatusUnauthorized)
+			return
+		}
+		streamIdentities(w, count, trailer)
+		if trailer == "" {
+			// Drop the connection in the middle of the response
+			panic(http.ErrAbortHandler)
+		}
+	})
+	defer ca.Close()
+	receive := func(ctx context.Context) ([]IdentityResponse, error) {
+		identities, errs, err := ca.services.StreamIdentities(ctx, registrar)
+		if err != nil {
+			t.Fatalf("StreamIdentities returned error: %v", err)
+		}
+		var received []IdentityResponse
+		for identity := range identities {
+			received = append(received, identity)
+		}
+		return received, <-errs
+	}
+
+	for _, count = range []int{0, 1, 250} {
+		trailer = streamTrailer
+		received, err := receive(context.Background())
+		if err != nil || len(received) != count {
+			t.Fatalf("Expected %d identities, got %d: %v", count, len(received), err)
+		}
+		for i, identity := range received {
+			if identity.Name != fmt.Sprintf("user%d", i) || identity.Affiliation != "org1" {
+				t.Fatalf("Unexpected identity %d: %+v", i, identity)
+			}
+		}
+	}
+
+	// Failures reported by the CA after the identities, or a dropped
+	// connection, fail the stream
+	count, trailer = 25, `],"caname":""},"errors":[{"code":0,"message":"Failed to get identities"}],"messages":[],`+
+		`"success":false}`
+	if received, err := receive(context.Background()); err == nil || len(received) != count {
+		t.Fatalf("Expected the stream to fail after %d identities, got %d: %v", count, len(received), err)
+	}
+	trailer = ""
+	if _, err := receive(context.Background()); !errors.Is(err, ErrCAUnreachable) {
+		t.Fatalf("Expected ErrCAUnreachable for a dropped connection, got: %v", err)
+	}
+
+	// Requests rejected by the CA fail before streaming
+	count = -1
+	if _, _, err := ca.services.StreamIdentities(context.Background(), registrar); !errors.Is(err,
+		ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials, got: %v", err)
+	}
+
+	// The consumer stops early by cancelling the context
+	count, trailer = 250, streamTrailer
+	ctx, cancel := context.WithCancel(context.Background())
+	identities, errs, err := ca.services.StreamIdentities(ctx, registrar)
+	if err != nil {
+		t.Fatalf("StreamIdentities returned error: %v", err)
+	}
+	<-identities
+	cancel()
+	for range identities {
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the stream to end with context.Canceled, got: %v", err)
+	}
+}
+
+func TestWithMaxListResults(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	ca := newStreamingCA(t, func(w http.ResponseWriter, r *http.Request) {
+		streamIdentities(w, 250, streamTrailer)
+	})
+	defer ca.Close()
+
+	identities, err := ca.services.GetAllIdentities(registrar)
+	if err != nil || len(identities) != 250 {
+		t.Fatalf("Expected all the streamed identities, got %d: %v", len(identities), err)
+	}
+	WithMaxListResults(250)(ca.services)
+	if identities, err := ca.services.GetAllIdentities(registrar); err != nil || len(identities) != 250 {
+		t.Fatalf("Expected the identities up to the maximum, got %d: %v", len(identities), err)
+	}
+	WithMaxListResults(100)(ca.services)
+	if _, err := ca.services.GetAllIdentities(registrar); !errors.Is(err, ErrTooManyResults) {
+		t.Fatalf("Expected ErrTooManyResults beyond the maximum, got: %v", err)
+	}
+	// Streams are not bounded
+	streamed, errs, err := ca.services.StreamIdentities(context.Background(), registrar)
+	if err != nil {
+		t.Fatalf("StreamIdentities returned error: %v", err)
+	}
+	count := 0
+	for range streamed {
+		count++
+	}
+	if err := <-errs; err != nil || count != 250 {
+		t.Fatalf("Expected all the identities to be streamed, got %d: %v", count, err)
+	}
+
+	cert := map[string]interface{}{"PEM": string(registrar.GetEnrollmentCertificate())}
+	affiliations := map[string]interface{}{"name": "", "affiliations": []interface{}{
+		map[string]interface{}{"name": "org1", "affiliations": []interface{}{
+			map[string]interface{}{"name": "org1.department1"},
+		}},
+	}}
+	listCA := newMockCA(t, map[string]mockCAHandler{
+		"certificates": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"caname": "", "certs": []interface{}{cert, cert}}, http.StatusOK
+		},
+		"affiliations": func(r *http.Request, body []byte) (interface{}, int) {
+			return affiliations, http.StatusOK
+		},
+	})
+	defer listCA.Close()
+	WithMaxListResults(1)(listCA.services)
+	if _, err := listCA.services.GetCertificates(registrar, CertFilter{Revoked: RevokedExcluded}); !errors.Is(err,
+		ErrTooManyResults) {
+		t.Fatalf("Expected GetCertificates to fail with ErrTooManyResults, got: %v", err)
+	}
+	if _, err := listCA.services.GetAllAffiliations(registrar); !errors.Is(err, ErrTooManyResults) {
+		t.Fatalf("Expected GetAllAffiliations to fail with ErrTooManyResults, got: %v", err)
+	}
+	WithMaxListResults(2)(listCA.services)
+	if certs, err := listCA.services.GetCertificates(registrar, CertFilter{Revoked: RevokedExcluded}); err != nil ||
+		len(certs) != 2 {
+		t.Fatalf("Expected the certificates up to the maximum, got %d: %v", len(certs), err)
+	}
+	if affiliations, err := listCA.services.GetAllAffiliations(registrar); err != nil || len(affiliations) != 2 {
+		t.Fatalf("Expected the affiliations up to the maximum, got %d: %v", len(affiliations), err)
+	}
+}
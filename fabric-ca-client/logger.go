@@ -0,0 +1,64 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"github.com/op/go-logging"
+)
+
+// Logger is the logger the Services log with, see WithLogger. Enrollment
+// secrets, private keys and tokens are never logged
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// defaultLogger logs with the go-logging logger of the SDK
+var defaultLogger Logger = goLogger{logging.MustGetLogger("fabric_sdk_go")}
+
+// goLogger adapts a go-logging logger to Logger
+type goLogger struct {
+	*logging.Logger
+}
+
+func (l goLogger) Warnf(format string, args ...interface{}) {
+	l.Warningf(format, args...)
+}
+
+// nopLogger discards all messages
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// WithLogger sets the logger the Services log with instead of the
+// "fabric_sdk_go" go-logging logger. A nil logger discards all messages
+func WithLogger(l Logger) Option {
+	return func(fabricCAServices *services) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		fabricCAServices.logger = l
+	}
+}
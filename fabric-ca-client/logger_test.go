@@ -0,0 +1,101 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingLogger records the messages logged at each level
+type recordingLogger struct {
+	messages map[string][]string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	if l.messages == nil {
+		l.messages = make(map[string][]string)
+	}
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", format, args...)
+}
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", format, args...)
+}
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("warn", format, args...)
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", format, args...)
+}
+
+func TestWithLogger(t *testing.T) {
+	initTestConfig(t, `client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "http://localhost:7054"
+`)
+	recorder := &recordingLogger{}
+	if _, err := NewFabricCAClient(WithLogger(recorder), WithInsecure()); err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if len(recorder.messages["info"]) != 0 || len(recorder.messages["debug"]) != 1 ||
+		!strings.Contains(recorder.messages["debug"][0], "http://localhost:7054") {
+		t.Fatalf("Expected the construction to be logged at debug level, got %v", recorder.messages)
+	}
+
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	recorder = &recordingLogger{}
+	WithLogger(recorder)(ca.services)
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond})(ca.services)
+	ca.services.transport = &failingTransport{failures: []func() (*http.Response, error){connectionReset}}
+	if _, _, err := ca.services.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	if len(recorder.messages["debug"]) != 1 {
+		t.Fatalf("Expected the retry to be logged, got %v", recorder.messages)
+	}
+	for _, messages := range recorder.messages {
+		for _, message := range messages {
+			if strings.Contains(message, "enrollmentSecret") {
+				t.Fatalf("The enrollment secret was logged: %s", message)
+			}
+		}
+	}
+
+	// A nil logger discards messages
+	WithLogger(nil)(ca.services)
+	ca.services.transport = &failingTransport{failures: []func() (*http.Response, error){connectionReset}}
+	if _, _, err := ca.services.Enroll("enrollmentID", "enrollmentSecret"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Metrics receives measurements of the requests sent to the CA, see
+// WithMetrics. Each attempt of a retried request is measured.
+//
+// op is the CA endpoint of the request, e.g. "enroll", "reenroll",
+// "register", "revoke" or "cainfo", prefixed by the HTTP method for requests
+// other than POST, e.g. "GET identities" or "DELETE affiliations".
+//
+// category is one of "unreachable", "invalid_credentials",
+// "permission_denied", "already_registered", "not_found", "pin_mismatch",
+// "enrollment_limit", "circuit_open" for requests failed fast by the circuit
+// breaker, "server" for other errors returned by the CA and "other" for
+// invalid responses
+type Metrics interface {
+	// ObserveCALatency is called with the duration of every request
+	ObserveCALatency(op string, d time.Duration)
+	// IncCAError is called for every failed request
+	IncCAError(op, category string)
+}
+
+// nopMetrics discards all measurements
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveCALatency(op string, d time.Duration) {}
+func (nopMetrics) IncCAError(op, category string)              {}
+
+// WithMetrics sets the Metrics the requests sent to the CA are measured
+// with. Requests are not measured by default
+func WithMetrics(m Metrics) Option {
+	return func(fabricCAServices *services) {
+		if m == nil {
+			m = nopMetrics{}
+		}
+		fabricCAServices.metrics = m
+	}
+}
+
+// metricsOp returns the Metrics op of a request to the CA
+func metricsOp(req *http.Request) string {
+	// Endpoints are served under /api/v1/cfssl/ of the CA URL
+	path := req.URL.Path
+	if i := strings.Index(path, "/api/v1/cfssl/"); i >= 0 {
+		path = path[i+len("/api/v1/cfssl/"):]
+	}
+	op := strings.SplitN(path, "/", 2)[0]
+	if req.Method != http.MethodPost {
+		op = req.Method + " " + op
+	}
+	return op
+}
+
+// errorCategory returns the Metrics category of a failed request
+func errorCategory(err error) string {
+	var caErr *CAError
+	if !errors.As(err, &caErr) {
+		return "other"
+	}
+	switch caErr.Kind {
+	case ErrCAUnreachable:
+		return "unreachable"
+	case ErrInvalidCredentials:
+		return "invalid_credentials"
+	case ErrPermissionDenied:
+		return "permission_denied"
+	case ErrAlreadyRegistered:
+		return "already_registered"
+	case ErrNotFound:
+		return "not_found"
+	case ErrCertificatePinMismatch:
+		return "pin_mismatch"
+	case ErrCircuitOpen:
+		return "circuit_open"
+	case ErrEnrollmentLimitReached:
+		return "enrollment_limit"
+	}
+	return "server"
+}
@@ -0,0 +1,100 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/base64"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingMetrics records the measurements of each op
+type recordingMetrics struct {
+	latencies map[string]int
+	errors    map[string][]string
+}
+
+func (m *recordingMetrics) ObserveCALatency(op string, d time.Duration) {
+	if m.latencies == nil {
+		m.latencies = make(map[string]int)
+	}
+	m.latencies[op]++
+}
+
+func (m *recordingMetrics) IncCAError(op, category string) {
+	if m.errors == nil {
+		m.errors = make(map[string][]string)
+	}
+	m.errors[op] = append(m.errors[op], category)
+}
+
+func TestWithMetrics(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			return "Identity 'user1' is already registered", http.StatusBadRequest
+		},
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			return "Identity not found", http.StatusNotFound
+		},
+	})
+	defer ca.Close()
+	recorder := &recordingMetrics{}
+	WithMetrics(recorder)(ca.services)
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond})(ca.services)
+	ca.services.transport = &failingTransport{failures: []func() (*http.Response, error){connectionReset}}
+
+	if _, _, err := ca.services.Enroll("user1", "user1pw"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+	ca.services.transport = nil
+	if _, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1",
+		Affiliation: "org1"}); err == nil {
+		t.Fatalf("Register should have failed")
+	}
+	if _, err := ca.services.GetIdentity(registrar, "user1"); err == nil {
+		t.Fatalf("GetIdentity should have failed")
+	}
+
+	// Each attempt is measured
+	expectedLatencies := map[string]int{"enroll": 2, "register": 1, "GET identities": 1}
+	if !reflect.DeepEqual(recorder.latencies, expectedLatencies) {
+		t.Fatalf("Expected latencies %v, got %v", expectedLatencies, recorder.latencies)
+	}
+	expectedErrors := map[string][]string{
+		"enroll":         {"unreachable"},
+		"register":       {"already_registered"},
+		"GET identities": {"not_found"},
+	}
+	if !reflect.DeepEqual(recorder.errors, expectedErrors) {
+		t.Fatalf("Expected errors %v, got %v", expectedErrors, recorder.errors)
+	}
+
+	// Nil Metrics discard measurements
+	WithMetrics(nil)(ca.services)
+	if _, _, err := ca.services.Enroll("user1", "user1pw"); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build pkcs11
+// +build pkcs11
+
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-sdk-go/config"
+	"github.com/hyperledger/fabric/bccsp/factory"
+)
+
+// newPKCS11Opts creates the options of the PKCS11 BCCSP from the
+// client.security.pkcs11 configuration. The token label selects the HSM
+// slot, keys are then looked up in the token by SKI
+func newPKCS11Opts() (*factory.PKCS11Opts, error) {
+	opts := &factory.PKCS11Opts{
+		SecLevel:   config.GetSecurityLevel(),
+		HashFamily: config.GetSecurityAlgorithm(),
+		Library:    config.GetSecurityProviderLibPath(),
+		Label:      config.GetSecurityProviderLabel(),
+		Pin:        config.GetSecurityProviderPin(),
+	}
+	if opts.Library == "" {
+		return nil, fmt.Errorf("PKCS11 library path is not configured")
+	}
+	if opts.Label == "" {
+		return nil, fmt.Errorf("PKCS11 token label is not configured")
+	}
+	if opts.Pin == "" {
+		return nil, fmt.Errorf("PKCS11 token pin is not configured")
+	}
+	return opts, nil
+}
@@ -0,0 +1,187 @@
+//go:build pkcs11
+// +build pkcs11
+
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-sdk-go/config"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric-sdk-go/fabric-client/keyvaluestore"
+	"github.com/hyperledger/fabric/bccsp/factory"
+)
+
+// softHSMConfig returns the client.security configuration of a softhsm
+// token, set by PKCS11_LIB, PKCS11_LABEL and PKCS11_PIN, skipping the test
+// when softhsm is not installed
+func softHSMConfig(t *testing.T) string {
+	lib := os.Getenv("PKCS11_LIB")
+	for _, path := range []string{"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so", "/usr/local/lib/softhsm/libsofthsm2.so"} {
+		if lib != "" {
+			break
+		}
+		if _, err := os.Stat(path); err == nil {
+			lib = path
+		}
+	}
+	if lib == "" {
+		t.Skip("softhsm is not installed, set PKCS11_LIB")
+	}
+	label, pin := os.Getenv("PKCS11_LABEL"), os.Getenv("PKCS11_PIN")
+	if label == "" {
+		label = "ForFabric"
+	}
+	if pin == "" {
+		pin = "98765432"
+	}
+	return `client:
+ security:
+  hashAlgorithm: "SHA2"
+  level: 256
+  provider: "PKCS11"
+  pkcs11:
+   library: "` + lib + `"
+   label: "` + label + `"
+   pin: "` + pin + `"
+`
+}
+
+func TestEnrollWithLabelInSoftHSM(t *testing.T) {
+	initTestConfig(t, softHSMConfig(t))
+	opts, err := newPKCS11Opts()
+	if err != nil {
+		t.Fatalf("newPKCS11Opts returned error: %v", err)
+	}
+	csp, err := (&factory.PKCS11Factory{}).Get(&factory.FactoryOpts{ProviderName: PKCS11Provider,
+		SwOpts: &factory.SwOpts{}, Pkcs11Opts: opts})
+	if err != nil {
+		t.Fatalf("Error opening the softhsm token: %v", err)
+	}
+	var labels []string
+	issue := newIssuingEnrollHandler(t)
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			var request enrollmentRequest
+			json.Unmarshal(body, &request)
+			labels = append(labels, request.Label)
+			return issue(r, body)
+		},
+	})
+	defer ca.Close()
+	ca.services.hsm = true
+	ca.services.tokenLabel = config.GetSecurityProviderLabel()
+	ca.services.csp = csp
+
+	if _, _, err := ca.services.EnrollWithOptions("user1", "user1pw",
+		&EnrollmentOptions{Label: "NotTheToken"}); err == nil {
+		t.Fatalf("EnrollWithOptions should have failed for another token")
+	}
+	key, certPEM, err := ca.services.EnrollWithOptions("user1", "user1pw",
+		&EnrollmentOptions{Label: ca.services.tokenLabel})
+	if err != nil {
+		t.Fatalf("EnrollWithOptions returned error: %v", err)
+	}
+	if key != nil {
+		t.Fatalf("The key generated in the token should not be returned")
+	}
+	if len(labels) != 1 || labels[0] != ca.services.tokenLabel {
+		t.Fatalf("Unexpected labels of the enrollment requests %q", labels)
+	}
+
+	// The key of the certificate is found in the token by its SKI
+	privateKey, err := importEnrollmentKey(csp, nil, certPEM)
+	if err != nil || !privateKey.Private() {
+		t.Fatalf("The private key of the certificate is not in the token: %v", err)
+	}
+}
+
+func TestStoreKeyReferenceInSoftHSM(t *testing.T) {
+	initTestConfig(t, softHSMConfig(t))
+	opts, err := newPKCS11Opts()
+	if err != nil {
+		t.Fatalf("newPKCS11Opts returned error: %v", err)
+	}
+	csp, err := (&factory.PKCS11Factory{}).Get(&factory.FactoryOpts{ProviderName: PKCS11Provider,
+		SwOpts: &factory.SwOpts{}, Pkcs11Opts: opts})
+	if err != nil {
+		t.Fatalf("Error opening the softhsm token: %v", err)
+	}
+	ca := newMockCA(t, map[string]mockCAHandler{"enroll": newIssuingEnrollHandler(t)})
+	defer ca.Close()
+	ca.services.hsm = true
+	ca.services.tokenLabel = config.GetSecurityProviderLabel()
+	ca.services.csp = csp
+	dir, err := ioutil.TempDir("", "pkcs11_test_store")
+	if err != nil {
+		t.Fatalf("Error creating store directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := keyvaluestore.CreateNewFileKeyValueStore(dir)
+	if err != nil {
+		t.Fatalf("CreateNewFileKeyValueStore returned error: %v", err)
+	}
+
+	enrolled, err := ca.services.EnrollAndStore("user1", "user1pw", store)
+	if err != nil {
+		t.Fatalf("EnrollAndStore returned error: %v", err)
+	}
+	files := 0
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		files++
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var userJSON fabricclient.UserJSON
+		if strings.Contains(string(data), "PRIVATE KEY") ||
+			(json.Unmarshal(data, &userJSON) == nil && userJSON.PrivateKey != nil) {
+			t.Fatalf("Private key material was written to %s", path)
+		}
+		return nil
+	})
+	if err != nil || files == 0 {
+		t.Fatalf("Error reading the stored identity: %v", err)
+	}
+
+	// The key handle is found in the token by the stored reference
+	value, _ := store.GetValue("user1")
+	var userJSON fabricclient.UserJSON
+	json.Unmarshal(value, &userJSON)
+	if userJSON.KeyLabel != ca.services.tokenLabel {
+		t.Fatalf("Expected the label of the token to be stored, got %s", userJSON.KeyLabel)
+	}
+	key, err := csp.GetKey(userJSON.PrivateKeySKI)
+	if err != nil || !key.Private() || string(key.SKI()) != string(enrolled.GetPrivateKey().SKI()) {
+		t.Fatalf("The stored reference does not select the key in the token: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// redactedValue replaces the values of redacted fields
+const redactedValue = "****"
+
+// redactedNames are the lowercase suffixes of the names of the fields and map
+// keys, like EnrollmentSecret or Pin, whose values are never logged
+var redactedNames = []string{"secret", "password", "pin"}
+
+// isRedacted reports whether the value of the field or map key name is
+// redacted
+func isRedacted(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range redactedNames {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact formats v like %+v, replacing the values of the fields and string
+// map keys named like a secret, password or PIN with "****", so that it can
+// be logged
+func redact(v interface{}) string {
+	var b strings.Builder
+	writeRedacted(&b, reflect.ValueOf(v), make(map[uintptr]bool))
+	return b.String()
+}
+
+// writeRedacted writes v redacted to b. Pointers already in visited are not
+// followed again, guarding against cycles
+func writeRedacted(b *strings.Builder, v reflect.Value, visited map[uintptr]bool) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		b.WriteString("<nil>")
+	case reflect.Ptr:
+		if v.IsNil() {
+			b.WriteString("<nil>")
+			return
+		}
+		if v.Elem().Kind() != reflect.Struct {
+			fmt.Fprintf(b, "%v", v)
+			return
+		}
+		b.WriteString("&")
+		if visited[v.Pointer()] {
+			b.WriteString("{...}")
+			return
+		}
+		visited[v.Pointer()] = true
+		writeRedacted(b, v.Elem(), visited)
+	case reflect.Interface:
+		writeRedacted(b, v.Elem(), visited)
+	case reflect.Struct:
+		b.WriteString("{")
+		for i := 0; i < v.NumField(); i++ {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			name := v.Type().Field(i).Name
+			b.WriteString(name + ":")
+			if isRedacted(name) {
+				b.WriteString(redactedValue)
+			} else {
+				writeRedacted(b, v.Field(i), visited)
+			}
+		}
+		b.WriteString("}")
+	case reflect.Slice, reflect.Array:
+		switch v.Type().Elem().Kind() {
+		case reflect.Struct, reflect.Ptr, reflect.Interface, reflect.Map:
+		default:
+			fmt.Fprintf(b, "%v", v)
+			return
+		}
+		b.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			writeRedacted(b, v.Index(i), visited)
+		}
+		b.WriteString("]")
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		b.WriteString("map[")
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			fmt.Fprintf(b, "%v:", key)
+			if key.Kind() == reflect.String && isRedacted(key.String()) {
+				b.WriteString(redactedValue)
+			} else {
+				writeRedacted(b, v.MapIndex(key), visited)
+			}
+		}
+		b.WriteString("]")
+	default:
+		fmt.Fprintf(b, "%v", v)
+	}
+}
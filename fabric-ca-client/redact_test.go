@@ -0,0 +1,108 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	cfssllog "github.com/cloudflare/cfssl/log"
+	"github.com/op/go-logging"
+)
+
+func TestRedact(t *testing.T) {
+	type token struct {
+		Label string
+		Pin   string
+	}
+	type request struct {
+		Name             string
+		EnrollmentSecret string
+		Password         string
+		Token            *token
+		Tokens           []token
+		Attrs            map[string]string
+		next             *request
+	}
+	req := &request{Name: "user1", EnrollmentSecret: "s3cret", Password: "passw0rd",
+		Token:  &token{Label: "ForFabric", Pin: "98765432"},
+		Tokens: []token{{Label: "Other", Pin: "12345678"}},
+		Attrs:  map[string]string{"secret": "hidden", "role": "client"}}
+	req.next = req
+
+	expected := "&{Name:user1 EnrollmentSecret:**** Password:**** Token:&{Label:ForFabric Pin:****} " +
+		"Tokens:[{Label:Other Pin:****}] Attrs:map[role:client secret:****] next:&{...}}"
+	if redacted := redact(req); redacted != expected {
+		t.Fatalf("Unexpected redaction:\n%s\nexpected:\n%s", redacted, expected)
+	}
+	if redacted := redact(nil); redacted != "<nil>" {
+		t.Fatalf("Unexpected redaction of nil: %s", redacted)
+	}
+}
+
+func TestSecretsNeverLogged(t *testing.T) {
+	const secret = "enrollmentSecret"
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	initTestConfig(t, `client:
+ fabricCA:
+  id: "DEFAULT"
+  serverURL: "`+ca.Server.URL+`"
+`)
+
+	// Capture the debug logs of the SDK and of the fabric-ca library, after
+	// the config has set the logging up
+	var output bytes.Buffer
+	backend := logging.AddModuleLevel(logging.NewLogBackend(&output, "", 0))
+	backend.SetLevel(logging.DEBUG, "")
+	logging.SetBackend(backend)
+	log.SetOutput(&output)
+	cfsslLevel := cfssllog.Level
+	cfssllog.Level = cfssllog.LevelDebug
+	defer func() {
+		logging.SetBackend(logging.NewLogBackend(os.Stderr, "", log.LstdFlags))
+		log.SetOutput(os.Stderr)
+		cfssllog.Level = cfsslLevel
+	}()
+
+	fabricCAClient, err := NewFabricCAClient(WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if _, _, err := fabricCAClient.Enroll("enrollmentID", secret); err != nil {
+		t.Fatalf("Enroll returned error: %v", err)
+	}
+
+	if !strings.Contains(output.String(), "Constructed fabricCAClient instance") {
+		t.Fatalf("Expected debug logging to be captured, got: %s", output.String())
+	}
+	if strings.Contains(output.String(), secret) {
+		t.Fatalf("The enrollment secret was logged: %s", output.String())
+	}
+}
@@ -0,0 +1,508 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// CertAttributesOID is the object identifier of the certificate extension the CA
+// embeds the attributes of an identity in
+var CertAttributesOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// Registrar attributes restricting the identities a registrar can register
+const (
+	// RegistrarRolesAttr lists the types of identities the registrar can
+	// register, * for any type
+	RegistrarRolesAttr = "hf.Registrar.Roles"
+	// RegistrarAffiliationsAttr lists the affiliations the registrar can
+	// register identities in, including their child affiliations
+	RegistrarAffiliationsAttr = "hf.Registrar.Affiliations"
+	// RevokerAttr allows the registrar to revoke certificates when true
+	RevokerAttr = "hf.Revoker"
+	// GenCRLAttr allows the registrar to generate CRLs when true
+	GenCRLAttr = "hf.GenCRL"
+	// RegistrarDelegateRolesAttr lists the types of identities the
+	// registrar can grant the registration of to the registrars it
+	// registers, its RegistrarRolesAttr when not set
+	RegistrarDelegateRolesAttr = "hf.Registrar.DelegateRoles"
+)
+
+// RegistrarCaps are the capabilities granted to a registrar by the
+// attributes of its enrollment certificate
+type RegistrarCaps struct {
+	// HasAttributes is false when the certificate embeds no attributes,
+	// issued by a CA not embedding them: the capabilities are then unknown
+	// and only checked by the CA
+	HasAttributes bool
+	// Roles are the types of identities the registrar can register, * for
+	// any type, see RegistrarRolesAttr
+	Roles []string
+	// Affiliations are the affiliations the registrar can register
+	// identities in, including their child affiliations, see
+	// RegistrarAffiliationsAttr
+	Affiliations []string
+	// Revoker is true when the registrar can revoke certificates
+	Revoker bool
+	// GenCRL is true when the registrar can generate CRLs
+	GenCRL bool
+	// DelegateRoles are the types of identities the registrar can allow the
+	// registrars it registers to register, * for any type, see
+	// RegistrarDelegateRolesAttr
+	DelegateRoles []string
+}
+
+// CanRegisterType returns true when the Roles allow registering identities
+// of type identityType
+func (caps *RegistrarCaps) CanRegisterType(identityType string) bool {
+	for _, role := range caps.Roles {
+		if role == "*" || role == identityType {
+			return true
+		}
+	}
+	return false
+}
+
+// CanDelegateRole returns true when the DelegateRoles allow granting the
+// registration of identities of type identityType
+func (caps *RegistrarCaps) CanDelegateRole(identityType string) bool {
+	for _, role := range caps.DelegateRoles {
+		if role == "*" || role == identityType {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRegisterAffiliation returns true when the Affiliations allow registering
+// identities in affiliation
+func (caps *RegistrarCaps) CanRegisterAffiliation(affiliation string) bool {
+	for _, allowed := range caps.Affiliations {
+		if affiliation == allowed || strings.HasPrefix(affiliation, allowed+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRegistrarCapabilities returns the capabilities granted to a registrar
+// by the attributes of its enrollment certificate, without contacting the CA
+// @param {User} registrar The registrar
+// @returns {RegistrarCaps} The capabilities of the registrar
+// @returns {error} Error
+func (fabricCAServices *services) GetRegistrarCapabilities(registrar fabricclient.User) (*RegistrarCaps, error) {
+	if registrar == nil {
+		return nil, fmt.Errorf("Registrar cannot be nil")
+	}
+	cert := registrar.GetEnrollmentCertificate()
+	if cert == nil {
+		return nil, fmt.Errorf("Unable to read registrar enrollment certificate")
+	}
+	attrs, err := certAttributes(cert)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the attributes of %s: %s", registrar.GetName(), err)
+	}
+	return NewRegistrarCaps(attrs), nil
+}
+
+// RegMetadata is what a registrar can register identities with, to populate
+// registration forms. It refers to nothing but its own values, so that it
+// can be cached, and compared with ETag
+type RegMetadata struct {
+	// Registrar is the name of the registrar
+	Registrar string
+	// IdentityTypes are the identity types the registrar can register,
+	// sorted. All the types identities can be registered with when the
+	// capabilities of the registrar are unknown
+	IdentityTypes []string
+	// Affiliations are the full paths of the affiliations of the CA the
+	// registrar can register identities in, sorted. All the affiliations
+	// returned by the CA when the registrar has no RegistrarAffiliationsAttr
+	Affiliations []string
+	// Capabilities are the capabilities of the registrar
+	Capabilities RegistrarCaps
+}
+
+// ETag returns an opaque digest of the metadata, identical for metadata
+// listing the same identity types, affiliations and capabilities
+func (metadata *RegMetadata) ETag() string {
+	state, _ := json.Marshal(metadata)
+	sum := sha256.Sum256(state)
+	return hex.EncodeToString(sum[:])
+}
+
+// GetRegistrationMetadata ...
+/**
+ * Get the identity types and affiliations a registrar can register
+ * identities with: the affiliations of the CA, filtered by the capabilities
+ * of the registrar read from its enrollment certificate
+ * @param {User} registrar The registrar
+ * @returns {RegMetadata} The metadata
+ * @returns {error} Error
+ */
+func (fabricCAServices *services) GetRegistrationMetadata(registrar fabricclient.User) (*RegMetadata, error) {
+	caps, err := fabricCAServices.GetRegistrarCapabilities(registrar)
+	if err != nil {
+		return nil, err
+	}
+	affiliations, err := fabricCAServices.GetAllAffiliations(registrar)
+	if err != nil {
+		return nil, err
+	}
+	identityTypes := fabricCAServices.identityTypes
+	if len(identityTypes) == 0 {
+		identityTypes = DefaultIdentityTypes
+	}
+	paths := make([]string, 0, len(affiliations))
+	for _, affiliation := range affiliations {
+		paths = append(paths, affiliation.Name)
+	}
+	return newRegMetadata(registrar.GetName(), caps, identityTypes, paths), nil
+}
+
+// newRegMetadata returns the identity types and affiliation paths the
+// capabilities allow registering identities with
+func newRegMetadata(registrar string, caps *RegistrarCaps, identityTypes []string,
+	affiliations []string) *RegMetadata {
+	metadata := &RegMetadata{Registrar: registrar, Capabilities: *caps,
+		IdentityTypes: []string{}, Affiliations: []string{}}
+	for _, identityType := range identityTypes {
+		if !caps.HasAttributes || caps.CanRegisterType(identityType) {
+			metadata.IdentityTypes = append(metadata.IdentityTypes, identityType)
+		}
+	}
+	for _, affiliation := range affiliations {
+		if len(caps.Affiliations) == 0 || caps.CanRegisterAffiliation(affiliation) {
+			metadata.Affiliations = append(metadata.Affiliations, affiliation)
+		}
+	}
+	sort.Strings(metadata.IdentityTypes)
+	sort.Strings(metadata.Affiliations)
+	return metadata
+}
+
+// NewRegistrarCaps returns the capabilities granted by the attributes of an
+// enrollment certificate, as returned by GetCertAttributes. HasAttributes is
+// false when there are none
+func NewRegistrarCaps(attrs map[string]string) *RegistrarCaps {
+	caps := &RegistrarCaps{HasAttributes: len(attrs) > 0}
+	caps.Roles = attrValues(attrs[RegistrarRolesAttr])
+	caps.Affiliations = attrValues(attrs[RegistrarAffiliationsAttr])
+	caps.Revoker, _ = strconv.ParseBool(attrs[RevokerAttr])
+	caps.GenCRL, _ = strconv.ParseBool(attrs[GenCRLAttr])
+	caps.DelegateRoles = caps.Roles
+	if delegateRoles, ok := attrs[RegistrarDelegateRolesAttr]; ok {
+		caps.DelegateRoles = attrValues(delegateRoles)
+	}
+	return caps
+}
+
+// attrValues returns the values of a comma separated attribute
+func attrValues(attr string) []string {
+	var values []string
+	for _, value := range strings.Split(attr, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// GetCertAttributes ...
+/**
+ * Get the attributes the CA embedded in an enrollment certificate, in the
+ * JSON payload of its 1.2.3.4.5.6.7.8.1 extension
+ * @param {[]byte} certPEM The PEM encoded certificate
+ * @returns {map[string]string} The attributes by name, empty when the
+ * certificate has no attribute extension
+ * @returns {error} Error parsing the certificate or its attribute extension
+ */
+func GetCertAttributes(certPEM []byte) (map[string]string, error) {
+	attrs, err := certAttributes(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading certificate attributes: %s", err)
+	}
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	return attrs, nil
+}
+
+// certAttributes returns the attributes embedded in a PEM encoded enrollment
+// certificate, nil when it has none
+func certAttributes(cert []byte) (map[string]string, error) {
+	x509Cert, err := fabric_ca.BytesToX509Cert(cert)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range x509Cert.Extensions {
+		if !ext.Id.Equal(CertAttributesOID) {
+			continue
+		}
+		var attrs struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		if err := json.Unmarshal(ext.Value, &attrs); err != nil {
+			return nil, fmt.Errorf("Invalid attributes extension: %s", err)
+		}
+		return attrs.Attrs, nil
+	}
+	return nil, nil
+}
+
+// checkRegistrarAuthority checks the registrar's attributes authorize the
+// registration request, so that requests the CA would refuse fail with a
+// clear message. Registrars whose certificate has no attributes are left for
+// the CA to check
+func (identity *signingIdentity) checkRegistrarAuthority(request *RegistrationRequest) error {
+	if roles, ok := identity.attrs[RegistrarRolesAttr]; ok && request.Type != "" {
+		if !containsAttrValue(roles, func(role string) bool { return role == "*" || role == request.Type }) {
+			return fmt.Errorf("Registrar %s is not authorized to register type %s: %w",
+				identity.name, request.Type, ErrPermissionDenied)
+		}
+	}
+	if affiliations, ok := identity.attrs[RegistrarAffiliationsAttr]; ok && strings.TrimSpace(affiliations) != "" {
+		authorized := containsAttrValue(affiliations, func(affiliation string) bool {
+			return request.Affiliation == affiliation || strings.HasPrefix(request.Affiliation, affiliation+".")
+		})
+		if !authorized {
+			return fmt.Errorf("Registrar %s is not authorized for affiliation %s: %w",
+				identity.name, request.Affiliation, ErrPermissionDenied)
+		}
+	}
+	return nil
+}
+
+// containsAttrValue returns true when one of the values of a comma separated
+// attribute matches
+func containsAttrValue(attr string, match func(value string) bool) bool {
+	for _, value := range attrValues(attr) {
+		if match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegistrarRegistrationRequest registers an identity which can itself
+// register identities, see RegisterRegistrar. The typed fields set the
+// registrar attributes of the identity, embedded in its enrollment
+// certificates, and can't be set through Attributes
+type RegistrarRegistrationRequest struct {
+	RegistrationRequest
+	// AllowedRoles are the types of identities the registrar can register,
+	// * for any type, see RegistrarRolesAttr. At least one is required
+	AllowedRoles []string
+	// AllowedAffiliations are the affiliations the registrar can register
+	// identities in, including their child affiliations, see
+	// RegistrarAffiliationsAttr. Unrestricted when empty
+	AllowedAffiliations []string
+	// CanRevoke allows the registrar to revoke certificates, see RevokerAttr
+	CanRevoke bool
+	// CanGenCRL allows the registrar to generate CRLs, see GenCRLAttr
+	CanGenCRL bool
+	// DelegateRoles are the AllowedRoles the registrar can grant in turn to
+	// the registrars it registers, see RegistrarDelegateRolesAttr. The
+	// registrar can't register registrars when empty
+	DelegateRoles []string
+}
+
+// ToRegistrationRequest ...
+/**
+ * Validate the request and convert it to the RegistrationRequest setting the
+ * registrar attributes of its typed fields
+ * @returns {RegistrationRequest} The registration request
+ * @returns {error} ValidationError listing the problems of the request
+ */
+func (request *RegistrarRegistrationRequest) ToRegistrationRequest() (*RegistrationRequest, error) {
+	var problems []string
+	if len(request.AllowedRoles) == 0 {
+		problems = append(problems, "AllowedRoles cannot be empty")
+	}
+	for _, values := range [][]string{request.AllowedRoles, request.AllowedAffiliations, request.DelegateRoles} {
+		for _, value := range values {
+			if value == "" || strings.Contains(value, ",") {
+				problems = append(problems, fmt.Sprintf("Invalid registrar attribute value %q", value))
+			}
+		}
+	}
+	allowed := &RegistrarCaps{Roles: request.AllowedRoles}
+	for _, role := range request.DelegateRoles {
+		if role != "" && !allowed.CanRegisterType(role) {
+			problems = append(problems, fmt.Sprintf("Delegate role %s is not one of the AllowedRoles", role))
+		}
+	}
+	for _, attr := range request.Attributes {
+		switch attr.Key {
+		case RegistrarRolesAttr, RegistrarAffiliationsAttr, RevokerAttr, GenCRLAttr, RegistrarDelegateRolesAttr:
+			problems = append(problems, fmt.Sprintf("Attribute %s is set by the typed fields of the request", attr.Key))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	registration := request.RegistrationRequest
+	registration.Attributes = append(append([]Attribute(nil), request.Attributes...),
+		Attribute{Key: RegistrarRolesAttr, Value: strings.Join(request.AllowedRoles, ","), ECert: true},
+		Attribute{Key: RegistrarDelegateRolesAttr, Value: strings.Join(request.DelegateRoles, ","), ECert: true},
+		Attribute{Key: RevokerAttr, Value: strconv.FormatBool(request.CanRevoke), ECert: true},
+		Attribute{Key: GenCRLAttr, Value: strconv.FormatBool(request.CanGenCRL), ECert: true})
+	if len(request.AllowedAffiliations) > 0 {
+		registration.Attributes = append(registration.Attributes, Attribute{Key: RegistrarAffiliationsAttr,
+			Value: strings.Join(request.AllowedAffiliations, ","), ECert: true})
+	}
+	return &registration, nil
+}
+
+// CheckDelegation ...
+/**
+ * Check the capabilities of the requesting registrar allow granting the
+ * capabilities of the request, so that no registrar registers a registrar
+ * more privileged than itself
+ * @param {RegistrarCaps} caps The capabilities of the requesting registrar
+ * @returns {error} Error matching ErrPermissionDenied with errors.Is
+ */
+func (request *RegistrarRegistrationRequest) CheckDelegation(caps *RegistrarCaps) error {
+	var denied []string
+	for _, role := range request.AllowedRoles {
+		if !caps.CanDelegateRole(role) {
+			denied = append(denied, "role "+role)
+		}
+	}
+	if len(caps.Affiliations) > 0 {
+		if len(request.AllowedAffiliations) == 0 {
+			denied = append(denied, "unrestricted affiliations")
+		}
+		for _, affiliation := range request.AllowedAffiliations {
+			if !caps.CanRegisterAffiliation(affiliation) {
+				denied = append(denied, "affiliation "+affiliation)
+			}
+		}
+	}
+	if request.CanRevoke && !caps.Revoker {
+		denied = append(denied, RevokerAttr)
+	}
+	if request.CanGenCRL && !caps.GenCRL {
+		denied = append(denied, GenCRLAttr)
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("Registrar is not authorized to grant %s: %w", strings.Join(denied, ", "),
+			ErrPermissionDenied)
+	}
+	return nil
+}
+
+// RegisterRegistrar ...
+/**
+ * Register an identity which can itself register identities. The requesting
+ * registrar can only grant the capabilities it has, read from the attributes
+ * of its enrollment certificate, or of its identity registered with the CA
+ * when its certificate embeds no attributes
+ * @param {User} registrar The User that is initiating the request
+ * @param {RegistrarRegistrationRequest} request Registrar Registration Request
+ * @returns {string} Enrollment secret
+ * @returns {error} Error, matching ErrPermissionDenied with errors.Is when the
+ * registrar can't grant the capabilities of the request
+ */
+func (fabricCAServices *services) RegisterRegistrar(registrar fabricclient.User,
+	request *RegistrarRegistrationRequest) (string, error) {
+	if request == nil {
+		return "", fmt.Errorf("Registration request cannot be nil")
+	}
+	registration, err := request.ToRegistrationRequest()
+	if err != nil {
+		return "", fmt.Errorf("Error Registering User: %w", err)
+	}
+	caps, err := fabricCAServices.GetRegistrarCapabilities(registrar)
+	if err != nil {
+		return "", err
+	}
+	if !caps.HasAttributes {
+		identity, err := fabricCAServices.GetIdentity(registrar, registrar.GetName())
+		if err != nil {
+			return "", fmt.Errorf("Error getting the capabilities of registrar %s: %w", registrar.GetName(), err)
+		}
+		attrs := make(map[string]string, len(identity.Attributes))
+		for _, attr := range identity.Attributes {
+			attrs[attr.Key] = attr.Value
+		}
+		caps = NewRegistrarCaps(attrs)
+	}
+	if err := request.CheckDelegation(caps); err != nil {
+		return "", fmt.Errorf("Error Registering User: %w", err)
+	}
+	return fabricCAServices.Register(registrar, registration)
+}
+
+// RegistrarProvider returns the current registrar of a long-running process,
+// e.g. after enrolling it again once its certificate expired
+type RegistrarProvider func() (fabricclient.User, error)
+
+// WithRegistrarProvider refreshes the registrar of the calls taking one, like
+// Register or GetIdentity, whose credential the CA rejects, typically because
+// its certificate expired or was revoked: provider is called and the request
+// is sent once more, signed by the registrar it returned. The requests of
+// later calls are signed by the registrar they get, so callers should get it
+// from provider too. provider may be called concurrently
+func WithRegistrarProvider(provider RegistrarProvider) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.registrarProvider = provider
+	}
+}
+
+// createRegistrarIdentity creates the identity of a registrar to sign Fabric
+// CA requests with, refreshed by the RegistrarProvider when rejected
+func (fabricCAServices *services) createRegistrarIdentity(registrar fabricclient.
+	User) (*signingIdentity, error) {
+	identity, err := fabricCAServices.createSigningIdentity(registrar)
+	if err != nil {
+		return nil, err
+	}
+	identity.registrar = true
+	return identity, nil
+}
+
+// refreshRegistrar returns the identity of the registrar returned by the
+// RegistrarProvider, replacing the rejected identity
+func (fabricCAServices *services) refreshRegistrar(rejected *signingIdentity) (*signingIdentity, error) {
+	registrar, err := fabricCAServices.registrarProvider()
+	if err != nil {
+		return nil, err
+	}
+	if registrar == nil {
+		return nil, fmt.Errorf("RegistrarProvider returned no registrar")
+	}
+	identity, err := fabricCAServices.createRegistrarIdentity(registrar)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	fabricCAServices.logger.Infof("Refreshed registrar %s after the CA rejected its credential", rejected.name)
+	return identity, nil
+}
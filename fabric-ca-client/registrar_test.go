@@ -0,0 +1,459 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric-sdk-go/fabric-client"
+	bccspFactory "github.com/hyperledger/fabric/bccsp/factory"
+)
+
+func TestRegistrarAuthority(t *testing.T) {
+	var registrations int
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			registrations++
+			return base64.StdEncoding.EncodeToString([]byte("user1pw")), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	registrar := newTestRegistrar(t, map[string]string{
+		RegistrarRolesAttr:        "peer, user",
+		RegistrarAffiliationsAttr: "org1.department1,org2",
+	})
+
+	for _, request := range []*RegistrationRequest{
+		{Name: "user1", Type: "user", Affiliation: "org1.department1"},
+		{Name: "user2", Type: "peer", Affiliation: "org1.department1.team1"},
+		{Name: "user3", Affiliation: "org2"},
+	} {
+		if _, err := ca.services.Register(registrar, request); err != nil {
+			t.Fatalf("Register of %s returned error: %v", request.Name, err)
+		}
+	}
+	if registrations != 3 {
+		t.Fatalf("Expected 3 registrations, got %d", registrations)
+	}
+
+	tests := []struct {
+		request *RegistrationRequest
+		message string
+	}{
+		{&RegistrationRequest{Name: "user4", Type: "orderer", Affiliation: "org2"},
+			"Registrar admin is not authorized to register type orderer"},
+		{&RegistrationRequest{Name: "user5", Affiliation: "org1"},
+			"Registrar admin is not authorized for affiliation org1"},
+		{&RegistrationRequest{Name: "user6", Affiliation: "org1.department10"},
+			"Registrar admin is not authorized for affiliation org1.department10"},
+	}
+	for _, test := range tests {
+		_, err := ca.services.Register(registrar, test.request)
+		if !errors.Is(err, ErrPermissionDenied) || !strings.Contains(err.Error(), test.message) {
+			t.Fatalf("Register of %s should have failed with %q, got: %v", test.request.Name, test.message, err)
+		}
+	}
+	if registrations != 3 {
+		t.Fatalf("Unauthorized requests should not be sent to the CA")
+	}
+
+	// Any type can be registered with the * role
+	registrar = newTestRegistrar(t, map[string]string{RegistrarRolesAttr: "*"})
+	request := &RegistrationRequest{Name: "user7", Type: "orderer", Affiliation: "org3"}
+	if _, err := ca.services.Register(registrar, request); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+}
+
+func TestGetRegistrarCapabilities(t *testing.T) {
+	ca := newMockCA(t, nil)
+	defer ca.Close()
+
+	tests := []struct {
+		attrs    map[string]string
+		expected RegistrarCaps
+	}{
+		{map[string]string{
+			RegistrarRolesAttr:        "peer, user",
+			RegistrarAffiliationsAttr: "org1.department1,org2",
+			RevokerAttr:               "true",
+			GenCRLAttr:                "true",
+		}, RegistrarCaps{HasAttributes: true, Roles: []string{"peer", "user"},
+			Affiliations: []string{"org1.department1", "org2"}, Revoker: true, GenCRL: true,
+			DelegateRoles: []string{"peer", "user"}}},
+		{map[string]string{RegistrarRolesAttr: "*", RevokerAttr: "false", GenCRLAttr: "invalid"},
+			RegistrarCaps{HasAttributes: true, Roles: []string{"*"}, DelegateRoles: []string{"*"}}},
+		{map[string]string{RegistrarRolesAttr: "peer,user", RegistrarDelegateRolesAttr: "user"},
+			RegistrarCaps{HasAttributes: true, Roles: []string{"peer", "user"}, DelegateRoles: []string{"user"}}},
+		{map[string]string{"hf.EnrollmentID": "admin"}, RegistrarCaps{HasAttributes: true}},
+	}
+	for _, test := range tests {
+		caps, err := ca.services.GetRegistrarCapabilities(newTestRegistrar(t, test.attrs))
+		if err != nil {
+			t.Fatalf("GetRegistrarCapabilities returned error: %v", err)
+		}
+		if !reflect.DeepEqual(*caps, test.expected) {
+			t.Fatalf("Expected capabilities %+v for %v, got %+v", test.expected, test.attrs, *caps)
+		}
+	}
+
+	// Certificates without attributes
+	user := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	caps, err := ca.services.GetRegistrarCapabilities(user)
+	if err != nil || caps.HasAttributes {
+		t.Fatalf("Expected unknown capabilities without attributes, got %+v, %v", caps, err)
+	}
+	if _, err := ca.services.GetRegistrarCapabilities(nil); err == nil {
+		t.Fatalf("GetRegistrarCapabilities should have failed for a nil registrar")
+	}
+	if _, err := ca.services.GetRegistrarCapabilities(fabricclient.NewUser("admin")); err == nil {
+		t.Fatalf("GetRegistrarCapabilities should have failed without certificate")
+	}
+
+	caps = &RegistrarCaps{Roles: []string{"peer"}, Affiliations: []string{"org1.department1"}}
+	for _, test := range []struct {
+		identityType, affiliation       string
+		typeAllowed, affiliationAllowed bool
+	}{
+		{"peer", "org1.department1", true, true},
+		{"user", "org1.department1.team1", false, true},
+		{"peer", "org1", true, false},
+		{"peer", "org1.department10", true, false},
+	} {
+		if caps.CanRegisterType(test.identityType) != test.typeAllowed ||
+			caps.CanRegisterAffiliation(test.affiliation) != test.affiliationAllowed {
+			t.Fatalf("Wrong capabilities for type %s and affiliation %s", test.identityType, test.affiliation)
+		}
+	}
+	if !(&RegistrarCaps{Roles: []string{"*"}}).CanRegisterType("orderer") {
+		t.Fatalf("The * role should allow registering any type")
+	}
+}
+
+func TestGetRegistrationMetadata(t *testing.T) {
+	var gets int
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"affiliations": func(r *http.Request, body []byte) (interface{}, int) {
+			gets++
+			return map[string]interface{}{"name": "", "affiliations": []interface{}{
+				map[string]interface{}{"name": "org2"},
+				map[string]interface{}{"name": "org1", "affiliations": []interface{}{
+					map[string]interface{}{"name": "org1.department2"},
+					map[string]interface{}{"name": "org1.department1"},
+				}},
+			}}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	tests := []struct {
+		attrs         map[string]string
+		identityTypes string
+		affiliations  string
+	}{
+		{
+			attrs:         map[string]string{RegistrarRolesAttr: "user,peer,admin", RegistrarAffiliationsAttr: "org1"},
+			identityTypes: "peer,user",
+			affiliations:  "org1,org1.department1,org1.department2",
+		},
+		{
+			attrs:         map[string]string{RegistrarRolesAttr: "*"},
+			identityTypes: "app,client,orderer,peer,user",
+			affiliations:  "org1,org1.department1,org1.department2,org2",
+		},
+		{
+			attrs:        map[string]string{RegistrarAffiliationsAttr: "org1.department1,org2"},
+			affiliations: "org1.department1,org2",
+		},
+	}
+	for _, test := range tests {
+		metadata, err := ca.services.GetRegistrationMetadata(newTestRegistrar(t, test.attrs))
+		if err != nil {
+			t.Fatalf("GetRegistrationMetadata returned error: %v", err)
+		}
+		if metadata.Registrar != "admin" || strings.Join(metadata.IdentityTypes, ",") != test.identityTypes ||
+			strings.Join(metadata.Affiliations, ",") != test.affiliations {
+			t.Fatalf("Unexpected metadata for %v: %+v", test.attrs, metadata)
+		}
+	}
+	if gets != len(tests) {
+		t.Fatalf("Expected a single affiliations request per call, got %d", gets)
+	}
+
+	// Without attributes, the capabilities are unknown and nothing filtered
+	metadata, err := ca.services.GetRegistrationMetadata(newTestUser(t, "admin",
+		time.Now().Add(-time.Hour), time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("GetRegistrationMetadata returned error: %v", err)
+	}
+	if len(metadata.IdentityTypes) != len(DefaultIdentityTypes) || len(metadata.Affiliations) != 4 {
+		t.Fatalf("Unexpected metadata without attributes: %+v", metadata)
+	}
+
+	registrar := newTestRegistrar(t, map[string]string{RegistrarRolesAttr: "user"})
+	first, err := ca.services.GetRegistrationMetadata(registrar)
+	if err != nil {
+		t.Fatalf("GetRegistrationMetadata returned error: %v", err)
+	}
+	second, err := ca.services.GetRegistrationMetadata(registrar)
+	if err != nil || first.ETag() != second.ETag() || first.ETag() == metadata.ETag() {
+		t.Fatalf("Expected the ETag to identify the metadata: %v", err)
+	}
+	if _, err := ca.services.GetRegistrationMetadata(nil); err == nil {
+		t.Fatalf("Expected an error with a nil registrar")
+	}
+}
+
+func TestGetCertAttributes(t *testing.T) {
+	registrar := newTestRegistrar(t, map[string]string{"hf.EnrollmentID": "admin", "role": "auditor"})
+	attrs, err := GetCertAttributes(registrar.GetEnrollmentCertificate())
+	if err != nil {
+		t.Fatalf("GetCertAttributes returned error: %v", err)
+	}
+	if !reflect.DeepEqual(attrs, map[string]string{"hf.EnrollmentID": "admin", "role": "auditor"}) {
+		t.Fatalf("Unexpected attributes %v", attrs)
+	}
+
+	// A certificate without attribute extension has no attributes
+	user := newTestUser(t, "user1", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	attrs, err = GetCertAttributes(user.GetEnrollmentCertificate())
+	if err != nil || attrs == nil || len(attrs) != 0 {
+		t.Fatalf("Expected an empty map without attribute extension, got %v, %v", attrs, err)
+	}
+
+	invalid := newTestUserWithTemplate(t, &x509.Certificate{
+		Subject:         pkix.Name{CommonName: "user2"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: CertAttributesOID, Value: []byte("attrs")}},
+	})
+	if _, err := GetCertAttributes(invalid.GetEnrollmentCertificate()); err == nil {
+		t.Fatalf("Expected an error for an invalid attribute extension")
+	}
+	if _, err := GetCertAttributes([]byte("not a certificate")); err == nil {
+		t.Fatalf("Expected an error for an invalid certificate")
+	}
+}
+
+// newTestRegistrar creates a registrar whose certificate embeds attrs
+func newTestRegistrar(t *testing.T, attrs map[string]string) fabricclient.User {
+	value, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+	if err != nil {
+		t.Fatalf("Error marshalling attributes: %v", err)
+	}
+	return newTestUserWithTemplate(t, &x509.Certificate{
+		Subject:         pkix.Name{CommonName: "admin"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: CertAttributesOID, Value: value}},
+	})
+}
+
+func TestRegisterRegistrar(t *testing.T) {
+	var registered map[string]caAttribute
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			var request struct {
+				Attributes []caAttribute `json:"attrs"`
+			}
+			json.Unmarshal(body, &request)
+			registered = make(map[string]caAttribute)
+			for _, attr := range request.Attributes {
+				registered[attr.Name] = attr
+			}
+			return map[string]interface{}{"secret": "registrar1pw"}, http.StatusOK
+		},
+		"identities": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{"id": "admin", "type": "client", "affiliation": "",
+				"attrs": []map[string]string{{"name": RegistrarRolesAttr, "value": "client"}}}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	registrar := newTestRegistrar(t, map[string]string{
+		RegistrarRolesAttr:         "client,peer,user",
+		RegistrarDelegateRolesAttr: "client,peer",
+		RegistrarAffiliationsAttr:  "org1",
+		RevokerAttr:                "true",
+	})
+	request := &RegistrarRegistrationRequest{
+		RegistrationRequest: RegistrationRequest{Name: "registrar1", Type: "client",
+			Affiliation: "org1.department1", Attributes: []Attribute{{Key: "team", Value: "ops"}}},
+		AllowedRoles:        []string{"client", "peer"},
+		AllowedAffiliations: []string{"org1.department1"},
+		CanRevoke:           true,
+		DelegateRoles:       []string{"client"},
+	}
+	secret, err := ca.services.RegisterRegistrar(registrar, request)
+	if err != nil || secret != "registrar1pw" {
+		t.Fatalf("RegisterRegistrar returned %s, error: %v", secret, err)
+	}
+	expected := map[string]caAttribute{
+		"team":                     {Name: "team", Value: "ops"},
+		RegistrarRolesAttr:         {Name: RegistrarRolesAttr, Value: "client,peer", ECert: true},
+		RegistrarDelegateRolesAttr: {Name: RegistrarDelegateRolesAttr, Value: "client", ECert: true},
+		RegistrarAffiliationsAttr:  {Name: RegistrarAffiliationsAttr, Value: "org1.department1", ECert: true},
+		RevokerAttr:                {Name: RevokerAttr, Value: "true", ECert: true},
+		GenCRLAttr:                 {Name: GenCRLAttr, Value: "false", ECert: true},
+	}
+	if !reflect.DeepEqual(registered, expected) {
+		t.Fatalf("Unexpected registered attributes %v", registered)
+	}
+
+	// The registrar can't grant more than it has
+	escalations := []struct {
+		modify  func(request *RegistrarRegistrationRequest)
+		message string
+	}{
+		{func(r *RegistrarRegistrationRequest) { r.AllowedRoles = []string{"client", "user"} }, "role user"},
+		{func(r *RegistrarRegistrationRequest) { r.AllowedRoles = []string{"*"} }, "role *"},
+		{func(r *RegistrarRegistrationRequest) { r.AllowedAffiliations = []string{"org2"} }, "affiliation org2"},
+		{func(r *RegistrarRegistrationRequest) { r.AllowedAffiliations = nil }, "unrestricted affiliations"},
+		{func(r *RegistrarRegistrationRequest) { r.CanGenCRL = true }, GenCRLAttr},
+	}
+	for _, escalation := range escalations {
+		registered = nil
+		modified := *request
+		escalation.modify(&modified)
+		_, err := ca.services.RegisterRegistrar(registrar, &modified)
+		if !errors.Is(err, ErrPermissionDenied) || !strings.Contains(err.Error(), escalation.message) {
+			t.Fatalf("RegisterRegistrar should have denied granting %s, got: %v", escalation.message, err)
+		}
+		if registered != nil {
+			t.Fatalf("Denied registrations should not be sent to the CA")
+		}
+	}
+
+	// Without attributes in its certificate, the capabilities of the
+	// registrar are those of its registered identity
+	user := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	_, err = ca.services.RegisterRegistrar(user, request)
+	if !errors.Is(err, ErrPermissionDenied) || !strings.Contains(err.Error(), "role peer") {
+		t.Fatalf("RegisterRegistrar should have denied granting role peer, got: %v", err)
+	}
+
+	invalid := []*RegistrarRegistrationRequest{
+		{RegistrationRequest: RegistrationRequest{Name: "registrar2"}},
+		{RegistrationRequest: RegistrationRequest{Name: "registrar2"}, AllowedRoles: []string{"client"},
+			DelegateRoles: []string{"peer"}},
+		{RegistrationRequest: RegistrationRequest{Name: "registrar2",
+			Attributes: []Attribute{{Key: RevokerAttr, Value: "true"}}}, AllowedRoles: []string{"client"}},
+	}
+	for _, request := range invalid {
+		var validationErr *ValidationError
+		if _, err := ca.services.RegisterRegistrar(registrar, request); !errors.As(err, &validationErr) {
+			t.Fatalf("RegisterRegistrar of %+v should have failed validation, got: %v", request, err)
+		}
+	}
+}
+
+func TestWithRegistrarProvider(t *testing.T) {
+	// The clock of the CA jumps an hour ahead once elapsed is set, expiring
+	// the certificate of the first registrar mid-run
+	var elapsed, registrations int32
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			cert, err := util.VerifyToken(bccspFactory.GetDefault(), r.Header.Get("authorization"), body)
+			if err != nil {
+				return "Authorization failure", http.StatusUnauthorized
+			}
+			now := time.Now()
+			if atomic.LoadInt32(&elapsed) == 1 {
+				now = now.Add(time.Hour)
+			}
+			if now.After(cert.NotAfter) {
+				return "Authorization failure", http.StatusUnauthorized
+			}
+			atomic.AddInt32(&registrations, 1)
+			return base64.StdEncoding.EncodeToString([]byte("user1pw")), http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	expiring := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(10*time.Minute))
+	renewed := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	var refreshes int
+	var provide RegistrarProvider = func() (fabricclient.User, error) {
+		refreshes++
+		return renewed, nil
+	}
+	WithRegistrarProvider(func() (fabricclient.User, error) {
+		return provide()
+	})(ca.services)
+	request := &RegistrationRequest{Name: "user1", Type: "user", Affiliation: "org1"}
+
+	if _, err := ca.services.Register(expiring, request); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if refreshes != 0 {
+		t.Fatalf("The registrar should not be refreshed while its credential is accepted")
+	}
+
+	atomic.StoreInt32(&elapsed, 1)
+	if _, err := ca.services.Register(expiring, request); err != nil {
+		t.Fatalf("Register should have succeeded with the refreshed registrar: %v", err)
+	}
+	if refreshes != 1 || registrations != 2 {
+		t.Fatalf("Expected 1 refresh and 2 registrations. Got: %d and %d", refreshes, registrations)
+	}
+
+	// The request is only sent once more
+	provide = func() (fabricclient.User, error) {
+		refreshes++
+		return expiring, nil
+	}
+	refreshes = 0
+	if _, err := ca.services.Register(expiring, request); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials for a refreshed registrar still expired. Got: %v", err)
+	}
+	if refreshes != 1 {
+		t.Fatalf("Expected the registrar to be refreshed once. Got: %d", refreshes)
+	}
+
+	provide = func() (fabricclient.User, error) {
+		return nil, fmt.Errorf("enrollment server down")
+	}
+	_, err := ca.services.Register(expiring, request)
+	if !errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "enrollment server down") {
+		t.Fatalf("Expected the rejection and the refresh failure. Got: %v", err)
+	}
+	provide = func() (fabricclient.User, error) {
+		return nil, nil
+	}
+	if _, err := ca.services.Register(expiring, request); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials without a refreshed registrar. Got: %v", err)
+	}
+
+	ca.services.registrarProvider = nil
+	if _, err := ca.services.Register(expiring, request); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Expected ErrInvalidCredentials without a RegistrarProvider. Got: %v", err)
+	}
+}
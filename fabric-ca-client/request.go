@@ -0,0 +1,427 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	cfsslapi "github.com/cloudflare/cfssl/api"
+
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/hyperledger/fabric-ca/util"
+	"github.com/hyperledger/fabric/bccsp"
+)
+
+// postEnrollment sends an enrollment request to an enrollment endpoint with
+// basic auth and returns the issued certificate. Transient failures are
+// retried with the retry policy
+func (fabricCAServices *services) postEnrollment(ctx context.Context, endpoint string,
+	enrollmentID string, enrollmentSecret string, req *enrollmentRequest) ([]byte, error) {
+	req.CAName = fabricCAServices.requestCAName(req.CAName)
+	body, err := util.Marshal(req, "SignRequest")
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	err = fabricCAServices.withRetry(ctx, func() error {
+		post, err := fabricCAServices.fabricCAClient.NewPost(endpoint, body)
+		if err != nil {
+			return err
+		}
+		post.SetBasicAuth(enrollmentID, enrollmentSecret)
+		result, err = fabricCAServices.sendPost(ctx, post)
+		return err
+	})
+	if err != nil {
+		return nil, withEnrollmentID(enrollmentID, err)
+	}
+	cert, err := decodeCertificate(result)
+	if err != nil {
+		return nil, err
+	}
+	fabricCAServices.warnIfNotYetValid(enrollmentID, cert)
+	return cert, nil
+}
+
+// decodeCertificate decodes the base64 encoded certificate of an enrollment
+// response
+func decodeCertificate(result interface{}) ([]byte, error) {
+	encoded, ok := result.(string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid response format from server: %v", result)
+	}
+	cert, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid response format from server: %s", err)
+	}
+	return cert, nil
+}
+
+// serverErrorMessage extracts the error message sent by the CA from an error
+func serverErrorMessage(err error) string {
+	var caErr *CAError
+	if errors.As(err, &caErr) {
+		return caErr.Message
+	}
+	return err.Error()
+}
+
+// decodeResult decodes the result of a CA response into the given structure
+func decodeResult(result interface{}, v interface{}) error {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("Invalid response format from server: %s", err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("Invalid response format from server: %s", err)
+	}
+	return nil
+}
+
+// signingIdentity is an identity Fabric CA requests are signed with
+type signingIdentity struct {
+	// name is the enrollment ID of the identity
+	name string
+	// cert is the PEM encoded enrollment certificate
+	cert []byte
+	// key is the private key of the enrollment certificate
+	key bccsp.Key
+	// csp is the BCCSP implementation requests are signed with
+	csp bccsp.BCCSP
+	// attrs are the attributes embedded in the enrollment certificate
+	attrs map[string]string
+	// registrar is set for the identities of registrars, which the
+	// RegistrarProvider refreshes
+	registrar bool
+}
+
+// send sends a request signed by identity to a CA endpoint with the given
+// HTTP method. The fabric-ca client only supports POST requests natively
+func (fabricCAServices *services) send(ctx context.Context, identity *signingIdentity,
+	method string, endpoint string, body []byte) (interface{}, error) {
+	return fabricCAServices.sendSigned(ctx, identity, method, endpoint, body, nil)
+}
+
+// sendStream sends a request signed by identity to a CA endpoint like send,
+// decoding the array field of the result of the response as it is received:
+// each element is passed to each, which stops the decoding by returning an
+// error
+func (fabricCAServices *services) sendStream(ctx context.Context, identity *signingIdentity,
+	method string, endpoint string, field string, each func(json.RawMessage) error) error {
+	_, err := fabricCAServices.sendSigned(ctx, identity, method, endpoint, nil,
+		func(status int, body io.Reader) error {
+			return decodeStream(status, body, field, each)
+		})
+	return err
+}
+
+// sendSigned sends a request signed by identity like sendRequest. When the CA
+// rejects the credential of a registrar and a RegistrarProvider is set, the
+// request is sent once more, signed by the registrar it returns
+func (fabricCAServices *services) sendSigned(ctx context.Context, identity *signingIdentity,
+	method string, endpoint string, body []byte,
+	stream func(status int, body io.Reader) error) (interface{}, error) {
+	req, err := fabricCAServices.newSignedRequest(identity, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	result, err := fabricCAServices.sendRequest(ctx, req, stream)
+	if err == nil || !identity.registrar || fabricCAServices.registrarProvider == nil ||
+		!errors.Is(err, ErrInvalidCredentials) {
+		return result, err
+	}
+	refreshed, refreshErr := fabricCAServices.refreshRegistrar(identity)
+	if refreshErr != nil {
+		return nil, fmt.Errorf("%w, and refreshing the registrar failed: %s", err, refreshErr)
+	}
+	if req, err = fabricCAServices.newSignedRequest(refreshed, method, endpoint, body); err != nil {
+		return nil, err
+	}
+	return fabricCAServices.sendRequest(ctx, req, stream)
+}
+
+// newSignedRequest creates a request signed by identity to a CA endpoint
+// with the given HTTP method
+func (fabricCAServices *services) newSignedRequest(identity *signingIdentity, method string,
+	endpoint string, body []byte) (*http.Request, error) {
+	req, err := fabricCAServices.fabricCAClient.NewPost(endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Method = method
+	token, err := identity.createToken(body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add token authorization header: %s", err)
+	}
+	req.Header.Set("authorization", token)
+	return req, nil
+}
+
+// checkKeyMatchesCert checks that key is the private key of the PEM encoded
+// certificate cert
+func checkKeyMatchesCert(key bccsp.Key, cert []byte) error {
+	x509Cert, err := fabric_ca.BytesToX509Cert(cert)
+	if err != nil {
+		return fmt.Errorf("Error parsing enrollment certificate: %s", err)
+	}
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		return fmt.Errorf("Error getting the public key of the private key: %s", err)
+	}
+	publicKeyBytes, err := publicKey.Bytes()
+	if err != nil {
+		return fmt.Errorf("Error marshalling the public key of the private key: %s", err)
+	}
+	if !bytes.Equal(publicKeyBytes, x509Cert.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("private key does not match certificate")
+	}
+	return nil
+}
+
+// createToken creates the authorization token of a request body, in the
+// format expected by the fabric-ca server
+func (identity *signingIdentity) createToken(body []byte) (string, error) {
+	x509Cert, err := fabric_ca.BytesToX509Cert(identity.cert)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := x509Cert.PublicKey.(*ecdsa.PublicKey); !ok {
+		return "", fmt.Errorf("Unsupported public key type %T, only ECDSA keys are supported: %w",
+			x509Cert.PublicKey, ErrKeyCannotSign)
+	}
+	b64cert := util.B64Encode(identity.cert)
+	digest, err := identity.csp.Hash([]byte(util.B64Encode(body)+"."+b64cert), &bccsp.SHAOpts{})
+	if err != nil {
+		return "", fmt.Errorf("Hash operation failed with error: %s", err)
+	}
+	signature, err := identity.csp.Sign(identity.key, digest, nil)
+	if err != nil {
+		return "", fmt.Errorf("BCCSP signature generation failed with error: %s", err)
+	}
+	if len(signature) == 0 {
+		return "", fmt.Errorf("BCCSP signature creation failed. Signature must be different than nil")
+	}
+	return b64cert + "." + util.B64Encode(signature), nil
+}
+
+// sendPost sends a request to the CA, bounded by ctx, with the HTTP client of
+// the Session of ctx if any, and returns the result of its response,
+// measured with the Metrics and unless failed fast by the circuit breaker.
+// Failures are returned as *CAError
+func (fabricCAServices *services) sendPost(ctx context.Context, req *http.Request) (interface{}, error) {
+	return fabricCAServices.sendRequest(ctx, req, nil)
+}
+
+// sendRequest sends a request to the CA like sendPost. When stream is set,
+// the body of a successful response is passed to it as it is received,
+// rather than read whole, and no result is returned
+func (fabricCAServices *services) sendRequest(ctx context.Context, req *http.Request,
+	stream func(status int, body io.Reader) error) (interface{}, error) {
+	httpClient, err := fabricCAServices.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	if client := sessionClient(ctx); client != nil {
+		httpClient = client
+	}
+	op := metricsOp(req)
+	breaker := fabricCAServices.breaker
+	if breaker != nil {
+		if err := breaker.allow(); err != nil {
+			fabricCAServices.metrics.IncCAError(op, errorCategory(err))
+			return nil, err
+		}
+	}
+	start := time.Now()
+	result, err := fabricCAServices.doPost(ctx, httpClient, req, stream)
+	fabricCAServices.metrics.ObserveCALatency(op, time.Since(start))
+	if err != nil {
+		fabricCAServices.metrics.IncCAError(op, errorCategory(err))
+	}
+	if breaker != nil {
+		if state, changed := breaker.record(ctx, err); changed && state == BreakerOpen {
+			fabricCAServices.logger.Warnf("CA requests suspended for %s after error: %s",
+				breaker.policy.Cooldown, err)
+		} else if changed && state == BreakerClosed {
+			fabricCAServices.logger.Infof("CA requests resumed")
+		}
+	}
+	return result, err
+}
+
+// doPost sends a request to the CA with httpClient and returns the result of
+// its response, or passes the body of a successful response to stream
+func (fabricCAServices *services) doPost(ctx context.Context, httpClient *http.Client,
+	req *http.Request, stream func(status int, body io.Reader) error) (interface{}, error) {
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, newTransportError(err)
+	}
+	defer resp.Body.Close()
+	if stream != nil && resp.StatusCode < 300 {
+		return nil, stream(resp.StatusCode, resp.Body)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newUnreachableError(err)
+	}
+	var body *cfsslapi.Response
+	if len(respBody) > 0 {
+		body = new(cfsslapi.Response)
+		if err := json.Unmarshal(respBody, body); err != nil {
+			if resp.StatusCode >= 300 {
+				return nil, newServerError(resp.StatusCode, 0, "")
+			}
+			return nil, fmt.Errorf("Failed to parse response: %s", err)
+		}
+		if len(body.Errors) > 0 {
+			return nil, newServerError(resp.StatusCode, body.Errors[0].Code, body.Errors[0].Message)
+		}
+	}
+	if resp.StatusCode >= 300 {
+		return nil, newServerError(resp.StatusCode, 0, "")
+	}
+	if body == nil {
+		return nil, nil
+	}
+	if !body.Success {
+		return nil, newServerError(resp.StatusCode, 0, "Server returned failure")
+	}
+	return body.Result, nil
+}
+
+// httpClient returns the HTTP client requests are sent to the CA with,
+// created on first use so that connections are reused across requests
+func (fabricCAServices *services) httpClient() (*http.Client, error) {
+	fabricCAServices.mu.Lock()
+	defer fabricCAServices.mu.Unlock()
+	if fabricCAServices.closed {
+		return nil, ErrClosed
+	}
+	if fabricCAServices.transport != nil {
+		return &http.Client{Transport: fabricCAServices.transport}, nil
+	}
+	if fabricCAServices.customClient != nil {
+		return fabricCAServices.customClient, nil
+	}
+	if fabricCAServices.client != nil {
+		return fabricCAServices.client, nil
+	}
+	connection := fabricCAServices.connection
+	dialer := &net.Dialer{Timeout: connection.ConnectTimeout, KeepAlive: connection.KeepAlive}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: connection.ConnectTimeout,
+		DisableKeepAlives:   connection.KeepAlive < 0,
+	}
+	config := fabricCAServices.fabricCAClient.Config
+	if config.TLS.Enabled {
+		if err := tls.AbsTLSClient(&config.TLS, fabricCAServices.fabricCAClient.HomeDir); err != nil {
+			return nil, err
+		}
+		// The system roots are trusted when no root certificate is configured
+		tlsConfig := &cryptotls.Config{}
+		if len(config.TLS.CertFilesList) > 0 {
+			var err error
+			if tlsConfig, err = tls.GetClientTLSConfig(&config.TLS); err != nil {
+				return nil, fmt.Errorf("Failed to get client TLS config: %s", err)
+			}
+			tlsConfig.Certificates = nil
+		}
+		// GetClientTLSConfig ignores client key pairs failing to load, which
+		// would only surface as a handshake failure with servers requiring
+		// mutual TLS
+		if config.TLS.Client.CertFile != "" || config.TLS.Client.KeyFile != "" {
+			clientCert, err := cryptotls.LoadX509KeyPair(config.TLS.Client.CertFile, config.TLS.Client.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to load client TLS certificate: %s", err)
+			}
+			tlsConfig.Certificates = []cryptotls.Certificate{clientCert}
+		}
+		tlsConfig.ServerName = fabricCAServices.serverNameOverride
+		if len(fabricCAServices.pinnedSHA256) > 0 {
+			tlsConfig.VerifyPeerCertificate = verifyPinnedCertificate(fabricCAServices.pinnedSHA256)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	var roundTripper http.RoundTripper = transport
+	if fabricCAServices.wrapTransport != nil {
+		roundTripper = fabricCAServices.wrapTransport(transport)
+	}
+	fabricCAServices.baseTransport = transport
+	fabricCAServices.client = &http.Client{Transport: roundTripper, Timeout: connection.RequestTimeout}
+	return fabricCAServices.client, nil
+}
+
+// WithHTTPClient sets the HTTP client requests are sent to the CA with, e.g.
+// to trust custom roots or go through a proxy. The client is used as is: the
+// connection settings of the CA config are not applied and creating the
+// Services fails when its TLS settings (tlsCACerts, the client key pair,
+// serverNameOverride or pinnedSHA256) are set, since they would be ignored.
+// Close does not close the connections of the client
+func WithHTTPClient(client *http.Client) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.customClient = client
+	}
+}
+
+// WithRoundTripper wraps the transport requests are sent to the CA with, e.g.
+// for tracing. The wrapped transport applies the TLS and connection settings
+// of the CA config, and the HTTP_PROXY environment variables
+func WithRoundTripper(wrap func(http.RoundTripper) http.RoundTripper) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.wrapTransport = wrap
+	}
+}
+
+// verifyPinnedCertificate creates a TLS verification callback rejecting
+// server certificates, already verified against the trusted roots, whose
+// SHA-256 fingerprint is not one of pins
+func verifyPinnedCertificate(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrCertificatePinMismatch
+		}
+		fingerprint := sha256.Sum256(rawCerts[0])
+		for _, pin := range pins {
+			if bytes.Equal(pin, fingerprint[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrCertificatePinMismatch, hex.EncodeToString(fingerprint[:]))
+	}
+}
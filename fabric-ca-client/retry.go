@@ -0,0 +1,133 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetryPolicy sets how Enroll, Register and Revoke requests failing with a
+// transient error, the CA being unreachable or a 5xx status, are retried.
+// Other failures, such as invalid credentials, are never retried. Register
+// is not idempotent: the CA may have registered the identity of a request
+// failing once sent, and a retry would then fail with ErrAlreadyRegistered,
+// losing the secret, so Register requests are only retried when the CA could
+// not be connected to
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of a request, including the
+	// first one. Requests are not retried when it is 1 or less
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry
+	BaseDelay time.Duration
+	// Multiplier is the factor the delay grows by after each retry, 1 when
+	// lower than 1
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, of each delay which is
+	// randomized, spreading the retries of concurrent clients
+	Jitter float64
+}
+
+// Option configures the Services created by NewFabricCAClient
+type Option func(*services)
+
+// WithRetryPolicy sets the policy transient failures of Enroll, Register and
+// Revoke requests are retried with, Register requests only when the CA could
+// not be connected to. Requests are not retried by default
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(fabricCAServices *services) {
+		fabricCAServices.retryPolicy = policy
+	}
+}
+
+// withRetry calls request until it succeeds, fails with an error which is
+// not transient, or the attempts of the retry policy are exhausted. The
+// error of the last attempt is returned
+func (fabricCAServices *services) withRetry(ctx context.Context, request func() error) error {
+	return fabricCAServices.withRetryIf(ctx, isRetryable, request)
+}
+
+// withRetryUnsent calls request like withRetry, only retrying the failures
+// raised before the request was sent, for requests which are not idempotent
+func (fabricCAServices *services) withRetryUnsent(ctx context.Context, request func() error) error {
+	return fabricCAServices.withRetryIf(ctx, isUnsent, request)
+}
+
+// withRetryIf calls request like withRetry, retrying the errors retryable
+// returns true for
+func (fabricCAServices *services) withRetryIf(ctx context.Context,
+	retryable func(context.Context, error) bool, request func() error) error {
+	policy := fabricCAServices.retryPolicy
+	delay := policy.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := request()
+		if err == nil || attempt >= policy.MaxAttempts || !retryable(ctx, err) {
+			return err
+		}
+		fabricCAServices.logger.Debugf("Retrying CA request after error: %s", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(policy.jittered(delay)):
+		}
+		if policy.Multiplier > 1 {
+			delay = time.Duration(float64(delay) * policy.Multiplier)
+		}
+	}
+}
+
+// jittered randomizes the Jitter fraction of delay
+func (policy RetryPolicy) jittered(delay time.Duration) time.Duration {
+	jitter := policy.Jitter
+	if jitter <= 0 {
+		return delay
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	return time.Duration(float64(delay) * (1 - jitter*rand.Float64()))
+}
+
+// isRetryable returns true for transient errors: the CA being unreachable or
+// responding with a 5xx status, unless ctx is done
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var caErr *CAError
+	if !errors.As(err, &caErr) {
+		return false
+	}
+	return caErr.Kind == ErrCAUnreachable ||
+		(caErr.StatusCode >= 500 && caErr.Kind != ErrEnrollmentLimitReached)
+}
+
+// isUnsent returns true for the errors of requests which were not sent, the
+// connection to the CA failing, unless ctx is done
+func isUnsent(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
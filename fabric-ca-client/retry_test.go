@@ -0,0 +1,237 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingTransport fails the first requests with the given failures, then
+// sends requests with the default transport
+type failingTransport struct {
+	failures []func() (*http.Response, error)
+	calls    int
+}
+
+func (transport *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.calls++
+	if transport.calls <= len(transport.failures) {
+		return transport.failures[transport.calls-1]()
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// connectionReset fails a request as a reset connection would
+func connectionReset() (*http.Response, error) {
+	return nil, fmt.Errorf("read: connection reset by peer")
+}
+
+// dialFailure fails a request as a refused connection would, before sending it
+func dialFailure() (*http.Response, error) {
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+}
+
+// statusResponse returns a function failing a request with status
+func statusResponse(status int) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return &http.Response{StatusCode: status, Header: make(http.Header),
+			Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+}
+
+func TestRetry(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString([]byte("user1pw")), http.StatusOK
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			return nil, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Multiplier: 2, Jitter: 0.5})(ca.services)
+
+	tests := []struct {
+		name     string
+		failures []func() (*http.Response, error)
+		request  func() error
+		calls    int
+		fails    bool
+	}{
+		{"enroll after transient failures", []func() (*http.Response, error){connectionReset, statusResponse(http.StatusServiceUnavailable)},
+			func() error { _, _, err := ca.services.Enroll("user1", "user1pw"); return err }, 3, false},
+		{"register after a dial failure", []func() (*http.Response, error){dialFailure},
+			func() error {
+				_, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1"})
+				return err
+			}, 2, false},
+		{"register after a server error", []func() (*http.Response, error){statusResponse(http.StatusInternalServerError)},
+			func() error {
+				_, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1"})
+				return err
+			}, 1, true},
+		{"register after a connection reset", []func() (*http.Response, error){connectionReset},
+			func() error {
+				_, err := ca.services.Register(registrar, &RegistrationRequest{Name: "user1", Affiliation: "org1"})
+				return err
+			}, 1, true},
+		{"revoke after a connection reset", []func() (*http.Response, error){connectionReset},
+			func() error { return ca.services.Revoke(registrar, &RevocationRequest{Name: "user1"}) }, 2, false},
+		{"enroll exhausting the attempts", []func() (*http.Response, error){connectionReset, connectionReset, connectionReset},
+			func() error { _, _, err := ca.services.Enroll("user1", "user1pw"); return err }, 3, true},
+		{"enroll with invalid credentials", []func() (*http.Response, error){statusResponse(http.StatusUnauthorized)},
+			func() error { _, _, err := ca.services.Enroll("user1", "wrongpw"); return err }, 1, true},
+	}
+	for _, test := range tests {
+		transport := &failingTransport{failures: test.failures}
+		ca.services.transport = transport
+		err := test.request()
+		if (err != nil) != test.fails {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if transport.calls != test.calls {
+			t.Fatalf("%s: expected %d attempts, got %d", test.name, test.calls, transport.calls)
+		}
+	}
+}
+
+// appliedThenUnavailable sends the first request with the default transport
+// and answers it with a 503, as a CA applying a request before failing would
+type appliedThenUnavailable struct {
+	calls int
+}
+
+func (transport *appliedThenUnavailable) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.calls++
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || transport.calls > 1 {
+		return resp, err
+	}
+	resp.Body.Close()
+	return statusResponse(http.StatusServiceUnavailable)()
+}
+
+func TestRetryRevokeAppliedBeforeFailure(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	crlDER := []byte("crl")
+	revoked := map[string]bool{}
+	var crlRequests int
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			var request map[string]interface{}
+			json.Unmarshal(body, &request)
+			name, _ := request["id"].(string)
+			if revoked[name] {
+				return "Identity " + name + " is already revoked", http.StatusBadRequest
+			}
+			revoked[name] = true
+			return map[string]interface{}{"RevokedCerts": []interface{}{}}, http.StatusOK
+		},
+		"gencrl": func(r *http.Request, body []byte) (interface{}, int) {
+			crlRequests++
+			crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+			return map[string]interface{}{"CRL": base64.StdEncoding.EncodeToString(crlPEM)}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})(ca.services)
+
+	transport := &appliedThenUnavailable{}
+	ca.services.transport = transport
+	if err := ca.services.Revoke(registrar, &RevocationRequest{Name: "user1"}); err != nil {
+		t.Fatalf("Revoke applied before a 503 should have succeeded, got: %v", err)
+	}
+	if transport.calls != 2 || !revoked["user1"] {
+		t.Fatalf("Expected the revocation to be applied and retried once, got %d attempts", transport.calls)
+	}
+
+	// The CRL of the applied attempt is generated again
+	transport = &appliedThenUnavailable{}
+	ca.services.transport = transport
+	crl, err := ca.services.RevokeWithCRL(registrar, &RevocationRequest{Name: "user2", GenCRL: true})
+	if err != nil {
+		t.Fatalf("RevokeWithCRL applied before a 503 should have succeeded, got: %v", err)
+	}
+	if string(crl) != string(crlDER) || crlRequests != 1 {
+		t.Fatalf("RevokeWithCRL returned wrong CRL %s after %d CRL requests", crl, crlRequests)
+	}
+
+	// Only retried attempts count an identity already revoked as success
+	transport = &appliedThenUnavailable{calls: 1}
+	ca.services.transport = transport
+	if err := ca.services.Revoke(registrar, &RevocationRequest{Name: "user1"}); !errors.Is(err, ErrAlreadyRevoked) {
+		t.Fatalf("Revoke should have failed with ErrAlreadyRevoked, got: %v", err)
+	}
+}
+
+func TestRetryDisabledByDefault(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{})
+	defer ca.Close()
+	transport := &failingTransport{failures: []func() (*http.Response, error){connectionReset}}
+	ca.services.transport = transport
+	if _, _, err := ca.services.Enroll("user1", "user1pw"); !errors.Is(err, ErrCAUnreachable) {
+		t.Fatalf("Enroll should have failed with ErrCAUnreachable, got: %v", err)
+	}
+	if transport.calls != 1 {
+		t.Fatalf("Expected a single attempt, got %d", transport.calls)
+	}
+}
+
+func TestRetryStopsWhenContextDone(t *testing.T) {
+	ca := newMockCA(t, map[string]mockCAHandler{})
+	defer ca.Close()
+	WithRetryPolicy(RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour})(ca.services)
+	transport := &failingTransport{failures: []func() (*http.Response, error){connectionReset}}
+	ca.services.transport = transport
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := ca.services.EnrollContext(ctx, "user1", "user1pw"); err == nil {
+		t.Fatalf("EnrollContext should have failed")
+	}
+	if transport.calls != 1 {
+		t.Fatalf("Expected a single attempt, got %d", transport.calls)
+	}
+}
+
+func TestNewFabricCAClientWithRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Second, Multiplier: 2, Jitter: 0.2}
+	fabricCAClient, err := NewFabricCAClient(WithRetryPolicy(policy), WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient returned error: %v", err)
+	}
+	if fabricCAClient.(*services).retryPolicy != policy {
+		t.Fatalf("NewFabricCAClient did not apply the retry policy")
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// Defaults of RotationPolicy
+const (
+	defaultRotationThreshold = 0.2
+	defaultRotationRetry     = time.Minute
+	defaultMaxRotationRetry  = time.Hour
+)
+
+// RotationPolicy sets when a RotationManager renews the certificate of its
+// user and how failed renewals are retried
+type RotationPolicy struct {
+	// Threshold is the fraction of the lifetime of the certificate left
+	// when it is renewed, between 0 and 1, 0.2 by default
+	Threshold float64
+	// RetryDelay is the delay before retrying a failed renewal, 1 minute by
+	// default. It doubles after each failure, up to MaxRetryDelay
+	RetryDelay time.Duration
+	// MaxRetryDelay bounds the delay between retries, 1 hour by default
+	MaxRetryDelay time.Duration
+	// Store, when set, persists the renewed identity in the format of
+	// LoadUser
+	Store StateStore
+	// StoreKey is the key the identity is stored under, the name of the
+	// user by default
+	StoreKey string
+	// OnRotate is called with the renewed user after each renewal, to reload
+	// whatever uses the previous certificate
+	OnRotate func(user fabricclient.User)
+	// OnError is called with the error of each failed scheduled renewal
+	OnError func(err error)
+}
+
+// RotationManager renews the certificate of a user with Reenroll before it
+// expires, once the Threshold fraction of its lifetime is left. Failed
+// renewals are retried with an exponential backoff until the certificate
+// expires, the user then having to enroll again
+type RotationManager struct {
+	ca     Services
+	policy RotationPolicy
+	// now and after read the clock and wait, replaced in tests
+	now   func() time.Time
+	after func(d time.Duration) <-chan time.Time
+	// rotate serializes the renewals
+	rotate sync.Mutex
+	// mu guards user and cert, its parsed certificate
+	mu   sync.Mutex
+	user fabricclient.User
+	cert *x509.Certificate
+	// stop stops the renewals, done is closed once they are stopped
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewRotationManager ...
+/**
+ * Create a RotationManager renewing the certificate of a user in the
+ * background until Close is called
+ * @param {Services} ca The CA the user is enrolled with
+ * @param {User} user The enrolled user
+ * @param {RotationPolicy} policy When the certificate is renewed, and where
+ * the renewed identity is stored and reported
+ * @returns {RotationManager} The started manager
+ * @returns {error} Error for an invalid policy, or a user without a valid
+ * certificate
+ */
+func NewRotationManager(ca Services, user fabricclient.User, policy RotationPolicy) (*RotationManager, error) {
+	manager, err := newRotationManager(ca, user, policy)
+	if err != nil {
+		return nil, err
+	}
+	go manager.run()
+	return manager, nil
+}
+
+// newRotationManager creates a RotationManager, without starting it
+func newRotationManager(ca Services, user fabricclient.User, policy RotationPolicy) (*RotationManager, error) {
+	if ca == nil {
+		return nil, fmt.Errorf("CA services are nil")
+	}
+	if user == nil || user.GetName() == "" {
+		return nil, fmt.Errorf("User is not enrolled")
+	}
+	cert, err := fabric_ca.BytesToX509Cert(user.GetEnrollmentCertificate())
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing enrollment certificate: %s", err)
+	}
+	if policy.Threshold < 0 || policy.Threshold >= 1 {
+		return nil, fmt.Errorf("Rotation threshold must be between 0 and 1, got %g", policy.Threshold)
+	}
+	if policy.Threshold == 0 {
+		policy.Threshold = defaultRotationThreshold
+	}
+	if policy.RetryDelay <= 0 {
+		policy.RetryDelay = defaultRotationRetry
+	}
+	if policy.MaxRetryDelay <= 0 {
+		policy.MaxRetryDelay = defaultMaxRotationRetry
+	}
+	if policy.StoreKey == "" {
+		policy.StoreKey = user.GetName()
+	}
+	return &RotationManager{
+		ca:     ca,
+		policy: policy,
+		now:    time.Now,
+		after:  time.After,
+		user:   user,
+		cert:   cert,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// User returns the user with the latest certificate
+func (manager *RotationManager) User() fabricclient.User {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	return manager.user
+}
+
+// RenewalTime returns the time the certificate of the user is renewed at
+func (manager *RotationManager) RenewalTime() time.Time {
+	cert := manager.certificate()
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Add(-time.Duration(float64(lifetime) * manager.policy.Threshold))
+}
+
+// Rotate ...
+/**
+ * Renew the certificate of the user now, regardless of its renewal time.
+ * The renewed identity is stored and reported to OnRotate
+ * @returns {User} The renewed user
+ * @returns {error} Error renewing or storing the identity, the previous
+ * certificate being kept
+ */
+func (manager *RotationManager) Rotate() (fabricclient.User, error) {
+	manager.rotate.Lock()
+	defer manager.rotate.Unlock()
+	user := manager.User()
+	keyPEM, cert, err := manager.ca.Reenroll(user)
+	if err != nil {
+		return nil, fmt.Errorf("Error renewing certificate of %s: %w", user.GetName(), err)
+	}
+	x509Cert, err := fabric_ca.BytesToX509Cert(cert)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing renewed certificate of %s: %s", user.GetName(), err)
+	}
+	renewed, err := newEnrolledUser(defaultCryptoSuite(), user.GetName(), keyPEM, cert)
+	if err != nil {
+		return nil, err
+	}
+	renewed.SetMspID(user.GetMspID())
+	if manager.policy.Store != nil {
+		if err := saveUser(renewed, keyPEM, manager.policy.StoreKey, manager.policy.Store); err != nil {
+			return nil, err
+		}
+	}
+	manager.mu.Lock()
+	manager.user = renewed
+	manager.cert = x509Cert
+	manager.mu.Unlock()
+	defaultLogger.Infof("Renewed certificate of %s, valid until %s", user.GetName(),
+		x509Cert.NotAfter.UTC().Format(time.RFC3339))
+	if manager.policy.OnRotate != nil {
+		manager.policy.OnRotate(renewed)
+	}
+	return renewed, nil
+}
+
+// Close stops the renewals, waiting for one in progress
+func (manager *RotationManager) Close() {
+	manager.stopOnce.Do(func() {
+		close(manager.stop)
+	})
+	<-manager.done
+}
+
+// run renews the certificate at its renewal time, retrying failed renewals
+// until the certificate expires or the manager is closed
+func (manager *RotationManager) run() {
+	defer close(manager.done)
+	var retryDelay time.Duration
+	for {
+		wait := retryDelay
+		if wait == 0 {
+			wait = manager.RenewalTime().Sub(manager.now())
+		}
+		select {
+		case <-manager.stop:
+			return
+		case <-manager.after(wait):
+		}
+		_, err := manager.Rotate()
+		if err == nil {
+			retryDelay = 0
+			continue
+		}
+		if manager.policy.OnError != nil {
+			manager.policy.OnError(err)
+		}
+		if expiry := manager.certificate().NotAfter; !manager.now().Before(expiry) {
+			defaultLogger.Errorf("Certificate of %s expired on %s, enroll again: %s", manager.User().GetName(),
+				expiry.UTC().Format(time.RFC3339), err)
+			return
+		}
+		retryDelay = manager.nextRetryDelay(retryDelay)
+		defaultLogger.Warnf("%s, retrying in %s", err, retryDelay)
+	}
+}
+
+// certificate returns the parsed certificate of the user
+func (manager *RotationManager) certificate() *x509.Certificate {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	return manager.cert
+}
+
+// nextRetryDelay returns the delay before the retry following one after
+// delay, 0 before the first retry
+func (manager *RotationManager) nextRetryDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		delay = manager.policy.RetryDelay
+	} else {
+		delay *= 2
+	}
+	if delay > manager.policy.MaxRetryDelay {
+		delay = manager.policy.MaxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,142 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric-sdk-go/fabric-client/keyvaluestore"
+)
+
+func TestRotationManager(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	var failing int32
+	issue := newIssuingHandler(t, func() (time.Time, time.Time) {
+		return start, start.Add(10 * time.Minute)
+	})
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"reenroll": func(r *http.Request, body []byte) (interface{}, int) {
+			if atomic.LoadInt32(&failing) == 1 {
+				return "Internal error", http.StatusInternalServerError
+			}
+			return issue(r, body)
+		},
+	})
+	defer ca.Close()
+
+	if _, err := newRotationManager(ca.services, newTestUser(t, "user1", start, start.Add(time.Hour)),
+		RotationPolicy{Threshold: 1}); err == nil {
+		t.Fatalf("Expected an error for a threshold of 1")
+	}
+
+	// The certificate has 6 of its 10 minutes of lifetime left
+	user := newTestUser(t, "user1", start.Add(-4*time.Minute), start.Add(6*time.Minute))
+	store := keyvaluestore.CreateNewMemoryKeyValueStore()
+	rotated := make(chan fabricclient.User, 1)
+	failures := make(chan error, 1)
+	manager, err := newRotationManager(ca.services, user, RotationPolicy{
+		RetryDelay:    time.Second,
+		MaxRetryDelay: 3 * time.Second,
+		Store:         store,
+		StoreKey:      "user1.ecert",
+		OnRotate:      func(user fabricclient.User) { rotated <- user },
+		OnError:       func(err error) { failures <- err },
+	})
+	if err != nil {
+		t.Fatalf("newRotationManager returned error: %v", err)
+	}
+	var clockMu sync.Mutex
+	now := start
+	manager.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}
+	waits := make(chan time.Duration)
+	fire := make(chan time.Time)
+	manager.after = func(d time.Duration) <-chan time.Time {
+		waits <- d
+		return fire
+	}
+	go manager.run()
+
+	// Renewed once 20% of the lifetime, 2 minutes, is left
+	if wait := <-waits; wait != 4*time.Minute {
+		t.Fatalf("Expected the certificate to be renewed in 4m, got %s", wait)
+	}
+	fire <- start
+	renewed := <-rotated
+	if bytes.Equal(renewed.GetEnrollmentCertificate(), user.GetEnrollmentCertificate()) ||
+		manager.User() != renewed {
+		t.Fatalf("Expected the user to be renewed")
+	}
+	stored, err := LoadUser("user1.ecert", store)
+	if err != nil || !bytes.Equal(stored.GetEnrollmentCertificate(), renewed.GetEnrollmentCertificate()) {
+		t.Fatalf("Expected the renewed identity to be stored: %v", err)
+	}
+	if wait := <-waits; wait != 8*time.Minute {
+		t.Fatalf("Expected the renewed certificate to be renewed in 8m, got %s", wait)
+	}
+
+	// Failed renewals are retried with a backoff, bounded by MaxRetryDelay
+	atomic.StoreInt32(&failing, 1)
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		fire <- start
+		if err := <-failures; err == nil {
+			t.Fatalf("Expected the renewal to fail")
+		}
+		if wait := <-waits; wait != expected {
+			t.Fatalf("Expected a retry in %s, got %s", expected, wait)
+		}
+	}
+	if manager.User() != renewed {
+		t.Fatalf("Expected the previous certificate to be kept after a failed renewal")
+	}
+	atomic.StoreInt32(&failing, 0)
+	fire <- start
+	<-rotated
+	if wait := <-waits; wait != 8*time.Minute {
+		t.Fatalf("Expected the backoff to be reset after a renewal, got %s", wait)
+	}
+
+	// Renewals stop once the certificate expired
+	atomic.StoreInt32(&failing, 1)
+	clockMu.Lock()
+	now = start.Add(10 * time.Minute)
+	clockMu.Unlock()
+	fire <- start
+	if err := <-failures; err == nil {
+		t.Fatalf("Expected the renewal to fail")
+	}
+	select {
+	case <-manager.done:
+	case <-waits:
+		t.Fatalf("Expected no retry once the certificate expired")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the renewals to stop once the certificate expired")
+	}
+	manager.Close()
+}
@@ -0,0 +1,96 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Schemes of the secret references resolved by ResolveSecret
+const (
+	// SecretRefEnv references a secret held by an environment variable,
+	// e.g. env:CA_SECRET
+	SecretRefEnv = "env:"
+	// SecretRefFile references a secret held by a file, e.g.
+	// file:/run/secrets/ca
+	SecretRefFile = "file:"
+	// SecretRefLiteral prefixes a literal secret, only needed for secrets
+	// starting with one of the schemes, e.g. literal:env:secret
+	SecretRefLiteral = "literal:"
+)
+
+// ResolveSecret ...
+/**
+ * Resolve a secret reference: the value of an environment variable for an
+ * env: reference, the content of a file without its trailing newlines for a
+ * file: reference, and the reference itself otherwise. Errors never include
+ * the secret
+ * @param {string} ref The secret reference
+ * @returns {string} The secret
+ */
+func ResolveSecret(ref string) (string, error) {
+	var secret string
+	switch {
+	case strings.HasPrefix(ref, SecretRefEnv):
+		name := strings.TrimPrefix(ref, SecretRefEnv)
+		secret = os.Getenv(name)
+		if secret == "" {
+			return "", fmt.Errorf("Secret environment variable %s is not set or empty", name)
+		}
+	case strings.HasPrefix(ref, SecretRefFile):
+		path := strings.TrimPrefix(ref, SecretRefFile)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Error reading secret file: %s", err)
+		}
+		// Secret mounts commonly end the secret with a newline
+		secret = strings.TrimRight(string(data), "\r\n")
+		if secret == "" {
+			return "", fmt.Errorf("Secret file %s is empty", path)
+		}
+	default:
+		secret = strings.TrimPrefix(ref, SecretRefLiteral)
+		if secret == "" {
+			return "", fmt.Errorf("Secret is empty")
+		}
+	}
+	return secret, nil
+}
+
+// EnrollWithSecretRef ...
+/**
+ * Enroll a registered user with the secret a reference resolves to, see
+ * ResolveSecret
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} secretRef The reference to the secret associated with the
+ * enrollment ID
+ * @returns {[]byte} private key, nil when keys are kept in an HSM
+ * @returns {[]byte} X509 certificate
+ */
+func (fabricCAServices *services) EnrollWithSecretRef(enrollmentID string, secretRef string) ([]byte, []byte, error) {
+	secret, err := ResolveSecret(secretRef)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Enroll failed: %w", err)
+	}
+	return fabricCAServices.Enroll(enrollmentID, secret)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret_test")
+	if err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeSecret := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Error writing secret file: %v", err)
+		}
+		return path
+	}
+	os.Setenv("SECRET_TEST_SECRET", "envpw")
+	defer os.Unsetenv("SECRET_TEST_SECRET")
+	os.Setenv("SECRET_TEST_EMPTY", "")
+	defer os.Unsetenv("SECRET_TEST_EMPTY")
+
+	for ref, expected := range map[string]string{
+		"userpw":                 "userpw",
+		"literal:env:userpw":     "env:userpw",
+		"env:SECRET_TEST_SECRET": "envpw",
+		"file:" + writeSecret("secret", "filepw\n"): "filepw",
+		"file:" + writeSecret("crlf", "filepw\r\n"): "filepw",
+		"file:" + writeSecret("space", " file pw "): " file pw ",
+	} {
+		secret, err := ResolveSecret(ref)
+		if err != nil {
+			t.Fatalf("ResolveSecret(%q) returned error: %v", ref, err)
+		}
+		if secret != expected {
+			t.Fatalf("ResolveSecret(%q) returned %q, expected %q", ref, secret, expected)
+		}
+	}
+	for _, ref := range []string{
+		"",
+		"literal:",
+		"env:SECRET_TEST_EMPTY",
+		"env:SECRET_TEST_UNSET",
+		"file:" + filepath.Join(dir, "missing"),
+		"file:" + writeSecret("empty", "\n"),
+	} {
+		if _, err := ResolveSecret(ref); err == nil {
+			t.Fatalf("ResolveSecret(%q) should have failed", ref)
+		}
+	}
+}
+
+func TestEnrollWithSecretRef(t *testing.T) {
+	var secrets []string
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			_, secret, _ := r.BasicAuth()
+			secrets = append(secrets, secret)
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+	})
+	defer ca.Close()
+	os.Setenv("SECRET_TEST_SECRET", "envpw")
+	defer os.Unsetenv("SECRET_TEST_SECRET")
+
+	if _, _, err := ca.services.EnrollWithSecretRef("user1", "env:SECRET_TEST_SECRET"); err != nil {
+		t.Fatalf("EnrollWithSecretRef returned error: %v", err)
+	}
+	_, _, err := ca.services.EnrollWithSecretRef("user1", "env:SECRET_TEST_UNSET")
+	if err == nil || !strings.Contains(err.Error(), "SECRET_TEST_UNSET") {
+		t.Fatalf("EnrollWithSecretRef should have failed for an unset variable, got: %v", err)
+	}
+	if len(secrets) != 1 || secrets[0] != "envpw" {
+		t.Fatalf("Expected a single enrollment with the resolved secret, got %v", secrets)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"net/http"
+
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+)
+
+// Session sends a batch of operations to the CA over a connection of its
+// own, kept open between the operations and closed by Close, e.g. to
+// register and enroll identities without a TLS handshake per request when
+// the connection config disables keep-alives. A Session is meant to be used
+// by one goroutine and must not be shared for concurrent use: its
+// operations then share its single idle connection and open new ones.
+// Sessions opened on Services created with WithHTTPClient send their
+// requests with that client
+type Session interface {
+	// Enroll enrolls a registered user, see Services.Enroll
+	Enroll(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error)
+	// Register registers a User with the Fabric CA, see Services.Register
+	Register(registrar fabricclient.User, request *RegistrationRequest) (string, error)
+	// Close closes the connection of the Session. Operations then fail
+	// with ErrClosed
+	Close() error
+}
+
+// sessionKey is the context key of the HTTP client of a Session
+type sessionKey struct{}
+
+// sessionClient returns the HTTP client of the Session ctx was created by,
+// nil outside of a Session
+func sessionClient(ctx context.Context) *http.Client {
+	client, _ := ctx.Value(sessionKey{}).(*http.Client)
+	return client
+}
+
+// session is the Session of services
+type session struct {
+	services *services
+	// client sends the requests of the session
+	client *http.Client
+	// transport is the transport of client, nil when client is shared
+	// with the Services
+	transport *http.Transport
+	closed    bool
+}
+
+// OpenSession opens a Session sending its operations over a connection of
+// its own. The Session must be closed once the operations are done: its
+// operations fail with ErrClosed once the Services are closed, but its
+// connection is only closed by its Close
+// @returns {Session} The session
+// @returns {error} Error
+func (fabricCAServices *services) OpenSession() (Session, error) {
+	client, err := fabricCAServices.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	fabricCAServices.mu.Lock()
+	defer fabricCAServices.mu.Unlock()
+	s := &session{services: fabricCAServices, client: client}
+	if fabricCAServices.baseTransport == nil {
+		return s, nil
+	}
+	// The connection is kept until the session is closed, even when
+	// keep-alives are disabled for the requests of the Services
+	s.transport = fabricCAServices.baseTransport.Clone()
+	s.transport.DisableKeepAlives = false
+	s.transport.MaxIdleConnsPerHost = 1
+	var roundTripper http.RoundTripper = s.transport
+	if fabricCAServices.wrapTransport != nil {
+		roundTripper = fabricCAServices.wrapTransport(s.transport)
+	}
+	s.client = &http.Client{Transport: roundTripper, Timeout: client.Timeout}
+	return s, nil
+}
+
+// operationContext returns the context the operations of the session are
+// sent with, bounded by the default timeout of the Services
+func (s *session) operationContext() (context.Context, context.CancelFunc, error) {
+	if s.closed {
+		return nil, nil, ErrClosed
+	}
+	ctx, cancel := s.services.defaultContext()
+	return context.WithValue(ctx, sessionKey{}, s.client), cancel, nil
+}
+
+// Enroll enrolls a registered user over the connection of the session
+func (s *session) Enroll(enrollmentID string, enrollmentSecret string) ([]byte, []byte, error) {
+	ctx, cancel, err := s.operationContext()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cancel()
+	return s.services.EnrollContext(ctx, enrollmentID, enrollmentSecret)
+}
+
+// Register registers a User with the Fabric CA over the connection of the
+// session
+func (s *session) Register(registrar fabricclient.User, request *RegistrationRequest) (string, error) {
+	ctx, cancel, err := s.operationContext()
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+	return s.services.RegisterContext(ctx, registrar, request)
+}
+
+// Close closes the connection of the session
+func (s *session) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.transport != nil {
+		s.transport.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-sdk-go/config"
+)
+
+// newSessionTestCA starts a fake fabric-ca server over TLS, with keep-alives
+// disabled for the requests of its Services, registering identities and
+// collecting the addresses of the connections of the requests in remoteAddrs
+func newSessionTestCA(t testing.TB, mu *sync.Mutex, remoteAddrs map[string]bool) *mockCA {
+	ca := newMockTLSCA(t, map[string]mockCAHandler{
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			mu.Lock()
+			remoteAddrs[r.RemoteAddr] = true
+			mu.Unlock()
+			return map[string]interface{}{"secret": "user1password"}, http.StatusOK
+		},
+	})
+	ca.services.connection = config.FabricCAConnectionConfig{KeepAlive: -1}
+	return ca
+}
+
+func TestOpenSession(t *testing.T) {
+	var mu sync.Mutex
+	remoteAddrs := map[string]bool{}
+	ca := newSessionTestCA(t, &mu, remoteAddrs)
+	defer ca.Close()
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+
+	session, err := ca.services.OpenSession()
+	if err != nil {
+		t.Fatalf("OpenSession returned error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		request := &RegistrationRequest{Name: fmt.Sprintf("user%d", i), Affiliation: "org1"}
+		if _, err := session.Register(registrar, request); err != nil {
+			t.Fatalf("Register returned error: %v", err)
+		}
+	}
+	if len(remoteAddrs) != 1 {
+		t.Fatalf("Expected the session to reuse its connection, got %d connections", len(remoteAddrs))
+	}
+	if err := session.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	_, err = session.Register(registrar, &RegistrationRequest{Name: "user3", Affiliation: "org1"})
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("Register should have failed with ErrClosed, got: %v", err)
+	}
+
+	// Outside of a session, each request opens a connection
+	for i := 0; i < 2; i++ {
+		request := &RegistrationRequest{Name: fmt.Sprintf("user%d", i), Affiliation: "org1"}
+		if _, err := ca.services.Register(registrar, request); err != nil {
+			t.Fatalf("Register returned error: %v", err)
+		}
+	}
+	if len(remoteAddrs) != 3 {
+		t.Fatalf("Expected a connection per request outside of the session, got %d connections", len(remoteAddrs))
+	}
+
+	ca.services.Close()
+	if _, err := ca.services.OpenSession(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("OpenSession should have failed with ErrClosed, got: %v", err)
+	}
+}
+
+func BenchmarkRegister(b *testing.B) {
+	var mu sync.Mutex
+	ca := newSessionTestCA(b, &mu, map[string]bool{})
+	defer ca.Close()
+	registrar := newTestUser(b, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	request := &RegistrationRequest{Name: "user1", Affiliation: "org1"}
+
+	b.Run("PerCall", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := ca.services.Register(registrar, request); err != nil {
+				b.Fatalf("Register returned error: %v", err)
+			}
+		}
+	})
+	b.Run("Session", func(b *testing.B) {
+		session, err := ca.services.OpenSession()
+		if err != nil {
+			b.Fatalf("OpenSession returned error: %v", err)
+		}
+		defer session.Close()
+		for i := 0; i < b.N; i++ {
+			if _, err := session.Register(registrar, request); err != nil {
+				b.Fatalf("Register returned error: %v", err)
+			}
+		}
+	})
+}
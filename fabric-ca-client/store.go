@@ -0,0 +1,361 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-sdk-go/config"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric/bccsp"
+)
+
+// StateStore persists enrolled identities. It matches the KeyValueStore the
+// client loads users from, keyvaluestore.FileKeyValueStore keeps them on the
+// filesystem and keyvaluestore.MemoryKeyValueStore in memory
+type StateStore interface {
+	SetValue(key string, value []byte) error
+	GetValue(key string) ([]byte, error)
+}
+
+// EnrollAndStore ...
+/**
+ * Enroll a registered user and persist the resulting identity in the store
+ * under the enrollment ID, in the format the client loads users from with
+ * GetUserContext. The private key is imported in the crypto suite and stored
+ * PEM encoded alongside the certificate, unless it is kept in an HSM: only
+ * its SKI and the label of the HSM token are then stored
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @param {StateStore} store The store the identity is persisted in
+ * @returns {User} enrolled user
+ */
+func (fabricCAServices *services) EnrollAndStore(enrollmentID string, enrollmentSecret string,
+	store StateStore) (fabricclient.User, error) {
+	if store == nil {
+		return nil, fmt.Errorf("State store is nil")
+	}
+	keyPEM, cert, err := fabricCAServices.Enroll(enrollmentID, enrollmentSecret)
+	if err != nil {
+		return nil, err
+	}
+	return fabricCAServices.storeEnrollment(enrollmentID, enrollmentID, "", keyPEM, cert, store)
+}
+
+// EnrollIdentityAndStore ...
+/**
+ * Enroll a registered user like EnrollIdentity and persist the resulting
+ * identity in the store under the enrollment ID, like EnrollAndStore, with
+ * the MSP ID. The stored user is loaded for its MSP by LoadUserForMSP, and
+ * the users loaded by LoadUser or the client report the MSP ID with
+ * GetMspID. Users of the same name in several MSPs must be kept in separate
+ * stores
+ * @param {string} mspID The ID of the MSP the identity belongs to
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @param {StateStore} store The store the identity is persisted in
+ * @returns {User} enrolled user
+ */
+func (fabricCAServices *services) EnrollIdentityAndStore(mspID string, enrollmentID string,
+	enrollmentSecret string, store StateStore) (fabricclient.User, error) {
+	if store == nil {
+		return nil, fmt.Errorf("State store is nil")
+	}
+	identity, err := fabricCAServices.EnrollIdentity(mspID, enrollmentID, enrollmentSecret)
+	if err != nil {
+		return nil, err
+	}
+	return fabricCAServices.storeEnrollment(enrollmentID, enrollmentID, identity.MSPID, identity.Key,
+		identity.Cert, store)
+}
+
+// ProfileEnrollment is the result of the enrollment with one profile of an
+// EnrollAll call
+type ProfileEnrollment struct {
+	// Key is the key the identity is stored under, see ProfileKey
+	Key string
+	// User is the enrolled user, nil when the enrollment failed
+	User fabricclient.User
+	// Err is the error the enrollment failed with, nil on success
+	Err error
+	// NotYetValid is set when the validity of the certificate starts after
+	// the local clock beyond the clock skew tolerance, see
+	// WithClockSkewTolerance
+	NotYetValid *CertNotYetValid
+}
+
+// ProfileKey returns the key EnrollAll stores the identity enrolled with a
+// profile under, e.g. user1.tls
+func ProfileKey(enrollmentID string, profile string) string {
+	return enrollmentID + "." + profile
+}
+
+// EnrollAll ...
+/**
+ * Enroll a registered user once per CA signing profile, e.g. ECertProfile and
+ * TLSProfile, and persist each identity in the store under its ProfileKey,
+ * like EnrollAndStore. Each enrollment uses the secret once, the identity
+ * must be registered with enough MaxEnrollments. Enrollments continue past
+ * the profiles which fail, the error of each is reported in its result
+ * @param {string} enrollmentID The registered ID to use for enrollment
+ * @param {string} enrollmentSecret The secret associated with the enrollment ID
+ * @param {[]string} profiles The profiles to enroll with, ECertProfile for
+ * the CA's default profile
+ * @param {StateStore} store The store the identities are persisted in
+ * @returns {map[string]*ProfileEnrollment} A result per profile
+ * @returns {error} Error preventing any enrollment, like a missing store
+ */
+func (fabricCAServices *services) EnrollAll(enrollmentID string, enrollmentSecret string, profiles []string,
+	store StateStore) (map[string]*ProfileEnrollment, error) {
+	if store == nil {
+		return nil, fmt.Errorf("State store is nil")
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("No profile to enroll with")
+	}
+	results := make(map[string]*ProfileEnrollment, len(profiles))
+	for _, profile := range profiles {
+		if profile == "" {
+			return nil, fmt.Errorf("Profile name is empty")
+		}
+		if results[profile] != nil {
+			return nil, fmt.Errorf("Profile %s is listed more than once", profile)
+		}
+		results[profile] = &ProfileEnrollment{Key: ProfileKey(enrollmentID, profile)}
+	}
+	for _, profile := range profiles {
+		result := results[profile]
+		opts := &EnrollmentOptions{Profile: profile, Label: fabricCAServices.tokenLabel}
+		if profile == ECertProfile {
+			opts.Profile = ""
+		}
+		keyPEM, cert, err := fabricCAServices.EnrollWithOptions(enrollmentID, enrollmentSecret, opts)
+		if err != nil {
+			result.Err = fmt.Errorf("Enrollment with profile %s failed: %w", profile, err)
+			continue
+		}
+		result.NotYetValid = fabricCAServices.notYetValid(cert)
+		result.User, result.Err = fabricCAServices.storeEnrollment(enrollmentID, result.Key, "", keyPEM, cert,
+			store)
+	}
+	return results, nil
+}
+
+// storeEnrollment imports the key of an enrollment in the crypto suite and
+// persists the enrolled identity of the MSP mspID, empty when unknown, in the
+// store under key
+func (fabricCAServices *services) storeEnrollment(enrollmentID string, key string, mspID string,
+	keyPEM []byte, cert []byte, store StateStore) (fabricclient.User, error) {
+	user, err := newEnrolledUser(fabricCAServices.cryptoSuite(), enrollmentID, keyPEM, cert)
+	if err != nil {
+		return nil, err
+	}
+	user.SetMspID(mspID)
+	if err := saveUser(user, keyPEM, key, store); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// newEnrolledUser imports the key of an enrollment in the crypto suite and
+// creates the enrolled user
+func newEnrolledUser(csp bccsp.BCCSP, enrollmentID string, keyPEM []byte,
+	cert []byte) (fabricclient.User, error) {
+	privateKey, err := importEnrollmentKey(csp, keyPEM, cert)
+	if err != nil {
+		return nil, fmt.Errorf("Error importing enrollment key: %w", err)
+	}
+	user := fabricclient.NewUser(enrollmentID)
+	user.SetEnrollmentCertificate(cert)
+	user.SetPrivateKey(privateKey)
+	return user, nil
+}
+
+// saveUser persists an enrolled user in the store under key, in the format
+// of LoadUser, with its PEM encoded private key and MSP ID. When the PKCS11 provider is
+// configured only the certificate and a reference to the key in the HSM
+// token, its SKI and the token label, are stored
+func saveUser(user fabricclient.User, keyPEM []byte, key string, store StateStore) error {
+	userJSON := &fabricclient.UserJSON{PrivateKeySKI: user.GetPrivateKey().SKI(),
+		EnrollmentCertificate: user.GetEnrollmentCertificate(), PrivateKey: keyPEM, MspID: user.GetMspID()}
+	if label, ok := hsmTokenLabel(); ok {
+		if keyPEM != nil {
+			return fmt.Errorf("Refusing to store the private key of %s outside of HSM token %s: %w",
+				user.GetName(), label, ErrKeyNotExportable)
+		}
+		userJSON.KeyLabel = label
+	}
+	data, err := json.Marshal(userJSON)
+	if err != nil {
+		return fmt.Errorf("Marshal json return error: %v", err)
+	}
+	if err := store.SetValue(key, data); err != nil {
+		return fmt.Errorf("Error storing identity of %s: %s", user.GetName(), err)
+	}
+	return nil
+}
+
+// hsmTokenLabel returns the label of the HSM token of the configured PKCS11
+// provider, false when keys are not kept in an HSM
+func hsmTokenLabel() (string, bool) {
+	if config.GetSecurityProvider() != PKCS11Provider {
+		return "", false
+	}
+	return config.GetSecurityProviderLabel(), true
+}
+
+// importEnrollmentKey imports the PEM encoded private key returned by an
+// enrollment in the crypto suite. Without a key, the key kept in the crypto
+// suite is looked up by the SKI of the enrollment certificate
+func importEnrollmentKey(csp bccsp.BCCSP, keyPEM []byte, cert []byte) (bccsp.Key, error) {
+	if keyPEM == nil {
+		x509Cert, err := fabric_ca.BytesToX509Cert(cert)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := csp.KeyImport(x509Cert, &bccsp.X509PublicKeyImportOpts{Temporary: true})
+		if err != nil {
+			return nil, err
+		}
+		return csp.GetKey(publicKey.SKI())
+	}
+	return importPrivateKey(csp, keyPEM)
+}
+
+// importPrivateKey imports a PEM encoded ecdsa private key in the crypto
+// suite, rsa keys failing with ErrKeyCannotSign
+func importPrivateKey(csp bccsp.BCCSP, keyPEM []byte) (bccsp.Key, error) {
+	if block, _ := pem.Decode(keyPEM); block != nil && isRSAKey(block) {
+		return nil, fmt.Errorf("rsa keys are only supported for enrollments which are not stored, "+
+			"the BCCSP imports ecdsa keys only: %w", ErrKeyCannotSign)
+	}
+	return fabricclient.ImportPrivateKey(csp, keyPEM)
+}
+
+// isRSAKey returns true for a PKCS1 or PKCS8 rsa private key
+func isRSAKey(block *pem.Block) bool {
+	if block.Type == "RSA PRIVATE KEY" {
+		return true
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return false
+	}
+	_, ok := key.(*rsa.PrivateKey)
+	return ok
+}
+
+// LoadUser ...
+/**
+ * Load a user persisted by EnrollAndStore, or by the client, from the store
+ * so that it can sign requests, e.g. as the registrar of Register or Revoke.
+ * The private key is imported in the default crypto suite when stored PEM
+ * encoded, otherwise it is looked up by its SKI, like keys kept in an HSM.
+ * Keys stored with the label of an HSM token are only looked up in that
+ * token, it must be the configured PKCS11 token. The user reports the stored
+ * MSP ID, if any, with GetMspID
+ * @param {string} name The name the user is stored under
+ * @param {StateStore} store The store the user is loaded from
+ * @returns {User} loaded user
+ * @returns {error} Error matching ErrNotEnrolled with errors.Is when the
+ * stored user has no certificate or key
+ */
+func LoadUser(name string, store StateStore) (fabricclient.User, error) {
+	return loadUser(name, "", store)
+}
+
+// LoadUserForMSP ...
+/**
+ * Load a user persisted by EnrollIdentityAndStore like LoadUser, checking
+ * that it was stored for the MSP mspID
+ * @param {string} mspID The ID of the MSP the user belongs to
+ * @param {string} name The name the user is stored under
+ * @param {StateStore} store The store the user is loaded from
+ * @returns {User} loaded user
+ * @returns {error} Error matching ErrMSPIDMismatch with errors.Is when the
+ * user is stored for another MSP, or without MSP ID
+ */
+func LoadUserForMSP(mspID string, name string, store StateStore) (fabricclient.User, error) {
+	if mspID == "" {
+		return nil, fmt.Errorf("MSP ID is empty")
+	}
+	return loadUser(name, mspID, store)
+}
+
+// loadUser loads the user stored under name, of the MSP mspID unless empty
+func loadUser(name string, mspID string, store StateStore) (fabricclient.User, error) {
+	if store == nil {
+		return nil, fmt.Errorf("State store is nil")
+	}
+	value, err := store.GetValue(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading user %s: %w", name, err)
+	}
+	var userJSON fabricclient.UserJSON
+	if err := json.Unmarshal(value, &userJSON); err != nil {
+		return nil, fmt.Errorf("Error decoding user %s: %s", name, err)
+	}
+	if len(userJSON.EnrollmentCertificate) == 0 {
+		return nil, fmt.Errorf("%w: no enrollment certificate stored for %s", ErrNotEnrolled, name)
+	}
+	if len(userJSON.PrivateKey) == 0 && len(userJSON.PrivateKeySKI) == 0 {
+		return nil, fmt.Errorf("%w: no private key stored for %s", ErrNotEnrolled, name)
+	}
+	if mspID != "" && userJSON.MspID != mspID {
+		if userJSON.MspID == "" {
+			return nil, fmt.Errorf("%w: %s is stored without MSP ID, not for MSP %s", ErrMSPIDMismatch, name, mspID)
+		}
+		return nil, fmt.Errorf("%w: %s is stored for MSP %s, not %s", ErrMSPIDMismatch, name,
+			userJSON.MspID, mspID)
+	}
+	if userJSON.KeyLabel != "" {
+		if len(userJSON.PrivateKey) > 0 {
+			return nil, fmt.Errorf("Private key of %s is stored although it is kept in HSM token %s: %w",
+				name, userJSON.KeyLabel, ErrKeyNotExportable)
+		}
+		if label, ok := hsmTokenLabel(); !ok || label != userJSON.KeyLabel {
+			return nil, fmt.Errorf("Private key of %s is kept in HSM token %s, which is not the "+
+				"configured PKCS11 token", name, userJSON.KeyLabel)
+		}
+	}
+	csp := defaultCryptoSuite()
+	var key bccsp.Key
+	if len(userJSON.PrivateKey) > 0 {
+		key, err = importPrivateKey(csp, userJSON.PrivateKey)
+	} else {
+		key, err = csp.GetKey(userJSON.PrivateKeySKI)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error loading private key of %s: %w", name, err)
+	}
+	if userJSON.KeyLabel != "" && !key.Private() {
+		return nil, fmt.Errorf("Private key of %s was not found in HSM token %s", name, userJSON.KeyLabel)
+	}
+	user := fabricclient.NewUser(name)
+	user.SetMspID(userJSON.MspID)
+	user.SetEnrollmentCertificate(userJSON.EnrollmentCertificate)
+	user.SetPrivateKey(key)
+	return user, nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/hyperledger/fabric-ca/api"
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/lib/tcert"
+	"github.com/hyperledger/fabric-ca/util"
+	fabricclient "github.com/hyperledger/fabric-sdk-go/fabric-client"
+	"github.com/hyperledger/fabric/bccsp"
+)
+
+// MaxTCertBatchSize is the maximum number of transaction certificates the
+// fabric-ca server issues in a single batch. Larger batches are rejected
+const MaxTCertBatchSize = 1000
+
+// TCert is a transaction certificate, with its private key derived from the
+// private key of the enrollment certificate
+type TCert struct {
+	// Cert is the PEM encoded transaction certificate
+	Cert []byte
+	// Key is the derived private key of the transaction certificate
+	Key bccsp.Key
+}
+
+// tcertBatchResponse is a batch of transaction certificates as returned by
+// the CA
+type tcertBatchResponse struct {
+	// Key is the key derivation key of the batch
+	Key    []byte `json:"key"`
+	TCerts []struct {
+		Cert []byte `json:"cert"`
+	} `json:"tcerts"`
+}
+
+// GetTransactionCerts ...
+/**
+ * Get a batch of transaction certificates for a user, each one signing
+ * transactions with a private key derived from the user's enrollment
+ * certificate key. The CA rejects batches larger than MaxTCertBatchSize
+ * @param {User} user The enrolled user requesting the transaction certificates
+ * @param {int} count The number of transaction certificates in the batch
+ * @param {[]string} attributes The names of the attributes sealed in the
+ * transaction certificates
+ * @returns {[]TCert} transaction certificates
+ */
+func (fabricCAServices *services) GetTransactionCerts(user fabricclient.User, count int,
+	attributes []string) ([]TCert, error) {
+	if count <= 0 {
+		return nil, &ValidationError{Problems: []string{
+			fmt.Sprintf("Count must be greater than 0, got %d", count)}}
+	}
+	// Create request signing identity
+	identity, err := fabricCAServices.createSigningIdentity(user)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating signing identity: %w", err)
+	}
+	body, err := util.Marshal(api.GetTCertBatchRequest{Count: count, AttrNames: attributes},
+		"GetTCertBatchRequest")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := fabricCAServices.defaultContext()
+	defer cancel()
+	result, err := fabricCAServices.send(ctx, identity, "POST", "tcert", body)
+	if err != nil {
+		return nil, fmt.Errorf("GetTransactionCerts failed: %w", err)
+	}
+	var response tcertBatchResponse
+	if err := decodeResult(result, &response); err != nil {
+		return nil, err
+	}
+	tcerts := make([]TCert, 0, len(response.TCerts))
+	for _, batchCert := range response.TCerts {
+		key, err := deriveTCertKey(identity, response.Key, batchCert.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("Error deriving transaction certificate key: %s", err)
+		}
+		tcerts = append(tcerts, TCert{Cert: batchCert.Cert, Key: key})
+	}
+	return tcerts, nil
+}
+
+// deriveTCertKey derives the private key of a transaction certificate from the
+// private key of the identity, the key derivation key of the batch and the
+// TCert index sealed in the certificate
+func deriveTCertKey(identity *signingIdentity, kdfKey []byte, certPEM []byte) (bccsp.Key, error) {
+	cert, err := fabric_ca.BytesToX509Cert(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	var encryptedIndex []byte
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(tcert.TCertEncTCertIndex) {
+			encryptedIndex = extension.Value
+			break
+		}
+	}
+	if encryptedIndex == nil {
+		return nil, fmt.Errorf("Transaction certificate has no TCert index")
+	}
+	mac := hmac.New(sha512.New384, kdfKey)
+	mac.Write([]byte{1})
+	index, err := tcert.CBCPKCS7Decrypt(mac.Sum(nil)[:32], encryptedIndex)
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting TCert index: %s", err)
+	}
+	mac = hmac.New(sha512.New384, kdfKey)
+	mac.Write([]byte{2})
+	mac = hmac.New(sha512.New384, mac.Sum(nil))
+	mac.Write(index)
+	key, err := identity.csp.KeyDeriv(identity.key, &bccsp.ECDSAReRandKeyOpts{Temporary: true,
+		Expansion: mac.Sum(nil)})
+	if err != nil {
+		return nil, err
+	}
+	// The derived key must match the certificate
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := publicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	expected, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if string(raw) != string(expected) {
+		return nil, fmt.Errorf("Derived key does not match the transaction certificate")
+	}
+	return key, nil
+}
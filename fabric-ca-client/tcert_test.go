@@ -0,0 +1,143 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-ca/api"
+	fabric_ca "github.com/hyperledger/fabric-ca/lib"
+	"github.com/hyperledger/fabric-ca/lib/tcert"
+	"github.com/hyperledger/fabric-ca/util"
+	bccspFactory "github.com/hyperledger/fabric/bccsp/factory"
+)
+
+func TestGetTransactionCerts(t *testing.T) {
+	user := newTestUser(t, "user1", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	mgr := newTestTCertMgr(t)
+	var requests []api.GetTCertBatchRequest
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"tcert": func(r *http.Request, body []byte) (interface{}, int) {
+			ecert, err := util.VerifyToken(bccspFactory.GetDefault(), r.Header.Get("authorization"), body)
+			if err != nil {
+				return fmt.Sprintf("Invalid token: %s", err), http.StatusUnauthorized
+			}
+			var request api.GetTCertBatchRequest
+			json.Unmarshal(body, &request)
+			requests = append(requests, request)
+			response, err := mgr.GetBatch(&tcert.GetBatchRequest{Count: request.Count,
+				PreKey: "prekey"}, ecert)
+			if err != nil {
+				return err.Error(), http.StatusBadRequest
+			}
+			return response, http.StatusOK
+		},
+	})
+	defer ca.Close()
+
+	tcerts, err := ca.services.GetTransactionCerts(user, 3, []string{"attr1"})
+	if err != nil {
+		t.Fatalf("GetTransactionCerts returned error: %v", err)
+	}
+	if len(tcerts) != 3 {
+		t.Fatalf("Expected 3 transaction certificates, got %d", len(tcerts))
+	}
+	if len(requests) != 1 || requests[0].Count != 3 || len(requests[0].AttrNames) != 1 {
+		t.Fatalf("Unexpected tcert requests: %v", requests)
+	}
+	// Each derived key signs for its own transaction certificate
+	digest := sha256.Sum256([]byte("transaction"))
+	for _, tc := range tcerts {
+		cert, err := fabric_ca.BytesToX509Cert(tc.Cert)
+		if err != nil {
+			t.Fatalf("Error parsing transaction certificate: %v", err)
+		}
+		signature, err := bccspFactory.GetDefault().Sign(tc.Key, digest[:], nil)
+		if err != nil {
+			t.Fatalf("Error signing with transaction certificate key: %v", err)
+		}
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+			t.Fatalf("Error decoding signature: %v", err)
+		}
+		if !ecdsa.Verify(cert.PublicKey.(*ecdsa.PublicKey), digest[:], sig.R, sig.S) {
+			t.Fatalf("Signature does not verify with the transaction certificate")
+		}
+	}
+
+	// Invalid counts are rejected without reaching the CA
+	for _, count := range []int{0, -1} {
+		_, err = ca.services.GetTransactionCerts(user, count, nil)
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("Expected a validation error for count %d, got: %v", count, err)
+		}
+	}
+	// The CA enforces the maximum batch size
+	if _, err = ca.services.GetTransactionCerts(user, MaxTCertBatchSize+1, nil); err == nil {
+		t.Fatalf("GetTransactionCerts should have failed above the maximum batch size")
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 tcert requests, got %d", len(requests))
+	}
+}
+
+// newTestTCertMgr creates a transaction certificate manager with a self-signed CA
+func newTestTCertMgr(t *testing.T) *tcert.Mgr {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "tcert-ca"},
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	mgr, err := tcert.NewMgr(caKey, caCert)
+	if err != nil {
+		t.Fatalf("Error creating TCert manager: %v", err)
+	}
+	return mgr
+}
@@ -0,0 +1,103 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+)
+
+// Tracer starts the spans EnrollContext, RegisterContext and RevokeContext
+// are traced with, see WithTracer. It can be implemented with OpenTelemetry
+// or any other tracing library
+type Tracer interface {
+	// Start starts a span named name, child of the span of ctx if any, with
+	// the given attributes and returns a context carrying it. The requests to
+	// the CA are sent with the returned context
+	Start(ctx context.Context, name string, attributes map[string]string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttribute sets an attribute of the span
+	SetAttribute(key string, value string)
+	// RecordError records the error the operation failed with
+	RecordError(err error)
+	// End ends the span
+	End()
+}
+
+// Attributes of the spans started by the Services. Enrollment secrets are
+// never recorded
+const (
+	// SpanAttributeCAName is the name of the CA the request is sent to
+	SpanAttributeCAName = "ca.name"
+	// SpanAttributeOperation is the operation, enroll, register or revoke
+	SpanAttributeOperation = "operation"
+	// SpanAttributeStatus is the outcome of the operation, ok or error
+	SpanAttributeStatus = "status"
+	// SpanAttributeErrorCategory is the category of the error of a failed
+	// operation, see Metrics
+	SpanAttributeErrorCategory = "error.category"
+)
+
+// nopTracer starts spans doing nothing
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string, attributes map[string]string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+// nopSpan does nothing
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(key string, value string) {}
+func (nopSpan) RecordError(err error)                 {}
+func (nopSpan) End()                                  {}
+
+// WithTracer sets the Tracer the operations of the Services are traced with.
+// Operations are not traced by default
+func WithTracer(tracer Tracer) Option {
+	return func(fabricCAServices *services) {
+		if tracer == nil {
+			tracer = nopTracer{}
+		}
+		fabricCAServices.tracer = tracer
+	}
+}
+
+// startSpan starts the span of an operation
+func (fabricCAServices *services) startSpan(ctx context.Context, operation string) (context.Context, Span) {
+	return fabricCAServices.tracer.Start(ctx, "fabric-ca "+operation, map[string]string{
+		SpanAttributeCAName:    fabricCAServices.caName,
+		SpanAttributeOperation: operation,
+	})
+}
+
+// endSpan records the outcome of an operation on its span and ends it
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.SetAttribute(SpanAttributeStatus, "error")
+		span.SetAttribute(SpanAttributeErrorCategory, errorCategory(err))
+		span.RecordError(err)
+	} else {
+		span.SetAttribute(SpanAttributeStatus, "ok")
+	}
+	span.End()
+}
@@ -0,0 +1,145 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fabricca
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type spanKey struct{}
+
+// recordingTracer records the spans it starts
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+func (tracer *recordingTracer) Start(ctx context.Context, name string,
+	attributes map[string]string) (context.Context, Span) {
+	span := &recordingSpan{name: name, attributes: make(map[string]string)}
+	for key, value := range attributes {
+		span.attributes[key] = value
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*recordingSpan); ok {
+		span.parent = parent.name
+	}
+	tracer.spans = append(tracer.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// recordingSpan records its attributes and errors
+type recordingSpan struct {
+	name       string
+	parent     string
+	attributes map[string]string
+	errors     []error
+	ended      bool
+}
+
+func (span *recordingSpan) SetAttribute(key string, value string) {
+	span.attributes[key] = value
+}
+
+func (span *recordingSpan) RecordError(err error) {
+	span.errors = append(span.errors, err)
+}
+
+func (span *recordingSpan) End() {
+	span.ended = true
+}
+
+func TestWithTracer(t *testing.T) {
+	registrar := newTestUser(t, "admin", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	var requestSpans []string
+	recordSpan := func(r *http.Request) {
+		if span, ok := r.Context().Value(spanKey{}).(*recordingSpan); ok {
+			requestSpans = append(requestSpans, span.name)
+		}
+	}
+	ca := newMockCA(t, map[string]mockCAHandler{
+		"enroll": func(r *http.Request, body []byte) (interface{}, int) {
+			return base64.StdEncoding.EncodeToString(readCert(t)), http.StatusOK
+		},
+		"register": func(r *http.Request, body []byte) (interface{}, int) {
+			return "Authorization failure", http.StatusUnauthorized
+		},
+		"revoke": func(r *http.Request, body []byte) (interface{}, int) {
+			return map[string]interface{}{}, http.StatusOK
+		},
+	})
+	defer ca.Close()
+	ca.services.caName = "ca1"
+	tracer := &recordingTracer{}
+	WithTracer(tracer)(ca.services)
+	ca.services.transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		recordSpan(r)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+
+	parent, _ := tracer.Start(context.Background(), "request", nil)
+	if _, _, err := ca.services.EnrollContext(parent, "user1", "user1pw"); err != nil {
+		t.Fatalf("EnrollContext returned error: %v", err)
+	}
+	if _, err := ca.services.RegisterContext(parent, registrar, &RegistrationRequest{Name: "user2",
+		Affiliation: "org1"}); err == nil {
+		t.Fatalf("RegisterContext should have failed")
+	}
+	if err := ca.services.RevokeContext(parent, registrar, &RevocationRequest{Name: "user2"}); err != nil {
+		t.Fatalf("RevokeContext returned error: %v", err)
+	}
+
+	if len(tracer.spans) != 4 {
+		t.Fatalf("Expected a span per operation, got %d", len(tracer.spans))
+	}
+	for i, operation := range []string{"enroll", "register", "revoke"} {
+		span := tracer.spans[i+1]
+		if span.name != "fabric-ca "+operation || span.parent != "request" || !span.ended ||
+			span.attributes[SpanAttributeCAName] != "ca1" || span.attributes[SpanAttributeOperation] != operation {
+			t.Fatalf("Unexpected span for %s: %+v", operation, span)
+		}
+		for key, value := range span.attributes {
+			if strings.Contains(value, "user1pw") {
+				t.Fatalf("The enrollment secret was recorded in attribute %s", key)
+			}
+		}
+	}
+	if enroll := tracer.spans[1]; enroll.attributes[SpanAttributeStatus] != "ok" || len(enroll.errors) != 0 {
+		t.Fatalf("Unexpected outcome recorded for enroll: %+v", enroll)
+	}
+	register := tracer.spans[2]
+	if register.attributes[SpanAttributeStatus] != "error" || len(register.errors) != 1 ||
+		register.attributes[SpanAttributeErrorCategory] != "invalid_credentials" {
+		t.Fatalf("Unexpected outcome recorded for register: %+v", register)
+	}
+	if fmt.Sprint(requestSpans) != "[fabric-ca enroll fabric-ca register fabric-ca revoke]" {
+		t.Fatalf("Requests should be sent with the context of their span, got %v", requestSpans)
+	}
+
+	// A nil Tracer traces nothing
+	WithTracer(nil)(ca.services)
+	if _, _, err := ca.services.EnrollContext(parent, "user1", "user1pw"); err != nil {
+		t.Fatalf("EnrollContext returned error: %v", err)
+	}
+}
@@ -21,6 +21,7 @@ package fabricclient
 
 import (
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 
 	kvs "github.com/hyperledger/fabric-sdk-go/fabric-client/keyvaluestore"
@@ -177,7 +178,8 @@ func (c *client) SetUserContext(user User, skipPersistence bool) error {
 		if c.stateStore == nil {
 			return fmt.Errorf("stateStore is nil")
 		}
-		userJSON := &UserJSON{PrivateKeySKI: user.GetPrivateKey().SKI(), EnrollmentCertificate: user.GetEnrollmentCertificate()}
+		userJSON := &UserJSON{PrivateKeySKI: user.GetPrivateKey().SKI(), EnrollmentCertificate: user.GetEnrollmentCertificate(),
+			MspID: user.GetMspID()}
 		data, err := json.Marshal(userJSON)
 		if err != nil {
 			return fmt.Errorf("Marshal json return error: %v", err)
@@ -222,8 +224,12 @@ func (c *client) GetUserContext(name string) (User, error) {
 		return nil, fmt.Errorf("stateStore GetValue return error: %v", err)
 	}
 	user := NewUser(name)
+	user.SetMspID(userJSON.MspID)
 	user.SetEnrollmentCertificate(userJSON.EnrollmentCertificate)
 	key, err := c.cryptoSuite.GetKey(userJSON.PrivateKeySKI)
+	if err != nil && userJSON.PrivateKey != nil {
+		key, err = ImportPrivateKey(c.cryptoSuite, userJSON.PrivateKey)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("cryptoSuite GetKey return error: %v", err)
 	}
@@ -232,3 +238,13 @@ func (c *client) GetUserContext(name string) (User, error) {
 	return c.userContext, nil
 
 }
+
+// ImportPrivateKey imports a PEM encoded ecdsa private key, like the private
+// key of a persisted user, in the crypto suite
+func ImportPrivateKey(cryptoSuite bccsp.BCCSP, keyPEM []byte) (bccsp.Key, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("Error decoding private key PEM")
+	}
+	return cryptoSuite.KeyImport(block.Bytes, &bccsp.ECDSAPrivateKeyImportOpts{Temporary: false})
+}
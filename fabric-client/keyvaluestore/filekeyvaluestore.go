@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/op/go-logging"
 
@@ -32,7 +33,9 @@ import (
 
 var logger = logging.MustGetLogger("fabric_sdk_go")
 
-// FileKeyValueStore ...
+// FileKeyValueStore keeps each value in its own <key>.json file under the
+// store directory. Values are written atomically, so a crash while writing
+// leaves the previous value in place
 type FileKeyValueStore struct {
 	path string
 }
@@ -53,9 +56,15 @@ func CreateNewFileKeyValueStore(path string) (*FileKeyValueStore, error) {
  * @returns []byte for the value
  */
 func (fkvs *FileKeyValueStore) GetValue(key string) ([]byte, error) {
-	file := path.Join(fkvs.path, key+".json")
+	file, err := fkvs.keyFile(key)
+	if err != nil {
+		return nil, err
+	}
 	value, err := ioutil.ReadFile(file)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w for key %s", ErrNotFound, key)
+		}
 		return nil, err
 	}
 	return value, nil
@@ -68,12 +77,37 @@ func (fkvs *FileKeyValueStore) GetValue(key string) ([]byte, error) {
  * @param {[]byte} value to save
  */
 func (fkvs *FileKeyValueStore) SetValue(key string, value []byte) error {
-	file := path.Join(fkvs.path, key+".json")
-	err := ioutil.WriteFile(file, value, 0600)
+	file, err := fkvs.keyFile(key)
 	if err != nil {
 		return err
 	}
-	return nil
+	// Write to a temporary file in the same directory and rename it over the
+	// destination, rename being atomic within a file system
+	tmp, err := ioutil.TempFile(fkvs.path, "."+key+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(value); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// keyFile returns the file holding the value of key, rejecting keys which
+// would resolve outside of the store directory
+func (fkvs *FileKeyValueStore) keyFile(key string) (string, error) {
+	if key == "" || key == "." || key == ".." ||
+		strings.ContainsAny(key, "/"+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Invalid key [%s] for FileKeyValueStore", key)
+	}
+	return path.Join(fkvs.path, key+".json"), nil
 }
 
 // createDirIfNotExists
@@ -20,6 +20,13 @@ limitations under the License.
 package keyvaluestore
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -38,3 +45,83 @@ func TestFKVSMethods(t *testing.T) {
 	}
 
 }
+
+func TestFKVSMissingKey(t *testing.T) {
+	stateStore, err := CreateNewFileKeyValueStore(tempStoreDir(t))
+	if err != nil {
+		t.Fatalf("CreateNewFileKeyValueStore return error[%s]", err)
+	}
+	if _, err := stateStore.GetValue("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stateStore.GetValue should have returned ErrNotFound, got [%v]", err)
+	}
+}
+
+func TestFKVSInvalidKeys(t *testing.T) {
+	dir := tempStoreDir(t)
+	stateStore, err := CreateNewFileKeyValueStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatalf("CreateNewFileKeyValueStore return error[%s]", err)
+	}
+	for _, key := range []string{"", ".", "..", "../outside", "sub/key", "/etc/passwd"} {
+		if err := stateStore.SetValue(key, []byte("data")); err == nil {
+			t.Fatalf("stateStore.SetValue should have rejected key [%s]", key)
+		}
+		if _, err := stateStore.GetValue(key); err == nil || errors.Is(err, ErrNotFound) {
+			t.Fatalf("stateStore.GetValue should have rejected key [%s], got [%v]", key, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "outside.json")); !os.IsNotExist(err) {
+		t.Fatalf("Value was written outside of the store directory")
+	}
+}
+
+func TestFKVSConcurrentWrites(t *testing.T) {
+	dir := tempStoreDir(t)
+	stateStore, err := CreateNewFileKeyValueStore(dir)
+	if err != nil {
+		t.Fatalf("CreateNewFileKeyValueStore return error[%s]", err)
+	}
+	const writers = 20
+	values := make(map[string]bool)
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		value := strings.Repeat(fmt.Sprintf("value-%d;", i), 1000)
+		values[value] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- stateStore.SetValue("user", []byte(value))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("stateStore.SetValue return error[%s]", err)
+		}
+	}
+	value, err := stateStore.GetValue("user")
+	if err != nil {
+		t.Fatalf("stateStore.GetValue return error[%s]", err)
+	}
+	if !values[string(value)] {
+		t.Fatalf("stateStore.GetValue returned a value no writer wrote")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir return error[%s]", err)
+	}
+	if len(files) != 1 || files[0].Name() != "user.json" {
+		t.Fatalf("Expected only user.json in the store directory, found %d files", len(files))
+	}
+}
+
+func tempStoreDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "keyvaluestore_test")
+	if err != nil {
+		t.Fatalf("TempDir return error[%s]", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
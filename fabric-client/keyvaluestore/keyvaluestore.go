@@ -19,6 +19,12 @@ limitations under the License.
 
 package keyvaluestore
 
+import "errors"
+
+// ErrNotFound is returned, possibly wrapped, by GetValue when no value is
+// stored for the key
+var ErrNotFound = errors.New("Value not found")
+
 // KeyValueStore ...
 /**
  * Abstract class for a Key-Value store. The Chain class uses this store
@@ -31,7 +37,7 @@ type KeyValueStore interface {
 	 * Get the value associated with name.
 	 *
 	 * @param {string} name of the key
-	 * @returns {[]byte}
+	 * @returns {[]byte}, an error wrapping ErrNotFound if there is no value
 	 */
 	GetValue(key string) ([]byte, error)
 
@@ -0,0 +1,66 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keyvaluestore
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryKeyValueStore is a KeyValueStore keeping values in memory, for tests
+// and short lived applications
+type MemoryKeyValueStore struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+// CreateNewMemoryKeyValueStore ...
+func CreateNewMemoryKeyValueStore() *MemoryKeyValueStore {
+	return &MemoryKeyValueStore{values: make(map[string][]byte)}
+}
+
+// GetValue ...
+/**
+ * Get the value associated with name.
+ * @param {string} name
+ * @returns []byte for the value
+ */
+func (mkvs *MemoryKeyValueStore) GetValue(key string) ([]byte, error) {
+	mkvs.mu.RLock()
+	defer mkvs.mu.RUnlock()
+	value, ok := mkvs.values[key]
+	if !ok {
+		return nil, fmt.Errorf("%w for key %s", ErrNotFound, key)
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// SetValue ...
+/**
+ * Set the value associated with name.
+ * @param {string} name of the key to save
+ * @param {[]byte} value to save
+ */
+func (mkvs *MemoryKeyValueStore) SetValue(key string, value []byte) error {
+	mkvs.mu.Lock()
+	defer mkvs.mu.Unlock()
+	mkvs.values[key] = append([]byte(nil), value...)
+	return nil
+}
@@ -0,0 +1,42 @@
+/*
+Copyright SecureKey Technologies Inc. All Rights Reserved.
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+
+      http://www.apache.org/licenses/LICENSE-2.0
+
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keyvaluestore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMKVSMethods(t *testing.T) {
+	stateStore := CreateNewMemoryKeyValueStore()
+	if _, err := stateStore.GetValue("testvalue"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stateStore.GetValue should have returned ErrNotFound, got [%v]", err)
+	}
+	data := []byte("data")
+	stateStore.SetValue("testvalue", data)
+	data[0] = 'x'
+	value, err := stateStore.GetValue("testvalue")
+	if err != nil {
+		t.Fatalf("stateStore.GetValue return error[%s]", err)
+	}
+	if string(value) != "data" {
+		t.Fatalf("stateStore.GetValue didn't return the right value")
+	}
+}
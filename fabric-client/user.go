@@ -20,6 +20,13 @@ limitations under the License.
 package fabricclient
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	kvs "github.com/hyperledger/fabric-sdk-go/fabric-client/keyvaluestore"
 	"github.com/hyperledger/fabric/bccsp"
 )
 
@@ -43,17 +50,22 @@ import (
  */
 type User interface {
 	GetName() string
+	GetMspID() string
+	SetMspID(mspID string)
 	GetRoles() []string
 	SetRoles([]string)
 	GetEnrollmentCertificate() []byte
 	SetEnrollmentCertificate(cert []byte)
 	SetPrivateKey(privateKey bccsp.Key)
 	GetPrivateKey() bccsp.Key
+	SetEnrollment(cert []byte, privateKey bccsp.Key) error
+	Store(stateStore kvs.KeyValueStore) error
 	GenerateTcerts(count int, attributes []string)
 }
 
 type user struct {
 	name                  string
+	mspID                 string
 	roles                 []string
 	PrivateKey            bccsp.Key // ****This key is temporary We use it to sign transaction until we have tcerts
 	enrollmentCertificate []byte
@@ -63,6 +75,15 @@ type user struct {
 type UserJSON struct {
 	PrivateKeySKI         []byte
 	EnrollmentCertificate []byte
+	// PrivateKey is the PEM encoded private key, imported when the key is
+	// missing from the crypto suite. It is omitted for keys kept in the
+	// crypto suite, like an HSM
+	PrivateKey []byte `json:",omitempty"`
+	// KeyLabel is the label of the HSM token the private key is kept in,
+	// found in it by PrivateKeySKI. PrivateKey is never stored along
+	KeyLabel string `json:",omitempty"`
+	// MspID is the ID of the MSP the user belongs to, omitted when unknown
+	MspID string `json:",omitempty"`
 }
 
 // NewUser ...
@@ -84,6 +105,24 @@ func (u *user) GetName() string {
 	return u.name
 }
 
+// GetMspID ...
+/**
+ * Get the ID of the MSP the user belongs to.
+ * @returns {string} The MSP ID, empty when unknown.
+ */
+func (u *user) GetMspID() string {
+	return u.mspID
+}
+
+// SetMspID ...
+/**
+ * Set the ID of the MSP the user belongs to.
+ * @param mspID {string} The MSP ID.
+ */
+func (u *user) SetMspID(mspID string) {
+	u.mspID = mspID
+}
+
 // GetRoles ...
 /**
  * Get the roles.
@@ -134,6 +173,69 @@ func (u *user) GetPrivateKey() bccsp.Key {
 	return u.PrivateKey
 }
 
+// SetEnrollment ...
+/**
+ * Set the user’s Enrollment Certificate and private key together, e.g. after a
+ * re-enrollment or a key rotation. Neither is set unless the key is the
+ * private key of the certificate.
+ * @param {[]byte} cert The PEM encoded enrollment certificate
+ * @param {bccsp.Key} privateKey The private key of the certificate
+ * @returns {error} Error when the key does not match the certificate
+ */
+func (u *user) SetEnrollment(cert []byte, privateKey bccsp.Key) error {
+	if privateKey == nil {
+		return fmt.Errorf("private key is nil")
+	}
+	block, _ := pem.Decode(cert)
+	if block == nil {
+		return fmt.Errorf("Error decoding enrollment certificate PEM")
+	}
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("Error parsing enrollment certificate: %v", err)
+	}
+	publicKey, err := privateKey.PublicKey()
+	if err != nil {
+		return fmt.Errorf("Error getting the public key of the private key: %v", err)
+	}
+	publicKeyBytes, err := publicKey.Bytes()
+	if err != nil {
+		return fmt.Errorf("Error marshalling the public key of the private key: %v", err)
+	}
+	if !bytes.Equal(publicKeyBytes, x509Cert.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("private key does not match the public key of the enrollment certificate")
+	}
+	u.enrollmentCertificate = cert
+	u.PrivateKey = privateKey
+	return nil
+}
+
+// Store ...
+/**
+ * Persist the user in the state store under its name, in the format
+ * GetUserContext loads users from. The private key is referenced by its SKI,
+ * it must be kept in the crypto suite.
+ * @param {KeyValueStore} stateStore The store the user is persisted in
+ * @returns {error} Error
+ */
+func (u *user) Store(stateStore kvs.KeyValueStore) error {
+	if stateStore == nil {
+		return fmt.Errorf("stateStore is nil")
+	}
+	if u.PrivateKey == nil || u.enrollmentCertificate == nil {
+		return fmt.Errorf("user %s is not enrolled", u.name)
+	}
+	data, err := json.Marshal(&UserJSON{PrivateKeySKI: u.PrivateKey.SKI(),
+		EnrollmentCertificate: u.enrollmentCertificate, MspID: u.mspID})
+	if err != nil {
+		return fmt.Errorf("Marshal json return error: %v", err)
+	}
+	if err := stateStore.SetValue(u.name, data); err != nil {
+		return fmt.Errorf("stateStore SetValue return error: %v", err)
+	}
+	return nil
+}
+
 // GenerateTcerts ...
 /**
  * Gets a batch of TCerts to use for transaction. there is a 1-to-1 relationship between
@@ -20,7 +20,21 @@ limitations under the License.
 package fabricclient
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"testing"
+	"time"
+
+	kvs "github.com/hyperledger/fabric-sdk-go/fabric-client/keyvaluestore"
+	"github.com/hyperledger/fabric/bccsp"
+	bccspFactory "github.com/hyperledger/fabric/bccsp/factory"
 )
 
 func TestUserMethods(t *testing.T) {
@@ -41,3 +55,89 @@ func TestUserMethods(t *testing.T) {
 	}
 
 }
+
+func TestUserSetEnrollment(t *testing.T) {
+	if err := bccspFactory.InitFactories(nil); err != nil {
+		t.Fatalf("Failed getting ephemeral software-based BCCSP [%s]", err)
+	}
+	cryptoSuite := bccspFactory.GetDefault()
+	key, err := cryptoSuite.KeyGen(&bccsp.ECDSAP256KeyGenOpts{Temporary: true})
+	if err != nil {
+		t.Fatalf("KeyGen return error[%s]", err)
+	}
+	otherKey, err := cryptoSuite.KeyGen(&bccsp.ECDSAP256KeyGenOpts{Temporary: true})
+	if err != nil {
+		t.Fatalf("KeyGen return error[%s]", err)
+	}
+	cert := newTestCertificate(t, key)
+
+	user := NewUser("testUser")
+	if err := user.SetEnrollment(cert, otherKey); err == nil {
+		t.Fatalf("SetEnrollment should have rejected a key not matching the certificate")
+	}
+	if user.GetEnrollmentCertificate() != nil || user.GetPrivateKey() != nil {
+		t.Fatalf("SetEnrollment should not set a mismatched certificate or key")
+	}
+	if err := user.SetEnrollment([]byte("not a certificate"), key); err == nil {
+		t.Fatalf("SetEnrollment should have rejected an invalid certificate")
+	}
+	if err := user.SetEnrollment(cert, key); err != nil {
+		t.Fatalf("SetEnrollment return error[%s]", err)
+	}
+	if !bytes.Equal(user.GetEnrollmentCertificate(), cert) || user.GetPrivateKey() != key {
+		t.Fatalf("SetEnrollment did not set the certificate and key")
+	}
+
+	user.SetMspID("Org1MSP")
+	stateStore := kvs.CreateNewMemoryKeyValueStore()
+	if err := user.Store(stateStore); err != nil {
+		t.Fatalf("Store return error[%s]", err)
+	}
+	value, err := stateStore.GetValue("testUser")
+	if err != nil {
+		t.Fatalf("GetValue return error[%s]", err)
+	}
+	var userJSON UserJSON
+	if err := json.Unmarshal(value, &userJSON); err != nil {
+		t.Fatalf("Unmarshal return error[%s]", err)
+	}
+	if !bytes.Equal(userJSON.EnrollmentCertificate, cert) || !bytes.Equal(userJSON.PrivateKeySKI, key.SKI()) ||
+		userJSON.MspID != "Org1MSP" {
+		t.Fatalf("Store persisted wrong user %+v", userJSON)
+	}
+	if err := NewUser("other").Store(stateStore); err == nil {
+		t.Fatalf("Store should have failed for a user which is not enrolled")
+	}
+}
+
+// newTestCertificate creates a PEM encoded certificate of the public key of
+// key, issued by a throwaway CA
+func newTestCertificate(t *testing.T, key bccsp.Key) []byte {
+	publicKey, err := key.PublicKey()
+	if err != nil {
+		t.Fatalf("PublicKey return error[%s]", err)
+	}
+	publicKeyBytes, err := publicKey.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes return error[%s]", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(publicKeyBytes)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey return error[%s]", err)
+	}
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey return error[%s]", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "testUser"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, issuerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate return error[%s]", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
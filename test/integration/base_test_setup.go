@@ -80,7 +80,7 @@ func (setup *BaseSetupImpl) GetChains(t *testing.T) (fabric_client.Chain, fabric
 		t.Fatalf("client.GetUserContext return error: %v", err)
 	}
 	if user == nil {
-		fabricCAClient, err1 := fabric_ca_client.NewFabricCAClient()
+		fabricCAClient, err1 := fabric_ca_client.NewFabricCAClient(fabric_ca_client.WithInsecure())
 		if err1 != nil {
 			t.Fatalf("NewFabricCAClient return error: %v", err)
 		}
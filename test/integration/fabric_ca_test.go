@@ -22,6 +22,7 @@ package integration
 import (
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/rand"
 	"strconv"
@@ -67,7 +68,7 @@ func TestRegisterEnrollRevoke(t *testing.T) {
 	}
 	client.SetStateStore(stateStore)
 
-	fabricCAClient, err := fabric_ca_client.NewFabricCAClient()
+	fabricCAClient, err := fabric_ca_client.NewFabricCAClient(fabric_ca_client.WithInsecure())
 	if err != nil {
 		t.Fatalf("NewFabricCAClient return error: %v", err)
 	}
@@ -149,6 +150,28 @@ func TestRegisterEnrollRevoke(t *testing.T) {
 	}
 }
 
+// This test requests an Idemix credential for the admin user, it is skipped
+// when the CA does not issue Idemix credentials
+func TestEnrollIdemix(t *testing.T) {
+	InitConfigForFabricCA()
+	fabricCAClient, err := fabric_ca_client.NewFabricCAClient(fabric_ca_client.WithInsecure())
+	if err != nil {
+		t.Fatalf("NewFabricCAClient return error: %v", err)
+	}
+	info, err := fabricCAClient.GetCAInfo()
+	if err != nil {
+		t.Fatalf("GetCAInfo return error: %v", err)
+	}
+	if len(info.IssuerPublicKey) == 0 {
+		t.Skipf("CA %s does not issue Idemix credentials", info.CAName)
+	}
+	// The SDK has no IdemixProvider of its own
+	_, err = fabricCAClient.EnrollIdemix("admin2", "adminpw2")
+	if !errors.Is(err, fabric_ca_client.ErrIdemixNotSupported) {
+		t.Fatalf("Expected ErrIdemixNotSupported without IdemixProvider, got: %v", err)
+	}
+}
+
 func InitConfigForFabricCA() {
 	config.InitConfig("../fixtures/config/config_test.yaml")
 }